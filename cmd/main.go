@@ -2,19 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"encoding/json"
 	"net/http"
 
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 
 	argocd "github.com/argoproj-labs/argocd-ephemeral-access/api/argoproj/v1alpha1"
 	api "github.com/argoproj-labs/argocd-ephemeral-access/api/ephemeral-access/v1alpha1"
@@ -25,30 +38,242 @@ import (
 	goPlugin "github.com/hashicorp/go-plugin"
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
 )
 
 type ServiceNowPlugin struct {
-	Logger hclog.Logger
+	Logger      hclog.Logger
+	configStore *ConfigStore
+}
+
+// The configuration is loaded in Init and loaded again when the secret or the controller-cm configmap
+// changes. A Config is not changed after it is stored: a reload stores a new Config.
+
+type Config struct {
+	Namespace                  string
+	SecretName                 string
+	ServiceNowUrl              string
+	ServiceNowUsername         string
+	ServiceNowPassword         string
+	ServiceNowAuthMethod       string
+	ServiceNowClientId         string
+	ServiceNowClientSecret     string
+	CILabel                    string
+	CIClass                    string
+	CICorrelationIdPattern     string
+	CIPolicy                   string
+	CIRelationTypes            []string
+	CIRelationDepth            int
+	ChangeAffectedCIs          bool
+	RequesterCheck             bool
+	RequesterUserField         string
+	RequesterMapping           map[string]string
+	RolePolicies               map[string]RolePolicy
+	BlackoutCheck              bool
+	ChangeTasks                bool
+	IncidentAccess             bool
+	IncidentNumberKey          string
+	IncidentPriorities         []string
+	IncidentAccessMinutes      int
+	ArgoCDNamespace            string
+	ChangeNumberKey            string
+	ChangeSelectionPolicy      string
+	ChangeEligibility          ChangeEligibility
+	CIValidity                 CIValidity
+	ExclusionRoles             []string
+	ExclusionPolicies          map[string]ExclusionPolicy
+	ExclusionRecordTable       string
+	JustificationKey           string
+	Timezone                   string
+	TimeWindowChangesDays      int
+	GraceBeforeStartMinutes    int
+	GraceAfterEndMinutes       int
+	RevokeMode                 string
+	RevokeJobImage             string
+	RevokeJobServiceAccount    string
+	RevokeJobTemplate          *v1.PodTemplateSpec
+	ExpiryCheckIntervalSeconds int
+	// The client is part of the configuration, so it is replaced together with the configuration
+	ServiceNowClient *ServiceNowClient
+}
+
+// The conditions that a change must meet are ServiceNow encoded queries, f.e. state=-1^approval=approved.
+// Types contains the conditions per change type, Default is used for all other types.
+
+type ChangeEligibility struct {
+	Default string            `json:"default"`
+	Types   map[string]string `json:"types"`
+}
+
+// A CI is valid when its install status is in InstallStatus and its operational status is in
+// OperationalStatus. An empty OperationalStatus accepts every operational status. Classes contains
+// the statuses per CI class (f.e. cmdb_ci_service), Default is used for all other classes.
+
+type CIStatusPolicy struct {
+	InstallStatus     []string `json:"installStatus"`
+	OperationalStatus []string `json:"operationalStatus"`
+}
+
+type CIValidity struct {
+	Default CIStatusPolicy            `json:"default"`
+	Classes map[string]CIStatusPolicy `json:"classes"`
+}
+
+// A role policy limits the changes that can be used for a role in Argo CD. An empty ChangeTypes accepts
+// every change type and an empty MaxRisk every risk. With NoChange, access is granted without a change.
+
+type RolePolicy struct {
+	ChangeTypes []string `json:"changeTypes"`
+	MaxRisk     string   `json:"maxRisk"`
+	NoChange    bool     `json:"noChange"`
+	// The grace periods of a role replace the global grace periods, nil means not given
+	GraceBeforeStartMinutes *int `json:"graceBeforeStartMinutes"`
+	GraceAfterEndMinutes    *int `json:"graceAfterEndMinutes"`
+}
+
+// An exclusion policy limits who can use an exclusion role and for how long. Without Users and Groups
+// every requester can use the role, a MaxDurationMinutes of 0 doesn't limit the duration. Groups are
+// names of groups in ServiceNow.
+
+type ExclusionPolicy struct {
+	MaxDurationMinutes    int      `json:"maxDurationMinutes"`
+	Users                 []string `json:"users"`
+	Groups                []string `json:"groups"`
+	JustificationRequired bool     `json:"justificationRequired"`
+}
+
+// The plugin and the expiry scheduler share one ConfigStore, so a reload is used by both.
+
+type ConfigStore struct {
+	mutex  sync.RWMutex
+	config *Config
+}
+
+// With sysparm_display_value=all ServiceNow returns both the value and the display value of a field,
+// f.e. 7 and Retired. A plain string is accepted as well, then both are the same.
+
+type ServiceNowValue struct {
+	Value        string `json:"value"`
+	DisplayValue string `json:"display_value"`
 }
 
 type CmdbServiceNow struct {
-	InstallStatus string `json:"install_status"`
-	Name          string `json:"name"`
-	SysId         string `json:"sys_id"`
+	InstallStatus     ServiceNowValue `json:"install_status"`
+	OperationalStatus ServiceNowValue `json:"operational_status"`
+	ClassName         ServiceNowValue `json:"sys_class_name"`
+	Name              ServiceNowValue `json:"name"`
+	SysId             ServiceNowValue `json:"sys_id"`
 }
 
 type CmdbResultsServiceNowType struct {
 	Result []*CmdbServiceNow `json:"result"`
 }
 
+type CIRelationServiceNow struct {
+	Parent string `json:"parent"`
+}
+
+type CIRelationResultsServiceNow struct {
+	Result []*CIRelationServiceNow `json:"result"`
+}
+
+type AffectedCIServiceNow struct {
+	CIItem string `json:"ci_item"`
+}
+
+type AffectedCIResultsServiceNow struct {
+	Result []*AffectedCIServiceNow `json:"result"`
+}
+
+type UserServiceNow struct {
+	SysId string `json:"sys_id"`
+}
+
+type UserResultsServiceNow struct {
+	Result []*UserServiceNow `json:"result"`
+}
+
+type GroupMemberServiceNow struct {
+	SysId string `json:"sys_id"`
+}
+
+type GroupMemberResultsServiceNow struct {
+	Result []*GroupMemberServiceNow `json:"result"`
+}
+
+// A blackout schedule in ServiceNow has one or more windows (spans). The conditions of the schedule
+// determine to which changes the blackout applies, a schedule without conditions applies to all changes.
+
+type ScheduleSpanServiceNow struct {
+	Name          string `json:"name"`
+	Schedule      string `json:"schedule"`
+	ScheduleName  string `json:"schedule.name"`
+	StartDateTime string `json:"start_date_time"`
+	EndDateTime   string `json:"end_date_time"`
+	RepeatType    string `json:"repeat_type"`
+	RepeatCount   string `json:"repeat_count"`
+	RepeatUntil   string `json:"repeat_until"`
+	DaysOfWeek    string `json:"days_of_week"`
+}
+
+type ScheduleSpanResultsServiceNow struct {
+	Result []*ScheduleSpanServiceNow `json:"result"`
+}
+
+type ScheduleConditionServiceNow struct {
+	Condition string `json:"condition"`
+}
+
+type ScheduleConditionResultsServiceNow struct {
+	Result []*ScheduleConditionServiceNow `json:"result"`
+}
+
+type Blackout struct {
+	Name         string
+	ScheduleName string
+	Schedule     string
+	EndDate      time.Time
+}
+
 type ChangeServiceNow struct {
-	Type             string `json:"type"`
-	Number           string `json:"number"`
-	EndDate          string `json:"end_date"`
-	ShortDescription string `json:"short_description"`
-	StartDate        string `json:"start_date"`
-	SysId            string `json:"sys_id"`
+	Type             string          `json:"type"`
+	Number           string          `json:"number"`
+	EndDate          string          `json:"end_date"`
+	ShortDescription string          `json:"short_description"`
+	StartDate        string          `json:"start_date"`
+	SysId            string          `json:"sys_id"`
+	CmdbCi           string          `json:"cmdb_ci"`
+	State            string          `json:"state"`
+	Approval         string          `json:"approval"`
+	Risk             string          `json:"risk"`
+	AssignedTo       ServiceNowValue `json:"assigned_to"`
+	AssignmentGroup  ServiceNowValue `json:"assignment_group"`
+}
+
+// Change tasks are read together with the fields of their change (dot-walking), the change doesn't
+// have to be read separately.
+
+type ChangeTaskServiceNow struct {
+	Number           string          `json:"number"`
+	ShortDescription string          `json:"short_description"`
+	StartDate        string          `json:"planned_start_date"`
+	EndDate          string          `json:"planned_end_date"`
+	SysId            string          `json:"sys_id"`
+	AssignedTo       ServiceNowValue `json:"assigned_to"`
+	AssignmentGroup  ServiceNowValue `json:"assignment_group"`
+	ChangeRequest    ServiceNowValue `json:"change_request"`
+	ChangeNumber     string          `json:"change_request.number"`
+	ChangeType       string          `json:"change_request.type"`
+	ChangeRisk       string          `json:"change_request.risk"`
+	ChangeState      string          `json:"change_request.state"`
+	ChangeApproval   string          `json:"change_request.approval"`
+}
+
+type ChangeTaskResultsServiceNow struct {
+	Result []*ChangeTaskServiceNow `json:"result"`
 }
 
 type Change struct {
@@ -58,38 +283,252 @@ type Change struct {
 	ShortDescription string
 	StartDate        time.Time
 	SysId            string
+	Risk             string
+	AssignedTo       string
+	AssignmentGroup  string
+	// Table is change_request for changes and change_task for change tasks, a change task also has
+	// the number and the sys_id of its change
+	Table        string
+	ParentNumber string
+	ParentSysId  string
+}
+
+// An application can have more than one CI. CIChange is a CI with the change that gives access to it.
+
+type CIChange struct {
+	CIName        string
+	CISysId       string
+	Change        *Change
+	RemainingTime time.Duration
+}
+
+// An incident of a CI is an alternative for a change, the CI is used for the grant record.
+
+type IncidentServiceNow struct {
+	Number           string `json:"number"`
+	ShortDescription string `json:"short_description"`
+	Priority         string `json:"priority"`
+	SysId            string `json:"sys_id"`
+	AssignedTo       string `json:"assigned_to"`
+	AssignmentGroup  string `json:"assignment_group"`
+}
+
+type IncidentResultsServiceNow struct {
+	Result []*IncidentServiceNow `json:"result"`
+}
+
+type CIIncident struct {
+	CIName   string
+	CISysId  string
+	Incident *IncidentServiceNow
+}
+
+// Every use of an exclusion role is registered as a record in ServiceNow (EXCLUSION_RECORD_TABLE).
+
+type ExclusionRecordServiceNow struct {
+	Number string `json:"number"`
+	SysId  string `json:"sys_id"`
+}
+
+type ExclusionRecordResultServiceNow struct {
+	Result ExclusionRecordServiceNow `json:"result"`
+}
+
+// The requester and the requested role determine which changes can be used. The filter is determined
+// once per access request, before the changes are searched. An empty filter accepts every change.
+
+type ChangeFilter struct {
+	RequesterSysId   string
+	Role             string
+	RolePolicy       *RolePolicy
+	GraceBeforeStart time.Duration
+	GraceAfterEnd    time.Duration
 }
 
 type ChangeResultsServicenow struct {
 	Result []*ChangeServiceNow `json:"result"`
 }
 
+type ServiceNowClientSettings struct {
+	ConnectTimeout  time.Duration
+	Timeout         time.Duration
+	CACert          string
+	ClientCert      string
+	ClientKey       string
+	MaxAttempts     int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	RequestDeadline time.Duration
+}
+
+type ServiceNowClient struct {
+	Settings   ServiceNowClientSettings
+	HttpClient *http.Client
+	tokenMutex sync.Mutex
+	token      *OAuthToken
+}
+
+type OAuthToken struct {
+	Key          string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+type OAuthTokenServiceNow struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// A PluginError has a message that is shown to the user and written to the log, and a kind that is
+// used to choose the deny message and to count denials by reason. Err is the underlying error, if any.
+
+type PluginError struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+type GrantRecord struct {
+	AccessRequestName string
+	Requester         string
+	Role              string
+	ChangeNumber      string
+	ChangeSysId       string
+	ChangeTable       string
+	CISysId           string
+	EndTime           time.Time
+	ExclusionRole     bool
+	ExpireByPlugin    bool
+	// Changes of other CIs of the application, these also get a note when the access ends
+	OtherChangeNumbers []string
+	OtherChangeSysIds  []string
+	OtherChangeTables  []string
+}
+
 const SysparmLimit = 5
 const ExclusionsConfigMapName = "controller-cm"
+const GrantRecordPrefix = "servicenow-grant-"
+const GrantRecordLabel = "argocd-ephemeral-access-plugin-servicenow/grant-record"
+const RevokeModeScheduler = "scheduler"
+const RevokeModeCronJob = "cronjob"
+const AuthMethodBasic = "basic"
+const AuthMethodOAuthClientCredentials = "oauth-client-credentials"
+const AuthMethodOAuthPassword = "oauth-password"
+const OAuthTokenRefreshMargin = 60 * time.Second
+const ChangeSelectionLatestEnd = "latest-end"
+const ChangeSelectionEarliestStart = "earliest-start"
+const ChangeSelectionDenyWhenAmbiguous = "deny-when-ambiguous"
+const ChangeSelectionExplicit = "explicit"
+const DefaultChangeEligibilityQuery = "state=-1^phase=requested^approval=approved^active=true"
+const CIPolicyAny = "any"
+const CIPolicyEvery = "every"
+const TableChangeRequest = "change_request"
+const TableChangeTask = "change_task"
+const TableIncident = "incident"
+const MaxGraceMinutes = 1440
+const InstallStatusRetired = "7"
+const OperationalStatusRetired = "6"
+
+// Installed, In maintenance, Pending install and Pending repair
+var defaultValidInstallStatus = []string{"1", "3", "4", "5"}
+
+// The values of the risk of a change in ServiceNow, a lower value is a higher risk
+var riskLevels = map[string]int{"very-high": 1, "high": 2, "moderate": 3, "low": 4}
+
+var (
+	ErrConfig                = errors.New("configuration error")
+	ErrKubernetes            = errors.New("kubernetes error")
+	ErrServiceNowUnavailable = errors.New("ServiceNow unavailable")
+	ErrServiceNowAPI         = errors.New("unexpected response from ServiceNow")
+	ErrCINotFound            = errors.New("CI not found")
+	ErrCIInvalidStatus       = errors.New("CI has invalid status")
+	ErrAmbiguousCI           = errors.New("more than one CI found")
+	ErrNoValidChange         = errors.New("no valid change")
+	ErrChangeNotLinked       = errors.New("change not linked to CI")
+	ErrAmbiguousChange       = errors.New("more than one valid change")
+	ErrChangeNumberRequired  = errors.New("change number required")
+	ErrRequesterNotAssigned  = errors.New("requester not assigned to change")
+	ErrChangeNotAllowed      = errors.New("change not allowed for role")
+	ErrBlackout              = errors.New("change freeze")
+	ErrNoValidIncident       = errors.New("no valid incident")
+	ErrExclusionNotAllowed   = errors.New("requester not allowed to use exclusion role")
+	ErrJustificationRequired = errors.New("justification required")
+)
 
 var unittest = false
 
-var serviceNowUrl string
-var serviceNowUsername string
-var serviceNowPassword string
-var ciLabel string
-var exclusionRoles []string
-var timezone string
-var timeWindowChangesDays int
 var k8sconfig *rest.Config
 var k8sclientset kubernetes.Interface
+var k8sdynamicclient dynamic.Interface
+
+var accessRequestResource = api.GroupVersion.WithResource("accessrequests")
+var appProjectResource = argocd.GroupVersion.WithResource("appprojects")
+var expirySchedulerWakeup = make(chan struct{}, 1)
+
+// Init waits at most this long for the first list of the secret and the configmap that are watched
+var configSyncTimeout = 30 * time.Second
+
+// The change number can be part of a longer text, f.e. "Deploy hotfix for CHG0030002"
+var changeNumberPattern = regexp.MustCompile(`(?i)\bCHG[0-9]+\b`)
+var incidentNumberPattern = regexp.MustCompile(`(?i)\bINC[0-9]+\b`)
 
-var ephemeralAccessPluginNamespace string
+// A sys_id in ServiceNow is always 32 hexadecimal characters, f.e. 1c741bd70b2322007518478d83673af3
+var sysIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
 
-func (p *ServiceNowPlugin) getEnvVarWithoutDefault(envVarName string, errorTextToReturn string) (string, string) {
-	errorText := ""
+// The CI class and the user field are used in the API calls, they should be the name of a table or a
+// field, f.e. cmdb_ci_appl or user_name
+var serviceNowNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Until the settings are read, a client with the default timeouts is used
+var defaultServiceNowClient = &ServiceNowClient{
+	HttpClient: &http.Client{Timeout: 30 * time.Second},
+}
+
+func (e *PluginError) Error() string {
+	return e.Message
+}
+
+func (e *PluginError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+func (v *ServiceNowValue) UnmarshalJSON(data []byte) error {
+	var value string
+	if json.Unmarshal(data, &value) == nil {
+		v.Value = value
+		v.DisplayValue = value
+		return nil
+	}
+
+	type valueAndDisplayValue ServiceNowValue
+	return json.Unmarshal(data, (*valueAndDisplayValue)(v))
+}
+
+func (p *ServiceNowPlugin) newError(kind error, err error, message string) error {
+	return &PluginError{
+		Kind:    kind,
+		Message: message,
+		Err:     err,
+	}
+}
+
+func (p *ServiceNowPlugin) getEnvVarWithoutDefault(envVarName string, errorTextToReturn string) (string, error) {
+	var err error
 
 	returnValue := os.Getenv(envVarName)
 	if returnValue == "" {
 		p.Logger.Error(errorTextToReturn)
-		errorText = errorTextToReturn
+		err = p.newError(ErrConfig, nil, errorTextToReturn)
 	}
-	return returnValue, errorText
+	return returnValue, err
 }
 
 func (p *ServiceNowPlugin) getEnvVarWithDefault(envVarName string, envVarDefault string) string {
@@ -101,8 +540,29 @@ func (p *ServiceNowPlugin) getEnvVarWithDefault(envVarName string, envVarDefault
 	return returnValue
 }
 
+func (p *ServiceNowPlugin) getFileContentFromEnvVar(envVarName string) (string, error) {
+	fileName := os.Getenv(envVarName)
+	if fileName == "" {
+		return "", nil
+	}
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		errorText := fmt.Sprintf("Error reading file %s (environment variable %s): %s", fileName, envVarName, err.Error())
+		p.Logger.Error(errorText)
+		return "", p.newError(ErrConfig, err, errorText)
+	}
+
+	return string(content), nil
+}
+
 func (p *ServiceNowPlugin) getLocalTime(t time.Time) string {
-	loc, _ := time.LoadLocation(timezone)
+	// The time zone is validated when the configuration is loaded, UTC is only used as a last resort
+	loc, err := time.LoadLocation(p.getConfig().Timezone)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Error loading time zone %s, using UTC: %s", p.getConfig().Timezone, err.Error()))
+		loc = time.UTC
+	}
 
 	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
 		t.In(loc).Year(),
@@ -113,73 +573,140 @@ func (p *ServiceNowPlugin) getLocalTime(t time.Time) string {
 		t.In(loc).Second())
 }
 
-func (p *ServiceNowPlugin) convertTime(timestring string) (time.Time, string) {
+func (p *ServiceNowPlugin) convertTime(timestring string) (time.Time, error) {
 
 	goTimeString := strings.ReplaceAll(timestring, " ", "T") + "Z"
 	var goTime time.Time
 
 	err := goTime.UnmarshalText([]byte(goTimeString))
-	errorText := ""
 	if err != nil {
-		errorText = "Error in converting " + timestring + " to go Time: " + err.Error()
+		errorText := "Error in converting " + timestring + " to go Time: " + err.Error()
+		p.Logger.Error(errorText)
+		return goTime, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	return goTime, nil
+}
+
+// The windows of schedules don't use the date format of other fields, f.e. 20250520T080000. They are in the
+// time zone of the schedule, which should be the time zone of the plugin (see TIMEZONE).
+
+func (p *ServiceNowPlugin) convertScheduleTime(timestring string) (time.Time, error) {
+	loc, err := time.LoadLocation(p.getConfig().Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	goTime, err := time.ParseInLocation("20060102T150405", timestring, loc)
+	if err != nil {
+		errorText := "Error in converting schedule time " + timestring + " to go Time: " + err.Error()
+		p.Logger.Error(errorText)
+		return goTime, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	return goTime, nil
+}
+
+// The repeat_until of a blackout window is a date, ServiceNow sends it as 2025-12-31 or as 20251231.
+
+func (p *ServiceNowPlugin) convertScheduleDate(datestring string) (time.Time, error) {
+	goTime, err := time.Parse("2006-01-02", datestring)
+	if err != nil {
+		goTime, err = time.Parse("20060102", datestring)
+	}
+	if err != nil {
+		errorText := "Error in converting schedule date " + datestring + " to go Time: " + err.Error()
 		p.Logger.Error(errorText)
+		return goTime, p.newError(ErrServiceNowAPI, err, errorText)
 	}
 
-	return goTime, errorText
+	return goTime, nil
 }
 
-func (p *ServiceNowPlugin) convertToInt(context string, s string, def int) int {
+func (p *ServiceNowPlugin) convertToInt(context string, s string, minimum int, maximum int) (int, error) {
 	i, err := strconv.Atoi(s)
+	if err != nil || i < minimum || i > maximum {
+		errorText := fmt.Sprintf("Incorrect value %s in %s: should be a number from %d to %d", s, context, minimum, maximum)
+		p.Logger.Error(errorText)
+		return 0, p.newError(ErrConfig, err, errorText)
+	}
+	return i, nil
+}
+
+func (p *ServiceNowPlugin) convertToBool(context string, s string) (bool, error) {
+	b, err := strconv.ParseBool(s)
 	if err != nil {
-		errorText := fmt.Sprintf("Incorrect value, %s in %s: should be a number, assuming %d", s, context, def)
+		errorText := fmt.Sprintf("Incorrect value %s in %s: should be true or false", s, context)
 		p.Logger.Error(errorText)
-		i = def
+		return false, p.newError(ErrConfig, err, errorText)
 	}
-	return i
+	return b, nil
 }
 
-func (p *ServiceNowPlugin) getK8sConfig() string {
+func (p *ServiceNowPlugin) getK8sConfig() error {
 	var err error
-	errorText := ""
 
 	if !unittest {
 		k8sconfig, err = rest.InClusterConfig()
 		if err != nil {
-			errorText = "Error in getK8sConfig, rest.InClusterConfig: " + err.Error()
-		} else {
+			return p.newError(ErrConfig, err, "Error in getK8sConfig, rest.InClusterConfig: "+err.Error())
+		}
 
-			k8sclientset, err = kubernetes.NewForConfig(k8sconfig)
-			if err != nil {
-				errorText = "Error in getK8sConfig, kubernetes.NewForConfig: " + err.Error()
-			}
+		k8sclientset, err = kubernetes.NewForConfig(k8sconfig)
+		if err != nil {
+			return p.newError(ErrConfig, err, "Error in getK8sConfig, kubernetes.NewForConfig: "+err.Error())
+		}
+
+		k8sdynamicclient, err = dynamic.NewForConfig(k8sconfig)
+		if err != nil {
+			return p.newError(ErrConfig, err, "Error in getK8sConfig, dynamic.NewForConfig: "+err.Error())
 		}
 	}
 
-	return errorText
+	return nil
 }
 
-func (p *ServiceNowPlugin) getCredentialsFromSecret(namespace string, secretName string, usernameKey string, passwordKey string) (string, string, string) {
+func (p *ServiceNowPlugin) getCredentialsFromSecret(namespace string, secretName string, usernameKey string, passwordKey string) (string, string, error) {
 	p.Logger.Debug(fmt.Sprintf("Get credentials from secret [%s]%s...", namespace, secretName))
-	errorText := ""
 
 	secret, err := k8sclientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
 	if err != nil {
-		errorText = fmt.Sprintf("Error getting secret %s, does secret exist in namespace %s? Error: %s", secretName, namespace, err.Error())
+		errorText := fmt.Sprintf("Error getting secret %s, does secret exist in namespace %s? Error: %s", secretName, namespace, err.Error())
 		p.Logger.Error(errorText)
+		return "", "", p.newError(ErrConfig, err, errorText)
 	}
 
-	return string(secret.Data[usernameKey]), string(secret.Data[passwordKey]), errorText
+	return string(secret.Data[usernameKey]), string(secret.Data[passwordKey]), nil
 }
 
-func (p *ServiceNowPlugin) getExclusionsFromConfigMap(namespace string) []string {
-	p.Logger.Debug(fmt.Sprintf("Get exclusions from configmap [%s]%s", namespace, ExclusionsConfigMapName))
+// The controller-cm configmap is read once per configuration load, the settings in it are read from
+// this copy. Without the configmap, the defaults are used. Other errors are returned: loading the
+// defaults instead would replace a stricter configuration.
 
-	exclusions := []string{}
+func (p *ServiceNowPlugin) getControllerConfigMap(namespace string) (*v1.ConfigMap, error) {
+	p.Logger.Debug(fmt.Sprintf("Get configmap [%s]%s", namespace, ExclusionsConfigMapName))
 
 	configmap, err := k8sclientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), ExclusionsConfigMapName, metav1.GetOptions{})
-	if err != nil {
+	if k8serrors.IsNotFound(err) {
 		debugText := fmt.Sprintf("Error getting configmap %s, does configmap exist in namespace %s?", ExclusionsConfigMapName, namespace)
 		p.Logger.Debug(debugText)
+		return nil, nil
+	}
+	if err != nil {
+		errorText := fmt.Sprintf("Error getting configmap %s in namespace %s: %s", ExclusionsConfigMapName, namespace, err.Error())
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrKubernetes, err, errorText)
+	}
+
+	return configmap, nil
+}
+
+func (p *ServiceNowPlugin) getExclusionsFromConfigMap(configmap *v1.ConfigMap) []string {
+	p.Logger.Debug("Get exclusions from configmap " + ExclusionsConfigMapName)
+
+	exclusions := []string{}
+
+	if configmap == nil {
 		p.Logger.Debug("No exclusions used")
 	} else {
 		exclusions = strings.Split(configmap.Data["exclusion-roles"], "\n")
@@ -189,513 +716,3457 @@ func (p *ServiceNowPlugin) getExclusionsFromConfigMap(namespace string) []string
 	return exclusions
 }
 
-func (p *ServiceNowPlugin) getGlobalVars() string {
-	errorText := p.getK8sConfig()
+func (p *ServiceNowPlugin) getRevokeJobTemplateFromConfigMap(configmap *v1.ConfigMap) (*v1.PodTemplateSpec, error) {
+	p.Logger.Debug("Get revoke job template from configmap " + ExclusionsConfigMapName)
 
-	serviceNowURLError := ""
-	serviceNowCredentialsError := ""
-
-	serviceNowUrl, serviceNowURLError = p.getEnvVarWithoutDefault("SERVICENOW_URL", "No Service Now URL given (environment variable SERVICENOW_URL is empty)")
-	timezone = p.getEnvVarWithDefault("TIMEZONE", "UTC")
-	ciLabel = p.getEnvVarWithDefault("CI_LABEL", "ci-name")
-	ephemeralAccessPluginNamespace = p.getEnvVarWithDefault("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", "argocd-ephemeral-access")
-	exclusionRoles = p.getExclusionsFromConfigMap(ephemeralAccessPluginNamespace)
-	timeWindowChangesDays = p.convertToInt("environment variable TIME_WINDOW_CHANGES_DAYS", p.getEnvVarWithDefault("TIME_WINDOW_CHANGES_DAYS", "7"), 7)
+	if configmap == nil || configmap.Data["revoke-job-template"] == "" {
+		p.Logger.Debug("No revoke job template used")
+		return nil, nil
+	}
 
-	serviceNowUsername, serviceNowPassword, serviceNowCredentialsError = p.getServiceNowCredentials()
+	var template v1.PodTemplateSpec
+	decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["revoke-job-template"]), 4096)
+	err := decoder.Decode(&template)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in revoke-job-template in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrConfig, err, errorText)
+	}
 
-	return errorText + serviceNowURLError + serviceNowCredentialsError
+	p.Logger.Debug("Revoke job template used: " + configmap.Data["revoke-job-template"])
+	return &template, nil
 }
 
-func (p *ServiceNowPlugin) showRequest(ar *api.AccessRequest, app *argocd.Application) {
-	username := ar.Spec.Subject.Username
-	role := ar.Spec.Role.TemplateRef.Name
-	namespace := ar.Spec.Application.Namespace
-	applicationName := ar.Spec.Application.Name
-	duration := ar.Spec.Duration.Duration.String()
-
-	infoText := fmt.Sprintf("Call to GrantAccess: username: %s, role: %s, application: [%s]%s, duration: %s", username, role, namespace, applicationName, duration)
-	p.Logger.Info(infoText)
-
-	jsonAr, _ := json.Marshal(ar)
-	jsonApp, _ := json.Marshal(app)
-	p.Logger.Debug("jsonAr: " + string(jsonAr))
-	p.Logger.Debug("jsonApp: " + string(jsonApp))
-}
+func (p *ServiceNowPlugin) getValidCIStatusFromConfigMap(configmap *v1.ConfigMap) (CIValidity, error) {
+	p.Logger.Debug("Get CI validity from configmap " + ExclusionsConfigMapName)
 
-func (p *ServiceNowPlugin) createRevokeJob(namespace string, accessrequestName string, jobStartTime time.Time) {
-	p.Logger.Debug(fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessrequestName))
-	jobName := strings.ReplaceAll("stop-"+accessrequestName, ".", "-")
-	cmd := fmt.Sprintf("kubectl delete accessrequest -n argocd %s && kubectl delete cronjob -n argocd %s", accessrequestName, jobName)
-	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+	validity := CIValidity{}
 
-	var backOffLimit int32 = 0
+	if configmap != nil && configmap.Data["ci-validity"] != "" {
+		decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["ci-validity"]), 4096)
+		err := decoder.Decode(&validity)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in ci-validity in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+			p.Logger.Error(errorText)
+			return CIValidity{}, p.newError(ErrConfig, err, errorText)
+		}
+	}
 
-	cronJobSpec := &batchv1.CronJob{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      jobName,
-			Namespace: namespace,
-		},
-		Spec: batchv1.CronJobSpec{
-			Schedule: fmt.Sprintf("%d %d %d %d *", jobStartTime.Minute(), jobStartTime.Hour(), jobStartTime.Day(), jobStartTime.Month()),
-			JobTemplate: batchv1.JobTemplateSpec{
-				Spec: batchv1.JobSpec{
-					Template: v1.PodTemplateSpec{
-						Spec: v1.PodSpec{
-							ServiceAccountName: "remove-accessrequest-job-sa",
-							Containers: []v1.Container{
-								{
-									Name:    jobName,
-									Image:   "bitnami/kubectl:latest",
-									Command: []string{"sh", "-c", cmd},
-								},
-							},
-							RestartPolicy: v1.RestartPolicyNever,
-						},
-					},
-					BackoffLimit: &backOffLimit,
-				},
-			},
-		},
+	if len(validity.Default.InstallStatus) == 0 {
+		validity.Default.InstallStatus = defaultValidInstallStatus
 	}
 
-	_, err := cronjobs.Create(context.TODO(), cronJobSpec, metav1.CreateOptions{})
-	if err != nil {
-		p.Logger.Error(fmt.Sprintf("Failed to create K8s job %s in namespace %s: %s.", jobName, namespace, err.Error()))
-	} else {
-		p.Logger.Info(fmt.Sprintf("Created K8s job %s successfully in namespace %s", jobName, namespace))
+	for className, policy := range validity.Classes {
+		if len(policy.InstallStatus) == 0 {
+			errorText := fmt.Sprintf("Error in ci-validity in configmap %s: no install status for class %s", ExclusionsConfigMapName, className)
+			p.Logger.Error(errorText)
+			return CIValidity{}, p.newError(ErrConfig, nil, errorText)
+		}
 	}
+
+	p.Logger.Debug(fmt.Sprintf("CI validity used: default %v, classes %v", validity.Default, validity.Classes))
+	return validity, nil
 }
 
-// Set duration to the time left for this (valid) change, unless original request was
-// shorter - then we are forced to use the duration of the original request.
-// In an ideal world, the enddate should always be the enddate of the change and the duration always the amount of time
-// that remains until that moment.
+func (p *ServiceNowPlugin) getChangeEligibilityFromConfigMap(configmap *v1.ConfigMap) (ChangeEligibility, error) {
+	p.Logger.Debug("Get change eligibility from configmap " + ExclusionsConfigMapName)
 
-func (p *ServiceNowPlugin) determineDurationAndRealEndTime(arDuration time.Duration, changeRemainingTime time.Duration, changeEndDate time.Time) (time.Duration, time.Time) {
-	var duration time.Duration
-	var realEndTime time.Time
+	eligibility := ChangeEligibility{}
 
-	if arDuration > changeRemainingTime {
-		duration = changeRemainingTime
-		realEndTime = changeEndDate
-	} else {
-		duration = arDuration
-		realEndTime = time.Now().Add(arDuration)
+	if configmap != nil && configmap.Data["change-eligibility"] != "" {
+		decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["change-eligibility"]), 4096)
+		err := decoder.Decode(&eligibility)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in change-eligibility in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+			p.Logger.Error(errorText)
+			return ChangeEligibility{}, p.newError(ErrConfig, err, errorText)
+		}
 	}
 
-	return duration, realEndTime
-}
+	if eligibility.Default == "" {
+		eligibility.Default = DefaultChangeEligibilityQuery
+	}
 
-func (p *ServiceNowPlugin) determineGrantedTextsChange(requesterName string, requestedRole string, validChange Change, remainingTime time.Duration, realEndDate time.Time) (string, string) {
+	for changeType, query := range eligibility.Types {
+		if query == "" {
+			errorText := fmt.Sprintf("Error in change-eligibility in configmap %s: no conditions for change type %s", ExclusionsConfigMapName, changeType)
+			p.Logger.Error(errorText)
+			return ChangeEligibility{}, p.newError(ErrConfig, nil, errorText)
+		}
+	}
 
-	grantedAccessText := fmt.Sprintf("Granted access for %s: %s change %s (%s), role %s, from %s to %s",
-		requesterName,
-		validChange.Type,
-		validChange.Number,
-		validChange.ShortDescription,
-		requestedRole,
-		time.Now().Truncate(time.Minute),
-		realEndDate.Truncate(time.Second).String())
+	p.Logger.Debug(fmt.Sprintf("Change eligibility used: default %s, types %v", eligibility.Default, eligibility.Types))
+	return eligibility, nil
+}
 
-	grantedAccessUIText := fmt.Sprintf("Granted access: change __%s__ (%s), until __%s (%s)__",
-		validChange.Number,
-		validChange.ShortDescription,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
+// Usernames in Argo CD are not always the same as in ServiceNow, f.e. when Argo CD uses the email address
+// of the user. The requester-mapping maps a username in Argo CD to the value of REQUESTER_USER_FIELD in
+// ServiceNow, usernames that are not in the mapping are used as they are.
 
-	grantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to %s, for role %s, until %s (%s)",
-		requesterName,
-		requestedRole,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
+func (p *ServiceNowPlugin) getRequesterMappingFromConfigMap(configmap *v1.ConfigMap) (map[string]string, error) {
+	p.Logger.Debug("Get requester mapping from configmap " + ExclusionsConfigMapName)
 
-	p.Logger.Info(grantedAccessText)
-	p.Logger.Debug(grantedAccessUIText)
+	mapping := map[string]string{}
 
-	return grantedAccessUIText, grantedAccessServiceNowText
+	if configmap != nil && configmap.Data["requester-mapping"] != "" {
+		decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["requester-mapping"]), 4096)
+		err := decoder.Decode(&mapping)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in requester-mapping in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, err, errorText)
+		}
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Requester mapping used for %d users", len(mapping)))
+	return mapping, nil
 }
 
-func (p *ServiceNowPlugin) determineGrantedTextsExclusions(requesterName string, requestedRole string, remainingTime time.Duration, realEndDate time.Time) string {
+func (p *ServiceNowPlugin) getRolePoliciesFromConfigMap(configmap *v1.ConfigMap) (map[string]RolePolicy, error) {
+	p.Logger.Debug("Get role policies from configmap " + ExclusionsConfigMapName)
 
-	grantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, %s is an exclusion role)",
-		requesterName,
-		requestedRole,
-		time.Now().Truncate(time.Minute),
+	policies := map[string]RolePolicy{}
+
+	if configmap != nil && configmap.Data["role-policies"] != "" {
+		decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["role-policies"]), 4096)
+		err := decoder.Decode(&policies)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in role-policies in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, err, errorText)
+		}
+	}
+
+	for role, policy := range policies {
+		_, found := riskLevels[policy.MaxRisk]
+		if policy.MaxRisk != "" && !found {
+			errorText := fmt.Sprintf("Error in role-policies in configmap %s: unknown maximum risk %s for role %s, use very-high, high, moderate or low", ExclusionsConfigMapName, policy.MaxRisk, role)
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, nil, errorText)
+		}
+		if policy.NoChange && (len(policy.ChangeTypes) > 0 || policy.MaxRisk != "" || policy.GraceBeforeStartMinutes != nil || policy.GraceAfterEndMinutes != nil) {
+			errorText := fmt.Sprintf("Error in role-policies in configmap %s: role %s doesn't need a change, so it cannot have change types, a maximum risk or grace periods", ExclusionsConfigMapName, role)
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, nil, errorText)
+		}
+		for _, grace := range []*int{policy.GraceBeforeStartMinutes, policy.GraceAfterEndMinutes} {
+			if grace != nil && (*grace < 0 || *grace > MaxGraceMinutes) {
+				errorText := fmt.Sprintf("Error in role-policies in configmap %s: grace period %d of role %s should be between 0 and %d minutes", ExclusionsConfigMapName, *grace, role, MaxGraceMinutes)
+				p.Logger.Error(errorText)
+				return nil, p.newError(ErrConfig, nil, errorText)
+			}
+		}
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Role policies used: %v", policies))
+	return policies, nil
+}
+
+func (p *ServiceNowPlugin) getExclusionPoliciesFromConfigMap(configmap *v1.ConfigMap) (map[string]ExclusionPolicy, error) {
+	p.Logger.Debug("Get exclusion policies from configmap " + ExclusionsConfigMapName)
+
+	policies := map[string]ExclusionPolicy{}
+
+	if configmap != nil && configmap.Data["exclusion-policies"] != "" {
+		decoder := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(configmap.Data["exclusion-policies"]), 4096)
+		err := decoder.Decode(&policies)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in exclusion-policies in configmap %s: %s", ExclusionsConfigMapName, err.Error())
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, err, errorText)
+		}
+	}
+
+	for role, policy := range policies {
+		if policy.MaxDurationMinutes < 0 {
+			errorText := fmt.Sprintf("Error in exclusion-policies in configmap %s: maximum duration %d of exclusion role %s should be 0 (no maximum) or more minutes", ExclusionsConfigMapName, policy.MaxDurationMinutes, role)
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, nil, errorText)
+		}
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Exclusion policies used: %v", policies))
+	return policies, nil
+}
+
+// A grant record is stored as a configmap in the namespace of the access request, with the access
+// request as owner. Kubernetes will remove the grant record when the access request is deleted.
+
+func (p *ServiceNowPlugin) getGrantRecordName(ar *api.AccessRequest) string {
+	return GrantRecordPrefix + string(ar.UID)
+}
+
+func (p *ServiceNowPlugin) storeGrantRecord(ar *api.AccessRequest, grantRecord GrantRecord) error {
+	grantRecordName := p.getGrantRecordName(ar)
+	p.Logger.Debug(fmt.Sprintf("Store grant record [%s]%s", ar.Namespace, grantRecordName))
+
+	if ar.UID == "" {
+		errorText := fmt.Sprintf("Access request %s has no UID, grant record is not stored", ar.Name)
+		p.Logger.Error(errorText)
+		return p.newError(ErrKubernetes, nil, errorText)
+	}
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      grantRecordName,
+			Namespace: ar.Namespace,
+			Labels: map[string]string{
+				GrantRecordLabel: "true",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: api.GroupVersion.String(),
+					Kind:       "AccessRequest",
+					Name:       ar.Name,
+					UID:        ar.UID,
+				},
+			},
+		},
+		Data: map[string]string{
+			"accessrequest":        grantRecord.AccessRequestName,
+			"requester":            grantRecord.Requester,
+			"role":                 grantRecord.Role,
+			"change-number":        grantRecord.ChangeNumber,
+			"change-sys-id":        grantRecord.ChangeSysId,
+			"change-table":         grantRecord.ChangeTable,
+			"ci-sys-id":            grantRecord.CISysId,
+			"end-time":             grantRecord.EndTime.UTC().Format(time.RFC3339),
+			"exclusion-role":       strconv.FormatBool(grantRecord.ExclusionRole),
+			"expire-by-plugin":     strconv.FormatBool(grantRecord.ExpireByPlugin),
+			"other-change-numbers": strings.Join(grantRecord.OtherChangeNumbers, ","),
+			"other-change-sys-ids": strings.Join(grantRecord.OtherChangeSysIds, ","),
+			"other-change-tables":  strings.Join(grantRecord.OtherChangeTables, ","),
+		},
+	}
+
+	_, err := k8sclientset.CoreV1().ConfigMaps(ar.Namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		_, err = k8sclientset.CoreV1().ConfigMaps(ar.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		errorText := fmt.Sprintf("Failed to store grant record %s in namespace %s: %s", grantRecordName, ar.Namespace, err.Error())
+		p.Logger.Error(errorText)
+		return p.newError(ErrKubernetes, err, errorText)
+	}
+
+	return nil
+}
+
+func (p *ServiceNowPlugin) splitCommaSeparated(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
+
+func (p *ServiceNowPlugin) parseGrantRecord(configMap *v1.ConfigMap) GrantRecord {
+	endTime, err := time.Parse(time.RFC3339, configMap.Data["end-time"])
+	if err != nil {
+		p.Logger.Debug(fmt.Sprintf("Incorrect end time in grant record %s: %s", configMap.Name, err.Error()))
+	}
+
+	// Grant records of older releases don't have a table, these were always changes
+	changeTable := configMap.Data["change-table"]
+	if changeTable == "" {
+		changeTable = TableChangeRequest
+	}
+
+	// In grant records of older releases, the other changes are in the table of the change
+	otherChangeSysIds := p.splitCommaSeparated(configMap.Data["other-change-sys-ids"])
+	otherChangeTables := p.splitCommaSeparated(configMap.Data["other-change-tables"])
+	if otherChangeTables == nil {
+		for range otherChangeSysIds {
+			otherChangeTables = append(otherChangeTables, changeTable)
+		}
+	}
+
+	return GrantRecord{
+		AccessRequestName:  configMap.Data["accessrequest"],
+		Requester:          configMap.Data["requester"],
+		Role:               configMap.Data["role"],
+		ChangeNumber:       configMap.Data["change-number"],
+		ChangeSysId:        configMap.Data["change-sys-id"],
+		ChangeTable:        changeTable,
+		CISysId:            configMap.Data["ci-sys-id"],
+		EndTime:            endTime,
+		ExclusionRole:      configMap.Data["exclusion-role"] == "true",
+		ExpireByPlugin:     configMap.Data["expire-by-plugin"] == "true",
+		OtherChangeNumbers: p.splitCommaSeparated(configMap.Data["other-change-numbers"]),
+		OtherChangeSysIds:  otherChangeSysIds,
+		OtherChangeTables:  otherChangeTables,
+	}
+}
+
+// A grant record can be changed by everyone that can change configmaps in the namespace. Notes are only
+// added to the tables that the plugin uses itself, and every other change needs a number and a sys_id.
+
+func (p *ServiceNowPlugin) validateGrantRecord(name string, grantRecord GrantRecord) error {
+	knownTables := []string{TableChangeRequest, TableChangeTask, TableIncident, p.getConfig().ExclusionRecordTable}
+	for _, table := range append([]string{grantRecord.ChangeTable}, grantRecord.OtherChangeTables...) {
+		if !slices.Contains(knownTables, table) {
+			errorText := fmt.Sprintf("Grant record %s has an unknown table %s", name, table)
+			p.Logger.Error(errorText)
+			return p.newError(ErrKubernetes, nil, errorText)
+		}
+	}
+
+	otherChanges := len(grantRecord.OtherChangeNumbers)
+	if len(grantRecord.OtherChangeSysIds) != otherChanges || len(grantRecord.OtherChangeTables) != otherChanges {
+		errorText := fmt.Sprintf("Grant record %s has %d other change numbers, %d other change sys_ids and %d other change tables", name, otherChanges, len(grantRecord.OtherChangeSysIds), len(grantRecord.OtherChangeTables))
+		p.Logger.Error(errorText)
+		return p.newError(ErrKubernetes, nil, errorText)
+	}
+
+	return nil
+}
+
+func (p *ServiceNowPlugin) loadGrantRecord(ar *api.AccessRequest) (*GrantRecord, error) {
+	grantRecordName := p.getGrantRecordName(ar)
+	p.Logger.Debug(fmt.Sprintf("Load grant record [%s]%s", ar.Namespace, grantRecordName))
+
+	configMap, err := k8sclientset.CoreV1().ConfigMaps(ar.Namespace).Get(context.TODO(), grantRecordName, metav1.GetOptions{})
+	if err != nil {
+		errorText := fmt.Sprintf("Error getting grant record %s in namespace %s: %s", grantRecordName, ar.Namespace, err.Error())
+		p.Logger.Debug(errorText)
+		return nil, p.newError(ErrKubernetes, err, errorText)
+	}
+
+	grantRecord := p.parseGrantRecord(configMap)
+	err = p.validateGrantRecord(grantRecordName, grantRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grantRecord, nil
+}
+
+// Values that are read without errors can still be wrong: these are checked after all values are read.
+
+func (p *ServiceNowPlugin) validateConfig(config *Config) error {
+	var errs []error
+
+	if config.ServiceNowUrl != "" {
+		serviceNowURL, err := url.Parse(config.ServiceNowUrl)
+		if err != nil || (serviceNowURL.Scheme != "https" && serviceNowURL.Scheme != "http") || serviceNowURL.Host == "" {
+			errorText := fmt.Sprintf("Incorrect ServiceNow URL %s (environment variable SERVICENOW_URL), use the format https://your-instance.service-now.com", config.ServiceNowUrl)
+			p.Logger.Error(errorText)
+			errs = append(errs, p.newError(ErrConfig, err, errorText))
+		}
+	}
+
+	_, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		errorText := fmt.Sprintf("Unknown time zone %s (environment variable TIMEZONE), use f.e. UTC or Europe/Amsterdam", config.Timezone)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, err, errorText))
+	}
+
+	if config.RevokeMode != RevokeModeScheduler && config.RevokeMode != RevokeModeCronJob {
+		errorText := fmt.Sprintf("Unknown revoke mode %s (environment variable REVOKE_MODE), use %s or %s", config.RevokeMode, RevokeModeScheduler, RevokeModeCronJob)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	if !serviceNowNamePattern.MatchString(config.CIClass) {
+		errorText := fmt.Sprintf("Incorrect CI class %s (environment variable CI_CLASS), use the name of a CMDB table, f.e. cmdb_ci or cmdb_ci_appl", config.CIClass)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	_, err = regexp.Compile(config.CICorrelationIdPattern)
+	if err != nil {
+		errorText := fmt.Sprintf("Incorrect regular expression %s (environment variable CI_CORRELATION_ID_PATTERN): %s", config.CICorrelationIdPattern, err.Error())
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, err, errorText))
+	}
+
+	if config.CIPolicy != CIPolicyAny && config.CIPolicy != CIPolicyEvery {
+		errorText := fmt.Sprintf("Unknown CI policy %s (environment variable CI_POLICY), use %s or %s", config.CIPolicy, CIPolicyAny, CIPolicyEvery)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	if !serviceNowNamePattern.MatchString(config.RequesterUserField) {
+		errorText := fmt.Sprintf("Incorrect user field %s (environment variable REQUESTER_USER_FIELD), use the name of a field in sys_user, f.e. user_name or email", config.RequesterUserField)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	if !serviceNowNamePattern.MatchString(config.ExclusionRecordTable) {
+		errorText := fmt.Sprintf("Incorrect table %s (environment variable EXCLUSION_RECORD_TABLE), use the name of a table, f.e. incident or u_break_glass", config.ExclusionRecordTable)
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	// A policy for a role that is not an exclusion role would never be used, this is probably a typing error
+	for role := range config.ExclusionPolicies {
+		if !slices.Contains(config.ExclusionRoles, role) {
+			errorText := fmt.Sprintf("Error in exclusion-policies in configmap %s: %s is not in exclusion-roles", ExclusionsConfigMapName, role)
+			p.Logger.Error(errorText)
+			errs = append(errs, p.newError(ErrConfig, nil, errorText))
+		}
+	}
+
+	for _, priority := range config.IncidentPriorities {
+		if !slices.Contains([]string{"1", "2", "3", "4", "5"}, priority) {
+			errorText := fmt.Sprintf("Incorrect incident priority %s (environment variable INCIDENT_PRIORITIES), use priorities from 1 to 5, f.e. 1,2", priority)
+			p.Logger.Error(errorText)
+			errs = append(errs, p.newError(ErrConfig, nil, errorText))
+		}
+	}
+
+	validChangeSelectionPolicies := []string{ChangeSelectionLatestEnd, ChangeSelectionEarliestStart, ChangeSelectionDenyWhenAmbiguous, ChangeSelectionExplicit}
+	if !slices.Contains(validChangeSelectionPolicies, config.ChangeSelectionPolicy) {
+		errorText := fmt.Sprintf("Unknown change selection policy %s (environment variable CHANGE_SELECTION_POLICY), use %s", config.ChangeSelectionPolicy, strings.Join(validChangeSelectionPolicies, ", "))
+		p.Logger.Error(errorText)
+		errs = append(errs, p.newError(ErrConfig, nil, errorText))
+	}
+
+	return errors.Join(errs...)
+}
+
+// The keys that are needed depend on the authentication method. All missing keys are reported in one
+// error, so they can be added to the secret at once.
+
+func (p *ServiceNowPlugin) validateSecretKeys(config *Config) error {
+	var missingKeys []string
+
+	if config.ServiceNowAuthMethod != AuthMethodOAuthClientCredentials {
+		if config.ServiceNowUsername == "" {
+			missingKeys = append(missingKeys, "username")
+		}
+		if config.ServiceNowPassword == "" {
+			missingKeys = append(missingKeys, "password")
+		}
+	}
+
+	if config.ServiceNowAuthMethod != AuthMethodBasic {
+		if config.ServiceNowClientId == "" {
+			missingKeys = append(missingKeys, "client-id")
+		}
+		if config.ServiceNowClientSecret == "" {
+			missingKeys = append(missingKeys, "client-secret")
+		}
+	}
+
+	if len(missingKeys) == 0 {
+		return nil
+	}
+
+	errorText := fmt.Sprintf("Secret %s in namespace %s has no value for %s (needed for authentication method %s)", config.SecretName, config.Namespace, strings.Join(missingKeys, ", "), config.ServiceNowAuthMethod)
+	p.Logger.Error(errorText)
+	return p.newError(ErrConfig, nil, errorText)
+}
+
+// All configuration errors are returned together, so that they can be solved at once.
+
+func (p *ServiceNowPlugin) loadConfig() (*Config, error) {
+	if k8sclientset == nil {
+		err := p.getK8sConfig()
+		if err != nil {
+			p.Logger.Error(err.Error())
+			return nil, err
+		}
+	}
+
+	config := &Config{}
+
+	var serviceNowURLError error
+	var timeWindowChangesDaysError error
+	var expiryCheckIntervalSecondsError error
+	var revokeJobTemplateError error
+	var changeEligibilityError error
+	var ciValidityError error
+	var ciRelationDepthError error
+	var changeAffectedCIsError error
+	var requesterCheckError error
+	var requesterMappingError error
+	var rolePoliciesError error
+	var exclusionPoliciesError error
+	var blackoutCheckError error
+	var changeTasksError error
+	var graceBeforeStartMinutesError error
+	var graceAfterEndMinutesError error
+	var incidentAccessError error
+	var incidentAccessMinutesError error
+
+	// The namespace is needed to read the secret and the configmap, so it is determined first
+	config.Namespace = p.getEnvVarWithDefault("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", "argocd-ephemeral-access")
+	config.SecretName = p.getEnvVarWithDefault("SERVICENOW_SECRET_NAME", "servicenow-secret")
+	configmap, configMapError := p.getControllerConfigMap(config.Namespace)
+	config.ServiceNowUrl, serviceNowURLError = p.getEnvVarWithoutDefault("SERVICENOW_URL", "No Service Now URL given (environment variable SERVICENOW_URL is empty)")
+	config.Timezone = p.getEnvVarWithDefault("TIMEZONE", "UTC")
+	config.CILabel = p.getEnvVarWithDefault("CI_LABEL", "ci-name")
+	config.CIClass = p.getEnvVarWithDefault("CI_CLASS", "cmdb_ci")
+	config.CICorrelationIdPattern = p.getEnvVarWithDefault("CI_CORRELATION_ID_PATTERN", "")
+	config.CIPolicy = p.getEnvVarWithDefault("CI_POLICY", CIPolicyEvery)
+	config.ArgoCDNamespace = p.getEnvVarWithDefault("ARGOCD_NAMESPACE", "argocd")
+	config.CIRelationTypes = p.splitCommaSeparated(p.getEnvVarWithDefault("CI_RELATION_TYPES", ""))
+	config.CIRelationDepth, ciRelationDepthError = p.convertToInt("environment variable CI_RELATION_DEPTH", p.getEnvVarWithDefault("CI_RELATION_DEPTH", "0"), 0, 5)
+	config.ChangeAffectedCIs, changeAffectedCIsError = p.convertToBool("environment variable CHANGE_AFFECTED_CIS", p.getEnvVarWithDefault("CHANGE_AFFECTED_CIS", "false"))
+	config.RequesterCheck, requesterCheckError = p.convertToBool("environment variable REQUESTER_CHECK", p.getEnvVarWithDefault("REQUESTER_CHECK", "false"))
+	config.RequesterUserField = p.getEnvVarWithDefault("REQUESTER_USER_FIELD", "user_name")
+	config.BlackoutCheck, blackoutCheckError = p.convertToBool("environment variable BLACKOUT_CHECK", p.getEnvVarWithDefault("BLACKOUT_CHECK", "false"))
+	config.ChangeTasks, changeTasksError = p.convertToBool("environment variable CHANGE_TASKS", p.getEnvVarWithDefault("CHANGE_TASKS", "false"))
+	config.ChangeNumberKey = p.getEnvVarWithDefault("CHANGE_NUMBER_KEY", "change-number")
+	config.IncidentAccess, incidentAccessError = p.convertToBool("environment variable INCIDENT_ACCESS", p.getEnvVarWithDefault("INCIDENT_ACCESS", "false"))
+	config.IncidentNumberKey = p.getEnvVarWithDefault("INCIDENT_NUMBER_KEY", "incident-number")
+	config.IncidentPriorities = p.splitCommaSeparated(p.getEnvVarWithDefault("INCIDENT_PRIORITIES", "1,2"))
+	config.IncidentAccessMinutes, incidentAccessMinutesError = p.convertToInt("environment variable INCIDENT_ACCESS_MINUTES", p.getEnvVarWithDefault("INCIDENT_ACCESS_MINUTES", "240"), 1, 1440)
+	config.ChangeSelectionPolicy = p.getEnvVarWithDefault("CHANGE_SELECTION_POLICY", ChangeSelectionLatestEnd)
+	config.ChangeEligibility, changeEligibilityError = p.getChangeEligibilityFromConfigMap(configmap)
+	config.CIValidity, ciValidityError = p.getValidCIStatusFromConfigMap(configmap)
+	config.ExclusionRoles = p.getExclusionsFromConfigMap(configmap)
+	config.ExclusionPolicies, exclusionPoliciesError = p.getExclusionPoliciesFromConfigMap(configmap)
+	config.ExclusionRecordTable = p.getEnvVarWithDefault("EXCLUSION_RECORD_TABLE", TableIncident)
+	config.JustificationKey = p.getEnvVarWithDefault("JUSTIFICATION_KEY", "justification")
+	config.RequesterMapping, requesterMappingError = p.getRequesterMappingFromConfigMap(configmap)
+	config.RolePolicies, rolePoliciesError = p.getRolePoliciesFromConfigMap(configmap)
+	config.TimeWindowChangesDays, timeWindowChangesDaysError = p.convertToInt("environment variable TIME_WINDOW_CHANGES_DAYS", p.getEnvVarWithDefault("TIME_WINDOW_CHANGES_DAYS", "7"), 0, 365)
+	config.GraceBeforeStartMinutes, graceBeforeStartMinutesError = p.convertToInt("environment variable GRACE_BEFORE_START_MINUTES", p.getEnvVarWithDefault("GRACE_BEFORE_START_MINUTES", "0"), 0, MaxGraceMinutes)
+	config.GraceAfterEndMinutes, graceAfterEndMinutesError = p.convertToInt("environment variable GRACE_AFTER_END_MINUTES", p.getEnvVarWithDefault("GRACE_AFTER_END_MINUTES", "0"), 0, MaxGraceMinutes)
+	config.RevokeMode = p.getEnvVarWithDefault("REVOKE_MODE", RevokeModeScheduler)
+	config.RevokeJobImage = p.getEnvVarWithDefault("REVOKE_JOB_IMAGE", "bitnami/kubectl:latest")
+	config.RevokeJobServiceAccount = p.getEnvVarWithDefault("REVOKE_JOB_SERVICE_ACCOUNT", "remove-accessrequest-job-sa")
+	config.ExpiryCheckIntervalSeconds, expiryCheckIntervalSecondsError = p.convertToInt("environment variable EXPIRY_CHECK_INTERVAL_SECONDS", p.getEnvVarWithDefault("EXPIRY_CHECK_INTERVAL_SECONDS", "60"), 1, 86400)
+
+	if config.RevokeMode == RevokeModeCronJob {
+		config.RevokeJobTemplate, revokeJobTemplateError = p.getRevokeJobTemplateFromConfigMap(configmap)
+	}
+
+	serviceNowCredentialsError := p.getServiceNowCredentials(config)
+	serviceNowAuthMethodError := p.getServiceNowAuthMethod(config)
+	serviceNowClientError := p.updateServiceNowClient(config)
+
+	// Missing keys are only reported when the secret itself could be read
+	var secretKeysError error
+	if serviceNowCredentialsError == nil && serviceNowAuthMethodError == nil {
+		secretKeysError = p.validateSecretKeys(config)
+	}
+
+	err := errors.Join(configMapError, serviceNowURLError, timeWindowChangesDaysError, graceBeforeStartMinutesError, graceAfterEndMinutesError, expiryCheckIntervalSecondsError, ciRelationDepthError, changeAffectedCIsError, requesterCheckError, blackoutCheckError, changeTasksError, incidentAccessError, incidentAccessMinutesError, serviceNowCredentialsError,
+		serviceNowAuthMethodError, secretKeysError, revokeJobTemplateError, changeEligibilityError, ciValidityError, requesterMappingError, rolePoliciesError, exclusionPoliciesError, serviceNowClientError,
+		p.validateConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Until a configuration is loaded, an empty configuration is returned.
+
+func (p *ServiceNowPlugin) getConfig() *Config {
+	p.configStore.mutex.RLock()
+	defer p.configStore.mutex.RUnlock()
+
+	if p.configStore.config == nil {
+		return &Config{}
+	}
+	return p.configStore.config
+}
+
+func (p *ServiceNowPlugin) setConfig(config *Config) {
+	p.configStore.mutex.Lock()
+	defer p.configStore.mutex.Unlock()
+
+	p.configStore.config = config
+}
+
+// When the new configuration has errors, the previous configuration is kept: a typo in the configmap
+// should not stop the plugin from handling access requests. The errors are logged by loadConfig.
+
+func (p *ServiceNowPlugin) reloadConfig() error {
+	config, err := p.loadConfig()
+	if err != nil {
+		p.configStore.mutex.RLock()
+		hasConfig := p.configStore.config != nil
+		p.configStore.mutex.RUnlock()
+
+		if hasConfig {
+			p.Logger.Warn("Configuration is not reloaded, the previous configuration is still used")
+		}
+		return err
+	}
+
+	p.setConfig(config)
+	p.Logger.Debug("Configuration loaded")
+	return nil
+}
+
+// The configuration is loaded in Init. When a method is called without a configuration, f.e. by the
+// expiry scheduler in a test, the configuration is loaded first.
+
+func (p *ServiceNowPlugin) requireConfig() error {
+	p.configStore.mutex.RLock()
+	hasConfig := p.configStore.config != nil
+	p.configStore.mutex.RUnlock()
+
+	if hasConfig {
+		return nil
+	}
+	return p.reloadConfig()
+}
+
+// The watch is limited to the secret and the controller-cm configmap by name, so the plugin only needs
+// permissions for these two objects.
+
+func (p *ServiceNowPlugin) selectServiceNowSecret(options *metav1.ListOptions) {
+	secretName := p.getEnvVarWithDefault("SERVICENOW_SECRET_NAME", "servicenow-secret")
+	options.FieldSelector = fields.OneTermEqualSelector("metadata.name", secretName).String()
+}
+
+func (p *ServiceNowPlugin) selectControllerConfigMap(options *metav1.ListOptions) {
+	options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ExclusionsConfigMapName).String()
+}
+
+func (p *ServiceNowPlugin) onConfigObjectAdded(obj interface{}, isInInitialList bool) {
+	// The objects that exist when the watch starts are already read in Init
+	if !isInInitialList {
+		p.Logger.Info("Configuration object added, reload configuration")
+		_ = p.reloadConfig()
+	}
+}
+
+func (p *ServiceNowPlugin) onConfigObjectUpdated(oldObj interface{}, newObj interface{}) {
+	p.Logger.Info("Configuration object changed, reload configuration")
+	_ = p.reloadConfig()
+}
+
+func (p *ServiceNowPlugin) onConfigObjectDeleted(obj interface{}) {
+	p.Logger.Info("Configuration object deleted, reload configuration")
+	_ = p.reloadConfig()
+}
+
+func (p *ServiceNowPlugin) watchConfig(stop <-chan struct{}) error {
+	namespace := p.getEnvVarWithDefault("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", "argocd-ephemeral-access")
+	handler := cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc:    p.onConfigObjectAdded,
+		UpdateFunc: p.onConfigObjectUpdated,
+		DeleteFunc: p.onConfigObjectDeleted,
+	}
+
+	secretInformers := informers.NewSharedInformerFactoryWithOptions(k8sclientset, 0, informers.WithNamespace(namespace), informers.WithTweakListOptions(p.selectServiceNowSecret))
+	_, secretErr := secretInformers.Core().V1().Secrets().Informer().AddEventHandler(handler)
+
+	configMapInformers := informers.NewSharedInformerFactoryWithOptions(k8sclientset, 0, informers.WithNamespace(namespace), informers.WithTweakListOptions(p.selectControllerConfigMap))
+	_, configMapErr := configMapInformers.Core().V1().ConfigMaps().Informer().AddEventHandler(handler)
+
+	err := errors.Join(secretErr, configMapErr)
+	if err != nil {
+		errorText := "Error watching the configuration: " + err.Error()
+		p.Logger.Error(errorText)
+		return p.newError(ErrKubernetes, err, errorText)
+	}
+
+	// Waiting for the first list makes sure that changes after watchConfig returns are not missed. The wait
+	// is limited, so that Init doesn't hang when the secret or the configmap cannot be listed.
+	secretInformers.Start(stop)
+	configMapInformers.Start(stop)
+
+	syncCtx, cancel := context.WithTimeout(context.Background(), configSyncTimeout)
+	defer cancel()
+
+	synced := secretInformers.WaitForCacheSync(syncCtx.Done())
+	maps.Copy(synced, configMapInformers.WaitForCacheSync(syncCtx.Done()))
+	for informerType, ok := range synced {
+		if !ok {
+			errorText := fmt.Sprintf("Timeout waiting for the first list of %s in namespace %s after %s", informerType, namespace, configSyncTimeout)
+			p.Logger.Error(errorText)
+			return p.newError(ErrKubernetes, nil, errorText)
+		}
+	}
+	p.Logger.Info(fmt.Sprintf("Watching secret and configmap %s in namespace %s for configuration changes", ExclusionsConfigMapName, namespace))
+
+	return nil
+}
+
+func (p *ServiceNowPlugin) showRequest(ar *api.AccessRequest, app *argocd.Application) {
+	username := ar.Spec.Subject.Username
+	role := ar.Spec.Role.TemplateRef.Name
+	namespace := ar.Spec.Application.Namespace
+	applicationName := ar.Spec.Application.Name
+	duration := ar.Spec.Duration.Duration.String()
+
+	infoText := fmt.Sprintf("Call to GrantAccess: username: %s, role: %s, application: [%s]%s, duration: %s", username, role, namespace, applicationName, duration)
+	p.Logger.Info(infoText)
+
+	jsonAr, _ := json.Marshal(ar)
+	jsonApp, _ := json.Marshal(app)
+	p.Logger.Debug("jsonAr: " + string(jsonAr))
+	p.Logger.Debug("jsonApp: " + string(jsonApp))
+}
+
+// The status history of the access request contains the message that was returned by GrantAccess.
+// When access was granted based on a change, this message contains the change number between
+// double underscores (see determineGrantedTextsChange).
+
+func (p *ServiceNowPlugin) getGrantedChangeNumber(ar *api.AccessRequest) string {
+	changeNumber := ""
+
+	for i := len(ar.Status.History) - 1; i >= 0; i-- {
+		history := ar.Status.History[i]
+		if history.RequestState != api.GrantedStatus || history.Details == nil {
+			continue
+		}
+
+		_, afterPrefix, found := strings.Cut(*history.Details, "change __")
+		if found {
+			changeNumber, _, _ = strings.Cut(afterPrefix, "__")
+		}
+		break
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Change number found in history of access request %s: %s", ar.Name, changeNumber))
+	return changeNumber
+}
+
+func (p *ServiceNowPlugin) getRevokeJobName(accessrequestName string) string {
+	return strings.ReplaceAll("stop-"+accessrequestName, ".", "-")
+}
+
+// The pod template of the revoke job can be configured in the controller-cm configmap. The plugin only
+// fills in what is missing: the service account, the name and image of the first container and the
+// restart policy. The command of the first container is always set by the plugin.
+
+func (p *ServiceNowPlugin) getRevokeJobPodTemplate(jobName string, cmd string) v1.PodTemplateSpec {
+	var template v1.PodTemplateSpec
+	config := p.getConfig()
+	if config.RevokeJobTemplate != nil {
+		template = *config.RevokeJobTemplate.DeepCopy()
+	}
+
+	if template.Spec.ServiceAccountName == "" {
+		template.Spec.ServiceAccountName = config.RevokeJobServiceAccount
+	}
+
+	if len(template.Spec.Containers) == 0 {
+		template.Spec.Containers = []v1.Container{{}}
+	}
+
+	container := &template.Spec.Containers[0]
+	if container.Name == "" {
+		container.Name = jobName
+	}
+	if container.Image == "" {
+		container.Image = config.RevokeJobImage
+	}
+	container.Command = []string{"sh", "-c", cmd}
+
+	if template.Spec.RestartPolicy == "" {
+		template.Spec.RestartPolicy = v1.RestartPolicyNever
+	}
+
+	return template
+}
+
+func (p *ServiceNowPlugin) createRevokeJob(namespace string, accessrequestName string, jobStartTime time.Time) {
+	p.Logger.Debug(fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessrequestName))
+	jobName := p.getRevokeJobName(accessrequestName)
+	cmd := fmt.Sprintf("kubectl delete accessrequest -n %s %s && kubectl delete cronjob -n %s %s", namespace, accessrequestName, namespace, jobName)
+	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+
+	var backOffLimit int32 = 0
+
+	cronJobSpec := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: namespace,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule: fmt.Sprintf("%d %d %d %d *", jobStartTime.Minute(), jobStartTime.Hour(), jobStartTime.Day(), jobStartTime.Month()),
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template:     p.getRevokeJobPodTemplate(jobName, cmd),
+					BackoffLimit: &backOffLimit,
+				},
+			},
+		},
+	}
+
+	_, err := cronjobs.Create(context.TODO(), cronJobSpec, metav1.CreateOptions{})
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to create K8s job %s in namespace %s: %s.", jobName, namespace, err.Error()))
+	} else {
+		p.Logger.Info(fmt.Sprintf("Created K8s job %s successfully in namespace %s", jobName, namespace))
+	}
+}
+
+func (p *ServiceNowPlugin) deleteRevokeJob(namespace string, accessrequestName string) {
+	p.Logger.Debug(fmt.Sprintf("deleteRevokeJob: %s, %s", namespace, accessrequestName))
+	jobName := p.getRevokeJobName(accessrequestName)
+	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+
+	err := cronjobs.Delete(context.TODO(), jobName, metav1.DeleteOptions{})
+	if k8serrors.IsNotFound(err) {
+		p.Logger.Debug(fmt.Sprintf("No K8s job %s found in namespace %s, nothing to delete", jobName, namespace))
+	} else if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete K8s job %s in namespace %s: %s.", jobName, namespace, err.Error()))
+	} else {
+		p.Logger.Info(fmt.Sprintf("Deleted K8s job %s successfully in namespace %s", jobName, namespace))
+	}
+}
+
+// The expiry scheduler replaces the CronJob when REVOKE_MODE is scheduler. It uses the grant records
+// as its state, so nothing is lost when the plugin restarts. The scheduler wakes up at the earliest
+// end time of the grant records, after EXPIRY_CHECK_INTERVAL_SECONDS or when a new grant is stored.
+
+func (p *ServiceNowPlugin) wakeExpiryScheduler() {
+	select {
+	case expirySchedulerWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Every configmap with the grant record label is listed, so the scheduler only uses a grant record that
+// is owned by the access request that it names.
+
+func (p *ServiceNowPlugin) isGrantRecordOwner(configMap *v1.ConfigMap, accessRequest metav1.Object) bool {
+	if configMap.Name != GrantRecordPrefix+string(accessRequest.GetUID()) {
+		return false
+	}
+
+	for _, owner := range configMap.OwnerReferences {
+		if owner.APIVersion == api.GroupVersion.String() && owner.Kind == "AccessRequest" && owner.Name == accessRequest.GetName() && owner.UID == accessRequest.GetUID() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ServiceNowPlugin) expireAccessRequest(configMap *v1.ConfigMap, grantRecord GrantRecord) {
+	namespace := configMap.Namespace
+	accessRequests := k8sdynamicclient.Resource(accessRequestResource).Namespace(namespace)
+
+	accessRequest, err := accessRequests.Get(context.TODO(), grantRecord.AccessRequestName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		p.Logger.Debug(fmt.Sprintf("Access request %s not found in namespace %s, nothing to delete", grantRecord.AccessRequestName, namespace))
+		return
+	} else if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to get access request %s in namespace %s: %s.", grantRecord.AccessRequestName, namespace, err.Error()))
+		return
+	}
+
+	if !p.isGrantRecordOwner(configMap, accessRequest) {
+		p.Logger.Warn(fmt.Sprintf("Grant record %s in namespace %s doesn't belong to access request %s, grant record is ignored", configMap.Name, namespace, grantRecord.AccessRequestName))
+		return
+	}
+
+	// The access request can stay for a while after the delete, f.e. because of a finalizer
+	if accessRequest.GetDeletionTimestamp() != nil {
+		p.Logger.Debug(fmt.Sprintf("Access request %s in namespace %s is already being deleted", grantRecord.AccessRequestName, namespace))
+		return
+	}
+
+	p.Logger.Info(fmt.Sprintf("End time %s reached, delete access request [%s]%s", p.getLocalTime(grantRecord.EndTime), namespace, grantRecord.AccessRequestName))
+
+	uid := accessRequest.GetUID()
+	err = accessRequests.Delete(context.TODO(), grantRecord.AccessRequestName, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+	if k8serrors.IsNotFound(err) {
+		p.Logger.Debug(fmt.Sprintf("Access request %s not found in namespace %s, nothing to delete", grantRecord.AccessRequestName, namespace))
+		return
+	} else if err != nil {
+		p.Logger.Error(fmt.Sprintf("Failed to delete access request %s in namespace %s: %s.", grantRecord.AccessRequestName, namespace, err.Error()))
+		return
+	}
+	p.Logger.Info(fmt.Sprintf("Deleted access request %s successfully in namespace %s", grantRecord.AccessRequestName, namespace))
+
+	// Deleting the access request removes the permissions, but the Ephemeral Access Extension will not
+	// call RevokeAccess for it: add the note to the change here.
+	if grantRecord.ChangeSysId != "" {
+		ctx, cancel := p.startServiceNowDeadline()
+		defer cancel()
+		_, revokedAccessServiceNowText := p.determineRevokedTexts(grantRecord.Requester, grantRecord.Role, grantRecord.ChangeTable, grantRecord.ChangeNumber)
+
+		note := fmt.Sprintf("{\"work_notes\":\"%s\"}", revokedAccessServiceNowText)
+		p.postNote(ctx, grantRecord.ChangeTable, grantRecord.ChangeSysId, note)
+
+		for i, otherChangeSysId := range grantRecord.OtherChangeSysIds {
+			_, revokedAccessServiceNowText = p.determineRevokedTexts(grantRecord.Requester, grantRecord.Role, grantRecord.OtherChangeTables[i], grantRecord.OtherChangeNumbers[i])
+			note = fmt.Sprintf("{\"work_notes\":\"%s\"}", revokedAccessServiceNowText)
+			p.postNote(ctx, grantRecord.OtherChangeTables[i], otherChangeSysId, note)
+		}
+	}
+
+	// Without the grant record, the note is not added again before Kubernetes removes the access request
+	err = k8sclientset.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Logger.Error(fmt.Sprintf("Failed to delete grant record %s in namespace %s: %s.", configMap.Name, namespace, err.Error()))
+	}
+}
+
+func (p *ServiceNowPlugin) expireAccessRequests() time.Time {
+	currentTime := time.Now()
+	nextCheck := currentTime.Add(time.Duration(p.getConfig().ExpiryCheckIntervalSeconds) * time.Second)
+
+	configMaps, err := k8sclientset.CoreV1().ConfigMaps("").List(context.TODO(), metav1.ListOptions{LabelSelector: GrantRecordLabel + "=true"})
+	if err != nil {
+		p.Logger.Error("Error listing grant records: " + err.Error())
+		return nextCheck
+	}
+
+	for _, configMap := range configMaps.Items {
+		grantRecord := p.parseGrantRecord(&configMap)
+		if !grantRecord.ExpireByPlugin {
+			continue
+		}
+
+		if grantRecord.EndTime.After(currentTime) {
+			if grantRecord.EndTime.Before(nextCheck) {
+				nextCheck = grantRecord.EndTime
+			}
+			continue
+		}
+
+		if p.validateGrantRecord(configMap.Name, grantRecord) != nil {
+			continue
+		}
+
+		p.expireAccessRequest(&configMap, grantRecord)
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Next check of the expiry scheduler: %s", p.getLocalTime(nextCheck)))
+	return nextCheck
+}
+
+func (p *ServiceNowPlugin) runExpiryScheduler(stop <-chan struct{}) {
+	p.Logger.Info("Expiry scheduler started")
+
+	for {
+		// Without a configuration, the scheduler tries again after the default interval
+		nextCheck := time.Now().Add(60 * time.Second)
+
+		err := p.requireConfig()
+		if err != nil {
+			p.Logger.Error("Expiry scheduler: " + err.Error())
+		} else {
+			nextCheck = p.expireAccessRequests()
+		}
+
+		select {
+		case <-stop:
+			p.Logger.Info("Expiry scheduler stopped")
+			return
+		case <-expirySchedulerWakeup:
+		case <-time.After(time.Until(nextCheck)):
+		}
+	}
+}
+
+// Set duration to the time left for this (valid) change, unless original request was
+// shorter - then we are forced to use the duration of the original request.
+// In an ideal world, the enddate should always be the enddate of the change and the duration always the amount of time
+// that remains until that moment.
+
+func (p *ServiceNowPlugin) determineDurationAndRealEndTime(arDuration time.Duration, changeRemainingTime time.Duration, changeEndDate time.Time) (time.Duration, time.Time) {
+	var duration time.Duration
+	var realEndTime time.Time
+
+	if arDuration > changeRemainingTime {
+		duration = changeRemainingTime
+		realEndTime = changeEndDate
+	} else {
+		duration = arDuration
+		realEndTime = time.Now().Add(arDuration)
+	}
+
+	return duration, realEndTime
+}
+
+// The grace periods are shown to the requester and in ServiceNow, so it is clear why the access starts
+// before the change or ends after it.
+
+func (p *ServiceNowPlugin) getGraceText(filter ChangeFilter) string {
+	var gracePeriods []string
+	if filter.GraceBeforeStart > 0 {
+		gracePeriods = append(gracePeriods, filter.GraceBeforeStart.String()+" before the start")
+	}
+	if filter.GraceAfterEnd > 0 {
+		gracePeriods = append(gracePeriods, filter.GraceAfterEnd.String()+" after the end")
+	}
+
+	if len(gracePeriods) == 0 {
+		return ""
+	}
+	return ", with a grace period of " + strings.Join(gracePeriods, " and ")
+}
+
+func (p *ServiceNowPlugin) determineGrantedTextsChange(requesterName string, requestedRole string, validChange Change, remainingTime time.Duration, realEndDate time.Time, filter ChangeFilter) (string, string) {
+
+	changeText := fmt.Sprintf("change %s (%s)", validChange.Number, validChange.ShortDescription)
+	changeUIText := fmt.Sprintf("change __%s__ (%s)", validChange.Number, validChange.ShortDescription)
+	if validChange.Table == TableChangeTask {
+		changeText = fmt.Sprintf("change task %s (%s) of change %s", validChange.Number, validChange.ShortDescription, validChange.ParentNumber)
+		changeUIText = fmt.Sprintf("change task __%s__ (%s) of change __%s__", validChange.Number, validChange.ShortDescription, validChange.ParentNumber)
+	}
+
+	graceText := p.getGraceText(filter)
+
+	grantedAccessText := fmt.Sprintf("Granted access for %s: %s %s, role %s, from %s to %s%s",
+		requesterName,
+		validChange.Type,
+		changeText,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Second).String(),
+		graceText)
+
+	grantedAccessUIText := fmt.Sprintf("Granted access: %s, until __%s (%s)__%s",
+		changeUIText,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String(),
+		graceText)
+
+	grantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to %s, for role %s, until %s (%s)%s",
+		requesterName,
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String(),
+		graceText)
+
+	p.Logger.Info(grantedAccessText)
+	p.Logger.Debug(grantedAccessUIText)
+
+	return grantedAccessUIText, grantedAccessServiceNowText
+}
+
+// Without a record number, the use of the exclusion role could not be registered in ServiceNow.
+
+func (p *ServiceNowPlugin) determineGrantedTextsExclusions(requesterName string, requestedRole string, justification string, recordNumber string, remainingTime time.Duration, realEndDate time.Time) string {
+
+	if justification == "" {
+		justification = "not given"
+	}
+
+	recordText := ", not registered in ServiceNow"
+	if recordNumber != "" {
+		recordText = fmt.Sprintf(", registered in ServiceNow as __%s__", recordNumber)
+	}
+
+	grantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, %s is an exclusion role, justification: %s)%s",
+		requesterName,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Minute),
+		requestedRole,
+		justification,
+		recordText)
+
+	grantedAccessUIText := fmt.Sprintf("Granted access: %s is an exclusion role, until __%s (%s)__%s",
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String(),
+		recordText)
+
+	p.Logger.Warn(grantedAccessText)
+	p.Logger.Debug(grantedAccessUIText)
+
+	return grantedAccessUIText
+}
+
+func (p *ServiceNowPlugin) determineGrantedTextsWithoutChange(requesterName string, requestedRole string, remainingTime time.Duration, realEndDate time.Time) string {
+
+	grantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, role %s doesn't need a change)",
+		requesterName,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
 		realEndDate.Truncate(time.Minute),
 		requestedRole)
 
-	grantedAccessUIText := fmt.Sprintf("Granted access: %s is an exclusion role, until __%s (%s)__",
-		requestedRole,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
+	grantedAccessUIText := fmt.Sprintf("Granted access: role %s doesn't need a change, until __%s (%s)__",
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	p.Logger.Info(grantedAccessText)
+	p.Logger.Debug(grantedAccessUIText)
+
+	return grantedAccessUIText
+}
+
+// Access for an incident is logged as a warning, so it can be found apart from access for a change.
+
+func (p *ServiceNowPlugin) determineGrantedTextsIncident(requesterName string, requestedRole string, incident IncidentServiceNow, remainingTime time.Duration, realEndDate time.Time) (string, string) {
+
+	grantedAccessText := fmt.Sprintf("Granted access for %s: incident %s (%s), priority %s, role %s, from %s to %s (no change, incident access)",
+		requesterName,
+		incident.Number,
+		incident.ShortDescription,
+		incident.Priority,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Second).String())
+
+	grantedAccessUIText := fmt.Sprintf("Granted access: incident __%s__ (%s), until __%s (%s)__",
+		incident.Number,
+		incident.ShortDescription,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	grantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to %s, for role %s, until %s (%s)",
+		requesterName,
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	p.Logger.Warn(grantedAccessText)
+	p.Logger.Debug(grantedAccessUIText)
+
+	return grantedAccessUIText, grantedAccessServiceNowText
+}
+
+func (p *ServiceNowPlugin) determineRevokedTexts(requesterName string, requestedRole string, table string, changeNumber string) (string, string) {
+	currentTime := time.Now()
+
+	// Records of exclusion roles can be in any table (EXCLUSION_RECORD_TABLE)
+	recordType := "record"
+	switch table {
+	case TableChangeRequest:
+		recordType = "change"
+	case TableChangeTask:
+		recordType = "change task"
+	case TableIncident:
+		recordType = "incident"
+	}
+
+	revokedAccessText := fmt.Sprintf("Revoked access for %s: %s %s, role %s, at %s",
+		requesterName,
+		recordType,
+		changeNumber,
+		requestedRole,
+		currentTime.Truncate(time.Second))
+
+	revokedAccessUIText := fmt.Sprintf("Revoked access: %s __%s__, at __%s__",
+		recordType,
+		changeNumber,
+		p.getLocalTime(currentTime))
+
+	revokedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin revoked access for %s, for role %s, at %s",
+		requesterName,
+		requestedRole,
+		p.getLocalTime(currentTime))
+
+	p.Logger.Info(revokedAccessText)
+	p.Logger.Debug(revokedAccessUIText)
+
+	return revokedAccessUIText, revokedAccessServiceNowText
+}
+
+func (p *ServiceNowPlugin) denyRequest(reason string) (*plugin.GrantResponse, error) {
+	return &plugin.GrantResponse{
+		Status:  plugin.GrantStatusDenied,
+		Message: reason,
+	}, nil
+}
+
+func (p *ServiceNowPlugin) grantRequest(reason string) (*plugin.GrantResponse, error) {
+	return &plugin.GrantResponse{
+		Status:  plugin.GrantStatusGranted,
+		Message: reason,
+	}, nil
+}
+
+func (p *ServiceNowPlugin) revokeRequest(reason string) (*plugin.RevokeResponse, error) {
+	return &plugin.RevokeResponse{
+		Status:  plugin.RevokeStatusRevoked,
+		Message: reason,
+	}, nil
+}
+
+// The deny reason is a fixed text per kind of error. It is logged as a separate field, so denials can
+// be counted by reason in the logging system.
+
+func (p *ServiceNowPlugin) getDenyReason(err error) string {
+	switch {
+	case errors.Is(err, ErrConfig):
+		return "config"
+	case errors.Is(err, ErrKubernetes):
+		return "kubernetes"
+	case errors.Is(err, ErrServiceNowUnavailable):
+		return "servicenow-unavailable"
+	case errors.Is(err, ErrServiceNowAPI):
+		return "servicenow-api"
+	case errors.Is(err, ErrCINotFound):
+		return "ci-not-found"
+	case errors.Is(err, ErrCIInvalidStatus):
+		return "ci-invalid-status"
+	case errors.Is(err, ErrAmbiguousCI):
+		return "ambiguous-ci"
+	case errors.Is(err, ErrNoValidChange):
+		return "no-valid-change"
+	case errors.Is(err, ErrChangeNotLinked):
+		return "change-not-linked"
+	case errors.Is(err, ErrAmbiguousChange):
+		return "ambiguous-change"
+	case errors.Is(err, ErrChangeNumberRequired):
+		return "change-number-required"
+	case errors.Is(err, ErrRequesterNotAssigned):
+		return "requester-not-assigned"
+	case errors.Is(err, ErrChangeNotAllowed):
+		return "change-not-allowed"
+	case errors.Is(err, ErrBlackout):
+		return "blackout"
+	case errors.Is(err, ErrNoValidIncident):
+		return "no-valid-incident"
+	case errors.Is(err, ErrExclusionNotAllowed):
+		return "exclusion-not-allowed"
+	case errors.Is(err, ErrJustificationRequired):
+		return "justification-required"
+	}
+
+	return "unknown"
+}
+
+// Errors in the configuration of the plugin are not shown to the requester: they cannot solve them,
+// and they might contain information about the installation. The details are in the log.
+
+func (p *ServiceNowPlugin) getDenyMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrConfig), errors.Is(err, ErrKubernetes):
+		return "Access cannot be checked: the ServiceNow plugin is not configured correctly, please contact your Argo CD administrator"
+	case errors.Is(err, ErrServiceNowUnavailable):
+		return "ServiceNow is not available, please try again later (" + err.Error() + ")"
+	case errors.Is(err, ErrServiceNowAPI):
+		return "Unexpected response from ServiceNow, please contact your Argo CD administrator (" + err.Error() + ")"
+	}
+
+	return err.Error()
+}
+
+func (p *ServiceNowPlugin) denyAccess(requesterName string, requestedRole string, err error) (*plugin.GrantResponse, error) {
+	reason := p.getDenyReason(err)
+	p.Logger.Warn(fmt.Sprintf("Access denied for %s, role %s (%s): %s", requesterName, requestedRole, reason, err.Error()), "reason", reason)
+
+	return p.denyRequest(p.getDenyMessage(err))
+}
+
+func (p *ServiceNowPlugin) getServiceNowCredentials(config *Config) error {
+	var err error
+	config.ServiceNowUsername, config.ServiceNowPassword, err = p.getCredentialsFromSecret(config.Namespace, config.SecretName, "username", "password")
+
+	return err
+}
+
+// The client id and client secret for OAuth are stored in the same secret as the username and password.
+
+func (p *ServiceNowPlugin) getServiceNowAuthMethod(config *Config) error {
+	config.ServiceNowAuthMethod = p.getEnvVarWithDefault("SERVICENOW_AUTH_METHOD", AuthMethodBasic)
+
+	switch config.ServiceNowAuthMethod {
+	case AuthMethodBasic:
+		return nil
+	case AuthMethodOAuthClientCredentials, AuthMethodOAuthPassword:
+		var err error
+		config.ServiceNowClientId, config.ServiceNowClientSecret, err = p.getCredentialsFromSecret(config.Namespace, config.SecretName, "client-id", "client-secret")
+		return err
+	}
+
+	errorText := fmt.Sprintf("Unknown authentication method %s (environment variable SERVICENOW_AUTH_METHOD), use %s, %s or %s", config.ServiceNowAuthMethod, AuthMethodBasic, AuthMethodOAuthClientCredentials, AuthMethodOAuthPassword)
+	p.Logger.Error(errorText)
+	return p.newError(ErrConfig, nil, errorText)
+}
+
+func (p *ServiceNowPlugin) readServiceNowClientSettings() (ServiceNowClientSettings, error) {
+	var settings ServiceNowClientSettings
+
+	connectTimeoutSeconds, connectTimeoutError := p.convertToInt("environment variable SERVICENOW_CONNECT_TIMEOUT_SECONDS", p.getEnvVarWithDefault("SERVICENOW_CONNECT_TIMEOUT_SECONDS", "10"), 1, 300)
+	timeoutSeconds, timeoutError := p.convertToInt("environment variable SERVICENOW_TIMEOUT_SECONDS", p.getEnvVarWithDefault("SERVICENOW_TIMEOUT_SECONDS", "30"), 1, 600)
+	settings.ConnectTimeout = time.Duration(connectTimeoutSeconds) * time.Second
+	settings.Timeout = time.Duration(timeoutSeconds) * time.Second
+
+	var maxAttemptsError error
+	settings.MaxAttempts, maxAttemptsError = p.convertToInt("environment variable SERVICENOW_RETRY_MAX_ATTEMPTS", p.getEnvVarWithDefault("SERVICENOW_RETRY_MAX_ATTEMPTS", "4"), 1, 10)
+	baseDelayMilliseconds, baseDelayError := p.convertToInt("environment variable SERVICENOW_RETRY_BASE_DELAY_MILLISECONDS", p.getEnvVarWithDefault("SERVICENOW_RETRY_BASE_DELAY_MILLISECONDS", "500"), 0, 60000)
+	maxDelaySeconds, maxDelayError := p.convertToInt("environment variable SERVICENOW_RETRY_MAX_DELAY_SECONDS", p.getEnvVarWithDefault("SERVICENOW_RETRY_MAX_DELAY_SECONDS", "10"), 0, 300)
+	requestDeadlineSeconds, requestDeadlineError := p.convertToInt("environment variable SERVICENOW_REQUEST_DEADLINE_SECONDS", p.getEnvVarWithDefault("SERVICENOW_REQUEST_DEADLINE_SECONDS", "60"), 0, 3600)
+	settings.BaseDelay = time.Duration(baseDelayMilliseconds) * time.Millisecond
+	settings.MaxDelay = time.Duration(maxDelaySeconds) * time.Second
+	settings.RequestDeadline = time.Duration(requestDeadlineSeconds) * time.Second
+
+	var caCertError error
+	var clientCertError error
+	var clientKeyError error
+
+	settings.CACert, caCertError = p.getFileContentFromEnvVar("SERVICENOW_CA_FILE")
+	settings.ClientCert, clientCertError = p.getFileContentFromEnvVar("SERVICENOW_CLIENT_CERT_FILE")
+	settings.ClientKey, clientKeyError = p.getFileContentFromEnvVar("SERVICENOW_CLIENT_KEY_FILE")
+
+	return settings, errors.Join(connectTimeoutError, timeoutError, maxAttemptsError, baseDelayError, maxDelayError, requestDeadlineError,
+		caCertError, clientCertError, clientKeyError)
+}
+
+// The transport is based on the default transport of Go, so HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// are used in the same way as in other Go programs.
+
+func (p *ServiceNowPlugin) newServiceNowClient(settings ServiceNowClientSettings) (*ServiceNowClient, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if settings.CACert != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM([]byte(settings.CACert)) {
+			errorText := "Error in CA bundle for ServiceNow: no valid certificates found"
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, nil, errorText)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		clientCertificate, err := tls.X509KeyPair([]byte(settings.ClientCert), []byte(settings.ClientKey))
+		if err != nil {
+			errorText := "Error in client certificate for ServiceNow: " + err.Error()
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrConfig, err, errorText)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCertificate}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   settings.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = settings.ConnectTimeout
+	transport.TLSClientConfig = tlsConfig
+
+	client := &ServiceNowClient{
+		Settings: settings,
+		HttpClient: &http.Client{
+			Transport: transport,
+			Timeout:   settings.Timeout,
+		},
+	}
+
+	return client, nil
+}
+
+// The client of the current configuration is reused when the settings are not changed, in this way
+// connections to ServiceNow are reused between calls. The new configuration gets the client: when the
+// new configuration is not valid, the current configuration keeps its own client.
+
+func (p *ServiceNowPlugin) updateServiceNowClient(config *Config) error {
+	settings, err := p.readServiceNowClientSettings()
+	if err != nil {
+		return err
+	}
+
+	currentClient := p.getServiceNowClient()
+	if currentClient.HttpClient.Transport != nil && currentClient.Settings == settings {
+		config.ServiceNowClient = currentClient
+		return nil
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Create ServiceNow client: connect timeout %s, timeout %s", settings.ConnectTimeout, settings.Timeout))
+	client, err := p.newServiceNowClient(settings)
+	if err == nil {
+		config.ServiceNowClient = client
+	}
+
+	return err
+}
+
+func (p *ServiceNowPlugin) getServiceNowClient() *ServiceNowClient {
+	client := p.getConfig().ServiceNowClient
+	if client == nil {
+		return defaultServiceNowClient
+	}
+	return client
+}
+
+// All calls to ServiceNow that are done for one access request share the same deadline: retries
+// stop when the next attempt would start after this deadline. The deadline is passed in the context,
+// so that access requests that are handled at the same moment don't share a deadline.
+
+func (p *ServiceNowPlugin) startServiceNowDeadline() (context.Context, context.CancelFunc) {
+	client := p.getServiceNowClient()
+
+	if client.Settings.RequestDeadline > 0 {
+		return context.WithTimeout(context.Background(), client.Settings.RequestDeadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// When a refresh token is available, it is used to get a new access token. When that fails (f.e. because
+// the refresh token is expired as well), a new token is requested with the client id and secret.
+
+func (p *ServiceNowPlugin) requestOAuthToken(ctx context.Context, refreshToken string) (*OAuthToken, error) {
+	config := p.getConfig()
+	client := p.getServiceNowClient()
+	form := url.Values{}
+	form.Set("client_id", config.ServiceNowClientId)
+	form.Set("client_secret", config.ServiceNowClientSecret)
+
+	switch {
+	case refreshToken != "":
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+	case config.ServiceNowAuthMethod == AuthMethodOAuthPassword:
+		form.Set("grant_type", "password")
+		form.Set("username", config.ServiceNowUsername)
+		form.Set("password", config.ServiceNowPassword)
+	default:
+		form.Set("grant_type", "client_credentials")
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Request OAuth token from ServiceNow, grant type %s", form.Get("grant_type")))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.ServiceNowUrl+"/oauth_token.do", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, p.newError(ErrConfig, err, "Error in NewRequest for OAuth token: "+err.Error())
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return nil, p.newError(ErrServiceNowUnavailable, err, "Error in client.Do for OAuth token: "+err.Error())
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var tokenServiceNow OAuthTokenServiceNow
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &tokenServiceNow)
+	}
+
+	// Incorrect credentials result in 400 or 401, that will not be solved by trying again later
+	if resp.StatusCode != http.StatusOK || err != nil || tokenServiceNow.AccessToken == "" {
+		errorText := fmt.Sprintf("Error getting OAuth token from ServiceNow (status code %d)", resp.StatusCode)
+		if tokenServiceNow.Error != "" {
+			errorText = fmt.Sprintf("%s: %s %s", errorText, tokenServiceNow.Error, tokenServiceNow.ErrorDescription)
+		}
+		kind := ErrServiceNowUnavailable
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+			kind = ErrConfig
+		}
+		return nil, p.newError(kind, err, errorText)
+	}
+
+	token := &OAuthToken{
+		AccessToken:  tokenServiceNow.AccessToken,
+		RefreshToken: tokenServiceNow.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(tokenServiceNow.ExpiresIn) * time.Second),
+	}
+
+	return token, nil
+}
+
+// The token is cached and reused until it is about to expire. The key of the token makes sure that a new
+// token is requested when the URL, the authentication method or the credentials are changed.
+
+func (p *ServiceNowPlugin) getOAuthToken(ctx context.Context) (string, error) {
+	config := p.getConfig()
+	client := p.getServiceNowClient()
+	key := strings.Join([]string{config.ServiceNowUrl, config.ServiceNowAuthMethod, config.ServiceNowClientId, config.ServiceNowClientSecret, config.ServiceNowUsername, config.ServiceNowPassword}, "\n")
+
+	client.tokenMutex.Lock()
+	defer client.tokenMutex.Unlock()
+
+	cachedToken := client.token
+	if cachedToken != nil && cachedToken.Key == key {
+		if time.Until(cachedToken.ExpiresAt) > OAuthTokenRefreshMargin {
+			return cachedToken.AccessToken, nil
+		}
+
+		if cachedToken.RefreshToken != "" {
+			token, err := p.requestOAuthToken(ctx, cachedToken.RefreshToken)
+			if err == nil {
+				token.Key = key
+				client.token = token
+				return token.AccessToken, nil
+			}
+			p.Logger.Debug("Refresh of OAuth token failed, request new token: " + err.Error())
+		}
+	}
+
+	token, err := p.requestOAuthToken(ctx, "")
+	if err != nil {
+		client.token = nil
+		return "", err
+	}
+
+	token.Key = key
+	client.token = token
+	return token.AccessToken, nil
+}
+
+func (p *ServiceNowPlugin) setServiceNowAuthentication(req *http.Request) error {
+	config := p.getConfig()
+	if config.ServiceNowAuthMethod == AuthMethodOAuthClientCredentials || config.ServiceNowAuthMethod == AuthMethodOAuthPassword {
+		accessToken, err := p.getOAuthToken(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return nil
+	}
+
+	req.SetBasicAuth(config.ServiceNowUsername, config.ServiceNowPassword)
+	return nil
+}
+
+// A token that is revoked in ServiceNow before it expires results in 401: forget the token, so the next
+// call will request a new one.
+
+func (p *ServiceNowPlugin) invalidateOAuthToken() {
+	client := p.getServiceNowClient()
+
+	client.tokenMutex.Lock()
+	defer client.tokenMutex.Unlock()
+
+	client.token = nil
+}
+
+func (p *ServiceNowPlugin) checkAPIResult(resp *http.Response, body []byte) ([]byte, error) {
+
+	var err error
+	if (resp.StatusCode >= 500 && resp.StatusCode <= 599) || strings.Contains(string(body), "<html>") {
+		err = p.newError(ErrServiceNowUnavailable, nil, "ServiceNow API server is down")
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 {
+		err = p.newError(ErrServiceNowAPI, nil, "ServiceNow API changed")
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		err = p.newError(ErrServiceNowUnavailable, nil, "ServiceNow API rate limit exceeded")
+	}
+
+	return body, err
+}
+
+// Only failures that are expected to go away are retried: rate limiting, a gateway that cannot reach
+// ServiceNow, refused connections and connections that are closed halfway. Other failures (f.e. 401, 404
+// or an unknown host) will fail again in the same way.
+//
+// POST and PATCH are not idempotent: after a gateway timeout or a connection that is closed halfway,
+// ServiceNow may already have created the record or added the note. These are only retried when
+// ServiceNow didn't handle the request: when it is rate limited or when the connection was refused.
+
+func (p *ServiceNowPlugin) isRetryableServiceNowError(method string, resp *http.Response, err error) bool {
+	idempotent := method == http.MethodGet
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return true
+		}
+		return idempotent && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent
+	}
+
+	return false
+}
+
+// When ServiceNow tells when to retry (via Retry-After or via X-RateLimit-Reset when no requests are
+// remaining), that moment is used. Otherwise exponential backoff with jitter is used: half of the delay
+// is fixed, the other half is random, so that plugins that are rate limited at the same moment don't
+// retry at the same moment.
+
+func (p *ServiceNowPlugin) getRetryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		retryAfter := resp.Header.Get("Retry-After")
+		if retryAfter != "" {
+			seconds, err := strconv.Atoi(retryAfter)
+			if err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			retryTime, err := http.ParseTime(retryAfter)
+			if err == nil {
+				return max(time.Until(retryTime), 0)
+			}
+		}
+
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			resetSeconds, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+			if err == nil {
+				return max(time.Until(time.Unix(resetSeconds, 0)), 0)
+			}
+		}
+	}
+
+	client := p.getServiceNowClient()
+	delay := client.Settings.MaxDelay
+	if attempt < 31 {
+		delay = min(client.Settings.BaseDelay*time.Duration(1<<(attempt-1)), client.Settings.MaxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (p *ServiceNowPlugin) doServiceNowRequest(ctx context.Context, method string, apiCall string, data string) (*http.Response, []byte, error) {
+	client := p.getServiceNowClient()
+
+	var requestBody io.Reader
+	if data != "" {
+		requestBody = strings.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiCall, requestBody)
+	if err != nil {
+		return nil, nil, p.newError(ErrConfig, err, "Error in NewRequest: "+err.Error())
+	}
+
+	req.Header.Add("Accept", "application/json")
+	err = p.setServiceNowAuthentication(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.HttpClient.Do(req)
+	if err != nil {
+		return nil, nil, p.newError(ErrServiceNowUnavailable, err, "Error in client.Do: "+err.Error())
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && p.getConfig().ServiceNowAuthMethod != AuthMethodBasic {
+		p.invalidateOAuthToken()
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, p.newError(ErrServiceNowUnavailable, err, "Error in io.ReadAll: "+err.Error())
+	}
+
+	return resp, body, nil
+}
+
+func (p *ServiceNowPlugin) callServiceNowAPI(ctx context.Context, method string, requestURI string, data string) ([]byte, error) {
+	client := p.getServiceNowClient()
+
+	apiCall := fmt.Sprintf("%s%s", p.getConfig().ServiceNowUrl, requestURI)
+	p.Logger.Debug("apiCall: " + apiCall)
+
+	maxAttempts := max(client.Settings.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		resp, body, requestErr := p.doServiceNowRequest(ctx, method, apiCall, data)
+
+		err := requestErr
+		if requestErr == nil {
+			p.Logger.Debug(string(body))
+			body, err = p.checkAPIResult(resp, body)
+			if err == nil {
+				return body, nil
+			}
+		}
+
+		if attempt >= maxAttempts || !p.isRetryableServiceNowError(method, resp, requestErr) {
+			if requestErr != nil {
+				p.Logger.Error(err.Error())
+			}
+			return body, err
+		}
+
+		delay := p.getRetryDelay(resp, attempt)
+		deadline, hasDeadline := ctx.Deadline()
+		if hasDeadline && time.Now().Add(delay).After(deadline) {
+			err = fmt.Errorf("%w (no retry: retry in %s would exceed the deadline)", err, delay.Round(time.Millisecond))
+			p.Logger.Error(err.Error())
+			return body, err
+		}
+
+		p.Logger.Warn(fmt.Sprintf("%s %s failed: %s, retry %d of %d in %s", method, requestURI, err.Error(), attempt, maxAttempts-1, delay.Round(time.Millisecond)))
+		time.Sleep(delay)
+	}
+}
+
+func (p *ServiceNowPlugin) getFromServiceNowAPI(ctx context.Context, requestURI string) ([]byte, error) {
+	return p.callServiceNowAPI(ctx, "GET", requestURI, "")
+}
+
+func (p *ServiceNowPlugin) patchServiceNowAPI(ctx context.Context, requestURI string, data string) ([]byte, error) {
+	p.Logger.Debug("Data: " + data)
+
+	return p.callServiceNowAPI(ctx, "PATCH", requestURI, data)
+}
+
+func (p *ServiceNowPlugin) postServiceNowAPI(ctx context.Context, requestURI string, data string) ([]byte, error) {
+	p.Logger.Debug("Data: " + data)
+
+	return p.callServiceNowAPI(ctx, "POST", requestURI, data)
+}
+
+// Names of CIs don't have to be unique. When the label contains a sys_id or a correlation id, the CI
+// is searched by this field instead of by name. Correlation ids are only used when a pattern is
+// configured: they are set by the tool that created the CI and have no fixed format.
+
+func (p *ServiceNowPlugin) determineCIQueryField(ciName string) string {
+	if sysIdPattern.MatchString(ciName) {
+		return "sys_id"
+	}
+
+	correlationIdPattern := p.getConfig().CICorrelationIdPattern
+	if correlationIdPattern != "" {
+		matched, _ := regexp.MatchString(correlationIdPattern, ciName)
+		if matched {
+			return "correlation_id"
+		}
+	}
+
+	return "name"
+}
+
+// A list of CIs can be given as a JSON list, f.e. ["app-frontend","app-backend"], or as comma separated
+// values, f.e. app-frontend,app-backend.
+
+func (p *ServiceNowPlugin) parseCINames(value string) ([]string, error) {
+	var ciNames []string
+
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		err := json.Unmarshal([]byte(value), &ciNames)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ciNames = strings.Split(value, ",")
+	}
+
+	var result []string
+	for _, ciName := range ciNames {
+		ciName = strings.Trim(ciName, "\" ")
+		if ciName != "" && !slices.Contains(result, ciName) {
+			result = append(result, ciName)
+		}
+	}
+
+	return result, nil
+}
+
+// The CIs are read from the annotation and the label with the name of CI_LABEL, and from labels that
+// start with the name of CI_LABEL and a dot, f.e. ci-name.backend.
+
+func (p *ServiceNowPlugin) readCINamesFromMetadata(objectDescription string, labels map[string]string, annotations map[string]string) ([]string, error) {
+	ciLabel := p.getConfig().CILabel
+	var ciNames []string
+
+	values := []string{annotations[ciLabel], labels[ciLabel]}
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if strings.HasPrefix(key, ciLabel+".") {
+			values = append(values, labels[key])
+		}
+	}
+
+	for _, value := range values {
+		names, err := p.parseCINames(value)
+		if err != nil {
+			errorText := fmt.Sprintf("Incorrect list of CIs %s in %s: %s", value, objectDescription, err.Error())
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrCINotFound, err, errorText)
+		}
+
+		for _, name := range names {
+			if !slices.Contains(ciNames, name) {
+				ciNames = append(ciNames, name)
+			}
+		}
+	}
+
+	return ciNames, nil
+}
+
+// Teams can add the CIs to the AppProject, these are used for applications without CIs. A missing
+// AppProject is not an error: the application then has no CIs.
+
+func (p *ServiceNowPlugin) readCINamesFromAppProject(projectName string) ([]string, error) {
+	namespace := p.getConfig().ArgoCDNamespace
+
+	appProject, err := k8sdynamicclient.Resource(appProjectResource).Namespace(namespace).Get(context.TODO(), projectName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		p.Logger.Debug(fmt.Sprintf("AppProject %s not found in namespace %s", projectName, namespace))
+		return nil, nil
+	}
+	if err != nil {
+		errorText := fmt.Sprintf("Error getting AppProject %s in namespace %s: %s", projectName, namespace, err.Error())
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrKubernetes, err, errorText)
+	}
+
+	return p.readCINamesFromMetadata("project "+projectName, appProject.GetLabels(), appProject.GetAnnotations())
+}
+
+func (p *ServiceNowPlugin) getCINames(app *argocd.Application) ([]string, error) {
+	ciLabel := p.getConfig().CILabel
+	p.Logger.Debug("Search for " + ciLabel + " in the CMDB...")
+
+	ciNames, err := p.readCINamesFromMetadata("application "+app.Name, app.Labels, app.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciNames) == 0 && app.Spec.Project != "" {
+		ciNames, err = p.readCINamesFromAppProject(app.Spec.Project)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(ciNames) == 0 {
+		errorText := fmt.Sprintf("No CI name found: expected label or annotation with name %s in application %s", ciLabel, app.Name)
+		if app.Spec.Project != "" {
+			errorText += " or in project " + app.Spec.Project
+		}
+		return nil, p.newError(ErrCINotFound, nil, errorText)
+	}
+
+	p.Logger.Debug(fmt.Sprintf("ciLabel %s found: %s", ciLabel, strings.Join(ciNames, ", ")))
+	return ciNames, nil
+}
+
+// When more than one CI matches, the plugin cannot know which CI is meant: the requester sees the
+// matching CIs, so the label can be changed to the sys_id of the right CI.
+
+func (p *ServiceNowPlugin) getCI(ctx context.Context, ciName string) (*CmdbServiceNow, error) {
+	config := p.getConfig()
+	queryField := p.determineCIQueryField(ciName)
+
+	requestURI := fmt.Sprintf("/api/now/table/%s?%s=%s&sysparm_fields=install_status,operational_status,sys_class_name,name,sys_id&sysparm_display_value=all", config.CIClass, queryField, url.QueryEscape(ciName))
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmdbResults CmdbResultsServiceNowType
+	err = json.Unmarshal(response, &cmdbResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(cmdbResults.Result) == 0 {
+		errorText := fmt.Sprintf("No CI with %s %s found in %s", queryField, ciName, config.CIClass)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrCINotFound, nil, errorText)
+	}
+
+	if len(cmdbResults.Result) > 1 {
+		var matchingCIs []string
+		for _, CI := range cmdbResults.Result {
+			matchingCIs = append(matchingCIs, fmt.Sprintf("%s (class %s, sys_id %s)", CI.Name.Value, CI.ClassName.Value, CI.SysId.Value))
+		}
+
+		errorText := fmt.Sprintf("More than one CI with %s %s found in %s: %s. Use the sys_id of the CI in label %s of the application", queryField, ciName, config.CIClass, strings.Join(matchingCIs, ", "), config.CILabel)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrAmbiguousCI, nil, errorText)
+	}
+
+	debugText := fmt.Sprintf("InstallStatus: %s, OperationalStatus: %s, Class: %s, CI name: %s, SysId: %s",
+		cmdbResults.Result[0].InstallStatus.Value,
+		cmdbResults.Result[0].OperationalStatus.Value,
+		cmdbResults.Result[0].ClassName.Value,
+		cmdbResults.Result[0].Name.Value,
+		cmdbResults.Result[0].SysId.Value)
+	p.Logger.Debug(debugText)
+
+	return cmdbResults.Result[0], nil
+}
+
+// Changes can be raised against a CI higher in the CMDB, f.e. the business service that uses the CI of
+// the application. The parents of the CI are followed up to CI_RELATION_DEPTH levels, a change of
+// the CI or of one of these parents gives access. The CI itself is always the first in the list.
+
+func (p *ServiceNowPlugin) getRelatedCIs(ctx context.Context, ciSysId string) ([]string, error) {
+	config := p.getConfig()
+
+	ciSysIds := []string{ciSysId}
+	children := []string{ciSysId}
+	for depth := 1; depth <= config.CIRelationDepth && len(children) > 0; depth++ {
+		query := "childIN" + strings.Join(children, ",")
+		if len(config.CIRelationTypes) > 0 {
+			query += "^type.nameIN" + strings.Join(config.CIRelationTypes, ",")
+		}
+
+		requestURI := fmt.Sprintf("/api/now/table/cmdb_rel_ci?sysparm_query=%s&sysparm_fields=parent&sysparm_exclude_reference_link=true", p.encodeServiceNowQuery(query))
+		response, err := p.getFromServiceNowAPI(ctx, requestURI)
+		if err != nil {
+			return nil, err
+		}
+
+		var relationResults CIRelationResultsServiceNow
+		err = json.Unmarshal(response, &relationResults)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+			p.Logger.Error(errorText)
+			return nil, p.newError(ErrServiceNowAPI, err, errorText)
+		}
+
+		// A parent that was already found is not followed again, relations in the CMDB can be circular
+		var parents []string
+		for _, relation := range relationResults.Result {
+			if relation.Parent != "" && !slices.Contains(ciSysIds, relation.Parent) {
+				ciSysIds = append(ciSysIds, relation.Parent)
+				parents = append(parents, relation.Parent)
+			}
+		}
+		children = parents
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Related CIs of %s: %s", ciSysId, strings.Join(ciSysIds, ", ")))
+	return ciSysIds, nil
+}
+
+// The requester can give the change number in an annotation or a label of the access request. When
+// neither is present, the changes of the CI are searched in the time window.
+
+func (p *ServiceNowPlugin) getRequestedChangeNumber(ar *api.AccessRequest) (string, error) {
+	changeNumberKey := p.getConfig().ChangeNumberKey
+
+	value, found := ar.Annotations[changeNumberKey]
+	if !found {
+		value, found = ar.Labels[changeNumberKey]
+	}
+	if !found || value == "" {
+		return "", nil
+	}
+
+	changeNumber := changeNumberPattern.FindString(value)
+	if changeNumber == "" {
+		errorText := fmt.Sprintf("No change number found in %s (%s) of access request %s, use f.e. CHG0030002", changeNumberKey, value, ar.Name)
+		p.Logger.Info(errorText)
+		return "", p.newError(ErrNoValidChange, nil, errorText)
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Change number %s requested in access request %s", changeNumber, ar.Name))
+	return strings.ToUpper(changeNumber), nil
+}
+
+func (p *ServiceNowPlugin) getRequestedIncidentNumber(ar *api.AccessRequest) (string, error) {
+	incidentNumberKey := p.getConfig().IncidentNumberKey
+
+	value, found := ar.Annotations[incidentNumberKey]
+	if !found {
+		value, found = ar.Labels[incidentNumberKey]
+	}
+	if !found || value == "" {
+		return "", nil
+	}
+
+	incidentNumber := incidentNumberPattern.FindString(value)
+	if incidentNumber == "" {
+		errorText := fmt.Sprintf("No incident number found in %s (%s) of access request %s, use f.e. INC0010001", incidentNumberKey, value, ar.Name)
+		p.Logger.Info(errorText)
+		return "", p.newError(ErrNoValidIncident, nil, errorText)
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Incident number %s requested in access request %s", incidentNumber, ar.Name))
+	return strings.ToUpper(incidentNumber), nil
+}
+
+// The justification for an exclusion role is free text, so an annotation is the most practical place:
+// the value of a label cannot contain spaces.
+
+func (p *ServiceNowPlugin) getJustification(ar *api.AccessRequest) string {
+	justificationKey := p.getConfig().JustificationKey
+
+	value, found := ar.Annotations[justificationKey]
+	if !found {
+		value = ar.Labels[justificationKey]
+	}
+
+	return strings.TrimSpace(value)
+}
+
+// The requester is searched once per access request, the changes are compared with the sys_id of the user.
+
+func (p *ServiceNowPlugin) getServiceNowUserSysId(ctx context.Context, requesterName string) (string, error) {
+	config := p.getConfig()
+
+	userName, found := config.RequesterMapping[requesterName]
+	if !found {
+		userName = requesterName
+	}
+
+	// A ^ in the value would start a new condition in the encoded query, ServiceNow reads ^^ as a ^
+	query := fmt.Sprintf("%s=%s^active=true", config.RequesterUserField, url.QueryEscape(strings.ReplaceAll(userName, "^", "^^")))
+	requestURI := fmt.Sprintf("/api/now/table/sys_user?sysparm_query=%s&sysparm_fields=sys_id&sysparm_limit=2", p.encodeServiceNowQuery(query))
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return "", err
+	}
+
+	var userResults UserResultsServiceNow
+	err = json.Unmarshal(response, &userResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return "", p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(userResults.Result) != 1 {
+		errorText := fmt.Sprintf("No active ServiceNow user found with %s %s for requester %s", config.RequesterUserField, userName, requesterName)
+		if len(userResults.Result) > 1 {
+			errorText = fmt.Sprintf("More than one active ServiceNow user found with %s %s for requester %s", config.RequesterUserField, userName, requesterName)
+		}
+		p.Logger.Info(errorText)
+		return "", p.newError(ErrRequesterNotAssigned, nil, errorText)
+	}
+
+	p.Logger.Debug(fmt.Sprintf("Requester %s is ServiceNow user %s", requesterName, userResults.Result[0].SysId))
+	return userResults.Result[0].SysId, nil
+}
+
+// The encoded query is part of the URL, the rest of the request URI doesn't need encoding.
+
+func (p *ServiceNowPlugin) encodeServiceNowQuery(query string) string {
+	query = strings.ReplaceAll(query, " ", "%20")
+	query = strings.ReplaceAll(query, "-", "%2d")
+	query = strings.ReplaceAll(query, ":", "%3a")
+	query = strings.ReplaceAll(query, "<", "%3c")
+	query = strings.ReplaceAll(query, "=", "%3d")
+	query = strings.ReplaceAll(query, ">", "%3e")
+	query = strings.ReplaceAll(query, "^", "%5e")
+
+	return query
+}
+
+func (p *ServiceNowPlugin) getChangeEligibilityQuery(changeType string) string {
+	eligibility := p.getConfig().ChangeEligibility
+
+	query, found := eligibility.Types[changeType]
+	if !found {
+		query = eligibility.Default
+	}
+	if query == "" {
+		query = DefaultChangeEligibilityQuery
+	}
+
+	return query
+}
+
+func (p *ServiceNowPlugin) getChangeRequestURI(ciSysIds []string, sysparmOffset int) string {
+	// See also: https://github.com/argoproj-labs/argocd-ephemeral-access/issues/109
+	// The requester can give the change number in the access request (see getRequestedChangeNumber),
+	// without it the changes of the CI are searched in a time window.
+	//
+	// The dates can only be used with > and < in the sysparam_query, that also needs to have the
+	// cmdb_ci sys_id instead of the name and -1 instead of the display name of the state.
+	//
+	// The reason for the window is to limit the number of changes that have to be
+	// processed by the API in large environments.
+	window, _ := time.ParseDuration(fmt.Sprintf("%d", p.getConfig().TimeWindowChangesDays*24) + "h")
+
+	fromDate := time.Now().Add(-window)
+	endDate := time.Now().Add(window)
+
+	fromDateString := fmt.Sprintf(`%04d-%02d-%02d 00:00:00`,
+		fromDate.Year(),
+		fromDate.Month(),
+		fromDate.Day())
+	endDateString := fmt.Sprintf(`%04d-%02d-%02d 23:59:59`,
+		endDate.Year(),
+		endDate.Month(),
+		endDate.Day())
+
+	// Every change type with its own conditions gets its own part of the query, ^NQ combines these
+	// parts with OR. The last part is for all other change types.
+	changeTypes := slices.Sorted(maps.Keys(p.getConfig().ChangeEligibility.Types))
+
+	ciSelection := "cmdb_ci=" + ciSysIds[0]
+	if len(ciSysIds) > 1 {
+		ciSelection = "cmdb_ciIN" + strings.Join(ciSysIds, ",")
+	}
+	ciSelections := []string{ciSelection}
+
+	// The affected CIs of a change are in the related list task_ci, RLQUERY selects the changes that
+	// have at least one of the CIs in this list.
+	if p.getConfig().ChangeAffectedCIs {
+		ciSelections = append(ciSelections, fmt.Sprintf("RLQUERYtask_ci.task,>=1^ci_itemIN%s^ENDRLQUERY", strings.Join(ciSysIds, ",")))
+	}
+
+	otherTypes := ""
+	if len(changeTypes) > 0 {
+		otherTypes = fmt.Sprintf("^typeNOT IN%s", strings.Join(changeTypes, ","))
+	}
+
+	var queries []string
+	for _, ciSelection := range ciSelections {
+		for _, changeType := range changeTypes {
+			queries = append(queries, fmt.Sprintf("%s^type=%s^%s^GOTOstart_date>%s^GOTOend_date<%s",
+				ciSelection,
+				changeType,
+				p.getChangeEligibilityQuery(changeType),
+				fromDateString,
+				endDateString))
+		}
+
+		queries = append(queries, fmt.Sprintf("%s%s^%s^GOTOstart_date>%s^GOTOend_date<%s",
+			ciSelection,
+			otherTypes,
+			p.getChangeEligibilityQuery(""),
+			fromDateString,
+			endDateString))
+	}
+
+	selection := p.encodeServiceNowQuery(strings.Join(queries, "^NQ"))
+
+	otherFields := fmt.Sprintf("sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=%d&sysparm_offset=%d",
+		SysparmLimit,
+		sysparmOffset)
+
+	requestURI := "/api/now/table/change_request?sysparm_query=" + selection + "&" + otherFields
+
+	return requestURI
+}
+
+func (p *ServiceNowPlugin) getChanges(ctx context.Context, ciSysIds []string, sysparmOffset int) ([]*ChangeServiceNow, int, error) {
+
+	requestURI := p.getChangeRequestURI(ciSysIds, sysparmOffset)
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		p.Logger.Error(err.Error())
+		return nil, sysparmOffset, err
+	}
+
+	var changeResults ChangeResultsServicenow
+	err = json.Unmarshal(response, &changeResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, sysparmOffset, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(changeResults.Result) == 0 {
+		errorText := "No changes found"
+		p.Logger.Info(errorText)
+		err = p.newError(ErrNoValidChange, nil, errorText)
+	}
+
+	return changeResults.Result, sysparmOffset + len(changeResults.Result), err
+}
+
+func (p *ServiceNowPlugin) getChangeByNumber(ctx context.Context, changeNumber string) (*ChangeServiceNow, error) {
+
+	requestURI := fmt.Sprintf("/api/now/table/change_request?number=%s&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,cmdb_ci,state,approval,risk,assigned_to,assignment_group&sysparm_exclude_reference_link=true", changeNumber)
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	var changeResults ChangeResultsServicenow
+	err = json.Unmarshal(response, &changeResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(changeResults.Result) == 0 {
+		errorText := fmt.Sprintf("No change with number %s found", changeNumber)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrNoValidChange, nil, errorText)
+	}
+
+	return changeResults.Result[0], nil
+}
+
+// Only open change tasks are read, the planned start and end dates are checked by the plugin. The change
+// number limits the tasks to the tasks of the change in the access request.
+
+func (p *ServiceNowPlugin) getChangeTaskRequestURI(ciSysIds []string, changeNumber string, sysparmOffset int) string {
+	query := "cmdb_ci=" + ciSysIds[0]
+	if len(ciSysIds) > 1 {
+		query = "cmdb_ciIN" + strings.Join(ciSysIds, ",")
+	}
+	query += "^active=true"
+	if changeNumber != "" {
+		query += "^change_request.number=" + changeNumber
+	}
+
+	otherFields := fmt.Sprintf("sysparm_fields=number,short_description,planned_start_date,planned_end_date,sys_id,assigned_to,assignment_group,"+
+		"change_request,change_request.number,change_request.type,change_request.risk,change_request.state,change_request.approval"+
+		"&sysparm_exclude_reference_link=true&sysparm_limit=%d&sysparm_offset=%d",
+		SysparmLimit,
+		sysparmOffset)
+
+	return "/api/now/table/change_task?sysparm_query=" + p.encodeServiceNowQuery(query) + "&" + otherFields
+}
+
+func (p *ServiceNowPlugin) getChangeTasks(ctx context.Context, ciSysIds []string, changeNumber string, sysparmOffset int) ([]*ChangeTaskServiceNow, int, error) {
+
+	requestURI := p.getChangeTaskRequestURI(ciSysIds, changeNumber, sysparmOffset)
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		p.Logger.Error(err.Error())
+		return nil, sysparmOffset, err
+	}
+
+	var changeTaskResults ChangeTaskResultsServiceNow
+	err = json.Unmarshal(response, &changeTaskResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, sysparmOffset, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(changeTaskResults.Result) == 0 {
+		errorText := "No open change tasks found"
+		if changeNumber != "" {
+			errorText = fmt.Sprintf("No open change tasks of change %s found", changeNumber)
+		}
+		p.Logger.Info(errorText)
+		err = p.newError(ErrNoValidChange, nil, errorText)
+	}
+
+	return changeTaskResults.Result, sysparmOffset + len(changeTaskResults.Result), err
+}
+
+// A requested change must meet the same conditions as the changes that are found in the time window.
+// The conditions are encoded queries, so ServiceNow is asked if the change meets them.
+
+func (p *ServiceNowPlugin) checkEligibility(ctx context.Context, changeServiceNow ChangeServiceNow) error {
+	eligibilityQuery := p.getChangeEligibilityQuery(changeServiceNow.Type)
+	query := fmt.Sprintf("sys_id=%s^%s", changeServiceNow.SysId, eligibilityQuery)
+
+	requestURI := "/api/now/table/change_request?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=sys_id"
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return err
+	}
+
+	var changeResults ChangeResultsServicenow
+	err = json.Unmarshal(response, &changeResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	if len(changeResults.Result) == 0 {
+		errorText := fmt.Sprintf("Change %s (type: %s, state: %s, approval: %s) doesn't meet the conditions to be implemented: %s",
+			changeServiceNow.Number,
+			changeServiceNow.Type,
+			changeServiceNow.State,
+			changeServiceNow.Approval,
+			eligibilityQuery)
+		p.Logger.Info(errorText)
+		return p.newError(ErrNoValidChange, nil, errorText)
+	}
+
+	return nil
+}
+
+func (p *ServiceNowPlugin) parseChange(changeServiceNow ChangeServiceNow) (Change, error) {
+	var change Change
+
+	p.Logger.Debug(fmt.Sprintf("Change: Type: %s, Number: %s, Short description: %s, Start Date: %s, End Date: %s, SysId: %s",
+		changeServiceNow.Type,
+		changeServiceNow.Number,
+		changeServiceNow.ShortDescription,
+		changeServiceNow.StartDate,
+		changeServiceNow.EndDate,
+		changeServiceNow.SysId))
+
+	var errStartDate error
+	var errEndDate error
+
+	change.Type = changeServiceNow.Type
+	change.Number = changeServiceNow.Number
+	change.ShortDescription = changeServiceNow.ShortDescription
+	change.StartDate, errStartDate = p.convertTime(changeServiceNow.StartDate)
+	change.EndDate, errEndDate = p.convertTime(changeServiceNow.EndDate)
+	change.SysId = changeServiceNow.SysId
+	change.Risk = changeServiceNow.Risk
+	change.AssignedTo = changeServiceNow.AssignedTo.Value
+	change.AssignmentGroup = changeServiceNow.AssignmentGroup.Value
+	change.Table = TableChangeRequest
+
+	return change, errors.Join(errStartDate, errEndDate)
+}
+
+// A change task is used as a change: the type and the risk are those of its change, the dates are the
+// planned dates of the task.
+
+func (p *ServiceNowPlugin) parseChangeTask(changeTaskServiceNow ChangeTaskServiceNow) (Change, error) {
+	var change Change
+
+	p.Logger.Debug(fmt.Sprintf("Change task: Number: %s, Change: %s, Short description: %s, Planned start date: %s, Planned end date: %s, SysId: %s",
+		changeTaskServiceNow.Number,
+		changeTaskServiceNow.ChangeNumber,
+		changeTaskServiceNow.ShortDescription,
+		changeTaskServiceNow.StartDate,
+		changeTaskServiceNow.EndDate,
+		changeTaskServiceNow.SysId))
+
+	var errStartDate error
+	var errEndDate error
+
+	change.Type = changeTaskServiceNow.ChangeType
+	change.Number = changeTaskServiceNow.Number
+	change.ShortDescription = changeTaskServiceNow.ShortDescription
+	change.StartDate, errStartDate = p.convertTime(changeTaskServiceNow.StartDate)
+	change.EndDate, errEndDate = p.convertTime(changeTaskServiceNow.EndDate)
+	change.SysId = changeTaskServiceNow.SysId
+	change.Risk = changeTaskServiceNow.ChangeRisk
+	change.AssignedTo = changeTaskServiceNow.AssignedTo.Value
+	change.AssignmentGroup = changeTaskServiceNow.AssignmentGroup.Value
+	change.Table = TableChangeTask
+	change.ParentNumber = changeTaskServiceNow.ChangeNumber
+	change.ParentSysId = changeTaskServiceNow.ChangeRequest.Value
+
+	return change, errors.Join(errStartDate, errEndDate)
+}
+
+func (p *ServiceNowPlugin) getCIStatusPolicy(className string) CIStatusPolicy {
+	validity := p.getConfig().CIValidity
+
+	policy, found := validity.Classes[className]
+	if !found {
+		policy = validity.Default
+	}
+	if len(policy.InstallStatus) == 0 {
+		policy.InstallStatus = defaultValidInstallStatus
+	}
+
+	return policy
+}
+
+// The display value is shown to the requester, the value is added because the configuration uses it.
+
+func (p *ServiceNowPlugin) formatServiceNowValue(value ServiceNowValue) string {
+	if value.DisplayValue == "" || value.DisplayValue == value.Value {
+		return value.Value
+	}
+	return fmt.Sprintf("%s (%s)", value.DisplayValue, value.Value)
+}
+
+func (p *ServiceNowPlugin) checkCI(CI CmdbServiceNow) error {
+	ciName := CI.Name.Value
+	if CI.ClassName.Value != "" {
+		ciName = fmt.Sprintf("%s (class %s)", ciName, CI.ClassName.Value)
+	}
+
+	// Retired CIs are never valid, whatever the configuration is
+	if CI.InstallStatus.Value == InstallStatusRetired || CI.OperationalStatus.Value == OperationalStatusRetired {
+		return p.newError(ErrCIInvalidStatus, nil, fmt.Sprintf("CI %s is retired (install status %s, operational status %s)",
+			ciName,
+			p.formatServiceNowValue(CI.InstallStatus),
+			p.formatServiceNowValue(CI.OperationalStatus)))
+	}
+
+	policy := p.getCIStatusPolicy(CI.ClassName.Value)
+
+	if !slices.Contains(policy.InstallStatus, CI.InstallStatus.Value) {
+		return p.newError(ErrCIInvalidStatus, nil, fmt.Sprintf("Invalid install status %s for CI %s", p.formatServiceNowValue(CI.InstallStatus), ciName))
+	}
+
+	if len(policy.OperationalStatus) > 0 && !slices.Contains(policy.OperationalStatus, CI.OperationalStatus.Value) {
+		return p.newError(ErrCIInvalidStatus, nil, fmt.Sprintf("Invalid operational status %s for CI %s", p.formatServiceNowValue(CI.OperationalStatus), ciName))
+	}
+
+	return nil
+}
+
+// The grace periods of the filter extend the time range of the change, so the requester can prepare
+// before the change starts and verify after it ends.
+
+func (p *ServiceNowPlugin) checkChange(change Change, filter ChangeFilter) (time.Duration, error) {
+	var err error
+	var remainingTime time.Duration
+	remainingTime = 0
+
+	currentTime := time.Now()
+
+	if change.EndDate.Add(filter.GraceAfterEnd).Before(currentTime) ||
+		change.StartDate.Add(-filter.GraceBeforeStart).After(currentTime) {
+		errorText := fmt.Sprintf("Change %s (%s) is not in the valid time range. start date: %s and end date: %s (current date: %s)%s",
+			change.Number,
+			change.ShortDescription,
+			p.getLocalTime(change.StartDate),
+			p.getLocalTime(change.EndDate),
+			p.getLocalTime(currentTime),
+			p.getGraceText(filter))
+		p.Logger.Debug(errorText)
+		err = p.newError(ErrNoValidChange, nil, errorText)
+	} else {
+		remainingTime = time.Until(change.EndDate.Add(filter.GraceAfterEnd))
+	}
+
+	return remainingTime, err
+}
+
+// The CIs of the application can also be in the affected CIs of the change (table task_ci) instead of
+// in the CI field of the change.
+
+func (p *ServiceNowPlugin) checkAffectedCIs(ctx context.Context, changeServiceNow ChangeServiceNow, ciSysIds []string) (bool, error) {
+	query := fmt.Sprintf("task=%s^ci_itemIN%s", changeServiceNow.SysId, strings.Join(ciSysIds, ","))
+	requestURI := fmt.Sprintf("/api/now/table/task_ci?sysparm_query=%s&sysparm_fields=ci_item&sysparm_exclude_reference_link=true&sysparm_limit=1", p.encodeServiceNowQuery(query))
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return false, err
+	}
+
+	var affectedCIResults AffectedCIResultsServiceNow
+	err = json.Unmarshal(response, &affectedCIResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return false, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	return len(affectedCIResults.Result) > 0, nil
+}
+
+// Without a requester (REQUESTER_CHECK is false) every change can be used.
+
+func (p *ServiceNowPlugin) checkRequester(ctx context.Context, requesterSysId string, change Change) error {
+	if requesterSysId == "" || change.AssignedTo == requesterSysId {
+		return nil
+	}
+
+	if change.AssignmentGroup != "" {
+		query := fmt.Sprintf("user=%s^group=%s", requesterSysId, change.AssignmentGroup)
+		requestURI := fmt.Sprintf("/api/now/table/sys_user_grmember?sysparm_query=%s&sysparm_fields=sys_id&sysparm_limit=1", p.encodeServiceNowQuery(query))
+		response, err := p.getFromServiceNowAPI(ctx, requestURI)
+		if err != nil {
+			return err
+		}
+
+		var memberResults GroupMemberResultsServiceNow
+		err = json.Unmarshal(response, &memberResults)
+		if err != nil {
+			errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+			p.Logger.Error(errorText)
+			return p.newError(ErrServiceNowAPI, err, errorText)
+		}
+
+		if len(memberResults.Result) > 0 {
+			p.Logger.Debug(fmt.Sprintf("Requester is a member of the assignment group of %s", change.Number))
+			return nil
+		}
+	}
+
+	// An incident is checked in the same way as a change
+	recordType := "Change"
+	if change.Table == TableIncident {
+		recordType = "Incident"
+	}
+	errorText := fmt.Sprintf("%s %s is not assigned to the requester or to one of the groups of the requester", recordType, change.Number)
+	p.Logger.Info(errorText)
+	return p.newError(ErrRequesterNotAssigned, nil, errorText)
+}
+
+// Without a policy for the role, every change can be used. The risk of a change without a risk is unknown,
+// so it is only accepted when the policy has no maximum risk.
+
+func (p *ServiceNowPlugin) checkRolePolicy(role string, policy *RolePolicy, change Change) error {
+	if policy == nil {
+		return nil
+	}
+
+	var problems []string
+	if len(policy.ChangeTypes) > 0 && !slices.Contains(policy.ChangeTypes, change.Type) {
+		problems = append(problems, fmt.Sprintf("type %s is not one of %s", change.Type, strings.Join(policy.ChangeTypes, ", ")))
+	}
+
+	if policy.MaxRisk != "" {
+		risk, err := strconv.Atoi(change.Risk)
+		if err != nil || risk < riskLevels[policy.MaxRisk] {
+			problems = append(problems, fmt.Sprintf("risk %s is higher than %s", change.Risk, policy.MaxRisk))
+		}
+	}
 
-	p.Logger.Warn(grantedAccessText)
-	p.Logger.Debug(grantedAccessUIText)
+	if len(problems) == 0 {
+		return nil
+	}
 
-	return grantedAccessUIText
+	errorText := fmt.Sprintf("Change %s cannot be used for role %s: %s", change.Number, role, strings.Join(problems, " and "))
+	p.Logger.Info(errorText)
+	return p.newError(ErrChangeNotAllowed, nil, errorText)
 }
 
-func (p *ServiceNowPlugin) denyRequest(reason string) (*plugin.GrantResponse, error) {
-	return &plugin.GrantResponse{
-		Status:  plugin.GrantStatusDenied,
-		Message: reason,
-	}, nil
+// Users are compared with the username in Argo CD, so they can be checked when ServiceNow is not
+// available. Groups are groups in ServiceNow: a requester that is not a ServiceNow user is not a member.
+// When ServiceNow is not available, the groups cannot be checked and only the users can use the role.
+
+func (p *ServiceNowPlugin) checkExclusionPolicy(ctx context.Context, requesterName string, role string, policy ExclusionPolicy) error {
+	if (len(policy.Users) == 0 && len(policy.Groups) == 0) || slices.Contains(policy.Users, requesterName) {
+		return nil
+	}
+
+	reason := ""
+	if len(policy.Groups) > 0 {
+		member, err := p.isExclusionGroupMember(ctx, requesterName, policy.Groups)
+		if member {
+			p.Logger.Debug(fmt.Sprintf("Requester %s is a member of one of the groups of exclusion role %s", requesterName, role))
+			return nil
+		}
+		if err != nil {
+			p.Logger.Warn(fmt.Sprintf("Groups of exclusion role %s cannot be checked, only the users of the role are allowed: %s", role, err.Error()))
+			reason = " (the groups of the role cannot be checked in ServiceNow)"
+		}
+	}
+
+	errorText := fmt.Sprintf("Requester %s is not allowed to use exclusion role %s%s", requesterName, role, reason)
+	p.Logger.Info(errorText)
+	return p.newError(ErrExclusionNotAllowed, nil, errorText)
 }
 
-func (p *ServiceNowPlugin) grantRequest(reason string) (*plugin.GrantResponse, error) {
-	return &plugin.GrantResponse{
-		Status:  plugin.GrantStatusGranted,
-		Message: reason,
-	}, nil
+// A requester that is not a ServiceNow user is not a member, an error means that membership could not be
+// checked.
+
+func (p *ServiceNowPlugin) isExclusionGroupMember(ctx context.Context, requesterName string, groups []string) (bool, error) {
+	requesterSysId, err := p.getServiceNowUserSysId(ctx, requesterName)
+	if errors.Is(err, ErrRequesterNotAssigned) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	query := fmt.Sprintf("user=%s^group.nameIN%s", requesterSysId, strings.Join(groups, ","))
+	requestURI := fmt.Sprintf("/api/now/table/sys_user_grmember?sysparm_query=%s&sysparm_fields=sys_id&sysparm_limit=1", p.encodeServiceNowQuery(query))
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return false, err
+	}
+
+	var memberResults GroupMemberResultsServiceNow
+	err = json.Unmarshal(response, &memberResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return false, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	return len(memberResults.Result) > 0, nil
+}
+
+// A change that doesn't pass the filter is not valid for this access request, other access requests can
+// still use it.
+
+func (p *ServiceNowPlugin) filterChange(ctx context.Context, filter ChangeFilter, change Change) error {
+	err := p.checkRolePolicy(filter.Role, filter.RolePolicy, change)
+	if err != nil {
+		return err
+	}
+
+	return p.checkRequester(ctx, filter.RequesterSysId, change)
+}
+
+func (p *ServiceNowPlugin) checkRequestedChange(ctx context.Context, changeServiceNow ChangeServiceNow, ciName string, ciSysIds []string) error {
+	if slices.Contains(ciSysIds, changeServiceNow.CmdbCi) {
+		return nil
+	}
+
+	if p.getConfig().ChangeAffectedCIs {
+		affected, err := p.checkAffectedCIs(ctx, changeServiceNow, ciSysIds)
+		if err != nil {
+			return err
+		}
+		if affected {
+			p.Logger.Debug(fmt.Sprintf("CI %s is an affected CI of change %s", ciName, changeServiceNow.Number))
+			return nil
+		}
+	}
+
+	errorText := fmt.Sprintf("Change %s is not linked to CI %s", changeServiceNow.Number, ciName)
+	if len(ciSysIds) > 1 {
+		errorText += " or to one of its parents in the CMDB"
+	}
+	p.Logger.Info(errorText)
+	return p.newError(ErrChangeNotLinked, nil, errorText)
+}
+
+func (p *ServiceNowPlugin) processCI(ctx context.Context, ciName string) (*CmdbServiceNow, error) {
+	CI, err := p.getCI(ctx, ciName)
+	if err != nil {
+		p.Logger.Error(err.Error())
+		return nil, err
+	}
+
+	err = p.checkCI(*CI)
+
+	return CI, err
+}
+
+// When more than one change is valid, the change selection policy determines which change is used.
+// The requester sees the valid changes when the policy doesn't allow the plugin to choose.
+
+func (p *ServiceNowPlugin) selectChange(ciName string, validChanges []Change) (*Change, error) {
+	if len(validChanges) == 0 {
+		return nil, p.newError(ErrNoValidChange, nil, "No valid change found")
+	}
+
+	config := p.getConfig()
+
+	var changeNumbers []string
+	for _, change := range validChanges {
+		changeNumbers = append(changeNumbers, change.Number)
+	}
+
+	switch config.ChangeSelectionPolicy {
+	case ChangeSelectionExplicit:
+		errorText := fmt.Sprintf("A change number is required, add it to the access request in annotation or label %s. Valid changes for CI %s: %s",
+			config.ChangeNumberKey,
+			ciName,
+			strings.Join(changeNumbers, ", "))
+		p.Logger.Info(errorText)
+		return nil, p.newError(ErrChangeNumberRequired, nil, errorText)
+	case ChangeSelectionDenyWhenAmbiguous:
+		if len(validChanges) > 1 {
+			errorText := fmt.Sprintf("More than one valid change found for CI %s: %s. Add the change number to the access request in annotation or label %s",
+				ciName,
+				strings.Join(changeNumbers, ", "),
+				config.ChangeNumberKey)
+			p.Logger.Info(errorText)
+			return nil, p.newError(ErrAmbiguousChange, nil, errorText)
+		}
+	}
+
+	selectedChange := validChanges[0]
+	for _, change := range validChanges[1:] {
+		if config.ChangeSelectionPolicy == ChangeSelectionEarliestStart && change.StartDate.Before(selectedChange.StartDate) {
+			selectedChange = change
+		}
+		if config.ChangeSelectionPolicy == ChangeSelectionLatestEnd && change.EndDate.After(selectedChange.EndDate) {
+			selectedChange = change
+		}
+	}
+
+	if len(validChanges) > 1 {
+		p.Logger.Debug(fmt.Sprintf("Change %s selected (%s) from valid changes %s", selectedChange.Number, config.ChangeSelectionPolicy, strings.Join(changeNumbers, ", ")))
+	}
+
+	return &selectedChange, nil
+}
+
+// All pages are read, because the change that is selected can be on any page.
+
+func (p *ServiceNowPlugin) processChanges(ctx context.Context, ciName string, ciSysIds []string, filter ChangeFilter) (time.Duration, *Change, error) {
+	var noDuration = 0 * time.Minute
+	var SysparmOffset = 0
+
+	serviceNowChanges, SysparmOffset, err := p.getChanges(ctx, ciSysIds, SysparmOffset)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	var validChanges []Change
+	var filterErr error
+
+	for {
+		for _, serviceNowChange := range serviceNowChanges {
+			change, err := p.parseChange(*serviceNowChange)
+			if err == nil {
+				_, err = p.checkChange(change, filter)
+				if err == nil {
+					err = p.filterChange(ctx, filter, change)
+					if errors.Is(err, ErrRequesterNotAssigned) || errors.Is(err, ErrChangeNotAllowed) {
+						// Another change of the CI can still pass the filter
+						filterErr = err
+					} else if err != nil {
+						return noDuration, nil, err
+					} else {
+						validChanges = append(validChanges, change)
+					}
+				}
+			}
+		}
+
+		if len(serviceNowChanges) < SysparmLimit {
+			break
+		}
+
+		serviceNowChanges, SysparmOffset, err = p.getChanges(ctx, ciSysIds, SysparmOffset)
+		if errors.Is(err, ErrNoValidChange) && (len(validChanges) > 0 || filterErr != nil) {
+			// The previous page was the last page
+			break
+		}
+		if err != nil {
+			return noDuration, nil, err
+		}
+	}
+
+	if len(validChanges) == 0 && filterErr != nil {
+		return noDuration, nil, filterErr
+	}
+
+	validChange, err := p.selectChange(ciName, validChanges)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	return time.Until(validChange.EndDate.Add(filter.GraceAfterEnd)), validChange, nil
+}
+
+func (p *ServiceNowPlugin) processRequestedChange(ctx context.Context, changeNumber string, ciName string, ciSysIds []string, filter ChangeFilter) (time.Duration, *Change, error) {
+	var noDuration = 0 * time.Minute
+
+	serviceNowChange, err := p.getChangeByNumber(ctx, changeNumber)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	err = p.checkRequestedChange(ctx, *serviceNowChange, ciName, ciSysIds)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	err = p.checkEligibility(ctx, *serviceNowChange)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	change, err := p.parseChange(*serviceNowChange)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	remainingTime, err := p.checkChange(change, filter)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	err = p.filterChange(ctx, filter, change)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	return remainingTime, &change, nil
+}
+
+// With CHANGE_TASKS, access is based on the open change tasks of the CI. The change of a task must meet
+// the conditions of its change type, this is checked once per change.
+
+func (p *ServiceNowPlugin) processChangeTasks(ctx context.Context, ciName string, ciSysIds []string, changeNumber string, filter ChangeFilter) (time.Duration, *Change, error) {
+	var noDuration = 0 * time.Minute
+	var SysparmOffset = 0
+
+	serviceNowChangeTasks, SysparmOffset, err := p.getChangeTasks(ctx, ciSysIds, changeNumber, SysparmOffset)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	var validChangeTasks []Change
+	var filterErr error
+	eligibility := map[string]error{}
+
+	for {
+		for _, serviceNowChangeTask := range serviceNowChangeTasks {
+			changeTask, err := p.parseChangeTask(*serviceNowChangeTask)
+			if err != nil {
+				continue
+			}
+
+			_, err = p.checkChange(changeTask, filter)
+			if err != nil {
+				continue
+			}
+
+			eligibilityErr, checked := eligibility[changeTask.ParentSysId]
+			if !checked {
+				eligibilityErr = p.checkEligibility(ctx, ChangeServiceNow{
+					Type:     serviceNowChangeTask.ChangeType,
+					Number:   serviceNowChangeTask.ChangeNumber,
+					SysId:    serviceNowChangeTask.ChangeRequest.Value,
+					State:    serviceNowChangeTask.ChangeState,
+					Approval: serviceNowChangeTask.ChangeApproval,
+				})
+				eligibility[changeTask.ParentSysId] = eligibilityErr
+			}
+			if errors.Is(eligibilityErr, ErrNoValidChange) {
+				continue
+			}
+			if eligibilityErr != nil {
+				return noDuration, nil, eligibilityErr
+			}
+
+			err = p.filterChange(ctx, filter, changeTask)
+			if errors.Is(err, ErrRequesterNotAssigned) || errors.Is(err, ErrChangeNotAllowed) {
+				// Another change task of the CI can still pass the filter
+				filterErr = err
+			} else if err != nil {
+				return noDuration, nil, err
+			} else {
+				validChangeTasks = append(validChangeTasks, changeTask)
+			}
+		}
+
+		if len(serviceNowChangeTasks) < SysparmLimit {
+			break
+		}
+
+		serviceNowChangeTasks, SysparmOffset, err = p.getChangeTasks(ctx, ciSysIds, changeNumber, SysparmOffset)
+		if errors.Is(err, ErrNoValidChange) && (len(validChangeTasks) > 0 || filterErr != nil) {
+			// The previous page was the last page
+			break
+		}
+		if err != nil {
+			return noDuration, nil, err
+		}
+	}
+
+	if len(validChangeTasks) == 0 && filterErr != nil {
+		return noDuration, nil, filterErr
+	}
+
+	// The requester already chose the change, of its tasks the task that ends last is used
+	if changeNumber != "" && len(validChangeTasks) > 0 {
+		validChangeTask := validChangeTasks[0]
+		for _, changeTask := range validChangeTasks[1:] {
+			if changeTask.EndDate.After(validChangeTask.EndDate) {
+				validChangeTask = changeTask
+			}
+		}
+		return time.Until(validChangeTask.EndDate.Add(filter.GraceAfterEnd)), &validChangeTask, nil
+	}
+
+	validChangeTask, err := p.selectChange(ciName, validChangeTasks)
+	if err != nil {
+		return noDuration, nil, err
+	}
+
+	return time.Until(validChangeTask.EndDate.Add(filter.GraceAfterEnd)), validChangeTask, nil
+}
+
+func (p *ServiceNowPlugin) processCIChange(ctx context.Context, ciName string, requestedChangeNumber string, filter ChangeFilter) (*CIChange, error) {
+	CI, err := p.processCI(ctx, ciName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The label can contain a sys_id or a correlation id, the messages use the name of the CI
+	ciName = CI.Name.Value
+	ciSysId := CI.SysId.Value
+
+	ciSysIds, err := p.getRelatedCIs(ctx, ciSysId)
+	if err != nil {
+		return nil, err
+	}
+
+	var remainingTime time.Duration
+	var validChange *Change
+	if p.getConfig().ChangeTasks {
+		remainingTime, validChange, err = p.processChangeTasks(ctx, ciName, ciSysIds, requestedChangeNumber, filter)
+		if err == nil {
+			return &CIChange{CIName: ciName, CISysId: ciSysId, Change: validChange, RemainingTime: remainingTime}, nil
+		}
+
+		// Changes that are not split into tasks (or without a valid open task) can still give access themselves
+		if !errors.Is(err, ErrNoValidChange) && !errors.Is(err, ErrRequesterNotAssigned) && !errors.Is(err, ErrChangeNotAllowed) {
+			return nil, err
+		}
+		p.Logger.Debug(fmt.Sprintf("No valid open change task for CI %s, the changes of the CI are used", ciName))
+	}
+
+	if requestedChangeNumber != "" {
+		remainingTime, validChange, err = p.processRequestedChange(ctx, requestedChangeNumber, ciName, ciSysIds, filter)
+	} else {
+		remainingTime, validChange, err = p.processChanges(ctx, ciName, ciSysIds, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &CIChange{CIName: ciName, CISysId: ciSysId, Change: validChange, RemainingTime: remainingTime}, nil
+}
+
+// With CI policy every, access is only granted when every CI of the application has a valid change.
+// With CI policy any, one CI with a valid change is enough.
+
+func (p *ServiceNowPlugin) findValidCIChanges(ctx context.Context, ciNames []string, requestedChangeNumber string, filter ChangeFilter) ([]CIChange, error) {
+	ciPolicy := p.getConfig().CIPolicy
+
+	var validCIChanges []CIChange
+	var errs []error
+	for _, ciName := range ciNames {
+		ciChange, err := p.processCIChange(ctx, ciName, requestedChangeNumber, filter)
+		if err != nil {
+			if ciPolicy == CIPolicyEvery {
+				return nil, err
+			}
+			if len(ciNames) > 1 {
+				p.Logger.Info(fmt.Sprintf("No valid change for CI %s: %s", ciName, err.Error()))
+			}
+			errs = append(errs, err)
+			continue
+		}
+
+		validCIChanges = append(validCIChanges, *ciChange)
+		if ciPolicy == CIPolicyAny {
+			break
+		}
+	}
+
+	if len(validCIChanges) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return validCIChanges, nil
+}
+
+// The access ends when the first change ends. The other changes get a note as well, a change that is
+// valid for more than one CI only gets one note.
+
+func (p *ServiceNowPlugin) selectCIChange(validCIChanges []CIChange) (CIChange, []Change) {
+	selected := validCIChanges[0]
+	for _, ciChange := range validCIChanges[1:] {
+		if ciChange.Change.EndDate.Before(selected.Change.EndDate) {
+			selected = ciChange
+		}
+	}
+
+	var otherChanges []Change
+	changeNumbers := []string{selected.Change.Number}
+	for _, ciChange := range validCIChanges {
+		if slices.Contains(changeNumbers, ciChange.Change.Number) {
+			continue
+		}
+		changeNumbers = append(changeNumbers, ciChange.Change.Number)
+		otherChanges = append(otherChanges, *ciChange.Change)
+	}
+
+	return selected, otherChanges
+}
+
+// Days are counted as calendar dates in UTC, so a change to or from daylight saving time doesn't move a
+// day. The days of the week in ServiceNow are 1 (Monday) to 7 (Sunday).
+
+func (p *ServiceNowPlugin) repeatsOnDay(span *ScheduleSpanServiceNow, day time.Time, firstDay time.Time, interval int) bool {
+	weekday := (int(day.Weekday())+6)%7 + 1
+	firstWeekday := (int(firstDay.Weekday())+6)%7 + 1
+
+	switch span.RepeatType {
+	case "daily":
+		return int(day.Sub(firstDay).Hours()/24)%interval == 0
+	case "weekdays":
+		return weekday <= 5
+	case "weekends":
+		return weekday >= 6
+	case "weekly":
+		// Without days of the week, the window repeats on the day of the week of the first occurrence
+		daysOfWeek := span.DaysOfWeek
+		if daysOfWeek == "" {
+			daysOfWeek = strconv.Itoa(firstWeekday)
+		}
+		firstMonday := firstDay.AddDate(0, 0, 1-firstWeekday)
+		weeks := int(day.Sub(firstMonday).Hours()/24) / 7
+		return strings.Contains(daysOfWeek, strconv.Itoa(weekday)) && weeks%interval == 0
+	}
+
+	return false
+}
+
+// A repeating window is described by its first occurrence and repeats at the same time of the day until
+// repeat_until. Windows that repeat daily, on weekdays, in the weekend or weekly are checked for the
+// current moment. Other repeat types are skipped with a warning: a window that cannot be checked should
+// not deny access forever.
+
+func (p *ServiceNowPlugin) getRepeatingWindowEnd(span *ScheduleSpanServiceNow, startDate time.Time, endDate time.Time, currentTime time.Time) (time.Time, bool, error) {
+	if !slices.Contains([]string{"daily", "weekdays", "weekends", "weekly"}, span.RepeatType) {
+		p.Logger.Warn(fmt.Sprintf("Blackout window %s of %s repeats (%s), this repeat type is not supported: the window is not checked", span.Name, span.ScheduleName, span.RepeatType))
+		return time.Time{}, false, nil
+	}
+
+	var repeatUntil time.Time
+	if span.RepeatUntil != "" {
+		var err error
+		repeatUntil, err = p.convertScheduleDate(span.RepeatUntil)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	interval, err := strconv.Atoi(span.RepeatCount)
+	if err != nil || interval < 1 {
+		interval = 1
+	}
+
+	duration := endDate.Sub(startDate)
+	localTime := currentTime.In(startDate.Location())
+	firstDay := time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, time.UTC)
+
+	// An occurrence that started on one of the previous days can still be active
+	for daysBack := 0; daysBack <= int(duration.Hours()/24)+1; daysBack++ {
+		day := time.Date(localTime.Year(), localTime.Month(), localTime.Day()-daysBack, 0, 0, 0, 0, time.UTC)
+		if day.Before(firstDay) || (!repeatUntil.IsZero() && day.After(repeatUntil)) || !p.repeatsOnDay(span, day, firstDay, interval) {
+			continue
+		}
+
+		occurrenceStart := time.Date(day.Year(), day.Month(), day.Day(), startDate.Hour(), startDate.Minute(), startDate.Second(), 0, startDate.Location())
+		occurrenceEnd := occurrenceStart.Add(duration)
+		if !occurrenceStart.After(currentTime) && occurrenceEnd.After(currentTime) {
+			return occurrenceEnd, true, nil
+		}
+	}
+
+	return time.Time{}, false, nil
 }
 
-func (p *ServiceNowPlugin) getServiceNowCredentials() (string, string, string) {
-	secretName := p.getEnvVarWithDefault("SERVICENOW_SECRET_NAME", "servicenow-secret")
+func (p *ServiceNowPlugin) getActiveBlackouts(ctx context.Context) ([]Blackout, error) {
+	requestURI := "/api/now/table/cmn_schedule_span?sysparm_query=" + p.encodeServiceNowQuery("schedule.type=blackout") +
+		"&sysparm_fields=name,schedule,schedule.name,start_date_time,end_date_time,repeat_type,repeat_count,repeat_until,days_of_week&sysparm_exclude_reference_link=true"
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	var spanResults ScheduleSpanResultsServiceNow
+	err = json.Unmarshal(response, &spanResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
+	}
+
+	currentTime := time.Now()
+
+	var blackouts []Blackout
+	for _, span := range spanResults.Result {
+		startDate, errStartDate := p.convertScheduleTime(span.StartDateTime)
+		endDate, errEndDate := p.convertScheduleTime(span.EndDateTime)
+		err = errors.Join(errStartDate, errEndDate)
+		if err != nil {
+			return nil, err
+		}
+
+		if span.RepeatType != "" {
+			windowEnd, active, err := p.getRepeatingWindowEnd(span, startDate, endDate, currentTime)
+			if err != nil {
+				return nil, err
+			}
+			if active {
+				blackouts = append(blackouts, Blackout{Name: span.Name, ScheduleName: span.ScheduleName, Schedule: span.Schedule, EndDate: windowEnd})
+			}
+			continue
+		}
+
+		if startDate.Before(currentTime) && endDate.After(currentTime) {
+			blackouts = append(blackouts, Blackout{Name: span.Name, ScheduleName: span.ScheduleName, Schedule: span.Schedule, EndDate: endDate})
+		}
+	}
 
-	return p.getCredentialsFromSecret(ephemeralAccessPluginNamespace, secretName, "username", "password")
+	p.Logger.Debug(fmt.Sprintf("%d active blackout windows found", len(blackouts)))
+	return blackouts, nil
 }
 
-func (p *ServiceNowPlugin) checkAPIResult(resp *http.Response, body []byte) ([]byte, string) {
+func (p *ServiceNowPlugin) getScheduleConditions(ctx context.Context, scheduleSysId string) ([]string, error) {
+	requestURI := fmt.Sprintf("/api/now/table/cmn_schedule_condition?schedule=%s&sysparm_fields=condition", scheduleSysId)
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return nil, err
+	}
 
-	errorText := ""
-	if (resp.StatusCode >= 500 && resp.StatusCode <= 599) || strings.Contains(string(body), "<html>") {
-		errorText = "ServiceNow API server is down"
+	var conditionResults ScheduleConditionResultsServiceNow
+	err = json.Unmarshal(response, &conditionResults)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
 	}
 
-	if resp.StatusCode >= 400 && resp.StatusCode <= 499 {
-		errorText = "ServiceNow API changed"
+	var conditions []string
+	for _, condition := range conditionResults.Result {
+		if condition.Condition != "" {
+			conditions = append(conditions, condition.Condition)
+		}
 	}
 
-	return body, errorText
+	return conditions, nil
 }
 
-func (p *ServiceNowPlugin) getFromServiceNowAPI(requestURI string) ([]byte, string) {
+// The conditions of a blackout schedule are encoded queries on the change, f.e. cmdb_ci=<sys_id>, so
+// ServiceNow is asked if the change meets them.
 
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
-	p.Logger.Debug("apiCall: " + apiCall)
-
-	req, err := http.NewRequest("GET", apiCall, nil)
-	if err != nil {
-		errorText := "Error in NewRequest: " + err.Error()
-		p.Logger.Error(errorText)
-		return []byte{}, errorText
+func (p *ServiceNowPlugin) checkBlackoutCondition(ctx context.Context, condition string, change Change) (bool, error) {
+	// The conditions of a blackout schedule are about changes, for a change task its change is checked
+	sysId := change.SysId
+	if change.Table == TableChangeTask {
+		sysId = change.ParentSysId
 	}
+	query := fmt.Sprintf("sys_id=%s^%s", sysId, condition)
 
-	req.Header.Add("Accept", "application/json")
-	req.SetBasicAuth(serviceNowUsername, serviceNowPassword)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	requestURI := "/api/now/table/change_request?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=sys_id"
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
 	if err != nil {
-		errorText := "Error in client.Do: " + err.Error()
-		p.Logger.Error(errorText)
-		return []byte{}, errorText
+		return false, err
 	}
 
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-
-	body, err := io.ReadAll(resp.Body)
+	var changeResults ChangeResultsServicenow
+	err = json.Unmarshal(response, &changeResults)
 	if err != nil {
-		errorText := "Error in io.ReadAll: " + err.Error()
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
 		p.Logger.Error(errorText)
-		return []byte{}, errorText
+		return false, p.newError(ErrServiceNowAPI, err, errorText)
 	}
 
-	p.Logger.Debug(string(body))
-	return p.checkAPIResult(resp, body)
+	return len(changeResults.Result) > 0, nil
 }
 
-func (p *ServiceNowPlugin) patchServiceNowAPI(requestURI string, data string) ([]byte, string) {
-
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
-	p.Logger.Debug("apiCall: " + apiCall)
-	p.Logger.Debug("Data: " + string(data))
+// Even with a valid change, no access is granted during a change freeze. The freeze applies when one of
+// the changes meets the conditions of a blackout schedule that has an active window.
 
-	req, err := http.NewRequest("PATCH", apiCall, strings.NewReader(data))
+func (p *ServiceNowPlugin) checkBlackouts(ctx context.Context, changes []Change) error {
+	blackouts, err := p.getActiveBlackouts(ctx)
 	if err != nil {
-		errorText := "Error in NewRequest: " + err.Error()
-		p.Logger.Error(errorText)
-		return nil, errorText
+		return err
 	}
 
-	req.Header.Add("Accept", "application/json")
-	req.SetBasicAuth(serviceNowUsername, serviceNowPassword)
+	for _, blackout := range blackouts {
+		conditions, err := p.getScheduleConditions(ctx, blackout.Schedule)
+		if err != nil {
+			return err
+		}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		errorText := "Error in client.Do: " + err.Error()
-		p.Logger.Error(errorText)
-		return nil, errorText
+		applies := len(conditions) == 0
+		for _, change := range changes {
+			for _, condition := range conditions {
+				if !applies {
+					applies, err = p.checkBlackoutCondition(ctx, condition, change)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if applies {
+			errorText := fmt.Sprintf("Change freeze %s (%s) is active until %s, no access is granted during a change freeze",
+				blackout.ScheduleName,
+				blackout.Name,
+				p.getLocalTime(blackout.EndDate))
+			p.Logger.Info(errorText)
+			return p.newError(ErrBlackout, nil, errorText)
+		}
 	}
 
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		errorText := "Error in io.ReadAll: " + err.Error()
-		p.Logger.Error(errorText)
-		return nil, errorText
+// An incident doesn't have a change type or a risk, so a role that only gets access with certain changes
+// doesn't get access with an incident. Roles that don't need a change are granted before incidents are used.
+
+func (p *ServiceNowPlugin) checkIncidentRolePolicy(role string, policy *RolePolicy) error {
+	if policy == nil || (len(policy.ChangeTypes) == 0 && policy.MaxRisk == "") {
+		return nil
 	}
 
-	p.Logger.Debug("Body: " + string(body))
-	return p.checkAPIResult(resp, body)
+	errorText := fmt.Sprintf("Role %s only gets access with a change that meets the role policy, an incident doesn't give access to this role", role)
+	p.Logger.Info(errorText)
+	return p.newError(ErrChangeNotAllowed, nil, errorText)
 }
 
-func (p *ServiceNowPlugin) getCIName(app *argocd.Application) string {
-	p.Logger.Debug("Search for " + ciLabel + " in the CMDB...")
-	ciName := string(app.Labels[ciLabel])
-	p.Logger.Debug(fmt.Sprintf("ciLabel %s found: %s", ciLabel, ciName))
+// An incident in the access request should be active, have one of INCIDENT_PRIORITIES and be linked to the
+// CI. Without an incident number, the active incident with the highest priority is used.
 
-	return ciName
-}
+func (p *ServiceNowPlugin) getIncident(ctx context.Context, ciName string, ciSysIds []string, incidentNumber string) (*IncidentServiceNow, error) {
+	config := p.getConfig()
 
-func (p *ServiceNowPlugin) getCI(ciName string) (*CmdbServiceNow, string) {
+	query := "cmdb_ciIN" + strings.Join(ciSysIds, ",") + "^active=true^priorityIN" + strings.Join(config.IncidentPriorities, ",")
+	if incidentNumber != "" {
+		query += "^number=" + incidentNumber
+	}
+	query += "^ORDERBYpriority"
 
-	requestURI := fmt.Sprintf("/api/now/table/cmdb_ci?name=%s&sysparm_fields=install_status,name,sys_id", ciName)
-	response, errorText := p.getFromServiceNowAPI(requestURI)
-	if errorText != "" {
-		return nil, errorText
+	requestURI := "/api/now/table/incident?sysparm_query=" + p.encodeServiceNowQuery(query) +
+		"&sysparm_fields=number,short_description,priority,sys_id,assigned_to,assignment_group&sysparm_exclude_reference_link=true&sysparm_limit=1"
+	response, err := p.getFromServiceNowAPI(ctx, requestURI)
+	if err != nil {
+		return nil, err
 	}
 
-	var cmdbResults CmdbResultsServiceNowType
-	err := json.Unmarshal(response, &cmdbResults)
+	var incidentResults IncidentResultsServiceNow
+	err = json.Unmarshal(response, &incidentResults)
 	if err != nil {
 		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
 		p.Logger.Error(errorText)
-		return nil, errorText
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
 	}
 
-	if len(cmdbResults.Result) == 0 {
-		errorText := fmt.Sprintf("No CI with name %s found", ciName)
-		p.Logger.Error(errorText)
-		return nil, errorText
+	if len(incidentResults.Result) == 0 {
+		errorText := fmt.Sprintf("No active incident with priority %s found for CI %s", strings.Join(config.IncidentPriorities, " or "), ciName)
+		if incidentNumber != "" {
+			errorText = fmt.Sprintf("Incident %s is not active, doesn't have priority %s or is not linked to CI %s", incidentNumber, strings.Join(config.IncidentPriorities, " or "), ciName)
+		}
+		p.Logger.Info(errorText)
+		return nil, p.newError(ErrNoValidIncident, nil, errorText)
 	}
 
-	debugText := fmt.Sprintf("InstallStatus: %s, CI name: %s, SysId: %s",
-		cmdbResults.Result[0].InstallStatus,
-		cmdbResults.Result[0].Name,
-		cmdbResults.Result[0].SysId)
-	p.Logger.Debug(debugText)
-
-	return cmdbResults.Result[0], ""
+	return incidentResults.Result[0], nil
 }
 
-func (p *ServiceNowPlugin) getChangeRequestURI(ciSysId string, sysparmOffset int) string {
-	// See also: https://github.com/argoproj-labs/argocd-ephemeral-access/issues/109
-	// Hopefully the Ephemeral Access Extension will be extended with a reference number
-	// that can be used to ask directly for the change number.
-	//
-	// In that case the original request will be extended with the change number and the
-	// request will be better readable as well (the dates can only be used with > and <
-	// in the sysparam_query, that also needs to have the cmdb_ci sys_id instead of the
-	// name and -1 instead of the display name of the state)
-	//
-	// Original requestURI without test for change number:
-	// requestURI := fmt.Sprintf("/api/now/table/change_request?cmdb_ci=%s&state=Implement&phase=Requested&approval=Approved&active=true&sysparm_fields=type,number,short_description,start_date,end_date,sys_id&sysparm_limit=%d&sysparm_offset=%d", ciName, SysparmLimit, SysparmOffset)
-	//
-	// The reason for the window is to limit the number of changes that have to be
-	// processed by the API in large environments.
-	window, _ := time.ParseDuration(fmt.Sprintf("%d", timeWindowChangesDays*24) + "h")
-
-	fromDate := time.Now().Add(-window)
-	endDate := time.Now().Add(window)
+// An incident of one of the CIs of the application is enough, the CI policy is only used for changes. The
+// role policy and the requester are checked in the same way as for changes.
 
-	fromDateString := fmt.Sprintf(`%04d-%02d-%02d 00:00:00`,
-		fromDate.Year(),
-		fromDate.Month(),
-		fromDate.Day())
-	endDateString := fmt.Sprintf(`%04d-%02d-%02d 23:59:59`,
-		endDate.Year(),
-		endDate.Month(),
-		endDate.Day())
+func (p *ServiceNowPlugin) findIncident(ctx context.Context, ciNames []string, incidentNumber string, filter ChangeFilter) (*CIIncident, error) {
+	err := p.checkIncidentRolePolicy(filter.Role, filter.RolePolicy)
+	if err != nil {
+		return nil, err
+	}
 
-	selection := fmt.Sprintf("cmdb_ci=%s&state=-1&phase=requested&approval=approved&active=true&GOTOstart_date>%s&GOTOend_date<%s",
-		ciSysId,
-		fromDateString,
-		endDateString)
+	var errs []error
+	for _, ciName := range ciNames {
+		CI, err := p.processCI(ctx, ciName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	// selection should be encoded for url (the rest doesn't matter)
-	selection = strings.ReplaceAll(selection, " ", "%20")
-	selection = strings.ReplaceAll(selection, "-", "%2d")
-	selection = strings.ReplaceAll(selection, ":", "%3a")
-	selection = strings.ReplaceAll(selection, "<", "%3c")
-	selection = strings.ReplaceAll(selection, "=", "%3d")
-	selection = strings.ReplaceAll(selection, ">", "%3e")
+		ciSysIds, err := p.getRelatedCIs(ctx, CI.SysId.Value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	// sysparam_query uses ^ to combine fields instead of &
-	selection = strings.ReplaceAll(selection, "&", "%5e")
+		incident, err := p.getIncident(ctx, CI.Name.Value, ciSysIds, incidentNumber)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	otherFields := fmt.Sprintf("sysparm_fields=type,number,short_description,start_date,end_date,sys_id&sysparm_limit=%d&sysparm_offset=%d",
-		SysparmLimit,
-		sysparmOffset)
+		err = p.checkRequester(ctx, filter.RequesterSysId, Change{
+			Number:          incident.Number,
+			SysId:           incident.SysId,
+			AssignedTo:      incident.AssignedTo,
+			AssignmentGroup: incident.AssignmentGroup,
+			Table:           TableIncident,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	requestURI := "/api/now/table/change_request?sysparm_query=" + selection + "&" + otherFields
+		return &CIIncident{CIName: CI.Name.Value, CISysId: CI.SysId.Value, Incident: incident}, nil
+	}
 
-	return requestURI
+	return nil, errors.Join(errs...)
 }
 
-func (p *ServiceNowPlugin) getChanges(ciSysId string, sysparmOffset int) ([]*ChangeServiceNow, int, string) {
+func (p *ServiceNowPlugin) postNote(ctx context.Context, table string, sysId string, noteText string) {
+	requestURI := fmt.Sprintf("/api/now/table/%s/%s", table, sysId)
 
-	requestURI := p.getChangeRequestURI(ciSysId, sysparmOffset)
-	response, errorText := p.getFromServiceNowAPI(requestURI)
-	if errorText != "" {
-		p.Logger.Error(errorText)
-		return nil, sysparmOffset, errorText
-	}
+	p.patchServiceNowAPI(ctx, requestURI, noteText)
+}
 
-	var changeResults ChangeResultsServicenow
-	err := json.Unmarshal(response, &changeResults)
-	if err != nil {
-		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
-		p.Logger.Error(errorText)
-		return nil, sysparmOffset, errorText
-	}
+// Access for an incident lasts INCIDENT_ACCESS_MINUTES at most, the note is added to the incident.
 
-	if len(changeResults.Result) == 0 {
-		errorText = "No changes found"
-		p.Logger.Info(errorText)
-	}
+func (p *ServiceNowPlugin) grantIncidentAccess(ctx context.Context, ar *api.AccessRequest, ciIncident CIIncident) (*plugin.GrantResponse, error) {
+	config := p.getConfig()
 
-	return changeResults.Result, sysparmOffset + len(changeResults.Result), errorText
-}
+	requesterName := ar.Spec.Subject.Username
+	requestedRole := ar.Spec.Role.TemplateRef.Name
+	arDuration := ar.Spec.Duration.Duration
+	incident := ciIncident.Incident
 
-func (p *ServiceNowPlugin) parseChange(changeServiceNow ChangeServiceNow) (Change, string) {
-	var change Change
+	incidentDuration := time.Duration(config.IncidentAccessMinutes) * time.Minute
+	duration, endDateTime := p.determineDurationAndRealEndTime(arDuration, incidentDuration, time.Now().Add(incidentDuration))
+	ar.Spec.Duration.Duration = duration
 
-	p.Logger.Debug(fmt.Sprintf("Change: Type: %s, Number: %s, Short description: %s, Start Date: %s, End Date: %s, SysId: %s",
-		changeServiceNow.Type,
-		changeServiceNow.Number,
-		changeServiceNow.ShortDescription,
-		changeServiceNow.StartDate,
-		changeServiceNow.EndDate,
-		changeServiceNow.SysId))
+	expireByPlugin := arDuration > incidentDuration
+	if expireByPlugin && config.RevokeMode == RevokeModeCronJob {
+		p.createRevokeJob(ar.Namespace, ar.Name, endDateTime)
+	}
 
-	errorTextStartDate := ""
-	errorTextEndDate := ""
+	grantedUIText, grantedAccessServiceNowText := p.determineGrantedTextsIncident(requesterName, requestedRole, *incident, duration, endDateTime)
+
+	grantRecord := GrantRecord{
+		AccessRequestName: ar.Name,
+		Requester:         requesterName,
+		Role:              requestedRole,
+		ChangeNumber:      incident.Number,
+		ChangeSysId:       incident.SysId,
+		ChangeTable:       TableIncident,
+		CISysId:           ciIncident.CISysId,
+		EndTime:           endDateTime,
+		ExpireByPlugin:    expireByPlugin && config.RevokeMode == RevokeModeScheduler,
+	}
+	err := p.storeGrantRecord(ar, grantRecord)
+	if err != nil && grantRecord.ExpireByPlugin {
+		return p.denyAccess(requesterName, requestedRole, err)
+	}
+	p.wakeExpiryScheduler()
 
-	change.Type = changeServiceNow.Type
-	change.Number = changeServiceNow.Number
-	change.ShortDescription = changeServiceNow.ShortDescription
-	change.StartDate, errorTextStartDate = p.convertTime(changeServiceNow.StartDate)
-	change.EndDate, errorTextEndDate = p.convertTime(changeServiceNow.EndDate)
-	change.SysId = changeServiceNow.SysId
+	note := fmt.Sprintf("{\"work_notes\":\"%s\"}", grantedAccessServiceNowText)
+	p.postNote(ctx, TableIncident, incident.SysId, note)
 
-	return change, errorTextStartDate + errorTextEndDate
+	return p.grantRequest(grantedUIText)
 }
 
-func (p *ServiceNowPlugin) checkCI(CI CmdbServiceNow) string {
-	errorText := ""
-	installStatus := CI.InstallStatus
-	ciName := CI.Name
+// The justification is written by the requester, json.Marshal takes care of quotes and newlines in it.
+// Tables that don't extend the task table have no number, then the sys_id is used as the number.
+
+func (p *ServiceNowPlugin) createExclusionRecord(ctx context.Context, requesterName string, requestedRole string, appName string, justification string, remainingTime time.Duration, realEndDate time.Time) (*ExclusionRecordServiceNow, error) {
+	config := p.getConfig()
 
-	validInstallStatus := []string{
-		"1", // Installed
-		"3", // In maintenance
-		"4", // Pending install
-		"5", // Pending repair
+	if justification == "" {
+		justification = "not given"
 	}
 
-	if !slices.Contains(validInstallStatus, installStatus) {
-		errorText = fmt.Sprintf("Invalid install status (%s) for CI %s", installStatus, ciName)
+	data, err := json.Marshal(map[string]string{
+		"short_description": fmt.Sprintf("Exclusion role %s used by %s for application %s", requestedRole, requesterName, appName),
+		"description": fmt.Sprintf("ServiceNow plugin granted access to %s, for exclusion role %s and application %s, until %s (%s), without a change. Justification: %s",
+			requesterName,
+			requestedRole,
+			appName,
+			p.getLocalTime(realEndDate),
+			remainingTime.Truncate(time.Second).String(),
+			justification),
+	})
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Marshal: %s", err.Error())
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
 	}
 
-	return errorText
-}
+	requestURI := fmt.Sprintf("/api/now/table/%s?sysparm_fields=number,sys_id", config.ExclusionRecordTable)
+	response, err := p.postServiceNowAPI(ctx, requestURI, string(data))
+	if err != nil {
+		return nil, err
+	}
 
-func (p *ServiceNowPlugin) checkChange(change Change) (string, time.Duration) {
-	errorText := ""
-	var remainingTime time.Duration
-	remainingTime = 0
+	var recordResult ExclusionRecordResultServiceNow
+	err = json.Unmarshal(response, &recordResult)
+	if err != nil {
+		errorText := fmt.Sprintf("Error in json.Unmarshal: %s (%s)", err.Error(), response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, err, errorText)
+	}
 
-	currentTime := time.Now()
+	if recordResult.Result.SysId == "" {
+		errorText := fmt.Sprintf("No record created in table %s (%s)", config.ExclusionRecordTable, response)
+		p.Logger.Error(errorText)
+		return nil, p.newError(ErrServiceNowAPI, nil, errorText)
+	}
 
-	if change.EndDate.Before(currentTime) ||
-		change.StartDate.After(currentTime) {
-		errorText = fmt.Sprintf("Change %s (%s) is not in the valid time range. start date: %s and end date: %s (current date: %s)",
-			change.Number,
-			change.ShortDescription,
-			p.getLocalTime(change.StartDate),
-			p.getLocalTime(change.EndDate),
-			p.getLocalTime(currentTime))
-		p.Logger.Debug(errorText)
-	} else {
-		remainingTime = time.Until(change.EndDate)
+	if recordResult.Result.Number == "" {
+		recordResult.Result.Number = recordResult.Result.SysId
 	}
 
-	return errorText, remainingTime
+	p.Logger.Debug(fmt.Sprintf("Use of exclusion role %s by %s registered in table %s as %s", requestedRole, requesterName, config.ExclusionRecordTable, recordResult.Result.Number))
+	return &recordResult.Result, nil
 }
 
-func (p *ServiceNowPlugin) processCI(ciName string) (string, string) {
-	CI, errorText := p.getCI(ciName)
-	if errorText != "" {
-		p.Logger.Error(errorText)
-		return errorText, ""
-	}
+// An exclusion role bypasses the CI and the change, so every use is registered in ServiceNow. Exclusion
+// roles are also meant for the moments that ServiceNow is not available: then the access is granted
+// without a record and the error is logged.
 
-	errorText = p.checkCI(*CI)
+func (p *ServiceNowPlugin) grantExclusionAccess(ctx context.Context, ar *api.AccessRequest, app *argocd.Application) (*plugin.GrantResponse, error) {
+	config := p.getConfig()
 
-	return errorText, CI.SysId
-}
+	requesterName := ar.Spec.Subject.Username
+	requestedRole := ar.Spec.Role.TemplateRef.Name
+	arDuration := ar.Spec.Duration.Duration
+	policy := config.ExclusionPolicies[requestedRole]
 
-func (p *ServiceNowPlugin) processChanges(ciName string, ciSysId string) (string, time.Duration, *Change) {
-	var SysparmOffset = 0
+	justification := p.getJustification(ar)
+	if policy.JustificationRequired && justification == "" {
+		errorText := fmt.Sprintf("A justification is required for exclusion role %s, add it to the access request as annotation %s", requestedRole, config.JustificationKey)
+		p.Logger.Info(errorText)
+		return p.denyAccess(requesterName, requestedRole, p.newError(ErrJustificationRequired, nil, errorText))
+	}
 
-	serviceNowChanges, SysparmOffset, errorText := p.getChanges(ciSysId, SysparmOffset)
-	if errorText != "" {
-		var noDuration = 0 * time.Minute
-		return errorText, noDuration, nil
+	err := p.checkExclusionPolicy(ctx, requesterName, requestedRole, policy)
+	if err != nil {
+		return p.denyAccess(requesterName, requestedRole, err)
 	}
 
-	var validChange *Change
-	var changeRemainingTime time.Duration
-	var remainingTime time.Duration
+	duration := arDuration
+	endDateTime := time.Now().Add(arDuration)
+	expireByPlugin := false
+	if policy.MaxDurationMinutes > 0 {
+		maxDuration := time.Duration(policy.MaxDurationMinutes) * time.Minute
+		duration, endDateTime = p.determineDurationAndRealEndTime(arDuration, maxDuration, time.Now().Add(maxDuration))
+		ar.Spec.Duration.Duration = duration
 
-	for {
-		for _, serviceNowChange := range serviceNowChanges {
-			change, errorText := p.parseChange(*serviceNowChange)
-			if errorText == "" {
-				errorText, remainingTime = p.checkChange(change)
-				if errorText == "" {
-					validChange = &change
-					changeRemainingTime = remainingTime
-					break
-				}
-			}
+		expireByPlugin = arDuration > maxDuration
+		if expireByPlugin && config.RevokeMode == RevokeModeCronJob {
+			p.createRevokeJob(ar.Namespace, ar.Name, endDateTime)
 		}
+	}
 
-		if validChange != nil {
-			break
-		} else if len(serviceNowChanges) < SysparmLimit {
-			errorText = "No valid change found"
-			break
-		} else {
-			serviceNowChanges, SysparmOffset, errorText = p.getChanges(ciSysId, SysparmOffset)
-			if errorText != "" {
-				break
-			}
-		}
+	grantRecord := GrantRecord{
+		AccessRequestName: ar.Name,
+		Requester:         requesterName,
+		Role:              requestedRole,
+		EndTime:           endDateTime,
+		ExclusionRole:     true,
+		ExpireByPlugin:    expireByPlugin && config.RevokeMode == RevokeModeScheduler,
+	}
+
+	// The grant record is stored before the record in ServiceNow is created, so a request that is denied
+	// because the access cannot be expired doesn't leave a record of a bypass behind
+	err = p.storeGrantRecord(ar, grantRecord)
+	if err != nil && grantRecord.ExpireByPlugin {
+		return p.denyAccess(requesterName, requestedRole, err)
+	}
+	p.wakeExpiryScheduler()
+
+	record, err := p.createExclusionRecord(ctx, requesterName, requestedRole, app.Name, justification, duration, endDateTime)
+	if err != nil {
+		p.Logger.Error(fmt.Sprintf("Use of exclusion role %s by %s is not registered in ServiceNow: %s", requestedRole, requesterName, err.Error()))
+	} else {
+		grantRecord.ChangeNumber = record.Number
+		grantRecord.ChangeSysId = record.SysId
+		grantRecord.ChangeTable = config.ExclusionRecordTable
+		_ = p.storeGrantRecord(ar, grantRecord)
 	}
 
-	return errorText, changeRemainingTime, validChange
+	grantedUIText := p.determineGrantedTextsExclusions(requesterName, requestedRole, justification, grantRecord.ChangeNumber, duration, endDateTime)
+
+	return p.grantRequest(grantedUIText)
 }
 
-func (p *ServiceNowPlugin) postNote(sysId string, noteText string) {
-	requestURI := fmt.Sprintf("/api/now/table/change_request/%s", sysId)
+// The validate-config subcommand uses the same checks as Init, so the configuration can be checked
+// before the controller is restarted: kubectl exec deploy/controller -- /tmp/plugin/plugin validate-config
+
+func (p *ServiceNowPlugin) runValidateConfig(out io.Writer) int {
+	config, err := p.loadConfig()
+	if err != nil {
+		fmt.Fprintln(out, "The configuration is not valid:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(out, "- "+line)
+		}
+		return 1
+	}
 
-	p.patchServiceNowAPI(requestURI, noteText)
+	fmt.Fprintf(out, "The configuration is valid: ServiceNow %s, authentication method %s, time zone %s, revoke mode %s\n",
+		config.ServiceNowUrl, config.ServiceNowAuthMethod, config.Timezone, config.RevokeMode)
+	return 0
 }
 
 // Public methods
 
 func (p *ServiceNowPlugin) Init() error {
 	p.Logger.Debug("This is a call to the Init method")
-	// p.getGlobalVars cannot be put in the Init method: the variables will be lost between different calls
+
+	// The plugin runs as long as the controller runs, so the configuration is kept between calls. An
+	// incorrect configuration stops the controller, instead of denying every access request later.
+	err := p.reloadConfig()
+	if err != nil {
+		p.Logger.Error("Configuration is not valid, the plugin is not started")
+		return err
+	}
+
+	if !unittest && k8sclientset != nil {
+		err = p.watchConfig(make(chan struct{}))
+		if err != nil {
+			p.Logger.Warn("Configuration changes may be missed until the watch is started, the plugin uses the loaded configuration")
+		}
+	}
+
+	if !unittest && p.getEnvVarWithDefault("REVOKE_MODE", RevokeModeScheduler) == RevokeModeScheduler {
+		go p.runExpiryScheduler(make(chan struct{}))
+	}
 
 	return nil
 }
@@ -706,65 +4177,239 @@ func (p *ServiceNowPlugin) GrantAccess(ar *api.AccessRequest, app *argocd.Applic
 
 	requesterName := ar.Spec.Subject.Username
 	requestedRole := ar.Spec.Role.TemplateRef.Name
-	namespace := ar.Spec.Application.Namespace
 	arName := ar.Name
 	arDuration := ar.Spec.Duration.Duration
-	applicationName := ar.Spec.Application.Name
 
-	errorText := p.getGlobalVars()
-	if errorText != "" {
-		p.Logger.Error(errorText)
-		return p.denyRequest(errorText)
+	err := p.requireConfig()
+	if err != nil {
+		return p.denyAccess(requesterName, requestedRole, err)
 	}
+	config := p.getConfig()
+	ctx, cancel := p.startServiceNowDeadline()
+	defer cancel()
 
-	if slices.Contains(exclusionRoles, requestedRole) {
-		endTime := time.Now().Add(arDuration)
-		grantedUIText := p.determineGrantedTextsExclusions(requesterName, requestedRole, arDuration, endTime)
+	if slices.Contains(config.ExclusionRoles, requestedRole) {
+		return p.grantExclusionAccess(ctx, ar, app)
+	}
+
+	// The role policy is evaluated before the changes are searched, a role without a change doesn't need a CI
+	filter := ChangeFilter{
+		Role:             requestedRole,
+		GraceBeforeStart: time.Duration(config.GraceBeforeStartMinutes) * time.Minute,
+		GraceAfterEnd:    time.Duration(config.GraceAfterEndMinutes) * time.Minute,
+	}
+	rolePolicy, found := config.RolePolicies[requestedRole]
+	if found {
+		filter.RolePolicy = &rolePolicy
+		if rolePolicy.GraceBeforeStartMinutes != nil {
+			filter.GraceBeforeStart = time.Duration(*rolePolicy.GraceBeforeStartMinutes) * time.Minute
+		}
+		if rolePolicy.GraceAfterEndMinutes != nil {
+			filter.GraceAfterEnd = time.Duration(*rolePolicy.GraceAfterEndMinutes) * time.Minute
+		}
+	}
 
+	if found && rolePolicy.NoChange {
+		endTime := time.Now().Add(arDuration)
+		grantedUIText := p.determineGrantedTextsWithoutChange(requesterName, requestedRole, arDuration, endTime)
+
+		// The extension ends this access itself, a grant record that cannot be stored is only logged
+		_ = p.storeGrantRecord(ar, GrantRecord{
+			AccessRequestName: arName,
+			Requester:         requesterName,
+			Role:              requestedRole,
+			EndTime:           endTime,
+		})
 		return p.grantRequest(grantedUIText)
 	}
 
-	ciName := p.getCIName(app)
-	if ciName == "\"\"" {
-		errorText := fmt.Sprintf("No CI name found: expected label with name %s in application %s", ciLabel, applicationName)
-		p.Logger.Error(errorText)
-		return p.denyRequest(errorText)
+	ciNames, err := p.getCINames(app)
+	if err != nil {
+		return p.denyAccess(requesterName, requestedRole, err)
 	}
 
-	errorString, ciSysId := p.processCI(ciName)
-	if errorString != "" {
-		p.Logger.Error("Access Denied for " + requesterName + " : " + errorString)
-		return p.denyRequest(errorString)
+	requestedChangeNumber, err := p.getRequestedChangeNumber(ar)
+	if err != nil {
+		return p.denyAccess(requesterName, requestedRole, err)
 	}
 
-	errorString, changeRemainingTime, validChange := p.processChanges(ciName, ciSysId)
+	// The requester is only searched in ServiceNow when the changes (or incidents) should be assigned to the requester
+	if config.RequesterCheck {
+		filter.RequesterSysId, err = p.getServiceNowUserSysId(ctx, requesterName)
+		if err != nil {
+			return p.denyAccess(requesterName, requestedRole, err)
+		}
+	}
 
-	if errorString == "" {
-		duration, endDateTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, validChange.EndDate)
-		ar.Spec.Duration.Duration = duration
+	// An incident in the access request is used instead of a change
+	if config.IncidentAccess {
+		requestedIncidentNumber, err := p.getRequestedIncidentNumber(ar)
+		if err != nil {
+			return p.denyAccess(requesterName, requestedRole, err)
+		}
+		if requestedIncidentNumber != "" {
+			ciIncident, err := p.findIncident(ctx, ciNames, requestedIncidentNumber, filter)
+			if err != nil {
+				return p.denyAccess(requesterName, requestedRole, err)
+			}
+			return p.grantIncidentAccess(ctx, ar, *ciIncident)
+		}
+	}
+
+	validCIChanges, err := p.findValidCIChanges(ctx, ciNames, requestedChangeNumber, filter)
+	if errors.Is(err, ErrNoValidChange) && config.IncidentAccess && requestedChangeNumber == "" {
+		// Without a valid change, a major incident of the CI gives access
+		ciIncident, incidentErr := p.findIncident(ctx, ciNames, "", filter)
+		if incidentErr != nil {
+			return p.denyAccess(requesterName, requestedRole, errors.Join(err, incidentErr))
+		}
+		return p.grantIncidentAccess(ctx, ar, *ciIncident)
+	}
+	if err != nil {
+		return p.denyAccess(requesterName, requestedRole, err)
+	}
+
+	validCIChange, otherChanges := p.selectCIChange(validCIChanges)
+	validChange := validCIChange.Change
+	changeRemainingTime := validCIChange.RemainingTime
 
-		// AbortJob is only needed when the end date of the change is earlier than the default for the access request time in
-		// the future, otherwise the ArgoCD Ephemeral Access Extension will revoke the permissions
-		if arDuration > changeRemainingTime {
-			p.createRevokeJob(namespace, arName, validChange.EndDate)
+	if config.BlackoutCheck {
+		err = p.checkBlackouts(ctx, append([]Change{*validChange}, otherChanges...))
+		if err != nil {
+			return p.denyAccess(requesterName, requestedRole, err)
 		}
+	}
 
-		jsonAr, _ := json.Marshal(ar)
-		p.Logger.Debug(string(jsonAr))
+	// The access ends at the end of the grace period after the change
+	accessEndDate := validChange.EndDate.Add(filter.GraceAfterEnd)
+	duration, endDateTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, accessEndDate)
+	ar.Spec.Duration.Duration = duration
 
-		grantedUIText, grantedAccessServiceNowText := p.determineGrantedTextsChange(requesterName, requestedRole, *validChange, duration, endDateTime)
+	// Revoking by the plugin is only needed when the end date of the change is earlier than the default for the access
+	// request time in the future, otherwise the ArgoCD Ephemeral Access Extension will revoke the permissions
+	expireByPlugin := arDuration > changeRemainingTime
+	if expireByPlugin && config.RevokeMode == RevokeModeCronJob {
+		p.createRevokeJob(ar.Namespace, arName, accessEndDate)
+	}
 
-		note := fmt.Sprintf("{\"work_notes\":\"%s\"}", grantedAccessServiceNowText)
-		p.postNote(validChange.SysId, note)
-		return p.grantRequest(grantedUIText)
-	} else {
-		p.Logger.Warn(fmt.Sprintf("Access Denied for %s, role %s: %s", requesterName, requestedRole, errorString))
-		return p.denyRequest(errorString)
+	jsonAr, _ := json.Marshal(ar)
+	p.Logger.Debug(string(jsonAr))
+
+	grantedUIText, grantedAccessServiceNowText := p.determineGrantedTextsChange(requesterName, requestedRole, *validChange, duration, endDateTime, filter)
+
+	var otherChangeNumbers []string
+	var otherChangeSysIds []string
+	var otherChangeTables []string
+	for _, otherChange := range otherChanges {
+		otherChangeNumbers = append(otherChangeNumbers, otherChange.Number)
+		otherChangeSysIds = append(otherChangeSysIds, otherChange.SysId)
+		otherChangeTables = append(otherChangeTables, otherChange.Table)
 	}
+
+	grantRecord := GrantRecord{
+		AccessRequestName:  arName,
+		Requester:          requesterName,
+		Role:               requestedRole,
+		ChangeNumber:       validChange.Number,
+		ChangeSysId:        validChange.SysId,
+		ChangeTable:        validChange.Table,
+		CISysId:            validCIChange.CISysId,
+		EndTime:            endDateTime,
+		ExclusionRole:      false,
+		ExpireByPlugin:     expireByPlugin && config.RevokeMode == RevokeModeScheduler,
+		OtherChangeNumbers: otherChangeNumbers,
+		OtherChangeSysIds:  otherChangeSysIds,
+		OtherChangeTables:  otherChangeTables,
+	}
+
+	// The expiry scheduler only ends the access at the end of the change when it finds the grant record, without
+	// it the access would last the full duration of the access request
+	err = p.storeGrantRecord(ar, grantRecord)
+	if err != nil && grantRecord.ExpireByPlugin {
+		return p.denyAccess(requesterName, requestedRole, err)
+	}
+	p.wakeExpiryScheduler()
+
+	// The note on a change task refers to its change
+	for _, change := range append([]Change{*validChange}, otherChanges...) {
+		serviceNowText := grantedAccessServiceNowText
+		if change.Table == TableChangeTask {
+			serviceNowText += ", change " + change.ParentNumber
+		}
+		note := fmt.Sprintf("{\"work_notes\":\"%s\"}", serviceNowText)
+		p.postNote(ctx, change.Table, change.SysId, note)
+	}
+
+	if len(otherChangeNumbers) > 0 {
+		grantedUIText += fmt.Sprintf(", changes of other CIs: __%s__", strings.Join(otherChangeNumbers, ", "))
+	}
+	return p.grantRequest(grantedUIText)
 }
 
+// RevokeAccess is called by the Ephemeral Access Extension when the access request is expired. The
+// extension removes the permissions itself, the plugin only cleans up and informs ServiceNow. Errors
+// are logged but never returned: returning an error would prevent the extension from removing the
+// permissions.
+
 func (p *ServiceNowPlugin) RevokeAccess(ar *api.AccessRequest, app *argocd.Application) (*plugin.RevokeResponse, error) {
-	return nil, nil
+	p.Logger.Debug("This is a call to the RevokeAccess method")
+
+	requesterName := ar.Spec.Subject.Username
+	requestedRole := ar.Spec.Role.TemplateRef.Name
+	arName := ar.Name
+
+	err := p.requireConfig()
+	if err != nil {
+		p.Logger.Error(err.Error())
+		return p.revokeRequest("Revoked access, ServiceNow is not updated: " + err.Error())
+	}
+	ctx, cancel := p.startServiceNowDeadline()
+	defer cancel()
+
+	p.deleteRevokeJob(ar.Namespace, arName)
+
+	// Access requests that were granted before grant records were introduced don't have a grant record,
+	// for these requests the change number is taken from the status history.
+	var changeNumber string
+	var changeSysId string
+	changeTable := TableChangeRequest
+
+	grantRecord, err := p.loadGrantRecord(ar)
+	if err == nil {
+		changeNumber = grantRecord.ChangeNumber
+		changeSysId = grantRecord.ChangeSysId
+		changeTable = grantRecord.ChangeTable
+	} else {
+		changeNumber = p.getGrantedChangeNumber(ar)
+	}
+
+	if changeNumber == "" {
+		p.Logger.Info(fmt.Sprintf("Revoked access for %s: role %s (no change)", requesterName, requestedRole))
+		return p.revokeRequest("Revoked access")
+	}
+
+	if changeSysId == "" {
+		change, err := p.getChangeByNumber(ctx, changeNumber)
+		if err != nil {
+			p.Logger.Warn(fmt.Sprintf("Revoked access for %s, role %s, but change %s is not updated: %s", requesterName, requestedRole, changeNumber, err.Error()))
+			return p.revokeRequest(fmt.Sprintf("Revoked access, change __%s__ is not updated: %s", changeNumber, err.Error()))
+		}
+		changeSysId = change.SysId
+	}
+
+	revokedUIText, revokedAccessServiceNowText := p.determineRevokedTexts(requesterName, requestedRole, changeTable, changeNumber)
+
+	note := fmt.Sprintf("{\"work_notes\":\"%s\"}", revokedAccessServiceNowText)
+	p.postNote(ctx, changeTable, changeSysId, note)
+
+	if grantRecord != nil {
+		for i, otherChangeSysId := range grantRecord.OtherChangeSysIds {
+			_, revokedAccessServiceNowText = p.determineRevokedTexts(requesterName, requestedRole, grantRecord.OtherChangeTables[i], grantRecord.OtherChangeNumbers[i])
+			note = fmt.Sprintf("{\"work_notes\":\"%s\"}", revokedAccessServiceNowText)
+			p.postNote(ctx, grantRecord.OtherChangeTables[i], otherChangeSysId, note)
+		}
+	}
+	return p.revokeRequest(revokedUIText)
 }
 
 func main() {
@@ -774,7 +4419,12 @@ func main() {
 	}
 
 	p := &ServiceNowPlugin{
-		Logger: logger,
+		Logger:      logger,
+		configStore: &ConfigStore{},
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(p.runValidateConfig(os.Stdout))
 	}
 
 	srvConfig := plugin.NewServerConfig(p, logger)
@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -24,8 +39,16 @@ import (
 
 	batchv1 "k8s.io/api/batch/v1"
 	coreV1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 const correctCMDBInstallStatus = "1"
@@ -171,18 +194,140 @@ func testResetEnvVar() {
 	_ = os.Setenv("KUBERNETES_SERVICE_PORT", "")
 	_ = os.Setenv("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", "")
 	_ = os.Setenv("SERVICENOW_SECRET_NAME", "")
+	_ = os.Setenv("SERVICENOW_AUTH_METHOD", "")
+	_ = os.Setenv("REVOKE_MODE", "")
+	_ = os.Setenv("REVOKE_JOB_IMAGE", "")
+	_ = os.Setenv("REVOKE_JOB_SERVICE_ACCOUNT", "")
+	_ = os.Setenv("SERVICENOW_CONNECT_TIMEOUT_SECONDS", "")
+	_ = os.Setenv("SERVICENOW_TIMEOUT_SECONDS", "")
+	_ = os.Setenv("SERVICENOW_CA_FILE", "")
+	_ = os.Setenv("SERVICENOW_CLIENT_CERT_FILE", "")
+	_ = os.Setenv("SERVICENOW_CLIENT_KEY_FILE", "")
+	_ = os.Setenv("SERVICENOW_RETRY_MAX_ATTEMPTS", "")
+	_ = os.Setenv("SERVICENOW_RETRY_BASE_DELAY_MILLISECONDS", "")
+	_ = os.Setenv("SERVICENOW_RETRY_MAX_DELAY_SECONDS", "")
+	_ = os.Setenv("SERVICENOW_REQUEST_DEADLINE_SECONDS", "")
+	_ = os.Setenv("EXPIRY_CHECK_INTERVAL_SECONDS", "")
+	_ = os.Setenv("TIME_WINDOW_CHANGES_DAYS", "")
+	_ = os.Setenv("CHANGE_NUMBER_KEY", "")
+	_ = os.Setenv("CHANGE_SELECTION_POLICY", "")
+	_ = os.Setenv("CI_CLASS", "")
+	_ = os.Setenv("CI_CORRELATION_ID_PATTERN", "")
+	_ = os.Setenv("CI_POLICY", "")
+	_ = os.Setenv("ARGOCD_NAMESPACE", "")
+	_ = os.Setenv("CI_RELATION_TYPES", "")
+	_ = os.Setenv("CI_RELATION_DEPTH", "")
+	_ = os.Setenv("CHANGE_AFFECTED_CIS", "")
+	_ = os.Setenv("REQUESTER_CHECK", "")
+	_ = os.Setenv("REQUESTER_USER_FIELD", "")
+	_ = os.Setenv("BLACKOUT_CHECK", "")
+	_ = os.Setenv("CHANGE_TASKS", "")
+	_ = os.Setenv("GRACE_BEFORE_START_MINUTES", "")
+	_ = os.Setenv("GRACE_AFTER_END_MINUTES", "")
+	_ = os.Setenv("INCIDENT_ACCESS", "")
+	_ = os.Setenv("INCIDENT_NUMBER_KEY", "")
+	_ = os.Setenv("INCIDENT_PRIORITIES", "")
+	_ = os.Setenv("INCIDENT_ACCESS_MINUTES", "")
+	_ = os.Setenv("EXCLUSION_RECORD_TABLE", "")
+	_ = os.Setenv("JUSTIFICATION_KEY", "")
 }
 
 func testGetPlugin() (*ServiceNowPlugin, *MockedLogger) {
 	loggerObj := new(MockedLogger)
 
 	p := &ServiceNowPlugin{
-		Logger: loggerObj,
+		Logger:      loggerObj,
+		configStore: &ConfigStore{},
 	}
 
 	return p, loggerObj
 }
 
+// Tests that don't load the configuration from the environment use this configuration, the values
+// are the same as the defaults of loadConfig.
+
+func testNewConfig(p *ServiceNowPlugin) *Config {
+	config := &Config{
+		Namespace:                  "argocd-ephemeral-access",
+		SecretName:                 "servicenow-secret",
+		ServiceNowUsername:         "testUser",
+		ServiceNowPassword:         "testPassword",
+		ServiceNowAuthMethod:       AuthMethodBasic,
+		CILabel:                    "ci-name",
+		CIClass:                    "cmdb_ci",
+		CIPolicy:                   CIPolicyEvery,
+		ArgoCDNamespace:            "argocd",
+		RequesterUserField:         "user_name",
+		ChangeNumberKey:            "change-number",
+		ChangeSelectionPolicy:      ChangeSelectionLatestEnd,
+		IncidentNumberKey:          "incident-number",
+		IncidentPriorities:         []string{"1", "2"},
+		IncidentAccessMinutes:      240,
+		ExclusionRecordTable:       TableIncident,
+		JustificationKey:           "justification",
+		Timezone:                   "UTC",
+		TimeWindowChangesDays:      7,
+		RevokeMode:                 RevokeModeScheduler,
+		RevokeJobImage:             "bitnami/kubectl:latest",
+		RevokeJobServiceAccount:    "remove-accessrequest-job-sa",
+		ExpiryCheckIntervalSeconds: 60,
+	}
+	p.setConfig(config)
+
+	return config
+}
+
+func (s *HelperMethodsTestSuite) TestErrorOfPluginError() {
+	pluginError := &PluginError{Kind: ErrCINotFound, Message: "CI not found"}
+
+	s.Equal("CI not found", pluginError.Error(), "Error should return the message")
+}
+
+func (s *HelperMethodsTestSuite) TestUnwrapOfPluginError() {
+	cause := errors.New("connection reset")
+	pluginError := &PluginError{Kind: ErrServiceNowUnavailable, Message: "ServiceNow not available", Err: cause}
+
+	s.Equal([]error{ErrServiceNowUnavailable, cause}, pluginError.Unwrap(), "Unwrap should return kind and cause")
+	s.ErrorIs(pluginError, ErrServiceNowUnavailable, "Kind should be found by errors.Is")
+	s.ErrorIs(pluginError, cause, "Cause should be found by errors.Is")
+	s.NotErrorIs(pluginError, ErrServiceNowAPI, "Other kinds should not be found by errors.Is")
+}
+
+func (s *HelperMethodsTestSuite) TestUnwrapOfPluginErrorWithoutCause() {
+	pluginError := &PluginError{Kind: ErrConfig, Message: "Config error"}
+
+	s.Equal([]error{ErrConfig}, pluginError.Unwrap(), "Unwrap should only return kind")
+}
+
+func (s *HelperMethodsTestSuite) TestUnmarshalJSONOfServiceNowValue() {
+	var ci CmdbServiceNow
+
+	err := json.Unmarshal([]byte(`{"install_status": {"display_value": "Retired", "value": "7"}, "name": "app-demoapp"}`), &ci)
+
+	s.NoError(err, "No error expected")
+	s.Equal(ServiceNowValue{Value: "7", DisplayValue: "Retired"}, ci.InstallStatus, "Value and display value should be read")
+	s.Equal(ServiceNowValue{Value: "app-demoapp", DisplayValue: "app-demoapp"}, ci.Name, "A plain string should be used as value and display value")
+}
+
+func (s *HelperMethodsTestSuite) TestUnmarshalJSONOfServiceNowValueIncorrect() {
+	var ci CmdbServiceNow
+
+	err := json.Unmarshal([]byte(`{"install_status": 7}`), &ci)
+
+	s.Error(err, "A number is not a ServiceNow value")
+}
+
+func (s *HelperMethodsTestSuite) TestNewError() {
+	p, _ := testGetPlugin()
+	cause := errors.New("cause")
+
+	err := p.newError(ErrNoValidChange, cause, "No valid change")
+
+	s.EqualError(err, "No valid change", "Message should be the error text")
+	s.ErrorIs(err, ErrNoValidChange, "Kind should be set")
+	s.ErrorIs(err, cause, "Cause should be set")
+}
+
 func (s *HelperMethodsTestSuite) TestgetEnvVarWithoutDefaultWithEnvVar() {
 	t := s.T()
 
@@ -191,10 +336,10 @@ func (s *HelperMethodsTestSuite) TestgetEnvVarWithoutDefaultWithEnvVar() {
 
 	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
 
-	serviceNowUrl, errorText := p.getEnvVarWithoutDefault("SERVICENOW_URL", "Whatever")
+	serviceNowUrl, err := p.getEnvVarWithoutDefault("SERVICENOW_URL", "Whatever")
 
 	s.Equal("https://example.com", serviceNowUrl, "The correct URL is retrieved")
-	s.Equal("", errorText, "No error text returned")
+	s.NoError(err, "No error text returned")
 	loggerObj.AssertExpectations(t)
 }
 
@@ -208,9 +353,9 @@ func (s *HelperMethodsTestSuite) TestgetEnvVarWithoutDefaultWithoutEnvVar() {
 
 	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.getEnvVarWithoutDefault("SERVICENOW_URL", expectedErrorText)
+	_, err := p.getEnvVarWithoutDefault("SERVICENOW_URL", expectedErrorText)
 
-	s.Equal(expectedErrorText, errorText, "Error text should be the expected errortext")
+	s.EqualError(err, expectedErrorText, "Error text should be the expected errortext")
 	loggerObj.AssertExpectations(t)
 }
 
@@ -242,14 +387,59 @@ func (s *HelperMethodsTestSuite) TestGetEnvVarWithDefaultWithoutEnvVar() {
 	loggerObj.AssertExpectations(t)
 }
 
+func (s *HelperMethodsTestSuite) TestGetFileContentFromEnvVarWithoutEnvVar() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	content, err := p.getFileContentFromEnvVar("SERVICENOW_CA_FILE")
+
+	s.Equal("", content, "No content expected")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestGetFileContentFromEnvVarWithFile() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	fileName := filepath.Join(t.TempDir(), "ca.crt")
+	_ = os.WriteFile(fileName, []byte("file content"), 0600)
+	_ = os.Setenv("SERVICENOW_CA_FILE", fileName)
+
+	content, err := p.getFileContentFromEnvVar("SERVICENOW_CA_FILE")
+
+	s.Equal("file content", content, "Content of the file expected")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestGetFileContentFromEnvVarFileDoesntExist() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = os.Setenv("SERVICENOW_CA_FILE", "/does/not/exist")
+	expectedErrorText := "Error reading file /does/not/exist (environment variable SERVICENOW_CA_FILE): open /does/not/exist: no such file or directory"
+
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getFileContentFromEnvVar("SERVICENOW_CA_FILE")
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
 func (s *HelperMethodsTestSuite) TestGetLocalTime() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	config := testNewConfig(p)
 
 	time.Local = time.UTC
 	currentTime := time.Now()
-	timezone = "Europe/Amsterdam"
+	config.Timezone = "Europe/Amsterdam"
 	currentTimeAmsterdamSummertime := time.Now().Add(2 * time.Hour)
 	currentTimeAmsterdamWintertime := time.Now().Add(1 * time.Hour)
 
@@ -281,16 +471,31 @@ func (s *HelperMethodsTestSuite) TestGetLocalTime() {
 	loggerObj.AssertExpectations(t)
 }
 
+func (s *HelperMethodsTestSuite) TestGetLocalTimeUnknownTimezone() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "Mars/Olympus_Mons"
+	loggerObj.On("Error", "Error loading time zone Mars/Olympus_Mons, using UTC: unknown time zone Mars/Olympus_Mons")
+
+	localTime := p.getLocalTime(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	s.Equal("2025-06-01 12:00:00", localTime, "UTC should be used for an unknown time zone")
+	loggerObj.AssertExpectations(t)
+}
+
 func (s *HelperMethodsTestSuite) TestConvertTimeCorrectTime() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	result, errorText := p.convertTime("2025-05-15 18:14:13")
+	result, err := p.convertTime("2025-05-15 18:14:13")
 	s.Equal(18, result.Hour(), "Hours match")
 	s.Equal(14, result.Minute(), "Minutes match")
 	s.Equal(13, result.Second(), "Seconds match")
-	s.Equal("", errorText, "No errors expected")
+	s.NoError(err, "No errors expected")
 
 	loggerObj.AssertExpectations(t)
 }
@@ -304,8 +509,62 @@ func (s *HelperMethodsTestSuite) TestConvertTimeIncorrectTime() {
 	expectedErrorText := fmt.Sprintf("Error in converting %s to go Time: parsing time \"currentZ\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"currentZ\" as \"2006\"", timeString)
 
 	loggerObj.On("Error", expectedErrorText)
-	_, errorText := p.convertTime(timeString)
-	s.Equal(expectedErrorText, errorText, "Error text is correct")
+	_, err := p.convertTime(timeString)
+	s.EqualError(err, expectedErrorText, "Error text is correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertScheduleTime() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.Timezone = "Europe/Amsterdam"
+
+	result, err := p.convertScheduleTime("20250515T181413")
+
+	s.NoError(err, "No errors expected")
+	s.Equal(time.Date(2025, 5, 15, 16, 14, 13, 0, time.UTC), result.UTC(), "Time should be in the time zone of the plugin")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertScheduleTimeIncorrectTime() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Error", mock.Anything)
+
+	_, err := p.convertScheduleTime("2025-05-15 18:14:13")
+
+	s.ErrorContains(err, "Error in converting schedule time 2025-05-15 18:14:13 to go Time: ", "Error text is correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertScheduleDate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	result, err := p.convertScheduleDate("2025-12-31")
+	s.NoError(err, "No errors expected")
+	s.Equal(time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), result, "Date with dashes should be converted")
+
+	result, err = p.convertScheduleDate("20251231")
+	s.NoError(err, "No errors expected")
+	s.Equal(time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), result, "Date without dashes should be converted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertScheduleDateIncorrectDate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	loggerObj.On("Error", mock.Anything)
+
+	_, err := p.convertScheduleDate("31-12-2025")
+
+	s.ErrorContains(err, "Error in converting schedule date 31-12-2025 to go Time: ", "Error text is correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
 	loggerObj.AssertExpectations(t)
 }
 
@@ -315,8 +574,9 @@ func (s *HelperMethodsTestSuite) TestConvertToIntSuccess() {
 	testResetEnvVar()
 
 	str := "1"
-	result := p.convertToInt("Test set", str, 0)
+	result, err := p.convertToInt("Test set", str, 0, 10)
 
+	s.NoError(err, "No error expected")
 	s.Equal(1, result, `Assuming string "1" to be 1`)
 	loggerObj.AssertExpectations(t)
 }
@@ -326,13 +586,55 @@ func (s *HelperMethodsTestSuite) TestConvertToIntFail() {
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	expectedErrorText := "Incorrect value, test in Test set: should be a number, assuming 0"
+	expectedErrorText := "Incorrect value test in Test set: should be a number from 0 to 10"
 	loggerObj.On("Error", expectedErrorText)
 
 	str := "test"
-	result := p.convertToInt("Test set", str, 0)
+	_, err := p.convertToInt("Test set", str, 0, 10)
+
+	s.EqualError(err, expectedErrorText, "Error text is correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertToIntOutOfRange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "Incorrect value 11 in Test set: should be a number from 0 to 10"
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.convertToInt("Test set", "11", 0, 10)
+
+	s.EqualError(err, expectedErrorText, "Error text is correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertToBoolSuccess() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	s.Equal(0, result, `Assuming string "test" to become default 0`)
+	result, err := p.convertToBool("Test set", "true")
+
+	s.NoError(err, "No error expected")
+	s.True(result, `Assuming string "true" to be true`)
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *HelperMethodsTestSuite) TestConvertToBoolFail() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "Incorrect value yes in Test set: should be true or false"
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.convertToBool("Test set", "yes")
+
+	s.EqualError(err, expectedErrorText, "Error text is correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
@@ -348,8 +650,8 @@ func (s *K8SRelatedTestSuite) TestGetK8sConfigInUnittest() {
 	// Will always return error text because the tests are not run from within a Kubernetes cluster
 	unittest = true
 
-	errorText := p.getK8sConfig()
-	s.Equal("", errorText, "Run in unittest should be successful")
+	err := p.getK8sConfig()
+	s.NoError(err, "Run in unittest should be successful")
 
 	loggerObj.AssertExpectations(t)
 }
@@ -367,8 +669,8 @@ func (s *K8SRelatedTestSuite) TestGetK8sConfigOutsideKubernetes() {
 	_ = os.Setenv("KUBERNETES_SERVICE_HOST", "https://kubernetes.example.com")
 	_ = os.Setenv("KUBERNETES_SERVICE_PORT", "6443")
 
-	errorText := p.getK8sConfig()
-	cont := s.Contains(errorText, "Error in getK8sConfig, rest.InClusterConfig: open /var/run/secrets/kubernetes.io/serviceaccount/token")
+	err := p.getK8sConfig()
+	cont := s.ErrorContains(err, "Error in getK8sConfig, rest.InClusterConfig: open /var/run/secrets/kubernetes.io/serviceaccount/token")
 	if !cont {
 		t.Error("Expected error when not run within a Kubernetes cluster")
 	}
@@ -390,11 +692,11 @@ func (s *K8SRelatedTestSuite) TestGetCredentialsFromSecret() {
 
 	loggerObj.On("Debug", fmt.Sprintf("Get credentials from secret [%s]%s...", namespace, secretName))
 
-	username, password, errorText := p.getCredentialsFromSecret(namespace, secretName, "username", "password")
+	username, password, err := p.getCredentialsFromSecret(namespace, secretName, "username", "password")
 
 	s.Equal(genericUsername, username, "Username found")
 	s.Equal(genericPassword, password, "Password found")
-	s.Equal("", errorText, "No error text expected")
+	s.NoError(err, "No error text expected")
 
 	loggerObj.AssertExpectations(t)
 }
@@ -420,9 +722,74 @@ func (s *K8SRelatedTestSuite) TestGetCredentialsFromSecretSecretDoesntExist() {
 	loggerObj.On("Debug", fmt.Sprintf("Get credentials from secret [%s]%s...", namespace, secretName))
 	loggerObj.On("Error", expectedErrorText)
 
-	_, _, errorText := p.getCredentialsFromSecret(namespace, secretName, "username", "password")
+	_, _, err := p.getCredentialsFromSecret(namespace, secretName, "username", "password")
+
+	s.EqualError(err, expectedErrorText, "Errortext should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetControllerConfigMap(p *ServiceNowPlugin, namespace string) *coreV1.ConfigMap {
+	configmap, _ := p.getControllerConfigMap(namespace)
+	return configmap
+}
+
+func testForbidConfigMapGet() {
+	clientset := k8sclientset.(*testclient.Clientset)
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, ExclusionsConfigMapName, errors.New("not allowed"))
+	})
+}
+
+func (s *K8SRelatedTestSuite) TestGetControllerConfigMap() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd-ephemeral-access"
+
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "administrator")
+	configmap, err := p.getControllerConfigMap(namespace)
+
+	s.NoError(err, "No error expected")
+	s.Equal("administrator", configmap.Data["exclusion-roles"], "Data of the configmap should be returned")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *K8SRelatedTestSuite) TestGetControllerConfigMapWithoutConfigMap() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Error getting configmap controller-cm, does configmap exist in namespace argocd-ephemeral-access?")
+
+	k8sclientset = testclient.NewClientset()
+	configmap, err := p.getControllerConfigMap("argocd-ephemeral-access")
+
+	s.NoError(err, "A missing configmap is not an error, the defaults are used")
+	s.Nil(configmap, "No configmap expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *K8SRelatedTestSuite) TestGetControllerConfigMapForbidden() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := `Error getting configmap controller-cm in namespace argocd-ephemeral-access: configmaps "controller-cm" is forbidden: not allowed`
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Error", expectedErrorText)
+
+	k8sclientset = testclient.NewClientset()
+	testForbidConfigMapGet()
+	configmap, err := p.getControllerConfigMap("argocd-ephemeral-access")
 
-	s.Equal(expectedErrorText, errorText, "Errortext should be correct")
+	s.Nil(configmap, "No configmap expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrKubernetes, "Kubernetes error expected")
 	loggerObj.AssertExpectations(t)
 }
 
@@ -434,12 +801,13 @@ func (s *K8SRelatedTestSuite) TestGetExclusionsFromConfigMapWithOneExclusion() {
 	namespace := "argocd-ephemeral-access"
 	exclusionsString := "administrator"
 
-	loggerObj.On("Debug", fmt.Sprintf("Get exclusions from configmap [argocd-ephemeral-access]%s", ExclusionsConfigMapName))
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get exclusions from configmap "+ExclusionsConfigMapName)
 	loggerObj.On("Debug", "Exclusions used: "+exclusionsString)
 
 	k8sclientset = testclient.NewClientset()
 	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", exclusionsString)
-	exclusions := p.getExclusionsFromConfigMap(namespace)
+	exclusions := p.getExclusionsFromConfigMap(testGetControllerConfigMap(p, namespace))
 
 	s.Equal([]string{"administrator"}, exclusions)
 	loggerObj.AssertExpectations(t)
@@ -453,12 +821,13 @@ func (s *K8SRelatedTestSuite) TestGetExclusionsFromConfigMapWithTwoExclusions()
 	namespace := "argocd-ephemeral-access"
 	exclusionsString := "administrator\nincidentmanager"
 
-	loggerObj.On("Debug", fmt.Sprintf("Get exclusions from configmap [argocd-ephemeral-access]%s", ExclusionsConfigMapName))
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get exclusions from configmap "+ExclusionsConfigMapName)
 	loggerObj.On("Debug", "Exclusions used: "+exclusionsString)
 
 	k8sclientset = testclient.NewClientset()
 	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", exclusionsString)
-	exclusions := p.getExclusionsFromConfigMap(namespace)
+	exclusions := p.getExclusionsFromConfigMap(testGetControllerConfigMap(p, namespace))
 
 	s.Equal([]string{"administrator", "incidentmanager"}, exclusions)
 	loggerObj.AssertExpectations(t)
@@ -472,12 +841,13 @@ func (s *K8SRelatedTestSuite) TestGetExclusionsFromConfigMapWithConfigMapWithout
 	namespace := "argocd-ephemeral-access"
 	exclusionsString := ""
 
-	loggerObj.On("Debug", fmt.Sprintf("Get exclusions from configmap [argocd-ephemeral-access]%s", ExclusionsConfigMapName))
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get exclusions from configmap "+ExclusionsConfigMapName)
 	loggerObj.On("Debug", "Exclusions used: "+exclusionsString)
 
 	k8sclientset = testclient.NewClientset()
 	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", exclusionsString)
-	exclusions := p.getExclusionsFromConfigMap(namespace)
+	exclusions := p.getExclusionsFromConfigMap(testGetControllerConfigMap(p, namespace))
 
 	s.Equal([]string{""}, exclusions, "No exclusions")
 	loggerObj.AssertExpectations(t)
@@ -490,1738 +860,8760 @@ func (s *K8SRelatedTestSuite) TestGetExclusionsFromConfigMapWithoutConfigMap() {
 
 	namespace := "argocd-ephemeral-access"
 
-	loggerObj.On("Debug", fmt.Sprintf("Get exclusions from configmap [argocd-ephemeral-access]%s", ExclusionsConfigMapName))
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get exclusions from configmap "+ExclusionsConfigMapName)
 	loggerObj.On("Debug", "Error getting configmap controller-cm, does configmap exist in namespace argocd-ephemeral-access?")
 	loggerObj.On("Debug", "No exclusions used")
 
 	k8sclientset = testclient.NewClientset()
-	exclusions := p.getExclusionsFromConfigMap(namespace)
+	exclusions := p.getExclusionsFromConfigMap(testGetControllerConfigMap(p, namespace))
 
 	s.Equal([]string{}, exclusions)
 	loggerObj.AssertExpectations(t)
 }
 
-func TestK8SRelated(t *testing.T) {
-	suite.Run(t, new(K8SRelatedTestSuite))
-}
-
-func (s *PluginHelperMethodsTestSuite) TestGetGlobalVars() {
+func (s *K8SRelatedTestSuite) TestGetRevokeJobTemplateFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	exampleUrl := "https://example.com"
-	_ = os.Setenv("SERVICENOW_URL", exampleUrl)
+	namespace := "argocd-ephemeral-access"
+	templateString := `spec:
+  serviceAccountName: my-sa
+  nodeSelector:
+    kubernetes.io/os: linux
+  containers:
+  - image: registry.example.com/kubectl:1.33.2
+    resources:
+      limits:
+        cpu: 100m
+        memory: 64Mi
+`
+
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get revoke job template from configmap "+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Revoke job template used: "+templateString)
 
-	secretName := "servicenow-secret"
-	ephemeralAccessPluginNamespace = "argocd-ephemeral-access"
-	testUsername := "my-username"
-	testPassword := "my-password"
 	k8sclientset = testclient.NewClientset()
-	setConfigMap(ephemeralAccessPluginNamespace, ExclusionsConfigMapName, "exclusion-roles", "")
-	setSecret(ephemeralAccessPluginNamespace, secretName, testUsername, testPassword)
-
-	loggerObj.On("Debug", mock.Anything)
-
-	unittest = true
-	errorText := p.getGlobalVars()
-
-	s.Equal(exampleUrl, serviceNowUrl, "serviceNowUrl should be retrieved from environment variables")
-	s.Equal("UTC", timezone, "Default timezone should be UTC")
-	s.Equal(testUsername, serviceNowUsername, "ServiceNow username should be correct")
-	s.Equal(testPassword, serviceNowPassword, "ServiceNow password should be correct")
-	s.Equal([]string{""}, exclusionRoles, "Default for exclusion roles is empty")
-	s.Equal("", errorText, "Not expected error texts")
+	setConfigMap(namespace, ExclusionsConfigMapName, "revoke-job-template", templateString)
+	template, err := p.getRevokeJobTemplateFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.NoError(err, "No error text expected")
+	s.Equal("my-sa", template.Spec.ServiceAccountName, "Service account should be read from the template")
+	s.Equal("linux", template.Spec.NodeSelector["kubernetes.io/os"], "Node selector should be read from the template")
+	s.Equal("registry.example.com/kubectl:1.33.2", template.Spec.Containers[0].Image, "Image should be read from the template")
+	s.Equal("64Mi", template.Spec.Containers[0].Resources.Limits.Memory().String(), "Resources should be read from the template")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestGetGlobalVarsExclusionGroupsWithValue() {
+func (s *K8SRelatedTestSuite) TestGetRevokeJobTemplateFromConfigMapWithoutTemplate() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	exampleUrl := "https://example.com"
-	_ = os.Setenv("SERVICENOW_URL", exampleUrl)
-
-	secretName := "servicenow-secret"
 	namespace := "argocd-ephemeral-access"
-	testUsername := "my-username"
-	testPassword := "my-password"
-
-	k8sclientset = testclient.NewClientset()
-	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
-	setSecret(namespace, secretName, testUsername, testPassword)
 
-	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get revoke job template from configmap "+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "No revoke job template used")
 
-	unittest = true
-	p.getGlobalVars()
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "administrator")
+	template, err := p.getRevokeJobTemplateFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	s.Equal([]string{"incidentmanagers"}, exclusionRoles, "Exclusion roles should be correct")
+	s.Nil(template, "No template expected")
+	s.NoError(err, "No error text expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestShowRequest() {
+func (s *K8SRelatedTestSuite) TestGetRevokeJobTemplateFromConfigMapIncorrectTemplate() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var ar = new(api.AccessRequest)
-	var app = new(argocd.Application)
-
-	ar.Spec.Subject.Username = "Testuser"
-	ar.Spec.Role.TemplateRef.Name = "administrator"
-	ar.Spec.Application.Namespace = "argocd"
-	ar.Spec.Application.Name = "demoapp"
-	ar.Spec.Duration.Duration = time.Hour * 4
+	namespace := "argocd-ephemeral-access"
 
-	jsonAr, _ := json.Marshal(ar)
-	jsonApp, _ := json.Marshal(app)
+	loggerObj.On("Debug", "Get configmap [argocd-ephemeral-access]"+ExclusionsConfigMapName)
+	loggerObj.On("Debug", "Get revoke job template from configmap "+ExclusionsConfigMapName)
+	loggerObj.On("Error", mock.Anything)
 
-	loggerObj.On("Info", "Call to GrantAccess: username: Testuser, role: administrator, application: [argocd]demoapp, duration: 4h0m0s")
-	loggerObj.On("Debug", "jsonAr: "+string(jsonAr))
-	loggerObj.On("Debug", "jsonApp: "+string(jsonApp))
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "revoke-job-template", "spec: [this is not a pod spec")
+	template, err := p.getRevokeJobTemplateFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	p.showRequest(ar, app)
+	s.Nil(template, "No template expected")
+	s.ErrorContains(err, "Error in revoke-job-template in configmap controller-cm: ", "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func testConvertTimeToString(t time.Time) string {
-	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
-}
-
-func (s *PluginHelperMethodsTestSuite) TestCreateRevokeJobCorrect() {
+func (s *K8SRelatedTestSuite) TestGetValidCIStatusFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	namespace := "argocd"
-	accessRequestName := "test-ar"
-	jobStartTime := time.Now().Add(-1 * time.Minute)
-	expectedJobName := "stop-" + accessRequestName
-
-	k8sclientset = testclient.NewClientset()
+	namespace := "argocd-ephemeral-access"
+	validityString := `
+default:
+  installStatus: ["1", "3"]
+classes:
+  cmdb_ci_service:
+    installStatus: ["1"]
+    operationalStatus: ["1", "5"]
+`
 
-	loggerObj.On("Debug", fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessRequestName))
-	loggerObj.On("Info", fmt.Sprintf("Created K8s job %s successfully in namespace argocd", expectedJobName))
+	loggerObj.On("Debug", mock.Anything)
 
-	p.createRevokeJob(namespace, accessRequestName, jobStartTime)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "ci-validity", validityString)
+	validity, err := p.getValidCIStatusFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	expectedSchedule := fmt.Sprintf("%d %d %d %d *",
-		jobStartTime.Minute(),
-		jobStartTime.Hour(),
-		jobStartTime.Day(),
-		jobStartTime.Month())
-	expectedCommand := []string{"sh", "-c", fmt.Sprintf("kubectl delete accessrequest -n argocd %s && kubectl delete cronjob -n argocd %s", accessRequestName, expectedJobName)}
-	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
-	myCronJob, err := cronjobs.Get(context.TODO(), expectedJobName, metav1.GetOptions{})
+	s.NoError(err, "No error text expected")
+	s.Equal([]string{"1", "3"}, validity.Default.InstallStatus, "Default install status should be read from the configmap")
+	s.Empty(validity.Default.OperationalStatus, "Every operational status is valid by default")
+	s.Equal(CIStatusPolicy{InstallStatus: []string{"1"}, OperationalStatus: []string{"1", "5"}}, validity.Classes["cmdb_ci_service"], "Statuses per class should be read from the configmap")
+	loggerObj.AssertExpectations(t)
+}
 
-	var zero int32 = 0
+func (s *K8SRelatedTestSuite) TestGetValidCIStatusFromConfigMapWithoutValidity() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	s.Equal(expectedJobName, myCronJob.Name, "Name should be the correct job name")
-	s.Equal(namespace, myCronJob.Namespace, "Namespace should be the correct namespace")
-	s.Equal(expectedSchedule, myCronJob.Spec.Schedule, "Schedule should be the correct schedule")
-	s.Equal("remove-accessrequest-job-sa", myCronJob.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName, "Service account name should be the correct service account name")
-	s.Equal(expectedJobName, myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Name, "Container name should be the correct container name")
-	s.Equal("bitnami/kubectl:latest", myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image, "Image should be the correct image")
-	s.Equal(expectedCommand, myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Command, "Image should be the correct image")
-	s.Equal(coreV1.RestartPolicyNever, myCronJob.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy, "Restart policy should be never")
-	s.Equal(&zero, myCronJob.Spec.JobTemplate.Spec.BackoffLimit, "BackoffLimit should be 0")
+	loggerObj.On("Debug", mock.Anything)
 
-	s.Equal(nil, err, "No errors expected")
+	k8sclientset = testclient.NewClientset()
+	validity, err := p.getValidCIStatusFromConfigMap(testGetControllerConfigMap(p, "argocd-ephemeral-access"))
 
+	s.NoError(err, "No error text expected")
+	s.Equal([]string{"1", "3", "4", "5"}, validity.Default.InstallStatus, "Installed, In maintenance, Pending install and Pending repair are valid by default")
+	s.Empty(validity.Classes, "No statuses per class expected")
 	loggerObj.AssertExpectations(t)
-	_ = cronjobs.Delete(context.TODO(), expectedJobName, metav1.DeleteOptions{})
 }
 
-func (s *PluginHelperMethodsTestSuite) TestCreateRevokeJobFail() {
+func (s *K8SRelatedTestSuite) TestGetValidCIStatusFromConfigMapIncorrectValidity() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	namespace := "argocd"
-	accessRequestName := "test-ar"
-	jobStartTime := time.Now().Add(-1 * time.Minute)
-	expectedJobName := "stop-" + accessRequestName
-
-	k8sclientset = testclient.NewClientset()
-
-	loggerObj.On("Debug", fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessRequestName))
-	loggerObj.On("Error", fmt.Sprintf("Failed to create K8s job %s in namespace argocd: cronjobs.batch \"stop-test-ar\" already exists.", expectedJobName))
+	namespace := "argocd-ephemeral-access"
 
-	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
-	cronJobSpec := &batchv1.CronJob{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      expectedJobName,
-			Namespace: namespace,
-		},
-	}
-	_, _ = cronjobs.Create(context.TODO(), cronJobSpec, metav1.CreateOptions{})
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
 
-	p.createRevokeJob(namespace, accessRequestName, jobStartTime)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "ci-validity", "default: [this is not a policy")
+	_, err := p.getValidCIStatusFromConfigMap(testGetControllerConfigMap(p, namespace))
 
+	s.ErrorContains(err, "Error in ci-validity in configmap controller-cm: ", "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
-	_ = cronjobs.Delete(context.TODO(), expectedJobName, metav1.DeleteOptions{})
 }
 
-func (s *PluginHelperMethodsTestSuite) TestDetermineDurationAndRealEndTimeChangeTimeWins() {
+func (s *K8SRelatedTestSuite) TestGetValidCIStatusFromConfigMapClassWithoutInstallStatus() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var arDuration = 4 * time.Hour
-	var changeRemainingTime = 1 * time.Hour
-	var endDate = time.Now().Add(1 * time.Hour)
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in ci-validity in configmap controller-cm: no install status for class cmdb_ci_appl"
 
-	duration, realEndTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, endDate)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	s.Equal(changeRemainingTime, duration, "Expected duration: 1 hour")
-	s.Equal(endDate, realEndTime, "Expected end time: 1 hour from now")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "ci-validity", "classes:\n  cmdb_ci_appl:\n    operationalStatus: [\"1\"]")
+	_, err := p.getValidCIStatusFromConfigMap(testGetControllerConfigMap(p, namespace))
 
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestDetermineDurationAndRealEndTimeArDurationWins() {
+func (s *K8SRelatedTestSuite) TestGetChangeEligibilityFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var arDuration = 4 * time.Hour
-	var changeRemainingTime = (8 * time.Hour) + (time.Microsecond * 50)
-	var endDate = time.Now().Add(8 * time.Hour)
-
-	var expectedRealEndTime = time.Now().Add(4 * time.Hour).Truncate(time.Second)
+	namespace := "argocd-ephemeral-access"
+	eligibilityString := `
+default: state=-1^approval=approved^active=true^risk!=1
+types:
+  emergency: state=-2^approval=approved^active=true
+`
 
-	duration, realEndTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, endDate)
+	loggerObj.On("Debug", mock.Anything)
 
-	s.Equal(arDuration, duration, "Expected duration: 4 hour")
-	s.Equal(expectedRealEndTime, realEndTime.Truncate(time.Second), "Expected end time: 4 hour from now")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "change-eligibility", eligibilityString)
+	eligibility, err := p.getChangeEligibilityFromConfigMap(testGetControllerConfigMap(p, namespace))
 
+	s.NoError(err, "No error text expected")
+	s.Equal("state=-1^approval=approved^active=true^risk!=1", eligibility.Default, "Default conditions should be read from the configmap")
+	s.Equal(map[string]string{"emergency": "state=-2^approval=approved^active=true"}, eligibility.Types, "Conditions per type should be read from the configmap")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsChange() {
+func (s *K8SRelatedTestSuite) TestGetChangeEligibilityFromConfigMapWithoutEligibility() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	requesterName := "TestUser"
-	requestedRole := "admin"
-	var validChange Change
+	namespace := "argocd-ephemeral-access"
 
-	validChange.Type = "1"
-	validChange.Number = "CHG300300"
-	validChange.ShortDescription = "unittests"
-	validChange.EndDate = time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
-	realEndDate := time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
+	loggerObj.On("Debug", mock.Anything)
 
-	var remainingTime = 1 * time.Hour
-	expectedGrantedAccessText := fmt.Sprintf("Granted access for %s: %s change %s (%s), role %s, from %s to %s",
-		requesterName,
-		validChange.Type,
-		validChange.Number,
-		validChange.ShortDescription,
-		requestedRole,
-		time.Now().Truncate(time.Minute),
-		realEndDate.Truncate(time.Second).String())
-	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: change __%s__ (%s), until __%s (%s)__",
-		validChange.Number,
-		validChange.ShortDescription,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
-	expectedGrantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to %s, for role %s, until %s (%s)",
-		requesterName,
-		requestedRole,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
+	k8sclientset = testclient.NewClientset()
+	eligibility, err := p.getChangeEligibilityFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	loggerObj.On("Info", expectedGrantedAccessText)
-	loggerObj.On("Debug", expectedGrantedAccessUIText)
+	s.NoError(err, "No error text expected")
+	s.Equal(DefaultChangeEligibilityQuery, eligibility.Default, "Default conditions expected")
+	s.Empty(eligibility.Types, "No conditions per type expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *K8SRelatedTestSuite) TestGetChangeEligibilityFromConfigMapIncorrectEligibility() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	grantedAccessUIText, grantedAccessServiceNowText := p.determineGrantedTextsChange(requesterName, requestedRole, validChange, remainingTime, realEndDate)
+	namespace := "argocd-ephemeral-access"
 
-	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
-	s.Equal(expectedGrantedAccessServiceNowText, grantedAccessServiceNowText, "Granted access text for ServiceNow should be what is expected")
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "change-eligibility", "types: [this is not a map")
+	_, err := p.getChangeEligibilityFromConfigMap(testGetControllerConfigMap(p, namespace))
 
+	s.ErrorContains(err, "Error in change-eligibility in configmap controller-cm: ", "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsExclusions() {
+func (s *K8SRelatedTestSuite) TestGetChangeEligibilityFromConfigMapTypeWithoutConditions() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	requesterName := "TestUser"
-	requestedRole := "admin"
-
-	var remainingTime = 1 * time.Hour
-	realEndDate := time.Now().Add(remainingTime)
-
-	expectedGrantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, %s is an exclusion role)",
-		requesterName,
-		requestedRole,
-		time.Now().Truncate(time.Minute),
-		realEndDate.Truncate(time.Minute),
-		requestedRole)
-	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: %s is an exclusion role, until __%s (%s)__",
-		requestedRole,
-		p.getLocalTime(realEndDate),
-		remainingTime.Truncate(time.Second).String())
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in change-eligibility in configmap controller-cm: no conditions for change type emergency"
 
-	loggerObj.On("Warn", expectedGrantedAccessText)
-	loggerObj.On("Debug", expectedGrantedAccessUIText)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	grantedAccessUIText := p.determineGrantedTextsExclusions(requesterName, requestedRole, remainingTime, realEndDate)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "change-eligibility", "types:\n  emergency: \"\"")
+	_, err := p.getChangeEligibilityFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestDenyRequest() {
+func (s *K8SRelatedTestSuite) TestGetRequesterMappingFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	reason := "whatever"
-	response, err := p.denyRequest(reason)
+	namespace := "argocd-ephemeral-access"
+	mappingString := `
+jane.doe@example.com: jdoe
+admin: itil.admin
+`
 
-	s.Equal(plugin.GrantStatusDenied, response.Status, response, "Access request should be denied")
-	s.Equal(reason, response.Message, response, "Reason should be correct")
-	s.Equal(nil, err, "No error")
+	loggerObj.On("Debug", mock.Anything)
+
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "requester-mapping", mappingString)
+	mapping, err := p.getRequesterMappingFromConfigMap(testGetControllerConfigMap(p, namespace))
 
+	s.NoError(err, "No error text expected")
+	s.Equal(map[string]string{"jane.doe@example.com": "jdoe", "admin": "itil.admin"}, mapping, "Mapping should be read from the configmap")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestGrantRequest() {
+func (s *K8SRelatedTestSuite) TestGetRequesterMappingFromConfigMapWithoutMapping() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	reason := "whatever"
-	response, err := p.grantRequest(reason)
+	namespace := "argocd-ephemeral-access"
 
-	s.Equal(plugin.GrantStatusGranted, response.Status, response, "Access request should be denied")
-	s.Equal(reason, response.Message, response, "Reason should be correct")
-	s.Equal(nil, err, "No error")
+	loggerObj.On("Debug", mock.Anything)
 
+	k8sclientset = testclient.NewClientset()
+	mapping, err := p.getRequesterMappingFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.NoError(err, "No error text expected")
+	s.Empty(mapping, "Empty mapping expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func setSecret(namespace string, secretName string, username string, password string) {
-	secret := &coreV1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
-		},
-		Type: "Opaque",
-		Data: map[string][]byte{
-			"username": []byte(username),
-			"password": []byte(password),
-		},
-	}
+func (s *K8SRelatedTestSuite) TestGetRequesterMappingFromConfigMapIncorrectMapping() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	_, _ = k8sclientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
-}
+	namespace := "argocd-ephemeral-access"
 
-func setConfigMap(namespace string, configmapName string, exclusionsListName string, exclusionsListValue string) {
-	configMap := &coreV1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      configmapName,
-			Namespace: namespace,
-		},
-		Data: map[string]string{
-			exclusionsListName: exclusionsListValue,
-		},
-	}
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
 
-	_, _ = k8sclientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "requester-mapping", "- this is a list\n- not a map")
+	_, err := p.getRequesterMappingFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.ErrorContains(err, "Error in requester-mapping in configmap controller-cm: ", "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestGetServiceNowCredentials() {
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	secretName := "servicenow-secret"
 	namespace := "argocd-ephemeral-access"
-	serviceNowUsername := "serviceNowUsername"
-	serviceNowPassword := "serviceNowPassword"
-	ephemeralAccessPluginNamespace = namespace
+	policiesString := `
+admin:
+  changeTypes: [normal, emergency]
+  maxRisk: moderate
+operator:
+  changeTypes: [standard]
+readonly-plus:
+  noChange: true
+deployer:
+  graceBeforeStartMinutes: 15
+  graceAfterEndMinutes: 0
+`
 
-	k8sclientset = testclient.NewClientset()
-	setSecret(namespace, secretName, serviceNowUsername, serviceNowPassword)
-
-	loggerObj.On("Debug", "Environment variable SERVICENOW_SECRET_NAME is empty, assuming servicenow-secret")
-	loggerObj.On("Debug", "Get credentials from secret [argocd-ephemeral-access]servicenow-secret...")
+	loggerObj.On("Debug", mock.Anything)
 
-	username, password, errorText := p.getServiceNowCredentials()
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "role-policies", policiesString)
+	policies, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	s.Equal(serviceNowUsername, username, "Username found")
-	s.Equal(serviceNowPassword, password, "Password found")
-	s.Equal("", errorText, "No error expected")
+	graceBeforeStart := 15
+	graceAfterEnd := 0
 
+	s.NoError(err, "No error text expected")
+	s.Equal(RolePolicy{ChangeTypes: []string{"normal", "emergency"}, MaxRisk: "moderate"}, policies["admin"], "Policy of admin should be read from the configmap")
+	s.Equal(RolePolicy{ChangeTypes: []string{"standard"}}, policies["operator"], "Policy of operator should be read from the configmap")
+	s.Equal(RolePolicy{GraceBeforeStartMinutes: &graceBeforeStart, GraceAfterEndMinutes: &graceAfterEnd}, policies["deployer"], "Grace periods of deployer should be read from the configmap, also when they are 0")
+	s.Equal(RolePolicy{NoChange: true}, policies["readonly-plus"], "Policy of readonly-plus should be read from the configmap")
 	loggerObj.AssertExpectations(t)
 }
 
-func TestPluginHelperMethods(t *testing.T) {
-	suite.Run(t, new(PluginHelperMethodsTestSuite))
-}
-
-func simulateHttpRequestToServiceNow(t *testing.T, responseMap map[string]string) *httptest.Server {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		response := ""
-
-		for uri := range responseMap {
-			if uri == r.URL.RequestURI() {
-				response = responseMap[uri]
-				break
-			}
-		}
-		if response == "" {
-			fmt.Printf("No response found for %s, error in testset?\n", r.URL.RequestURI())
-		}
-		if r.Header.Get("Accept") != "application/json" {
-			t.Errorf("Expected Accept: application/json header, got: %s", r.Header.Get("Accept"))
-		}
-		usedUsername, usedPassword, ok := r.BasicAuth()
-		if ok {
-			assert.Equal(t, serviceNowUsername, usedUsername, "Username that is used should match username that is requested")
-			assert.Equal(t, serviceNowPassword, usedPassword, "Password that is used should match username that is requested")
-		}
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMapWithoutPolicies() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte(response))
-	}))
-	return server
-}
+	namespace := "argocd-ephemeral-access"
 
-func simulateSimpleHttpRequestWithStatusCodeRedirect(response string) (*httptest.Server, *httptest.Server) {
+	loggerObj.On("Debug", mock.Anything)
 
-	var secondServer = httptest.NewServer(http.HandlerFunc(func(w2 http.ResponseWriter, r2 *http.Request) {
-		w2.WriteHeader(http.StatusOK)
-		_, _ = w2.Write([]byte(response))
-	}))
+	k8sclientset = testclient.NewClientset()
+	policies, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	server := httptest.NewServer(http.HandlerFunc(func(w1 http.ResponseWriter, r1 *http.Request) {
-		http.Redirect(w1, r1, secondServer.URL, http.StatusFound)
-	}))
-	return server, secondServer
+	s.NoError(err, "No error text expected")
+	s.Empty(policies, "No policies expected")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestCheckAPIResultNormalResponse() {
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMapIncorrectPolicies() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var resp = http.Response{
-		Status:     "200 OK",
-		StatusCode: 200,
-	}
-	var body = `{"result":[]}`
+	namespace := "argocd-ephemeral-access"
 
-	result, errorText := p.checkAPIResult(&resp, []byte(body))
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
 
-	s.Equal(body, string(result), "Body should not be changed")
-	s.Equal("", errorText, "No error expected")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "role-policies", "admin: [this is not a policy")
+	_, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.ErrorContains(err, "Error in role-policies in configmap controller-cm: ", "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestCheckAPIResultForbidden() {
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMapUnknownRisk() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	expectedErrorText := "ServiceNow API changed"
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in role-policies in configmap controller-cm: unknown maximum risk medium for role admin, use very-high, high, moderate or low"
 
-	var resp = http.Response{
-		Status:     "403 Forbidden",
-		StatusCode: 403,
-	}
-	var body = `{"result":[]}`
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.checkAPIResult(&resp, []byte(body))
-	s.Equal(expectedErrorText, errorText, "Correct error text")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "role-policies", "admin:\n  maxRisk: medium")
+	_, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestCheckAPIResultBadGateway() {
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMapNoChangeWithChangeTypes() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	expectedErrorText := "ServiceNow API server is down"
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in role-policies in configmap controller-cm: role readonly-plus doesn't need a change, so it cannot have change types, a maximum risk or grace periods"
 
-	var resp = http.Response{
-		Status:     "502 Bad Gateway",
-		StatusCode: 502,
-	}
-	var body = `{"result":[]}`
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.checkAPIResult(&resp, []byte(body))
-	s.Equal(expectedErrorText, errorText, "Correct error text")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "role-policies", "readonly-plus:\n  noChange: true\n  changeTypes: [standard]")
+	_, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestCheckAPIResultBadGatewayWith200() {
+func (s *K8SRelatedTestSuite) TestGetRolePoliciesFromConfigMapIncorrectGracePeriod() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	expectedErrorText := "ServiceNow API server is down"
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in role-policies in configmap controller-cm: grace period -5 of role admin should be between 0 and 1440 minutes"
 
-	var resp = http.Response{
-		Status:     "200 OK",
-		StatusCode: 200,
-	}
-	responseText := "<html><body>Server down!</body></html>"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.checkAPIResult(&resp, []byte(responseText))
-	s.Equal(expectedErrorText, errorText, "Correct error text")
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "role-policies", "admin:\n  graceAfterEndMinutes: -5")
+	_, err := p.getRolePoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestgetFromServiceNowAPINormalResponse() {
+func (s *K8SRelatedTestSuite) TestGetExclusionPoliciesFromConfigMap() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	responseText := "{\"results\":[]}"
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	requestURI := "/api/test"
-
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	namespace := "argocd-ephemeral-access"
+	policiesString := `
+incidentmanagers:
+  maxDurationMinutes: 60
+  users: [jane.doe@example.com]
+  groups: [Major Incident Managers]
+  justificationRequired: true
+breakglass:
+  maxDurationMinutes: 30
+`
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	loggerObj.On("Debug", mock.Anything)
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-policies", policiesString)
+	policies, err := p.getExclusionPoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	result, errorText := p.getFromServiceNowAPI(requestURI)
-	s.Equal(responseText, string(result), "Correct result from API")
-	s.Equal("", errorText, "No errors expected")
+	s.NoError(err, "No error text expected")
+	s.Equal(ExclusionPolicy{MaxDurationMinutes: 60, Users: []string{"jane.doe@example.com"}, Groups: []string{"Major Incident Managers"}, JustificationRequired: true}, policies["incidentmanagers"], "Policy of incidentmanagers should be read from the configmap")
+	s.Equal(ExclusionPolicy{MaxDurationMinutes: 30}, policies["breakglass"], "Policy of breakglass should be read from the configmap")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestgetFromServiceNowAPINormalResponseWithRedirect() {
+func (s *K8SRelatedTestSuite) TestGetExclusionPoliciesFromConfigMapWithoutPolicies() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	responseText := "{\"results\":[]}"
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	requestURI := "/api/test"
-
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-
-	server, secondServer := simulateSimpleHttpRequestWithStatusCodeRedirect(responseText)
-	defer server.Close()
-	defer secondServer.Close()
-	serviceNowUrl = server.URL
+	namespace := "argocd-ephemeral-access"
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
+	loggerObj.On("Debug", mock.Anything)
 
-	// Redirect is done by http, not by the plugin program. We will therefore just get the apiCall for the primary address,
-	// not for the redirect server.
-	//
-	// It is very important that redirects works.
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
+	policies, err := p.getExclusionPoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	result, errorText := p.getFromServiceNowAPI(requestURI)
-	s.Equal(responseText, string(result), "Correct result from API")
-	s.Equal("", errorText, "No errors expected")
+	s.NoError(err, "No error text expected")
+	s.Empty(policies, "No policies expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestGetFromServiceNowAPIErrorInApiCall() {
+func (s *K8SRelatedTestSuite) TestGetExclusionPoliciesFromConfigMapIncorrectPolicies() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	responseText := "{\"results\":[]}"
+	namespace := "argocd-ephemeral-access"
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	ciName := "app-demoapp"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
 
-	requestURI := getTestCIRequestURI(ciName)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-policies", "incidentmanagers: [this is not a policy")
+	_, err := p.getExclusionPoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
+	s.ErrorContains(err, "Error in exclusion-policies in configmap controller-cm: ", "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
+	loggerObj.AssertExpectations(t)
+}
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+func (s *K8SRelatedTestSuite) TestGetExclusionPoliciesFromConfigMapNegativeDuration() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	// requestURI is changed to something incorrect (contains serviceNowUrl which it shouldn't)
+	namespace := "argocd-ephemeral-access"
+	expectedErrorText := "Error in exclusion-policies in configmap controller-cm: maximum duration -10 of exclusion role incidentmanagers should be 0 (no maximum) or more minutes"
 
-	requestURI = fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	// Expected apiCall contains the serviceNowUrl twice
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-policies", "incidentmanagers:\n  maxDurationMinutes: -10")
+	_, err := p.getExclusionPoliciesFromConfigMap(testGetControllerConfigMap(p, namespace))
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Error", mock.Anything)
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
+	loggerObj.AssertExpectations(t)
+}
 
-	_, errorText := p.getFromServiceNowAPI(requestURI)
-	if !strings.Contains(errorText, "no such host") {
-		t.Errorf("%s should contain text no such host", errorText)
+func testGetARForGrantRecord() *api.AccessRequest {
+	var ar = new(api.AccessRequest)
+	ar.Name = "test-ar"
+	ar.Namespace = "argocd"
+	ar.UID = "ar-uid-1"
+
+	return ar
+}
+
+func testGetGrantRecord() GrantRecord {
+	return GrantRecord{
+		AccessRequestName: "test-ar",
+		Requester:         "Test User",
+		Role:              "administrator",
+		ChangeNumber:      "CHG300030",
+		ChangeSysId:       "1",
+		ChangeTable:       TableChangeRequest,
+		CISysId:           "5",
+		EndTime:           time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC),
+		ExclusionRole:     false,
 	}
+}
+
+func (s *K8SRelatedTestSuite) TestGetGrantRecordName() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar := testGetARForGrantRecord()
 
+	s.Equal("servicenow-grant-ar-uid-1", p.getGrantRecordName(ar), "Grant record name should contain the UID of the access request")
 	loggerObj.AssertExpectations(t)
 }
 
-// PostNote is a very simple method, so re-use the test for PatchServiceNowAPINormalRequest for both methods
-
-func testPatchServiceNowAPINormalRequest(s *ServiceNowTestSuite, requestURI string, data string, responseText string) {
+func (s *K8SRelatedTestSuite) TestStoreGrantRecord() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
-
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
-	loggerObj.On("Debug", "apiCall: "+apiCall)
-	loggerObj.On("Debug", "Data: "+data)
-	loggerObj.On("Debug", "Body: "+responseText)
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
 
-	result, errorText := p.patchServiceNowAPI(requestURI, data)
-	s.Equal(responseText, string(result), "Correct result from API")
-	s.Equal("", errorText, "No errors expected")
+	loggerObj.On("Debug", "Store grant record [argocd]servicenow-grant-ar-uid-1")
+
+	err := p.storeGrantRecord(ar, testGetGrantRecord())
+
+	configMap, err := k8sclientset.CoreV1().ConfigMaps("argocd").Get(context.TODO(), "servicenow-grant-ar-uid-1", metav1.GetOptions{})
+	s.NoError(err, "No error text expected")
+	s.Equal(nil, err, "Grant record should exist")
+	s.Equal("CHG300030", configMap.Data["change-number"], "Change number should be stored")
+	s.Equal("1", configMap.Data["change-sys-id"], "Change sys_id should be stored")
+	s.Equal("5", configMap.Data["ci-sys-id"], "CI sys_id should be stored")
+	s.Equal("administrator", configMap.Data["role"], "Role should be stored")
+	s.Equal("2025-05-20T23:59:59Z", configMap.Data["end-time"], "End time should be stored")
+	s.Equal("false", configMap.Data["exclusion-role"], "Exclusion role should be stored")
+	s.Equal("true", configMap.Labels[GrantRecordLabel], "Grant record should be labeled")
+	s.Equal(ar.UID, configMap.OwnerReferences[0].UID, "Access request should be the owner of the grant record")
+	s.Equal("AccessRequest", configMap.OwnerReferences[0].Kind, "Owner should be an access request")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestPatchServiceNowAPINormalRequest() {
-	serviceNowUrl = "https://example.com"
-	requestURI := "/api/test/1"
-	data := `{"test": 1, "result": "success"}`
-	responseText := `{"test": 1, "testText": "More results than the data that is sent", "result": "success"}`
+func (s *K8SRelatedTestSuite) TestSplitCommaSeparated() {
+	p, _ := testGetPlugin()
 
-	testPatchServiceNowAPINormalRequest(s, requestURI, data, responseText)
+	s.Equal([]string{"CHG300031", "CHG300032"}, p.splitCommaSeparated("CHG300031,CHG300032"), "Values should be split")
+	s.Nil(p.splitCommaSeparated(""), "No values expected for an empty string")
 }
 
-func (s *ServiceNowTestSuite) TestPatchServiceNowAPIErrorInApiCall() {
+func (s *K8SRelatedTestSuite) TestStoreGrantRecordWithOtherChanges() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	serviceNowUrl = "https://example.com"
-	// Incorrect requestURI containing the serviceNowUrl
-	incorrectRequestURI := fmt.Sprintf("%s/api/test/1", serviceNowUrl)
-	data := `{"test": 1, "result": "success"}`
-
-	// No need to set up simulation server, as this will never be reached
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
 
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, incorrectRequestURI)
-	loggerObj.On("Debug", "apiCall: "+apiCall)
-	loggerObj.On("Debug", "Data: "+data)
-	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Debug", mock.Anything)
 
-	_, errorText := p.patchServiceNowAPI(incorrectRequestURI, data)
-	if !strings.Contains(fmt.Sprintf("%v", errorText), "no such host") {
-		t.Errorf("%s should contain text no such host", errorText)
-	}
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CTASK0010001", "CHG300032"}
+	grantRecord.OtherChangeSysIds = []string{"2", "3"}
+	grantRecord.OtherChangeTables = []string{TableChangeTask, TableChangeRequest}
+	err := p.storeGrantRecord(ar, grantRecord)
+	s.NoError(err, "No error text expected")
+
+	configMap, _ := k8sclientset.CoreV1().ConfigMaps("argocd").Get(context.TODO(), "servicenow-grant-ar-uid-1", metav1.GetOptions{})
+	s.Equal("CTASK0010001,CHG300032", configMap.Data["other-change-numbers"], "Other change numbers should be stored")
+	s.Equal("2,3", configMap.Data["other-change-sys-ids"], "Other change sys_ids should be stored")
+	s.Equal("change_task,change_request", configMap.Data["other-change-tables"], "Table of every other change should be stored")
+
+	loadedGrantRecord, err := p.loadGrantRecord(ar)
+	s.NoError(err, "No error text expected")
+	s.Equal(grantRecord, *loadedGrantRecord, "Loaded grant record should be the same as the stored grant record")
 	loggerObj.AssertExpectations(t)
 }
 
-func TestServiceNowMethods(t *testing.T) {
-	suite.Run(t, new(ServiceNowTestSuite))
-}
-
-func (s *ServiceNowTestSuite) TestGetCINameFilled() {
+func (s *K8SRelatedTestSuite) TestStoreGrantRecordTwice() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var app = new(argocd.Application)
-	var m = make(map[string]string)
-
-	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
-	loggerObj.On("Debug", "ciLabel ci-name found: app-demoapp")
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
 
-	ciLabel = "ci-name"
-	m[ciLabel] = "app-demoapp"
-	app.Labels = m
+	loggerObj.On("Debug", "Store grant record [argocd]servicenow-grant-ar-uid-1")
 
-	ciLabel := p.getCIName(app)
+	grantRecord := testGetGrantRecord()
+	p.storeGrantRecord(ar, grantRecord)
+	grantRecord.ChangeNumber = "CHG300031"
+	err := p.storeGrantRecord(ar, grantRecord)
 
-	s.Equal("app-demoapp", ciLabel, "Label found, correct content")
+	configMap, _ := k8sclientset.CoreV1().ConfigMaps("argocd").Get(context.TODO(), "servicenow-grant-ar-uid-1", metav1.GetOptions{})
+	s.NoError(err, "No error text expected")
+	s.Equal("CHG300031", configMap.Data["change-number"], "Grant record should be overwritten")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestGetCINameEmpty() {
+func (s *K8SRelatedTestSuite) TestStoreGrantRecordWithoutUID() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var app = new(argocd.Application)
-	var m map[string]string
+	ar := testGetARForGrantRecord()
+	ar.UID = ""
+	k8sclientset = testclient.NewClientset()
+	expectedErrorText := "Access request test-ar has no UID, grant record is not stored"
 
-	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
-	loggerObj.On("Debug", "ciLabel ci-name found: ")
+	loggerObj.On("Debug", "Store grant record [argocd]servicenow-grant-")
+	loggerObj.On("Error", expectedErrorText)
 
-	app.Labels = m
-	ciLabel = "ci-name"
-	ciName := p.getCIName(app)
+	err := p.storeGrantRecord(ar, testGetGrantRecord())
 
-	s.Equal("", ciName, "No label found, assume empty string")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func testPrepareGetCI(t *testing.T, ciName string, responseText string) (*httptest.Server, string) {
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	requestURI := getTestCIRequestURI(ciName)
-
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
+func (s *K8SRelatedTestSuite) TestParseGrantRecord() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	serviceNowUrl = server.URL
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "servicenow-grant-ar-uid-1",
+		},
+		Data: map[string]string{
+			"accessrequest":    "test-ar",
+			"change-number":    "CHG300030",
+			"end-time":         "2025-05-20T23:59:59Z",
+			"exclusion-role":   "false",
+			"expire-by-plugin": "true",
+		},
+	}
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	grantRecord := p.parseGrantRecord(configMap)
 
-	return server, apiCall
+	s.Equal("test-ar", grantRecord.AccessRequestName, "Access request name should be parsed")
+	s.Equal("CHG300030", grantRecord.ChangeNumber, "Change number should be parsed")
+	s.Equal(time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC), grantRecord.EndTime, "End time should be parsed")
+	s.False(grantRecord.ExclusionRole, "Exclusion role should be parsed")
+	s.True(grantRecord.ExpireByPlugin, "Expire by plugin should be parsed")
+	s.Equal(TableChangeRequest, grantRecord.ChangeTable, "A grant record without a table should be for a change")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *CITestSuite) TestGetCIOneCI() {
+func (s *K8SRelatedTestSuite) TestParseGrantRecordChangeTask() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	ciName := "app-demoapp"
-	responseText := fmt.Sprintf(`{"result":[{"install_status":"1", "name":"%s", "sys_id": "5"}]}`, ciName)
-	server, apiCall := testPrepareGetCI(t, ciName, responseText)
-	defer server.Close()
-
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Debug", "InstallStatus: 1, CI name: app-demoapp, SysId: 5")
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "servicenow-grant-ar-uid-1",
+		},
+		Data: map[string]string{
+			"change-number": "CTASK0010001",
+			"change-table":  "change_task",
+			"end-time":      "2025-05-20T23:59:59Z",
+		},
+	}
 
-	cmdb, errorText := p.getCI(ciName)
+	grantRecord := p.parseGrantRecord(configMap)
 
-	s.Equal("1", cmdb.InstallStatus, "InstallStatus should be 1")
-	s.Equal(ciName, cmdb.Name, "Name should be "+ciName)
-	s.Equal("5", cmdb.SysId, "SysId should be 5")
-	s.Equal("", errorText, "No errors expected")
+	s.Equal("CTASK0010001", grantRecord.ChangeNumber, "Change task number should be parsed")
+	s.Equal(TableChangeTask, grantRecord.ChangeTable, "Table should be parsed")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *CITestSuite) TestGetCITwoCIs() {
+func (s *K8SRelatedTestSuite) TestParseGrantRecordOtherChangesWithoutTables() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	ciName := "app-demoapp"
-
-	responseText := `{"result":[{"install_status":"1", "name":"app-demoapp", "sys_id": "1"},
-	                            {"install_status":"6", "name":"app-demoapp", "sys_id": "2"}]}`
-	server, apiCall := testPrepareGetCI(t, ciName, responseText)
-	defer server.Close()
-
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Debug", "InstallStatus: 1, CI name: app-demoapp, SysId: 1")
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "servicenow-grant-ar-uid-1",
+		},
+		Data: map[string]string{
+			"change-number":        "CTASK0010001",
+			"change-table":         "change_task",
+			"end-time":             "2025-05-20T23:59:59Z",
+			"other-change-numbers": "CTASK0010002,CTASK0010003",
+			"other-change-sys-ids": "2,3",
+		},
+	}
 
-	cmdb, errorText := p.getCI(ciName)
+	grantRecord := p.parseGrantRecord(configMap)
 
-	s.Equal("1", cmdb.InstallStatus, "InstallStatus should be 1")
-	s.Equal(ciName, cmdb.Name, "Name should be "+ciName)
-	s.Equal("", errorText, "No errors expected")
+	s.Equal([]string{TableChangeTask, TableChangeTask}, grantRecord.OtherChangeTables, "Without tables, the other changes should be in the table of the change")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *CITestSuite) TestGetCINoCI() {
+func (s *K8SRelatedTestSuite) TestParseGrantRecordIncorrectEndTime() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	responseText := "{\"result\":[]}"
-	expectedErrorText := "No CI with name app-demoapp found"
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	ciName := "app-demoapp"
-
-	requestURI := getTestCIRequestURI(ciName)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-
-	serviceNowUrl = server.URL
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "servicenow-grant-ar-uid-1",
+		},
+		Data: map[string]string{
+			"end-time": "tomorrow",
+		},
+	}
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Error", expectedErrorText)
+	loggerObj.On("Debug", `Incorrect end time in grant record servicenow-grant-ar-uid-1: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`)
 
-	_, errorText := p.getCI(ciName)
+	grantRecord := p.parseGrantRecord(configMap)
 
-	s.Equal(expectedErrorText, errorText, "Expected error text is correct")
+	s.True(grantRecord.EndTime.IsZero(), "End time should be empty")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestGetCIServerDown() {
+func (s *K8SRelatedTestSuite) TestValidateGrantRecord() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	config := testNewConfig(p)
 
-	expectedErrorText := "ServiceNow API server is down"
-	responseText := "<html><body>Server down!</body></html>"
+	config.ExclusionRecordTable = "u_exclusion_record"
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CTASK0010001"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{TableChangeTask}
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	ciName := "app-demoapp"
+	s.NoError(p.validateGrantRecord("servicenow-grant-ar-uid-1", grantRecord), "A change should be accepted")
+	grantRecord.ChangeTable = "u_exclusion_record"
+	s.NoError(p.validateGrantRecord("servicenow-grant-ar-uid-1", grantRecord), "The table of the exclusion records should be accepted")
+	loggerObj.AssertExpectations(t)
+}
 
-	requestURI := getTestCIRequestURI(ciName)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
+func (s *K8SRelatedTestSuite) TestValidateGrantRecordUnknownTable() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	testNewConfig(p)
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	grantRecord := testGetGrantRecord()
+	grantRecord.ChangeTable = "sys_user"
+	expectedErrorText := "Grant record servicenow-grant-ar-uid-1 has an unknown table sys_user"
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.getCI("app-demoapp")
+	err := p.validateGrantRecord("servicenow-grant-ar-uid-1", grantRecord)
 
-	s.Equal(expectedErrorText, errorText, "Correct error")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrKubernetes, "Error should be of the correct kind")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ServiceNowTestSuite) TestGetCINoJSON() {
+func (s *K8SRelatedTestSuite) TestValidateGrantRecordUnknownOtherChangeTable() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	testNewConfig(p)
 
-	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
-	responseText := "<Result/>"
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	ciName := "app-demoapp"
-
-	requestURI := getTestCIRequestURI(ciName)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
-
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CHG300031"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{"sys_user"}
+	expectedErrorText := "Grant record servicenow-grant-ar-uid-1 has an unknown table sys_user"
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
 	loggerObj.On("Error", expectedErrorText)
 
-	_, errorText := p.getCI(ciName)
-	s.Equal(expectedErrorText, errorText, "Correct error text")
-	loggerObj.AssertExpectations(t)
-}
+	err := p.validateGrantRecord("servicenow-grant-ar-uid-1", grantRecord)
 
-func TestCIMethods(t *testing.T) {
-	suite.Run(t, new(CITestSuite))
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
 }
 
-func getHttpDateTime(t time.Time) string {
-	return fmt.Sprintf("%04d%%2d%02d%%2d%02d", t.Year(), t.Month(), t.Day())
-}
+func (s *K8SRelatedTestSuite) TestValidateGrantRecordOtherChangesDontMatch() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	testNewConfig(p)
 
-func getExpectedRequestURI(cmdb_ci string, startDate time.Time, endDate time.Time, sysparmOffset int) string {
-	requestURIStart := "/api/now/table/change_request?sysparm_query=cmdb_ci%3d" + cmdb_ci + "%5estate%3d%2d1%5ephase%3drequested%5eapproval%3dapproved%5eactive%3dtrue"
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CHG300031", "CHG300032"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{TableChangeRequest}
+	expectedErrorText := "Grant record servicenow-grant-ar-uid-1 has 2 other change numbers, 1 other change sys_ids and 1 other change tables"
 
-	startDateHttpString := getHttpDateTime(startDate)
-	endDateHttpString := getHttpDateTime(endDate)
-	firstTimeString := "00%3a00%3a00"
-	lastTimeString := "23%3a59%3a59"
-	requestURIStartDatePart := "GOTOstart_date%3e" + startDateHttpString + "%20" + firstTimeString
-	requestURIEndDatePart := "GOTOend_date%3c" + endDateHttpString + "%20" + lastTimeString
+	loggerObj.On("Error", expectedErrorText)
 
-	sysparmOffsetString := fmt.Sprintf("%d", sysparmOffset)
-	requestURIEnd := "&sysparm_fields=type,number,short_description,start_date,end_date,sys_id&sysparm_limit=5&sysparm_offset=" + sysparmOffsetString
+	err := p.validateGrantRecord("servicenow-grant-ar-uid-1", grantRecord)
 
-	return requestURIStart + "%5e" + requestURIStartDatePart + "%5e" + requestURIEndDatePart + requestURIEnd
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow0Days() {
+func (s *K8SRelatedTestSuite) TestLoadGrantRecord() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	cmdbCi := "id1"
-	sysparmOffset := 0
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
 
-	timeWindowChangesDays = 0
-	startDate := time.Now() // first time of today
-	endDate := time.Now()   // last time of today
-	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+	loggerObj.On("Debug", "Store grant record [argocd]servicenow-grant-ar-uid-1")
+	loggerObj.On("Debug", "Load grant record [argocd]servicenow-grant-ar-uid-1")
 
-	requestURI := p.getChangeRequestURI(cmdbCi, sysparmOffset)
+	p.storeGrantRecord(ar, testGetGrantRecord())
+	grantRecord, err := p.loadGrantRecord(ar)
 
-	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	s.NoError(err, "No error text expected")
+	s.Equal(testGetGrantRecord(), *grantRecord, "Loaded grant record should be equal to the stored grant record")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow1Days() {
+func (s *K8SRelatedTestSuite) TestLoadGrantRecordDoesntExist() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	cmdbCi := "id2"
-	sysparmOffset := 0
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
+	expectedErrorText := `Error getting grant record servicenow-grant-ar-uid-1 in namespace argocd: configmaps "servicenow-grant-ar-uid-1" not found`
 
-	timeWindowChangesDays = 1
-	startDate := time.Now().Add(-1 * 24 * time.Hour) // first time of yesterday
-	endDate := time.Now().Add(1 * 24 * time.Hour)    // last time of tomorrow
-	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+	loggerObj.On("Debug", "Load grant record [argocd]servicenow-grant-ar-uid-1")
+	loggerObj.On("Debug", expectedErrorText)
 
-	requestURI := p.getChangeRequestURI(cmdbCi, sysparmOffset)
+	grantRecord, err := p.loadGrantRecord(ar)
 
-	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	s.Nil(grantRecord, "No grant record expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow7Days() {
+func (s *K8SRelatedTestSuite) TestLoadGrantRecordIncorrectOtherChanges() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	testNewConfig(p)
 
-	cmdbCi := "id3"
-	sysparmOffset := 0
+	ar := testGetARForGrantRecord()
+	k8sclientset = testclient.NewClientset()
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CHG300031"}
+	expectedErrorText := "Grant record servicenow-grant-ar-uid-1 has 1 other change numbers, 0 other change sys_ids and 0 other change tables"
 
-	timeWindowChangesDays = 7
-	startDate := time.Now().Add(-7 * 24 * time.Hour) // first time of last week
-	endDate := time.Now().Add(7 * 24 * time.Hour)    // last time of next week
-	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
 
-	requestURI := p.getChangeRequestURI(cmdbCi, sysparmOffset)
+	p.storeGrantRecord(ar, grantRecord)
+	loadedGrantRecord, err := p.loadGrantRecord(ar)
 
-	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	s.Nil(loadedGrantRecord, "No grant record expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindowDifferentSysparmOffset() {
+func TestK8SRelated(t *testing.T) {
+	suite.Run(t, new(K8SRelatedTestSuite))
+}
+
+func (s *PluginHelperMethodsTestSuite) TestValidateConfig() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
-
-	cmdbCi := "cioffset"
-	sysparmOffset := 5
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
 
-	timeWindowChangesDays = 7
-	startDate := time.Now().Add(-7 * 24 * time.Hour) // first time of last week
-	endDate := time.Now().Add(7 * 24 * time.Hour)    // last time of next week
-	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+	err := p.validateConfig(config)
 
-	requestURI := p.getChangeRequestURI(cmdbCi, sysparmOffset)
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
 
-	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigWithErrors() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "example.com"
+	config.Timezone = "Mars/Olympus_Mons"
+	config.RevokeMode = "manual"
+
+	expectedURLErrorText := "Incorrect ServiceNow URL example.com (environment variable SERVICENOW_URL), use the format https://your-instance.service-now.com"
+	expectedTimezoneErrorText := "Unknown time zone Mars/Olympus_Mons (environment variable TIMEZONE), use f.e. UTC or Europe/Amsterdam"
+	expectedRevokeModeErrorText := "Unknown revoke mode manual (environment variable REVOKE_MODE), use scheduler or cronjob"
+	loggerObj.On("Error", expectedURLErrorText)
+	loggerObj.On("Error", expectedTimezoneErrorText)
+	loggerObj.On("Error", expectedRevokeModeErrorText)
+
+	err := p.validateConfig(config)
+
+	s.EqualError(err, expectedURLErrorText+"\n"+expectedTimezoneErrorText+"\n"+expectedRevokeModeErrorText, "All errors should be returned")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesOneChange() {
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigUnknownChangeSelectionPolicy() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.ChangeSelectionPolicy = "first"
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	expectedErrorText := "Unknown change selection policy first (environment variable CHANGE_SELECTION_POLICY), use latest-end, earliest-start, deny-when-ambiguous, explicit"
+	loggerObj.On("Error", expectedErrorText)
 
-	cmdbCi := "1chg"
+	err := p.validateConfig(config)
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "1"}]}`
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
 
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
-	loggerObj.On("Debug", "apiCall: "+apiCall)
-	loggerObj.On("Debug", responseText)
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigIncorrectCIClassAndPattern() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.CIClass = "cmdb_ci?name=app-demoapp"
+	config.CICorrelationIdPattern = "^(app-"
 
-	changes, number, errorText := p.getChanges(cmdbCi, sysparmOffset)
+	expectedCIClassErrorText := "Incorrect CI class cmdb_ci?name=app-demoapp (environment variable CI_CLASS), use the name of a CMDB table, f.e. cmdb_ci or cmdb_ci_appl"
+	expectedPatternErrorText := "Incorrect regular expression ^(app- (environment variable CI_CORRELATION_ID_PATTERN): error parsing regexp: missing closing ): `^(app-`"
+	loggerObj.On("Error", expectedCIClassErrorText)
+	loggerObj.On("Error", expectedPatternErrorText)
 
-	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
-	s.Equal(1, number, "Number should be incremented by the number of changes that are received")
-	s.Equal("", errorText, "No errors expected")
+	err := p.validateConfig(config)
 
+	s.EqualError(err, expectedCIClassErrorText+"\n"+expectedPatternErrorText, "All errors should be returned")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesTwoChanges() {
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigUnknownCIPolicy() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-
-	cmdbCi := "chg2"
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.CIPolicy = "some"
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "2"},
-                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00", "sys_id": "22"}]}`
+	expectedErrorText := "Unknown CI policy some (environment variable CI_POLICY), use any or every"
+	loggerObj.On("Error", expectedErrorText)
 
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
+	err := p.validateConfig(config)
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	serviceNowUrl = server.URL
-	defer server.Close()
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
 
-	apiCall := fmt.Sprintf("%s%s", serviceNowUrl, requestURI)
-	loggerObj.On("Debug", "apiCall: "+apiCall)
-	loggerObj.On("Debug", responseText)
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigIncorrectRequesterUserField() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.RequesterUserField = "email^active=false"
 
-	changes, newSysparmOffset, errorText := p.getChanges(cmdbCi, sysparmOffset)
+	expectedErrorText := "Incorrect user field email^active=false (environment variable REQUESTER_USER_FIELD), use the name of a field in sys_user, f.e. user_name or email"
+	loggerObj.On("Error", expectedErrorText)
 
-	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
-	s.Equal(2, newSysparmOffset, "SysparmOffset should be incremented by the number of changes that are received")
-	s.Equal("2", changes[0].SysId, "SysId should be incremented by the number of changes that are received")
-	s.Equal("CHG300031", changes[1].Number, "Change number should be the same as in the API result")
-	s.Equal("22", changes[1].SysId, "SysId should be the same as in the API result")
-	s.Equal("", errorText, "No errors expected")
+	err := p.validateConfig(config)
 
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesExactAPIWindowSize() {
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigIncorrectExclusionRecordTable() {
 	t := s.T()
-
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.ExclusionRecordTable = "incident/i1"
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	expectedErrorText := "Incorrect table incident/i1 (environment variable EXCLUSION_RECORD_TABLE), use the name of a table, f.e. incident or u_break_glass"
+	loggerObj.On("Error", expectedErrorText)
 
-	cmdbCi := "chg5"
+	err := p.validateConfig(config)
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "1"},
-                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00", "sys_id": "2"},
-                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00", "sys_id": "3"},
-                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00", "sys_id": "4"},
-                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00", "sys_id": "5"}]}`
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
 
-	loggerObj.On("Debug", mock.Anything)
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigExclusionPolicyWithoutExclusionRole() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.ExclusionRoles = []string{"incidentmanagers"}
+	config.ExclusionPolicies = map[string]ExclusionPolicy{"incidentmanager": {MaxDurationMinutes: 60}}
 
-	changes, newSysparmOffet, errorText := p.getChanges(cmdbCi, sysparmOffset)
+	expectedErrorText := "Error in exclusion-policies in configmap controller-cm: incidentmanager is not in exclusion-roles"
+	loggerObj.On("Error", expectedErrorText)
 
-	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
-	s.Equal(5, newSysparmOffet, "New sysparmOffset should be incremented by the number of changes that are received")
-	s.Equal("CHG300031", changes[1].Number, "Change number should be the same as in the API result")
-	s.Equal("CHG300032", changes[2].Number, "Change number should be the same as in the API result")
-	s.Equal("CHG300033", changes[3].Number, "Change number should be the same as in the API result")
-	s.Equal("CHG300034", changes[4].Number, "Change number should be the same as in the API result")
-	s.Equal("", errorText, "No errors expected")
+	err := p.validateConfig(config)
 
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesNoChange() {
+func (s *PluginHelperMethodsTestSuite) TestValidateConfigIncorrectIncidentPriority() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
-
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "https://example.com"
+	config.IncidentPriorities = []string{"1", "P2"}
 
-	cmdbCi := "ci1"
+	expectedErrorText := "Incorrect incident priority P2 (environment variable INCIDENT_PRIORITIES), use priorities from 1 to 5, f.e. 1,2"
+	loggerObj.On("Error", expectedErrorText)
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := "{\"result\":[]}"
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	err := p.validateConfig(config)
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Info", "No changes found")
+func (s *PluginHelperMethodsTestSuite) TestValidateSecretKeys() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
 
-	changes, newPointer, errorText := p.getChanges(cmdbCi, 0)
+	err := p.validateSecretKeys(config)
 
-	s.Equal(0, len(changes), "No changes should be found")
-	s.Equal(0, newPointer, "New value for offset should be 0")
-	s.Equal("No changes found", errorText, "Correct error text")
+	s.NoError(err, "No error expected")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesNoJSON() {
+func (s *PluginHelperMethodsTestSuite) TestValidateSecretKeysMissingKeys() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
-	testResetEnvVar()
-
-	responseText := "!"
-	expectedErrorText := "Error in json.Unmarshal: invalid character '!' looking for beginning of value (!)"
+	config := testNewConfig(p)
+	config.ServiceNowAuthMethod = AuthMethodOAuthPassword
+	config.ServiceNowPassword = ""
+	config.ServiceNowClientId = "testClientId"
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	expectedErrorText := "Secret servicenow-secret in namespace argocd-ephemeral-access has no value for password, client-secret (needed for authentication method oauth-password)"
+	loggerObj.On("Error", expectedErrorText)
 
-	cmdbCi := "ci5"
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	err := p.validateSecretKeys(config)
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Error", expectedErrorText)
+func (s *PluginHelperMethodsTestSuite) TestValidateSecretKeysClientCredentials() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowAuthMethod = AuthMethodOAuthClientCredentials
+	config.ServiceNowUsername = ""
+	config.ServiceNowPassword = ""
+	config.ServiceNowClientId = "testClientId"
+	config.ServiceNowClientSecret = "testClientSecret"
 
-	_, _, errorText := p.getChanges(cmdbCi, 0)
+	err := p.validateSecretKeys(config)
 
-	s.Equal(expectedErrorText, errorText, "Correct error text")
+	s.NoError(err, "Username and password are not needed for client credentials")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestGetChangesAPIServerDown() {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfig() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-
-	sysparmOffset := 0
-	cmdbCi := "ci6"
-	responseText := "<html><body>Server down!</body></html>"
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
+	exampleUrl := "https://example.com"
+	_ = os.Setenv("SERVICENOW_URL", exampleUrl)
 
-	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
-	expectedErrorText := "ServiceNow API server is down"
+	secretName := "servicenow-secret"
+	namespace := "argocd-ephemeral-access"
+	testUsername := "my-username"
+	testPassword := "my-password"
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "")
+	setSecret(namespace, secretName, testUsername, testPassword)
 
-	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
-	loggerObj.On("Debug", responseText)
-	loggerObj.On("Error", expectedErrorText)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	loggerObj.On("Debug", mock.Anything)
 
-	_, _, errorText := p.getChanges(cmdbCi, sysparmOffset)
-	s.Equal(expectedErrorText, errorText, "Correct error text")
+	unittest = true
+	config, err := p.loadConfig()
+
+	s.NoError(err, "Not expected error texts")
+	s.Equal(exampleUrl, config.ServiceNowUrl, "ServiceNow URL should be retrieved from environment variables")
+	s.Equal("UTC", config.Timezone, "Default timezone should be UTC")
+	s.Equal(namespace, config.Namespace, "Default namespace should be argocd-ephemeral-access")
+	s.Equal(secretName, config.SecretName, "Default secret name should be servicenow-secret")
+	s.Equal(testUsername, config.ServiceNowUsername, "ServiceNow username should be correct")
+	s.Equal(testPassword, config.ServiceNowPassword, "ServiceNow password should be correct")
+	s.Equal([]string{""}, config.ExclusionRoles, "Default for exclusion roles is empty")
+	s.Equal(RevokeModeScheduler, config.RevokeMode, "Default revoke mode should be scheduler")
+	s.Equal(60, config.ExpiryCheckIntervalSeconds, "Default expiry check interval should be 60 seconds")
+	s.Equal(0, config.GraceBeforeStartMinutes, "By default, there should be no grace period before the start of a change")
+	s.Equal(0, config.GraceAfterEndMinutes, "By default, there should be no grace period after the end of a change")
+	s.False(config.IncidentAccess, "By default, incidents should not give access")
+	s.Equal("incident-number", config.IncidentNumberKey, "Default incident number key should be incident-number")
+	s.Equal([]string{"1", "2"}, config.IncidentPriorities, "By default, incidents with priority 1 and 2 should give access")
+	s.Equal(240, config.IncidentAccessMinutes, "Default duration of incident access should be 4 hours")
+	s.Equal("cmdb_ci", config.CIClass, "Default CI class should be cmdb_ci")
+	s.Equal("", config.CICorrelationIdPattern, "Default correlation id pattern should be empty")
+	s.Equal(CIPolicyEvery, config.CIPolicy, "Default CI policy should be every")
+	s.Equal("argocd", config.ArgoCDNamespace, "Default Argo CD namespace should be argocd")
+	s.Nil(config.CIRelationTypes, "Default relation types should be empty")
+	s.Equal(0, config.CIRelationDepth, "By default, relations should not be followed")
+	s.False(config.ChangeAffectedCIs, "By default, affected CIs should not be used")
+	s.False(config.RequesterCheck, "By default, the requester should not be checked")
+	s.Equal("user_name", config.RequesterUserField, "Default user field should be user_name")
+	s.Empty(config.RequesterMapping, "Default requester mapping should be empty")
+	s.Empty(config.RolePolicies, "Default role policies should be empty")
+	s.False(config.BlackoutCheck, "By default, blackout schedules should not be checked")
+	s.False(config.ChangeTasks, "By default, change tasks should not be used")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *ChangeTestSuite) TestParseChange() {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigExclusionGroupsWithValue() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var change_servicenow = ChangeServiceNow{
-		Type:             "1",
-		Number:           "CHG12345",
-		EndDate:          "2025-05-16 23:59:59",
-		ShortDescription: "Test",
-		StartDate:        "2025-05-16 08:00:00",
-		SysId:            "sys_id",
-	}
+	exampleUrl := "https://example.com"
+	_ = os.Setenv("SERVICENOW_URL", exampleUrl)
 
-	debugText := fmt.Sprintf("Change: Type: %s, Number: %s, Short description: %s, Start Date: %s, End Date: %s, SysId: %s",
-		change_servicenow.Type,
-		change_servicenow.Number,
-		change_servicenow.ShortDescription,
-		change_servicenow.StartDate,
-		change_servicenow.EndDate,
-		change_servicenow.SysId)
-	loggerObj.On("Debug", debugText)
+	secretName := "servicenow-secret"
+	namespace := "argocd-ephemeral-access"
+	testUsername := "my-username"
+	testPassword := "my-password"
 
-	chg, errorText := p.parseChange(change_servicenow)
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
+	setSecret(namespace, secretName, testUsername, testPassword)
 
-	s.Equal(change_servicenow.Type, chg.Type, "Change type should be the same")
-	s.Equal(change_servicenow.Number, chg.Number, "Change number should be the same")
-	s.Equal(time.Date(2025, 05, 16, 23, 59, 59, 0, time.UTC), chg.EndDate, "Change end date should be the same")
-	s.Equal(change_servicenow.ShortDescription, chg.ShortDescription, "Change short description should be the same")
-	s.Equal(time.Date(2025, 05, 16, 8, 0, 0, 0, time.UTC), chg.StartDate, "Change start date should be the same")
-	s.Equal(change_servicenow.SysId, chg.SysId, "Change sys_id should be the same")
-	s.Equal("", errorText, "No errors expected")
-	loggerObj.AssertExpectations(t)
-}
+	loggerObj.On("Debug", mock.Anything)
 
-func TestChangeMethods(t *testing.T) {
-	suite.Run(t, new(ChangeTestSuite))
+	unittest = true
+	config, _ := p.loadConfig()
+
+	s.Equal([]string{"incidentmanagers"}, config.ExclusionRoles, "Exclusion roles should be correct")
+	loggerObj.AssertExpectations(t)
 }
 
-func testAllowedCIStatus(s *CheckCITestSuite, status string) {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigChangeEligibility() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var ci = CmdbServiceNow{
-		InstallStatus: status,
-		Name:          "whatever",
-	}
+	namespace := "my-namespace"
+	_ = os.Setenv("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", namespace)
+	testPrepareConfigEnvironment(namespace)
+	addToConfigMap(namespace, ExclusionsConfigMapName, "change-eligibility", "default: state=-1^approval=approved^risk!=1")
+
+	loggerObj.On("Debug", mock.Anything)
 
-	checkString := p.checkCI(ci)
+	config, err := p.loadConfig()
 
-	s.Equal("", checkString, "Installed state should be accepted")
+	s.NoError(err, "No error expected")
+	s.Equal("state=-1^approval=approved^risk!=1", config.ChangeEligibility.Default, "Change eligibility should be read from the configmap in the namespace of the extension")
 	loggerObj.AssertExpectations(t)
 }
 
-func testNotAllowedCIStatus(s *CheckCITestSuite, status string) {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigCIValidity() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	var ci = CmdbServiceNow{
-		InstallStatus: status,
-		Name:          "whatever",
-	}
+	namespace := "my-namespace"
+	_ = os.Setenv("EPHEMERAL_ACCESS_EXTENSION_NAMESPACE", namespace)
+	testPrepareConfigEnvironment(namespace)
+	addToConfigMap(namespace, ExclusionsConfigMapName, "ci-validity", "default:\n  installStatus: [\"1\"]")
+
+	loggerObj.On("Debug", mock.Anything)
 
-	checkString := p.checkCI(ci)
-	expectedCheckString := fmt.Sprintf("Invalid install status (%s) for CI whatever", status)
-	s.Equal(expectedCheckString, checkString, "Other states should not be accepted")
+	config, err := p.loadConfig()
 
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"1"}, config.CIValidity.Default.InstallStatus, "CI validity should be read from the configmap in the namespace of the extension")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *CheckCITestSuite) TestCheckCICorrectState() {
-	const installed = "1"
-	const inMaintenance = "3"
-	const pendingInstall = "4"
-	const pendingRepair = "5"
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigReadsConfigMapOnce() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	validStates := []string{installed, inMaintenance, pendingInstall, pendingRepair}
-	for _, state := range validStates {
-		testAllowedCIStatus(s, state)
-	}
-}
+	_ = os.Setenv("REVOKE_MODE", "cronjob")
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	clientset := k8sclientset.(*testclient.Clientset)
+	clientset.ClearActions()
 
-func (s *CheckCITestSuite) TestCheckCIInvalidState() {
-	invalidStates := []string{"0", "2", "6"}
-	for _, state := range invalidStates {
-		testNotAllowedCIStatus(s, state)
-	}
-}
+	loggerObj.On("Debug", mock.Anything)
 
-func TestCheckCI(t *testing.T) {
-	suite.Run(t, new(CheckCITestSuite))
+	_, err := p.loadConfig()
+
+	configMapReads := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "configmaps" {
+			configMapReads++
+		}
+	}
+	s.NoError(err, "No error expected")
+	s.Equal(1, configMapReads, "The configmap should be read once")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *CheckChangeTestSuite) TestCheckChangeCorrectTime() {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigTimeWindowChangesDaysZero() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	timezone = "UTC"
-	currentTime := time.Now()
-	startDate := currentTime.Add(-5 * time.Minute)
-	endDate := currentTime.Add(time.Hour * 2).Add(time.Microsecond * 50)
+	_ = os.Setenv("TIME_WINDOW_CHANGES_DAYS", "0")
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
 
-	var change = Change{
-		Type:             "1",
-		Number:           "CHG12345",
-		EndDate:          endDate,
-		ShortDescription: "Test",
-		StartDate:        startDate,
-	}
+	loggerObj.On("Debug", mock.Anything)
 
-	expectedErrorText := ""
+	config, err := p.loadConfig()
 
-	checkString, remainingTime := p.checkChange(change)
+	s.NoError(err, "A time window of 0 days should be allowed")
+	s.Equal(0, config.TimeWindowChangesDays, "Only changes of the current day should be searched")
+	loggerObj.AssertExpectations(t)
+}
 
-	expectedRemainingTime := time.Duration(time.Hour * 2).Truncate(time.Second)
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigIncorrectRevokeJobTemplate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	s.Equal(expectedErrorText, checkString, "Change that is started between start date and end date should be accepted")
-	s.Equal(expectedRemainingTime, remainingTime.Truncate(time.Second), "Remaining time should be correct")
+	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
+	_ = os.Setenv("REVOKE_MODE", "cronjob")
+
+	namespace := "argocd-ephemeral-access"
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "revoke-job-template", "spec: [this is not a pod spec")
+	setSecret(namespace, "servicenow-secret", "my-username", "my-password")
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	unittest = true
+	config, err := p.loadConfig()
+
+	s.Nil(config, "No configuration expected")
+	s.ErrorContains(err, "Error in revoke-job-template in configmap controller-cm: ", "Incorrect template should result in an error")
+	s.ErrorIs(err, ErrConfig, "Error should be a configuration error")
 	loggerObj.AssertExpectations(t)
 }
 
-func testChangeTimeIncorrect(s *CheckChangeTestSuite, currentTime time.Time, startDate time.Time, endDate time.Time, situation string) {
+func (s *PluginHelperMethodsTestSuite) TestLoadConfigReportsAllErrors() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	timezone = "UTC"
-
-	var change = Change{
-		Type:             "1",
-		Number:           "CHG12345",
-		EndDate:          endDate,
-		ShortDescription: "Test",
-		StartDate:        startDate,
-		SysId:            "1",
-	}
+	_ = os.Setenv("SERVICENOW_URL", "not a url")
+	_ = os.Setenv("TIMEZONE", "Mars/Olympus_Mons")
+	_ = os.Setenv("TIME_WINDOW_CHANGES_DAYS", "abc")
+	_ = os.Setenv("SERVICENOW_TIMEOUT_SECONDS", "0")
 
-	expectedErrorText := fmt.Sprintf("Change %s (%s) is not in the valid time range. start date: %s and end date: %s (current date: %s)",
-		change.Number,
-		change.ShortDescription,
-		p.getLocalTime(change.StartDate),
-		p.getLocalTime(change.EndDate),
-		p.getLocalTime(currentTime))
-	loggerObj.On("Debug", expectedErrorText)
+	namespace := "argocd-ephemeral-access"
+	k8sclientset = testclient.NewClientset()
+	setSecret(namespace, "servicenow-secret", "my-username", "")
 
-	checkString, _ := p.checkChange(change)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
 
-	assert.Equal(t, expectedErrorText, checkString, "Change that is started "+situation+" should not be accepted")
+	unittest = true
+	config, err := p.loadConfig()
+
+	s.Nil(config, "No configuration expected")
+	s.ErrorContains(err, "Incorrect value abc in environment variable TIME_WINDOW_CHANGES_DAYS: should be a number from 0 to 365", "Incorrect number should be reported")
+	s.ErrorContains(err, "Incorrect value 0 in environment variable SERVICENOW_TIMEOUT_SECONDS: should be a number from 1 to 600", "Number out of range should be reported")
+	s.ErrorContains(err, "Secret servicenow-secret in namespace argocd-ephemeral-access has no value for password", "Missing key should be reported")
+	s.ErrorContains(err, "Incorrect ServiceNow URL not a url", "Incorrect URL should be reported")
+	s.ErrorContains(err, "Unknown time zone Mars/Olympus_Mons", "Unknown time zone should be reported")
 	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareConfigEnvironment(namespace string) {
+	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
 
+	unittest = true
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
+	setSecret(namespace, "servicenow-secret", "my-username", "my-password")
 }
 
-func (s *CheckChangeTestSuite) TestCheckChangeTooEarly() {
-	currentTime := time.Now()
-	startDate := currentTime.Add(time.Hour)
-	endDate := currentTime.Add(time.Hour * 2)
+func (s *PluginHelperMethodsTestSuite) TestGetConfigWithoutConfig() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
 
-	testChangeTimeIncorrect(s, currentTime, startDate, endDate, "too early")
+	config := p.getConfig()
+
+	s.Equal(Config{}, *config, "Empty configuration expected when no configuration is loaded")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *CheckChangeTestSuite) TestCheckChangeTooLate() {
-	timezone = "UTC"
-	currentTime := time.Now()
-	startDate := currentTime.Add(-2 * time.Hour)
-	endDate := currentTime.Add(-1 * time.Hour)
+func (s *PluginHelperMethodsTestSuite) TestSetConfig() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
 
-	testChangeTimeIncorrect(s, currentTime, startDate, endDate, "too late")
+	config := &Config{ServiceNowUrl: "https://example.com"}
+	p.setConfig(config)
+
+	s.Same(config, p.getConfig(), "Stored configuration should be returned")
+	loggerObj.AssertExpectations(t)
 }
 
-func TestCheckChange(t *testing.T) {
-	suite.Run(t, new(CheckChangeTestSuite))
+func (s *PluginHelperMethodsTestSuite) TestReloadConfig() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	loggerObj.On("Debug", mock.Anything)
+
+	err := p.reloadConfig()
+
+	s.NoError(err, "No error expected")
+	s.Equal("https://example.com", p.getConfig().ServiceNowUrl, "ServiceNow URL should be loaded")
+	s.Equal("my-password", p.getConfig().ServiceNowPassword, "ServiceNow password should be loaded")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessCIWithValidCI() {
+func (s *PluginHelperMethodsTestSuite) TestReloadConfigKeepsPreviousConfig() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	previousConfig := testNewConfig(p)
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{Timeout: 30 * time.Second})
+	previousClient := previousConfig.ServiceNowClient
+	_ = os.Setenv("SERVICENOW_URL", "")
+	_ = os.Setenv("SERVICENOW_TIMEOUT_SECONDS", "5")
+
 	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", "No Service Now URL given (environment variable SERVICENOW_URL is empty)")
+	loggerObj.On("Warn", "Configuration is not reloaded, the previous configuration is still used")
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	err := p.reloadConfig()
 
-	ciName := "app-demoapp"
+	s.ErrorIs(err, ErrConfig, "Configuration error expected")
+	s.Same(previousConfig, p.getConfig(), "Previous configuration should be kept")
+	s.Same(previousClient, p.getServiceNowClient(), "Client of the previous configuration should be kept")
+	s.Equal(30*time.Second, p.getServiceNowClient().HttpClient.Timeout, "Timeout of the previous client should be kept")
+	loggerObj.AssertExpectations(t)
+}
 
-	requestURI := getTestCIRequestURI(ciName)
-	responseText := fmt.Sprintf(`{"result":[{"install_status":"1", "name":"%s", "sys_id": "1"}]}`, ciName)
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+func (s *PluginHelperMethodsTestSuite) TestReloadConfigConfigMapNotReadable() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	errorString, sysId := p.processCI(ciName)
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	previousConfig := testNewConfig(p)
+	testForbidConfigMapGet()
 
-	s.Equal("", errorString, "Errorstring should be empty")
-	s.Equal("1", sysId, "sys_id should be 1")
-	// Don't assert logging, is done in other tests
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", `Error getting configmap controller-cm in namespace argocd-ephemeral-access: configmaps "controller-cm" is forbidden: not allowed`)
+	loggerObj.On("Warn", "Configuration is not reloaded, the previous configuration is still used")
+
+	err := p.reloadConfig()
+
+	s.ErrorIs(err, ErrKubernetes, "Kubernetes error expected")
+	s.Same(previousConfig, p.getConfig(), "Previous configuration should be kept, the defaults should not be loaded")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessCIWithoutValidCI() {
+func (s *PluginHelperMethodsTestSuite) TestRequireConfigWithConfig() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	config := testNewConfig(p)
 
-	ciName := "app-demoapp"
-	requestURI := getTestCIRequestURI(ciName)
-	responseText := `{"result":[]}`
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	err := p.requireConfig()
+
+	s.NoError(err, "No error expected")
+	s.Same(config, p.getConfig(), "Configuration should not be loaded again")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRequireConfigWithoutConfig() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	expectedErrorText := fmt.Sprintf("No CI with name %s found", ciName)
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
 	loggerObj.On("Debug", mock.Anything)
-	loggerObj.On("Error", expectedErrorText)
 
-	errorString, sysId := p.processCI(ciName)
+	err := p.requireConfig()
 
-	s.Equal(expectedErrorText, errorString, "Errorstring should be correct")
-	s.Equal("", sysId, "sys_id should be empty")
-	// Don't assert logging, is done in other tests
+	s.NoError(err, "No error expected")
+	s.Equal("my-username", p.getConfig().ServiceNowUsername, "Configuration should be loaded")
+	loggerObj.AssertExpectations(t)
 }
 
-func getTestCIRequestURI(ciName string) string {
-	requestURI := fmt.Sprintf(`/api/now/table/cmdb_ci?name=%s&sysparm_fields=install_status,name,sys_id`, ciName)
-	return requestURI
+func (s *PluginHelperMethodsTestSuite) TestSelectServiceNowSecret() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = os.Setenv("SERVICENOW_SECRET_NAME", "my-secret")
+	options := metav1.ListOptions{}
+
+	p.selectServiceNowSecret(&options)
+
+	s.Equal("metadata.name=my-secret", options.FieldSelector, "Only the secret of the plugin should be watched")
+	loggerObj.AssertExpectations(t)
 }
 
-func getTestChangeRequestURI(cmdbCi string, sysparmOffset int) string {
+func (s *PluginHelperMethodsTestSuite) TestSelectControllerConfigMap() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
 
-	// I know, next part is awful.
-	//
-	// Reason: search for start_date > 2025-05-20 00:00:00 and end_date < 2025-05-22 23:59:59 is not possible without sysparm_query,
-	// and to make it possible you need to use %20 for space, %5e for ^, etc.
-	//
-	// When we can search for number=CHG0030002 we don't need the time window anymore and then this part will be better
-	// readable.
-	//
-	// Sorry for now!
+	options := metav1.ListOptions{}
 
-	startDate := time.Now().Add(-1 * time.Hour * 24 * time.Duration(timeWindowChangesDays))
-	startYear := startDate.Year()
-	startMonth := startDate.Month()
-	startDay := startDate.Day()
+	p.selectControllerConfigMap(&options)
 
-	endDate := time.Now().Add(+1 * time.Hour * 24 * time.Duration(timeWindowChangesDays))
-	endYear := endDate.Year()
-	endMonth := endDate.Month()
-	endDay := endDate.Day()
+	s.Equal("metadata.name=controller-cm", options.FieldSelector, "Only the controller-cm configmap should be watched")
+	loggerObj.AssertExpectations(t)
+}
 
-	requestURIBegin := "/api/now/table/change_request?sysparm_query=cmdb_ci%3d" + cmdbCi + "%5estate%3d%2d1%5ephase%3drequested%5eapproval%3dapproved%5eactive%3dtrue%5eGOTOstart_date%3e"
-	startDateURI := fmt.Sprintf("%04d%%2d%02d%%2d%02d", startYear, startMonth, startDay)
-	endDateURI := fmt.Sprintf("%04d%%2d%02d%%2d%02d", endYear, endMonth, endDay)
-	requestURIEndDate := "%2000%3a00%3a00%5eGOTOend_date%3c"
-	requestURIRest := "%2023%3a59%3a59&sysparm_fields=type,number,short_description,start_date,end_date,sys_id&sysparm_limit=5&sysparm_offset="
+func (s *PluginHelperMethodsTestSuite) TestOnConfigObjectAddedExistingObject() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
 
-	sysparmOffsetString := fmt.Sprintf("%d", sysparmOffset)
-	requestURI := requestURIBegin + startDateURI + requestURIEndDate + endDateURI + requestURIRest + sysparmOffsetString
+	p.onConfigObjectAdded(&coreV1.Secret{}, true)
 
-	return requestURI
+	s.Equal(Config{}, *p.getConfig(), "Configuration should not be loaded for the initial list")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithChange() {
+func (s *PluginHelperMethodsTestSuite) TestOnConfigObjectAdded() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	timezone = "UTC"
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Configuration object added, reload configuration")
 
-	currentTime := time.Now()
-	startDate := currentTime.Add(-5 * time.Minute)
-	endDate := currentTime.Add(time.Hour * 2)
+	p.onConfigObjectAdded(&coreV1.Secret{}, false)
 
-	cmdbCi := "a7b5e1"
-	ciName := "app-demoapp"
-	sysparmOffset := 0
+	s.Equal("my-username", p.getConfig().ServiceNowUsername, "Configuration should be loaded")
+	loggerObj.AssertExpectations(t)
+}
 
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"%s", "end_date":"%s", "sys_id": "1"}]}`,
-		testConvertTimeToString(startDate),
-		testConvertTimeToString(endDate))
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+func (s *PluginHelperMethodsTestSuite) TestOnConfigObjectUpdated() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	testNewConfig(p)
 	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Configuration object changed, reload configuration")
 
-	errorString, changeRemainingTime, validChange := p.processChanges(ciName, cmdbCi)
-
-	s.Equal("", errorString, "Errorstring should be empty")
-	if changeRemainingTime.Minutes() < 40 {
-		s.Fail("changeRemainingTime is too small, less than 40 minutes")
-	}
+	p.onConfigObjectUpdated(&coreV1.ConfigMap{}, &coreV1.ConfigMap{})
 
-	s.Equal("CHG300030", validChange.Number, "Numbers must be equal")
-	s.Equal("test", validChange.ShortDescription, "Short descriptions must be equal")
-	// Don't assert logging, is done in other tests
+	s.Equal([]string{"incidentmanagers"}, p.getConfig().ExclusionRoles, "Configuration should be reloaded")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithoutChange() {
+func (s *PluginHelperMethodsTestSuite) TestOnConfigObjectDeleted() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	timezone = "UTC"
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	previousConfig := testNewConfig(p)
+	_ = k8sclientset.CoreV1().Secrets("argocd-ephemeral-access").Delete(context.TODO(), "servicenow-secret", metav1.DeleteOptions{})
 
-	sysparmOffset := 0
-	ciName := "app-demoapp1"
-	cmdbCi := "a7b5e2"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Configuration object deleted, reload configuration")
+	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Warn", "Configuration is not reloaded, the previous configuration is still used")
 
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[]}`
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	p.onConfigObjectDeleted(&coreV1.Secret{})
 
-	expectedInfoString := "No changes found"
+	s.Same(previousConfig, p.getConfig(), "Previous configuration should be kept when the secret is deleted")
+	loggerObj.AssertExpectations(t)
+}
 
+func (s *PluginHelperMethodsTestSuite) TestWatchConfig() {
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd-ephemeral-access"
+	testPrepareConfigEnvironment(namespace)
 	loggerObj.On("Debug", mock.Anything)
-	loggerObj.On("Info", expectedInfoString)
+	loggerObj.On("Info", mock.Anything)
 
-	errorString, _, _ := p.processChanges(ciName, cmdbCi)
+	_ = p.reloadConfig()
+	s.Equal("my-password", p.getConfig().ServiceNowPassword, "Initial password expected")
 
-	s.Equal(expectedInfoString, errorString, "Errorstring should be correct")
+	stop := make(chan struct{})
+	defer close(stop)
 
-	// Don't assert logging, is done in other tests
+	err := p.watchConfig(stop)
+	s.NoError(err, "No error expected")
+
+	secret, _ := k8sclientset.CoreV1().Secrets(namespace).Get(context.TODO(), "servicenow-secret", metav1.GetOptions{})
+	secret.Data["password"] = []byte("new-password")
+	secret.ResourceVersion = "2"
+	_, _ = k8sclientset.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+
+	// The change is handled in the background
+	s.Eventually(func() bool {
+		return p.getConfig().ServiceNowPassword == "new-password"
+	}, 5*time.Second, 50*time.Millisecond, "Changed password should be loaded without a restart")
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithOneInvalidChange() {
+func (s *PluginHelperMethodsTestSuite) TestWatchConfigSyncTimeout() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	timezone = "UTC"
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-
-	sysparmOffset := 0
-	ciName := "app-demoapp1"
-	cmdbCi := "a7b5e2"
+	originalTimeout := configSyncTimeout
+	configSyncTimeout = 100 * time.Millisecond
+	defer func() { configSyncTimeout = originalTimeout }()
 
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00", "sys_id": "abc123def567"}]}`
-	var responseMap = make(map[string]string)
-	responseMap[requestURI] = responseText
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	defer server.Close()
-	serviceNowUrl = server.URL
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	clientset := k8sclientset.(*testclient.Clientset)
+	clientset.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("secrets is forbidden")
+	})
 
-	expectedInfoString := "No valid change found"
+	expectedErrorText := "Timeout waiting for the first list of *v1.Secret in namespace argocd-ephemeral-access after 100ms"
 
 	loggerObj.On("Debug", mock.Anything)
-	loggerObj.On("Info", expectedInfoString)
+	loggerObj.On("Error", expectedErrorText)
 
-	errorString, _, _ := p.processChanges(ciName, cmdbCi)
+	stop := make(chan struct{})
+	defer close(stop)
 
-	s.Equal(expectedInfoString, errorString, "Errorstring should be correct")
+	err := p.watchConfig(stop)
 
-	// Don't assert logging, is done in other tests
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrKubernetes, "Kubernetes error expected")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessChangesTwoAPIWindowsWithValidChange() {
+func (s *PluginHelperMethodsTestSuite) TestShowRequest() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	timezone = "UTC"
+	var ar = new(api.AccessRequest)
+	var app = new(argocd.Application)
 
-	currentTime := time.Now()
-	startDate := currentTime.Add(-5 * time.Minute)
-	endDate := currentTime.Add(time.Hour * 2)
+	ar.Spec.Subject.Username = "Testuser"
+	ar.Spec.Role.TemplateRef.Name = "administrator"
+	ar.Spec.Application.Namespace = "argocd"
+	ar.Spec.Application.Name = "demoapp"
+	ar.Spec.Duration.Duration = time.Hour * 4
 
-	ciName := "app-demoapp2"
-	cmdbCi := "ci1"
+	jsonAr, _ := json.Marshal(ar)
+	jsonApp, _ := json.Marshal(app)
 
-	var responseMap = make(map[string]string)
+	loggerObj.On("Info", "Call to GrantAccess: username: Testuser, role: administrator, application: [argocd]demoapp, duration: 4h0m0s")
+	loggerObj.On("Debug", "jsonAr: "+string(jsonAr))
+	loggerObj.On("Debug", "jsonApp: "+string(jsonApp))
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00","sys_id": "abc123def561"},
-                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00","sys_id": "abc123def562"},
-                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00","sys_id": "abc123def563"},
-                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00","sys_id": "abc123def564"},
-                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00","sys_id": "abc123def565"}]}`
+	p.showRequest(ar, app)
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetARWithHistory(details ...string) *api.AccessRequest {
+	var ar = new(api.AccessRequest)
+	ar.Name = "test-ar"
+
+	ar.UpdateStatusHistory(api.RequestedStatus, "")
+	for _, detail := range details {
+		ar.UpdateStatusHistory(api.GrantedStatus, detail)
+	}
+
+	return ar
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetGrantedChangeNumberWithChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar := testGetARWithHistory("Granted access: change __CHG300030__ (valid change), until __2025-05-20 23:59:59 (1h0m0s)__")
+
+	loggerObj.On("Debug", "Change number found in history of access request test-ar: CHG300030")
+
+	changeNumber := p.getGrantedChangeNumber(ar)
+
+	s.Equal("CHG300030", changeNumber, "Change number should be found in the history")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetGrantedChangeNumberUsesLastGrant() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar := testGetARWithHistory("Granted access: change __CHG300030__ (first change), until __2025-05-20 23:59:59 (1h0m0s)__",
+		"Granted access: change __CHG300031__ (second change), until __2025-05-21 23:59:59 (1h0m0s)__")
+
+	loggerObj.On("Debug", "Change number found in history of access request test-ar: CHG300031")
+
+	changeNumber := p.getGrantedChangeNumber(ar)
+
+	s.Equal("CHG300031", changeNumber, "Change number of the last grant should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetGrantedChangeNumberExclusionRole() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar := testGetARWithHistory("Granted access: incidentmanagers is an exclusion role, until __2025-05-20 23:59:59 (1h0m0s)__")
+
+	loggerObj.On("Debug", "Change number found in history of access request test-ar: ")
+
+	changeNumber := p.getGrantedChangeNumber(ar)
+
+	s.Equal("", changeNumber, "No change number for exclusion roles")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetGrantedChangeNumberNotGranted() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar := testGetARWithHistory()
+
+	loggerObj.On("Debug", "Change number found in history of access request test-ar: ")
+
+	changeNumber := p.getGrantedChangeNumber(ar)
+
+	s.Equal("", changeNumber, "No change number when access was never granted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRevokeJobName() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	s.Equal("stop-test-ar", p.getRevokeJobName("test-ar"), "Job name should start with stop-")
+	s.Equal("stop-test-ar-1", p.getRevokeJobName("test-ar.1"), "Dots should be replaced by dashes")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRevokeJobPodTemplateDefault() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.RevokeJobTemplate = nil
+	config.RevokeJobImage = "bitnami/kubectl:latest"
+	config.RevokeJobServiceAccount = "remove-accessrequest-job-sa"
+
+	template := p.getRevokeJobPodTemplate("stop-test-ar", "echo test")
+
+	s.Equal("remove-accessrequest-job-sa", template.Spec.ServiceAccountName, "Default service account should be used")
+	s.Equal("stop-test-ar", template.Spec.Containers[0].Name, "Container name should be the job name")
+	s.Equal("bitnami/kubectl:latest", template.Spec.Containers[0].Image, "Default image should be used")
+	s.Equal([]string{"sh", "-c", "echo test"}, template.Spec.Containers[0].Command, "Command should be set")
+	s.Equal(coreV1.RestartPolicyNever, template.Spec.RestartPolicy, "Restart policy should be never")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRevokeJobPodTemplateWithTemplate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	runAsNonRoot := true
+	config.RevokeJobImage = "bitnami/kubectl:latest"
+	config.RevokeJobServiceAccount = "remove-accessrequest-job-sa"
+	config.RevokeJobTemplate = &coreV1.PodTemplateSpec{
+		Spec: coreV1.PodSpec{
+			ServiceAccountName: "my-sa",
+			NodeSelector:       map[string]string{"kubernetes.io/os": "linux"},
+			SecurityContext:    &coreV1.PodSecurityContext{RunAsNonRoot: &runAsNonRoot},
+			Containers: []coreV1.Container{
+				{
+					Image:   "registry.example.com/kubectl:1.33.2",
+					Command: []string{"overwritten"},
+				},
+			},
+		},
+	}
+
+	template := p.getRevokeJobPodTemplate("stop-test-ar", "echo test")
+
+	s.Equal("my-sa", template.Spec.ServiceAccountName, "Service account of the template should be used")
+	s.Equal("linux", template.Spec.NodeSelector["kubernetes.io/os"], "Node selector of the template should be used")
+	s.Equal(&runAsNonRoot, template.Spec.SecurityContext.RunAsNonRoot, "Security context of the template should be used")
+	s.Equal("stop-test-ar", template.Spec.Containers[0].Name, "Container name should be the job name")
+	s.Equal("registry.example.com/kubectl:1.33.2", template.Spec.Containers[0].Image, "Image of the template should be used")
+	s.Equal([]string{"sh", "-c", "echo test"}, template.Spec.Containers[0].Command, "Command should always be set by the plugin")
+	s.Equal([]string{"overwritten"}, config.RevokeJobTemplate.Spec.Containers[0].Command, "Template itself should not be changed")
+	loggerObj.AssertExpectations(t)
+
+	config.RevokeJobTemplate = nil
+}
+
+func testConvertTimeToString(t time.Time) string {
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateRevokeJobCorrect() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	namespace := "argocd"
+	accessRequestName := "test-ar"
+	jobStartTime := time.Now().Add(-1 * time.Minute)
+	expectedJobName := "stop-" + accessRequestName
+
+	k8sclientset = testclient.NewClientset()
+	config.RevokeJobTemplate = nil
+	config.RevokeJobImage = "bitnami/kubectl:latest"
+	config.RevokeJobServiceAccount = "remove-accessrequest-job-sa"
+
+	loggerObj.On("Debug", fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessRequestName))
+	loggerObj.On("Info", fmt.Sprintf("Created K8s job %s successfully in namespace argocd", expectedJobName))
+
+	p.createRevokeJob(namespace, accessRequestName, jobStartTime)
+
+	expectedSchedule := fmt.Sprintf("%d %d %d %d *",
+		jobStartTime.Minute(),
+		jobStartTime.Hour(),
+		jobStartTime.Day(),
+		jobStartTime.Month())
+	expectedCommand := []string{"sh", "-c", fmt.Sprintf("kubectl delete accessrequest -n argocd %s && kubectl delete cronjob -n argocd %s", accessRequestName, expectedJobName)}
+	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+	myCronJob, err := cronjobs.Get(context.TODO(), expectedJobName, metav1.GetOptions{})
+
+	var zero int32 = 0
+
+	s.Equal(expectedJobName, myCronJob.Name, "Name should be the correct job name")
+	s.Equal(namespace, myCronJob.Namespace, "Namespace should be the correct namespace")
+	s.Equal(expectedSchedule, myCronJob.Spec.Schedule, "Schedule should be the correct schedule")
+	s.Equal("remove-accessrequest-job-sa", myCronJob.Spec.JobTemplate.Spec.Template.Spec.ServiceAccountName, "Service account name should be the correct service account name")
+	s.Equal(expectedJobName, myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Name, "Container name should be the correct container name")
+	s.Equal("bitnami/kubectl:latest", myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image, "Image should be the correct image")
+	s.Equal(expectedCommand, myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Command, "Image should be the correct image")
+	s.Equal(coreV1.RestartPolicyNever, myCronJob.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy, "Restart policy should be never")
+	s.Equal(&zero, myCronJob.Spec.JobTemplate.Spec.BackoffLimit, "BackoffLimit should be 0")
+
+	s.Equal(nil, err, "No errors expected")
+
+	loggerObj.AssertExpectations(t)
+	_ = cronjobs.Delete(context.TODO(), expectedJobName, metav1.DeleteOptions{})
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateRevokeJobOtherNamespace() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	namespace := "team-a"
+	accessRequestName := "test-ar"
+	expectedJobName := "stop-" + accessRequestName
+
+	k8sclientset = testclient.NewClientset()
+	config.RevokeJobTemplate = nil
+
+	loggerObj.On("Debug", fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessRequestName))
+	loggerObj.On("Info", fmt.Sprintf("Created K8s job %s successfully in namespace team-a", expectedJobName))
+
+	p.createRevokeJob(namespace, accessRequestName, time.Now())
+
+	expectedCommand := []string{"sh", "-c", "kubectl delete accessrequest -n team-a test-ar && kubectl delete cronjob -n team-a stop-test-ar"}
+	myCronJob, err := k8sclientset.BatchV1().CronJobs(namespace).Get(context.TODO(), expectedJobName, metav1.GetOptions{})
+
+	s.Equal(nil, err, "CronJob should be created in the namespace of the access request")
+	s.Equal(expectedCommand, myCronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Command, "Command should use the namespace of the access request")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateRevokeJobFail() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd"
+	accessRequestName := "test-ar"
+	jobStartTime := time.Now().Add(-1 * time.Minute)
+	expectedJobName := "stop-" + accessRequestName
+
+	k8sclientset = testclient.NewClientset()
+
+	loggerObj.On("Debug", fmt.Sprintf("createRevokeJob: %s, %s", namespace, accessRequestName))
+	loggerObj.On("Error", fmt.Sprintf("Failed to create K8s job %s in namespace argocd: cronjobs.batch \"stop-test-ar\" already exists.", expectedJobName))
+
+	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+	cronJobSpec := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      expectedJobName,
+			Namespace: namespace,
+		},
+	}
+	_, _ = cronjobs.Create(context.TODO(), cronJobSpec, metav1.CreateOptions{})
+
+	p.createRevokeJob(namespace, accessRequestName, jobStartTime)
+
+	loggerObj.AssertExpectations(t)
+	_ = cronjobs.Delete(context.TODO(), expectedJobName, metav1.DeleteOptions{})
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDeleteRevokeJobCorrect() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd"
+	accessRequestName := "test-ar"
+	expectedJobName := "stop-" + accessRequestName
+
+	k8sclientset = testclient.NewClientset()
+	cronjobs := k8sclientset.BatchV1().CronJobs(namespace)
+	cronJobSpec := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      expectedJobName,
+			Namespace: namespace,
+		},
+	}
+	_, _ = cronjobs.Create(context.TODO(), cronJobSpec, metav1.CreateOptions{})
+
+	loggerObj.On("Debug", fmt.Sprintf("deleteRevokeJob: %s, %s", namespace, accessRequestName))
+	loggerObj.On("Info", fmt.Sprintf("Deleted K8s job %s successfully in namespace argocd", expectedJobName))
+
+	p.deleteRevokeJob(namespace, accessRequestName)
+
+	_, err := cronjobs.Get(context.TODO(), expectedJobName, metav1.GetOptions{})
+	s.True(k8serrors.IsNotFound(err), "CronJob should be deleted")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDeleteRevokeJobDoesntExist() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd"
+	accessRequestName := "test-ar"
+	expectedJobName := "stop-" + accessRequestName
+
+	k8sclientset = testclient.NewClientset()
+
+	loggerObj.On("Debug", fmt.Sprintf("deleteRevokeJob: %s, %s", namespace, accessRequestName))
+	loggerObj.On("Debug", fmt.Sprintf("No K8s job %s found in namespace argocd, nothing to delete", expectedJobName))
+
+	p.deleteRevokeJob(namespace, accessRequestName)
+
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetDynamicClient(objects ...runtime.Object) dynamic.Interface {
+	listKinds := map[schema.GroupVersionResource]string{
+		accessRequestResource: "AccessRequestList",
+		appProjectResource:    "AppProjectList",
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+func testGetUnstructuredAR(namespace string, name string, uid string) *unstructured.Unstructured {
+	ar := &unstructured.Unstructured{}
+	ar.SetAPIVersion(api.GroupVersion.String())
+	ar.SetKind("AccessRequest")
+	ar.SetNamespace(namespace)
+	ar.SetName(name)
+	ar.SetUID(k8stypes.UID(uid))
+
+	return ar
+}
+
+func testStoreGrantRecordForScheduler(namespace string, name string, uid string, grantRecord GrantRecord) *coreV1.ConfigMap {
+	var ar = new(api.AccessRequest)
+	ar.Name = name
+	ar.Namespace = namespace
+	ar.UID = k8stypes.UID(uid)
+
+	grantRecord.AccessRequestName = name
+
+	p, loggerObj := testGetPlugin()
+	loggerObj.On("Debug", mock.Anything)
+	p.storeGrantRecord(ar, grantRecord)
+
+	configMap, _ := k8sclientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), p.getGrantRecordName(ar), metav1.GetOptions{})
+	return configMap
+}
+
+func testGetGrantRecordForScheduler(endTime time.Time, expireByPlugin bool) GrantRecord {
+	grantRecord := testGetGrantRecord()
+	grantRecord.EndTime = endTime
+	grantRecord.ExpireByPlugin = expireByPlugin
+
+	return grantRecord
+}
+
+func (s *PluginHelperMethodsTestSuite) TestWakeExpiryScheduler() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	// A second wake up should not block when the scheduler didn't process the first one yet
+	p.wakeExpiryScheduler()
+	p.wakeExpiryScheduler()
+
+	s.Equal(1, len(expirySchedulerWakeup), "Exactly one wake up should be pending")
+	<-expirySchedulerWakeup
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestIsGrantRecordOwner() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	k8sclientset = testclient.NewClientset()
+	configMap := testStoreGrantRecordForScheduler("argocd", "test-ar", "ar-uid-1", testGetGrantRecord())
+
+	s.True(p.isGrantRecordOwner(configMap, testGetUnstructuredAR("argocd", "test-ar", "ar-uid-1")), "Access request should be the owner")
+	s.False(p.isGrantRecordOwner(configMap, testGetUnstructuredAR("argocd", "test-ar", "ar-uid-2")), "Access request with the same name but another UID should not be the owner")
+	s.False(p.isGrantRecordOwner(configMap, testGetUnstructuredAR("argocd", "other-ar", "ar-uid-1")), "Access request with another name should not be the owner")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestIsGrantRecordOwnerWithoutOwnerReference() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "servicenow-grant-ar-uid-1",
+			Namespace: "argocd",
+			Labels:    map[string]string{GrantRecordLabel: "true"},
+		},
+	}
+
+	s.False(p.isGrantRecordOwner(configMap, testGetUnstructuredAR("argocd", "test-ar", "ar-uid-1")), "A configmap without owner should not be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAR(namespace, "test-ar", "ar-uid-1"))
+	configMap := testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", testGetGrantRecord())
+
+	requestURI := "/api/now/table/change_request/1"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = `{"whatever":"true"}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	p.expireAccessRequest(configMap, testGetGrantRecord())
+
+	_, err := k8sdynamicclient.Resource(accessRequestResource).Namespace(namespace).Get(context.TODO(), "test-ar", metav1.GetOptions{})
+	s.True(k8serrors.IsNotFound(err), "Access request should be deleted")
+	_, err = k8sclientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configMap.Name, metav1.GetOptions{})
+	s.True(k8serrors.IsNotFound(err), "Grant record should be deleted, so the note is not added again")
+	loggerObj.AssertCalled(t, "Info", "Deleted access request test-ar successfully in namespace argocd")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+config.ServiceNowUrl+requestURI)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequestWithOtherChanges() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	namespace := "argocd"
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAR(namespace, "test-ar", "ar-uid-1"))
+
+	var responseMap = make(map[string]string)
+	responseMap["/api/now/table/change_request/1"] = `{"whatever":"true"}`
+	responseMap["/api/now/table/change_task/2"] = `{"whatever":"true"}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CTASK0010001"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{TableChangeTask}
+	configMap := testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", grantRecord)
+	p.expireAccessRequest(configMap, grantRecord)
+
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+config.ServiceNowUrl+"/api/now/table/change_request/1")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+config.ServiceNowUrl+"/api/now/table/change_task/2")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequestDoesntExist() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient()
+	configMap := testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", testGetGrantRecord())
+
+	loggerObj.On("Debug", "Access request test-ar not found in namespace argocd, nothing to delete")
+
+	p.expireAccessRequest(configMap, testGetGrantRecord())
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequestOtherOwner() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAR(namespace, "test-ar", "ar-uid-2"))
+	configMap := testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", testGetGrantRecord())
+
+	loggerObj.On("Warn", "Grant record servicenow-grant-ar-uid-1 in namespace argocd doesn't belong to access request test-ar, grant record is ignored")
+
+	p.expireAccessRequest(configMap, testGetGrantRecord())
+
+	_, err := k8sdynamicclient.Resource(accessRequestResource).Namespace(namespace).Get(context.TODO(), "test-ar", metav1.GetOptions{})
+	s.NoError(err, "Access request of another grant record should not be deleted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequestBeingDeleted() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	ar := testGetUnstructuredAR(namespace, "test-ar", "ar-uid-1")
+	deletionTime := metav1.Now()
+	ar.SetDeletionTimestamp(&deletionTime)
+	ar.SetFinalizers([]string{"ephemeral-access.argoproj-labs.io/finalizer"})
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(ar)
+	configMap := testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", testGetGrantRecord())
+
+	loggerObj.On("Debug", "Access request test-ar in namespace argocd is already being deleted")
+
+	p.expireAccessRequest(configMap, testGetGrantRecord())
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequests() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	config.ExpiryCheckIntervalSeconds = 60
+	futureEndTime := time.Now().Add(10 * time.Second).Truncate(time.Second)
+
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(
+		testGetUnstructuredAR(namespace, "ar-ended", "uid-ended"),
+		testGetUnstructuredAR(namespace, "ar-running", "uid-running"),
+		testGetUnstructuredAR(namespace, "ar-by-extension", "uid-by-extension"))
+	testStoreGrantRecordForScheduler(namespace, "ar-ended", "uid-ended", testGetGrantRecordForScheduler(time.Now().Add(-1*time.Minute), true))
+	testStoreGrantRecordForScheduler(namespace, "ar-running", "uid-running", testGetGrantRecordForScheduler(futureEndTime, true))
+	testStoreGrantRecordForScheduler(namespace, "ar-by-extension", "uid-by-extension", testGetGrantRecordForScheduler(time.Now().Add(-1*time.Minute), false))
+
+	var responseMap = make(map[string]string)
+	responseMap["/api/now/table/change_request/1"] = `{"whatever":"true"}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	nextCheck := p.expireAccessRequests()
+
+	accessRequests := k8sdynamicclient.Resource(accessRequestResource).Namespace(namespace)
+	_, err := accessRequests.Get(context.TODO(), "ar-ended", metav1.GetOptions{})
+	s.True(k8serrors.IsNotFound(err), "Access request with end time in the past should be deleted")
+	_, err = accessRequests.Get(context.TODO(), "ar-running", metav1.GetOptions{})
+	s.Equal(nil, err, "Access request with end time in the future should not be deleted")
+	_, err = accessRequests.Get(context.TODO(), "ar-by-extension", metav1.GetOptions{})
+	s.Equal(nil, err, "Access request that is expired by the extension should not be deleted")
+	s.True(futureEndTime.Equal(nextCheck), "Next check should be at the earliest end time in the future")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestExpireAccessRequestsIncorrectGrantRecord() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	namespace := "argocd"
+	config.ExpiryCheckIntervalSeconds = 60
+
+	grantRecord := testGetGrantRecordForScheduler(time.Now().Add(-1*time.Minute), true)
+	grantRecord.ChangeTable = "sys_user"
+
+	k8sclientset = testclient.NewClientset()
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAR(namespace, "test-ar", "ar-uid-1"))
+	testStoreGrantRecordForScheduler(namespace, "test-ar", "ar-uid-1", grantRecord)
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", "Grant record servicenow-grant-ar-uid-1 has an unknown table sys_user")
+
+	p.expireAccessRequests()
+
+	_, err := k8sdynamicclient.Resource(accessRequestResource).Namespace(namespace).Get(context.TODO(), "test-ar", metav1.GetOptions{})
+	s.NoError(err, "Access request of an incorrect grant record should not be deleted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRunExpiryScheduler() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	k8sdynamicclient = testGetDynamicClient()
+
+	stop := make(chan struct{})
+	close(stop)
+
+	p.runExpiryScheduler(stop)
+
+	loggerObj.AssertCalled(t, "Info", "Expiry scheduler started")
+	loggerObj.AssertCalled(t, "Info", "Expiry scheduler stopped")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineDurationAndRealEndTimeChangeTimeWins() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var arDuration = 4 * time.Hour
+	var changeRemainingTime = 1 * time.Hour
+	var endDate = time.Now().Add(1 * time.Hour)
+
+	duration, realEndTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, endDate)
+
+	s.Equal(changeRemainingTime, duration, "Expected duration: 1 hour")
+	s.Equal(endDate, realEndTime, "Expected end time: 1 hour from now")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineDurationAndRealEndTimeArDurationWins() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var arDuration = 4 * time.Hour
+	var changeRemainingTime = (8 * time.Hour) + (time.Microsecond * 50)
+	var endDate = time.Now().Add(8 * time.Hour)
+
+	var expectedRealEndTime = time.Now().Add(4 * time.Hour).Truncate(time.Second)
+
+	duration, realEndTime := p.determineDurationAndRealEndTime(arDuration, changeRemainingTime, endDate)
+
+	s.Equal(arDuration, duration, "Expected duration: 4 hour")
+	s.Equal(expectedRealEndTime, realEndTime.Truncate(time.Second), "Expected end time: 4 hour from now")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetGraceText() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	s.Equal("", p.getGraceText(ChangeFilter{}), "Without grace periods, no text is expected")
+	s.Equal(", with a grace period of 15m0s before the start", p.getGraceText(ChangeFilter{GraceBeforeStart: 15 * time.Minute}), "Only the grace period before the start is expected")
+	s.Equal(", with a grace period of 15m0s before the start and 10m0s after the end", p.getGraceText(ChangeFilter{GraceBeforeStart: 15 * time.Minute, GraceAfterEnd: 10 * time.Minute}), "Both grace periods are expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	requesterName := "TestUser"
+	requestedRole := "admin"
+	var validChange Change
+
+	validChange.Type = "1"
+	validChange.Number = "CHG300300"
+	validChange.ShortDescription = "unittests"
+	validChange.EndDate = time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
+	realEndDate := time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
+
+	var remainingTime = 1 * time.Hour
+	expectedGrantedAccessText := fmt.Sprintf("Granted access for %s: %s change %s (%s), role %s, from %s to %s",
+		requesterName,
+		validChange.Type,
+		validChange.Number,
+		validChange.ShortDescription,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Second).String())
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: change __%s__ (%s), until __%s (%s)__",
+		validChange.Number,
+		validChange.ShortDescription,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+	expectedGrantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to %s, for role %s, until %s (%s)",
+		requesterName,
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	loggerObj.On("Info", expectedGrantedAccessText)
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText, grantedAccessServiceNowText := p.determineGrantedTextsChange(requesterName, requestedRole, validChange, remainingTime, realEndDate, ChangeFilter{})
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
+	s.Equal(expectedGrantedAccessServiceNowText, grantedAccessServiceNowText, "Granted access text for ServiceNow should be what is expected")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsChangeWithGracePeriod() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	validChange := Change{Type: "normal", Number: "CHG300300", ShortDescription: "unittests", Table: TableChangeRequest}
+	realEndDate := time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
+	filter := ChangeFilter{GraceBeforeStart: 15 * time.Minute, GraceAfterEnd: 10 * time.Minute}
+
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: change __CHG300300__ (unittests), until __%s (1h0m0s)__, with a grace period of 15m0s before the start and 10m0s after the end",
+		p.getLocalTime(realEndDate))
+	expectedGrantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to TestUser, for role admin, until %s (1h0m0s), with a grace period of 15m0s before the start and 10m0s after the end",
+		p.getLocalTime(realEndDate))
+
+	loggerObj.On("Info", mock.Anything)
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText, grantedAccessServiceNowText := p.determineGrantedTextsChange("TestUser", "admin", validChange, 1*time.Hour, realEndDate, filter)
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "The UI text should show the grace periods")
+	s.Equal(expectedGrantedAccessServiceNowText, grantedAccessServiceNowText, "The note in ServiceNow should show the grace periods")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsChangeTask() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	validChange := testGetChangeTask()
+	realEndDate := time.Date(2025, 5, 20, 23, 59, 59, 0, time.UTC)
+	remainingTime := 1 * time.Hour
+
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: change task __CTASK0010001__ (deploy) of change __CHG300030__, until __%s (1h0m0s)__",
+		p.getLocalTime(realEndDate))
+
+	loggerObj.On("Info", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Granted access for TestUser: normal change task CTASK0010001 (deploy) of change CHG300030, role admin")
+	}))
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText, _ := p.determineGrantedTextsChange("TestUser", "admin", validChange, remainingTime, realEndDate, ChangeFilter{})
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "The UI text should show the change task and its change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsExclusions() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	requesterName := "TestUser"
+	requestedRole := "admin"
+
+	var remainingTime = 1 * time.Hour
+	realEndDate := time.Now().Add(remainingTime)
+
+	expectedGrantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, %s is an exclusion role, justification: database down), registered in ServiceNow as __INC0010010__",
+		requesterName,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Minute),
+		requestedRole)
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: %s is an exclusion role, until __%s (%s)__, registered in ServiceNow as __INC0010010__",
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	loggerObj.On("Warn", expectedGrantedAccessText)
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText := p.determineGrantedTextsExclusions(requesterName, requestedRole, "database down", "INC0010010", remainingTime, realEndDate)
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsExclusionsWithoutRecord() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var remainingTime = 1 * time.Hour
+	realEndDate := time.Now().Add(remainingTime)
+
+	loggerObj.On("Warn", mock.MatchedBy(func(text string) bool {
+		return strings.HasSuffix(text, "(no change, admin is an exclusion role, justification: not given), not registered in ServiceNow")
+	}))
+	loggerObj.On("Debug", mock.Anything)
+
+	grantedAccessUIText := p.determineGrantedTextsExclusions("TestUser", "admin", "", "", remainingTime, realEndDate)
+
+	s.True(strings.HasSuffix(grantedAccessUIText, ", not registered in ServiceNow"), "The UI text should show that there is no record in ServiceNow")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsWithoutChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	requesterName := "TestUser"
+	requestedRole := "readonly-plus"
+
+	var remainingTime = 1 * time.Hour
+	realEndDate := time.Now().Add(remainingTime)
+
+	expectedGrantedAccessText := fmt.Sprintf("Granted access for %s: role %s, from %s to %s (no change, role %s doesn't need a change)",
+		requesterName,
+		requestedRole,
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Minute),
+		requestedRole)
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: role %s doesn't need a change, until __%s (%s)__",
+		requestedRole,
+		p.getLocalTime(realEndDate),
+		remainingTime.Truncate(time.Second).String())
+
+	loggerObj.On("Info", expectedGrantedAccessText)
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText := p.determineGrantedTextsWithoutChange(requesterName, requestedRole, remainingTime, realEndDate)
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineGrantedTextsIncident() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	incident := IncidentServiceNow{Number: "INC0010001", ShortDescription: "website down", Priority: "1", SysId: "i1"}
+	var remainingTime = 1 * time.Hour
+	realEndDate := time.Now().Add(remainingTime)
+
+	expectedGrantedAccessText := fmt.Sprintf("Granted access for TestUser: incident INC0010001 (website down), priority 1, role admin, from %s to %s (no change, incident access)",
+		time.Now().Truncate(time.Minute),
+		realEndDate.Truncate(time.Second).String())
+	expectedGrantedAccessUIText := fmt.Sprintf("Granted access: incident __INC0010001__ (website down), until __%s (1h0m0s)__",
+		p.getLocalTime(realEndDate))
+	expectedGrantedAccessServiceNowText := fmt.Sprintf("ServiceNow plugin granted access to TestUser, for role admin, until %s (1h0m0s)",
+		p.getLocalTime(realEndDate))
+
+	loggerObj.On("Warn", expectedGrantedAccessText)
+	loggerObj.On("Debug", expectedGrantedAccessUIText)
+
+	grantedAccessUIText, grantedAccessServiceNowText := p.determineGrantedTextsIncident("TestUser", "admin", incident, remainingTime, realEndDate)
+
+	s.Equal(expectedGrantedAccessUIText, grantedAccessUIText, "Granted access text for UI should be what is expected")
+	s.Equal(expectedGrantedAccessServiceNowText, grantedAccessServiceNowText, "Granted access text for ServiceNow should be what is expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineRevokedTexts() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	requesterName := "TestUser"
+	requestedRole := "admin"
+	changeNumber := "CHG300300"
+
+	loggerObj.On("Info", mock.Anything)
+	loggerObj.On("Debug", mock.Anything)
+
+	revokedAccessUIText, revokedAccessServiceNowText := p.determineRevokedTexts(requesterName, requestedRole, TableChangeRequest, changeNumber)
+
+	s.Contains(revokedAccessUIText, "Revoked access: change __CHG300300__, at __", "Revoked access text for UI should contain the change number")
+	s.Contains(revokedAccessServiceNowText, "ServiceNow plugin revoked access for TestUser, for role admin, at ", "Revoked access text for ServiceNow should contain user and role")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineRevokedTextsIncident() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Info", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Revoked access for TestUser: incident INC0010001, role admin, at ")
+	}))
+	loggerObj.On("Debug", mock.Anything)
+
+	revokedAccessUIText, _ := p.determineRevokedTexts("TestUser", "admin", TableIncident, "INC0010001")
+
+	s.Contains(revokedAccessUIText, "Revoked access: incident __INC0010001__, at __", "Revoked access text for UI should contain the incident number")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDetermineRevokedTextsExclusionRecord() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Info", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Revoked access for TestUser: record BG0001001, role incidentmanagers, at ")
+	}))
+	loggerObj.On("Debug", mock.Anything)
+
+	revokedAccessUIText, _ := p.determineRevokedTexts("TestUser", "incidentmanagers", "u_break_glass", "BG0001001")
+
+	s.Contains(revokedAccessUIText, "Revoked access: record __BG0001001__, at __", "Revoked access text for UI should contain the number of the record")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDenyRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	reason := "whatever"
+	response, err := p.denyRequest(reason)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, response, "Access request should be denied")
+	s.Equal(reason, response.Message, response, "Reason should be correct")
+	s.Equal(nil, err, "No error")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGrantRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	reason := "whatever"
+	response, err := p.grantRequest(reason)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, response, "Access request should be denied")
+	s.Equal(reason, response.Message, response, "Reason should be correct")
+	s.Equal(nil, err, "No error")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRevokeRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	reason := "whatever"
+	response, err := p.revokeRequest(reason)
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, response, "Access request should be revoked")
+	s.Equal(reason, response.Message, response, "Reason should be correct")
+	s.Equal(nil, err, "No error")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetDenyReason() {
+	p, _ := testGetPlugin()
+
+	testCases := []struct {
+		kind     error
+		expected string
+	}{
+		{ErrConfig, "config"},
+		{ErrKubernetes, "kubernetes"},
+		{ErrServiceNowUnavailable, "servicenow-unavailable"},
+		{ErrServiceNowAPI, "servicenow-api"},
+		{ErrCINotFound, "ci-not-found"},
+		{ErrCIInvalidStatus, "ci-invalid-status"},
+		{ErrAmbiguousCI, "ambiguous-ci"},
+		{ErrNoValidChange, "no-valid-change"},
+		{ErrChangeNotLinked, "change-not-linked"},
+		{ErrAmbiguousChange, "ambiguous-change"},
+		{ErrChangeNumberRequired, "change-number-required"},
+		{ErrRequesterNotAssigned, "requester-not-assigned"},
+		{ErrChangeNotAllowed, "change-not-allowed"},
+		{ErrBlackout, "blackout"},
+		{ErrNoValidIncident, "no-valid-incident"},
+		{ErrExclusionNotAllowed, "exclusion-not-allowed"},
+		{ErrJustificationRequired, "justification-required"},
+	}
+
+	for _, testCase := range testCases {
+		err := p.newError(testCase.kind, nil, "whatever")
+		s.Equal(testCase.expected, p.getDenyReason(err), "Deny reason should match the kind")
+	}
+
+	s.Equal("unknown", p.getDenyReason(errors.New("whatever")), "Deny reason of an untyped error should be unknown")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetDenyMessageConfigError() {
+	p, _ := testGetPlugin()
+
+	err := p.newError(ErrConfig, nil, "Secret servicenow-secret not found")
+
+	message := p.getDenyMessage(err)
+
+	s.NotContains(message, "servicenow-secret", "Details of the configuration should not be shown")
+	s.Contains(message, "not configured correctly", "Message should point to the configuration")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetDenyMessageServiceNowUnavailable() {
+	p, _ := testGetPlugin()
+
+	err := p.newError(ErrServiceNowUnavailable, nil, "Timeout")
+
+	s.Equal("ServiceNow is not available, please try again later (Timeout)", p.getDenyMessage(err), "Message should be correct")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetDenyMessageServiceNowAPI() {
+	p, _ := testGetPlugin()
+
+	err := p.newError(ErrServiceNowAPI, nil, "Status 404")
+
+	s.Equal("Unexpected response from ServiceNow, please contact your Argo CD administrator (Status 404)", p.getDenyMessage(err), "Message should be correct")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetDenyMessageNoValidChange() {
+	p, _ := testGetPlugin()
+
+	err := p.newError(ErrNoValidChange, nil, "No valid change found")
+
+	s.Equal("No valid change found", p.getDenyMessage(err), "Message should be the error text")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestDenyAccess() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (ci-invalid-status): CI is retired")
+
+	response, err := p.denyAccess("Test User", "administrator", p.newError(ErrCIInvalidStatus, nil, "CI is retired"))
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Access should be denied")
+	s.Equal("CI is retired", response.Message, "Message should be the error text")
+	s.NoError(err, "No error")
+	loggerObj.AssertExpectations(t)
+}
+
+func setSecret(namespace string, secretName string, username string, password string) {
+	secret := &coreV1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+		},
+		Type: "Opaque",
+		Data: map[string][]byte{
+			"username": []byte(username),
+			"password": []byte(password),
+		},
+	}
+
+	_, _ = k8sclientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+}
+
+func addToConfigMap(namespace string, configmapName string, key string, value string) {
+	configMap, _ := k8sclientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configmapName, metav1.GetOptions{})
+	configMap.Data[key] = value
+
+	_, _ = k8sclientset.CoreV1().ConfigMaps(namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+}
+
+func setConfigMap(namespace string, configmapName string, exclusionsListName string, exclusionsListValue string) {
+	configMap := &coreV1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configmapName,
+			Namespace: namespace,
+		},
+		Data: map[string]string{
+			exclusionsListName: exclusionsListValue,
+		},
+	}
+
+	_, _ = k8sclientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetServiceNowCredentials() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	secretName := "servicenow-secret"
+	namespace := "argocd-ephemeral-access"
+	serviceNowUsername := "serviceNowUsername"
+	serviceNowPassword := "serviceNowPassword"
+	config := &Config{Namespace: namespace, SecretName: secretName}
+
+	k8sclientset = testclient.NewClientset()
+	setSecret(namespace, secretName, serviceNowUsername, serviceNowPassword)
+
+	loggerObj.On("Debug", "Get credentials from secret [argocd-ephemeral-access]servicenow-secret...")
+
+	err := p.getServiceNowCredentials(config)
+
+	s.Equal(serviceNowUsername, config.ServiceNowUsername, "Username found")
+	s.Equal(serviceNowPassword, config.ServiceNowPassword, "Password found")
+	s.NoError(err, "No error expected")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetServiceNowAuthMethodDefault() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	loggerObj.On("Debug", "Environment variable SERVICENOW_AUTH_METHOD is empty, assuming basic")
+
+	config := &Config{}
+	err := p.getServiceNowAuthMethod(config)
+
+	s.Equal(AuthMethodBasic, config.ServiceNowAuthMethod, "Basic authentication is the default")
+	s.Equal("", config.ServiceNowClientId, "No client id expected")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetServiceNowAuthMethodOAuth() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	namespace := "argocd-ephemeral-access"
+	config := &Config{Namespace: namespace, SecretName: "servicenow-secret"}
+	k8sclientset = testclient.NewClientset()
+	secret := &coreV1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "servicenow-secret",
+			Namespace: namespace,
+		},
+		Type: "Opaque",
+		Data: map[string][]byte{
+			"client-id":     []byte("testClientId"),
+			"client-secret": []byte("testClientSecret"),
+		},
+	}
+	_, _ = k8sclientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+
+	_ = os.Setenv("SERVICENOW_AUTH_METHOD", AuthMethodOAuthClientCredentials)
+
+	loggerObj.On("Debug", "Get credentials from secret [argocd-ephemeral-access]servicenow-secret...")
+
+	err := p.getServiceNowAuthMethod(config)
+
+	s.Equal(AuthMethodOAuthClientCredentials, config.ServiceNowAuthMethod, "Authentication method should be read from the environment variable")
+	s.Equal("testClientId", config.ServiceNowClientId, "Client id should be read from the secret")
+	s.Equal("testClientSecret", config.ServiceNowClientSecret, "Client secret should be read from the secret")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetServiceNowAuthMethodUnknown() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = os.Setenv("SERVICENOW_AUTH_METHOD", "kerberos")
+	expectedErrorText := "Unknown authentication method kerberos (environment variable SERVICENOW_AUTH_METHOD), use basic, oauth-client-credentials or oauth-password"
+
+	loggerObj.On("Error", expectedErrorText)
+
+	err := p.getServiceNowAuthMethod(&Config{})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func testCreateCertificate(t *testing.T) (string, string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "argocd-ephemeral-access-plugin-servicenow"},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+
+	return string(certificatePEM), string(keyPEM)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestReadServiceNowClientSettingsDefault() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	settings, err := p.readServiceNowClientSettings()
+
+	s.Equal(10*time.Second, settings.ConnectTimeout, "Default connect timeout should be 10 seconds")
+	s.Equal(30*time.Second, settings.Timeout, "Default timeout should be 30 seconds")
+	s.Equal("", settings.CACert, "No CA certificate by default")
+	s.Equal("", settings.ClientCert, "No client certificate by default")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestReadServiceNowClientSettingsIncorrectNumbers() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = os.Setenv("SERVICENOW_RETRY_MAX_ATTEMPTS", "0")
+	_ = os.Setenv("SERVICENOW_REQUEST_DEADLINE_SECONDS", "one minute")
+
+	expectedMaxAttemptsErrorText := "Incorrect value 0 in environment variable SERVICENOW_RETRY_MAX_ATTEMPTS: should be a number from 1 to 10"
+	expectedDeadlineErrorText := "Incorrect value one minute in environment variable SERVICENOW_REQUEST_DEADLINE_SECONDS: should be a number from 0 to 3600"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedMaxAttemptsErrorText)
+	loggerObj.On("Error", expectedDeadlineErrorText)
+
+	_, err := p.readServiceNowClientSettings()
+
+	s.EqualError(err, expectedMaxAttemptsErrorText+"\n"+expectedDeadlineErrorText, "Both errors should be returned")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestReadServiceNowClientSettingsWithFiles() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	directory := t.TempDir()
+	_ = os.WriteFile(filepath.Join(directory, "ca.crt"), []byte("ca"), 0600)
+	_ = os.WriteFile(filepath.Join(directory, "tls.crt"), []byte("cert"), 0600)
+	_ = os.WriteFile(filepath.Join(directory, "tls.key"), []byte("key"), 0600)
+	_ = os.Setenv("SERVICENOW_CA_FILE", filepath.Join(directory, "ca.crt"))
+	_ = os.Setenv("SERVICENOW_CLIENT_CERT_FILE", filepath.Join(directory, "tls.crt"))
+	_ = os.Setenv("SERVICENOW_CLIENT_KEY_FILE", filepath.Join(directory, "tls.key"))
+	_ = os.Setenv("SERVICENOW_CONNECT_TIMEOUT_SECONDS", "2")
+	_ = os.Setenv("SERVICENOW_TIMEOUT_SECONDS", "5")
+
+	loggerObj.On("Debug", mock.Anything)
+
+	settings, err := p.readServiceNowClientSettings()
+
+	s.Equal(2*time.Second, settings.ConnectTimeout, "Connect timeout should be read from environment variable")
+	s.Equal(5*time.Second, settings.Timeout, "Timeout should be read from environment variable")
+	s.Equal("ca", settings.CACert, "CA certificate should be read from file")
+	s.Equal("cert", settings.ClientCert, "Client certificate should be read from file")
+	s.Equal("key", settings.ClientKey, "Client key should be read from file")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestNewServiceNowClientDefault() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	settings := ServiceNowClientSettings{ConnectTimeout: 10 * time.Second, Timeout: 30 * time.Second}
+
+	client, err := p.newServiceNowClient(settings)
+
+	transport := client.HttpClient.Transport.(*http.Transport)
+	s.NoError(err, "No error expected")
+	s.Equal(30*time.Second, client.HttpClient.Timeout, "Timeout should be set on the client")
+	s.Equal(10*time.Second, transport.TLSHandshakeTimeout, "Connect timeout should be used for the TLS handshake")
+	s.NotNil(transport.Proxy, "Proxy settings from the environment should be used")
+	s.Nil(transport.TLSClientConfig.RootCAs, "System CAs should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestNewServiceNowClientWithCACert() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	clientWithoutCA, _ := p.newServiceNowClient(ServiceNowClientSettings{Timeout: 5 * time.Second})
+	_, err := clientWithoutCA.HttpClient.Get(server.URL)
+	s.NotNil(err, "Certificate of the server should not be trusted without CA")
+
+	clientWithCA, err := p.newServiceNowClient(ServiceNowClientSettings{Timeout: 5 * time.Second, CACert: string(caCert)})
+	s.NoError(err, "No error expected")
+	resp, err := clientWithCA.HttpClient.Get(server.URL)
+	s.Equal(nil, err, "Certificate of the server should be trusted with CA")
+	_ = resp.Body.Close()
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestNewServiceNowClientIncorrectCACert() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "Error in CA bundle for ServiceNow: no valid certificates found"
+	loggerObj.On("Error", expectedErrorText)
+
+	client, err := p.newServiceNowClient(ServiceNowClientSettings{CACert: "not a certificate"})
+
+	s.Nil(client, "No client expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestNewServiceNowClientWithClientCert() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	clientCert, clientKey := testCreateCertificate(t)
+
+	client, err := p.newServiceNowClient(ServiceNowClientSettings{ClientCert: clientCert, ClientKey: clientKey})
+
+	transport := client.HttpClient.Transport.(*http.Transport)
+	s.NoError(err, "No error expected")
+	s.Equal(1, len(transport.TLSClientConfig.Certificates), "Client certificate should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestNewServiceNowClientIncorrectClientCert() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "Error in client certificate for ServiceNow: tls: failed to find any PEM data in certificate input"
+	loggerObj.On("Error", expectedErrorText)
+
+	client, err := p.newServiceNowClient(ServiceNowClientSettings{ClientCert: "not a certificate", ClientKey: "not a key"})
+
+	s.Nil(client, "No client expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestUpdateServiceNowClient() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	config := testNewConfig(p)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	err := p.updateServiceNowClient(config)
+	firstClient := config.ServiceNowClient
+	s.NoError(err, "No error expected")
+	s.NotNil(firstClient, "Client should be created")
+
+	newConfig := &Config{}
+	err = p.updateServiceNowClient(newConfig)
+	s.NoError(err, "No error expected")
+	s.Same(firstClient, newConfig.ServiceNowClient, "Client should be reused when the settings didn't change")
+
+	_ = os.Setenv("SERVICENOW_TIMEOUT_SECONDS", "5")
+	newConfig = &Config{}
+	err = p.updateServiceNowClient(newConfig)
+	s.NoError(err, "No error expected")
+	s.NotSame(firstClient, newConfig.ServiceNowClient, "Client should be replaced when the settings changed")
+	s.Equal(5*time.Second, newConfig.ServiceNowClient.HttpClient.Timeout, "New timeout should be used")
+	s.Same(firstClient, p.getServiceNowClient(), "The current configuration should keep its client")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestUpdateServiceNowClientFileDoesntExist() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	config := testNewConfig(p)
+
+	_ = os.Setenv("SERVICENOW_CA_FILE", "/does/not/exist")
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	err := p.updateServiceNowClient(config)
+
+	s.ErrorContains(err, "Error reading file /does/not/exist", "Error text should be correct")
+	s.Nil(config.ServiceNowClient, "No client expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetServiceNowClient() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+
+	s.Same(defaultServiceNowClient, p.getServiceNowClient(), "Default client expected without a client in the configuration")
+
+	config.ServiceNowClient, _ = p.newServiceNowClient(ServiceNowClientSettings{Timeout: 5 * time.Second})
+	s.Same(config.ServiceNowClient, p.getServiceNowClient(), "Client of the configuration expected")
+	loggerObj.AssertExpectations(t)
+}
+
+// The client is stored in the configuration of the test, tests without a configuration get one
+func testUseServiceNowClient(t *testing.T, p *ServiceNowPlugin, settings ServiceNowClientSettings) {
+	config := p.getConfig()
+	if p.configStore.config == nil {
+		config = testNewConfig(p)
+	}
+
+	config.ServiceNowClient, _ = p.newServiceNowClient(settings)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestStartServiceNowDeadline() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{RequestDeadline: 60 * time.Second})
+
+	before := time.Now()
+	ctx, cancel := p.startServiceNowDeadline()
+	defer cancel()
+
+	deadline, hasDeadline := ctx.Deadline()
+	s.True(hasDeadline, "Deadline expected")
+	s.False(deadline.Before(before.Add(60*time.Second)), "Deadline should be 60 seconds from now")
+	s.False(deadline.After(time.Now().Add(60*time.Second)), "Deadline should be 60 seconds from now")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestStartServiceNowDeadlineWithoutDeadline() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{RequestDeadline: 0})
+
+	ctx, cancel := p.startServiceNowDeadline()
+	defer cancel()
+
+	_, hasDeadline := ctx.Deadline()
+	s.False(hasDeadline, "No deadline expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestStartServiceNowDeadlinePerAccessRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{RequestDeadline: 60 * time.Second})
+
+	firstCtx, firstCancel := p.startServiceNowDeadline()
+	secondCtx, secondCancel := p.startServiceNowDeadline()
+	defer secondCancel()
+	firstCancel()
+
+	s.Error(firstCtx.Err(), "First context should be cancelled")
+	s.NoError(secondCtx.Err(), "Second context should not be affected by the first context")
+	loggerObj.AssertExpectations(t)
+}
+
+type testOAuthServer struct {
+	server        *httptest.Server
+	tokenRequests []url.Values
+	apiRequests   []string
+}
+
+func testSimulateOAuthServer(t *testing.T, p *ServiceNowPlugin, authMethod string, expiresIn int) *testOAuthServer {
+	oauthServer := &testOAuthServer{}
+
+	oauthServer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth_token.do" {
+			_ = r.ParseForm()
+			oauthServer.tokenRequests = append(oauthServer.tokenRequests, r.PostForm)
+			if r.PostForm.Get("client_secret") != "testClientSecret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = fmt.Fprint(w, `{"error_description":"access_denied","error":"server_error"}`)
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"access_token":"token-%d","refresh_token":"refresh-%d","scope":"useraccount","token_type":"Bearer","expires_in":%d}`,
+				len(oauthServer.tokenRequests), len(oauthServer.tokenRequests), expiresIn)
+			return
+		}
+
+		oauthServer.apiRequests = append(oauthServer.apiRequests, r.Header.Get("Authorization"))
+		_, _ = fmt.Fprint(w, `{"result":[]}`)
+	}))
+	t.Cleanup(oauthServer.server.Close)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{Timeout: 5 * time.Second})
+	config := testNewConfig(p)
+	config.ServiceNowUrl = oauthServer.server.URL
+	config.ServiceNowAuthMethod = authMethod
+	config.ServiceNowClientId = "testClientId"
+	config.ServiceNowClientSecret = "testClientSecret"
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	return oauthServer
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRequestOAuthTokenClientCredentials() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+
+	loggerObj.On("Debug", "Request OAuth token from ServiceNow, grant type client_credentials")
+
+	token, err := p.requestOAuthToken(context.Background(), "")
+
+	s.NoError(err, "No error expected")
+	s.Equal("token-1", token.AccessToken, "Access token should be returned")
+	s.Equal("refresh-1", token.RefreshToken, "Refresh token should be returned")
+	s.WithinDuration(time.Now().Add(1800*time.Second), token.ExpiresAt, 5*time.Second, "Expiry time should be computed")
+	s.Equal("testClientId", oauthServer.tokenRequests[0].Get("client_id"), "Client id should be sent")
+	s.Equal("", oauthServer.tokenRequests[0].Get("username"), "No username should be sent")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRequestOAuthTokenPassword() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthPassword, 1800)
+
+	loggerObj.On("Debug", "Request OAuth token from ServiceNow, grant type password")
+
+	_, err := p.requestOAuthToken(context.Background(), "")
+
+	s.NoError(err, "No error expected")
+	s.Equal("testUser", oauthServer.tokenRequests[0].Get("username"), "Username should be sent")
+	s.Equal("testPassword", oauthServer.tokenRequests[0].Get("password"), "Password should be sent")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRequestOAuthTokenRefresh() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthPassword, 1800)
+
+	loggerObj.On("Debug", "Request OAuth token from ServiceNow, grant type refresh_token")
+
+	_, err := p.requestOAuthToken(context.Background(), "refresh-0")
+
+	s.NoError(err, "No error expected")
+	s.Equal("refresh-0", oauthServer.tokenRequests[0].Get("refresh_token"), "Refresh token should be sent")
+	s.Equal("", oauthServer.tokenRequests[0].Get("password"), "No password should be sent")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRequestOAuthTokenIncorrectSecret() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+	config := p.getConfig()
+	config.ServiceNowClientSecret = "incorrect"
+
+	loggerObj.On("Debug", mock.Anything)
+
+	token, err := p.requestOAuthToken(context.Background(), "")
+
+	s.Nil(token, "No token expected")
+	s.EqualError(err, "Error getting OAuth token from ServiceNow (status code 401): server_error access_denied", "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetOAuthTokenCached() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+	config := p.getConfig()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	firstToken, err := p.getOAuthToken(context.Background())
+	s.NoError(err, "No error expected")
+	secondToken, err := p.getOAuthToken(context.Background())
+	s.NoError(err, "No error expected")
+
+	s.Equal("token-1", firstToken, "First token expected")
+	s.Equal(firstToken, secondToken, "Cached token expected")
+	s.Equal(1, len(oauthServer.tokenRequests), "Only one token request expected")
+
+	config.ServiceNowClientSecret = "testClientSecret"
+	config.ServiceNowClientId = "otherClientId"
+	thirdToken, _ := p.getOAuthToken(context.Background())
+	s.Equal("token-2", thirdToken, "New token expected when the credentials change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetOAuthTokenRefreshBeforeExpiry() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	// Tokens expire within the refresh margin, so every call refreshes the token
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthPassword, 30)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	firstToken, _ := p.getOAuthToken(context.Background())
+	secondToken, err := p.getOAuthToken(context.Background())
+
+	s.NoError(err, "No error expected")
+	s.Equal("token-1", firstToken, "First token expected")
+	s.Equal("token-2", secondToken, "Refreshed token expected")
+	s.Equal("password", oauthServer.tokenRequests[0].Get("grant_type"), "First token via password grant")
+	s.Equal("refresh_token", oauthServer.tokenRequests[1].Get("grant_type"), "Second token via refresh token")
+	s.Equal("refresh-1", oauthServer.tokenRequests[1].Get("refresh_token"), "Refresh token of the first token expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSetServiceNowAuthenticationBasic() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowAuthMethod = AuthMethodBasic
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	defer func() { config.ServiceNowAuthMethod = "" }()
+
+	req, _ := http.NewRequest("GET", "https://servicenow.example.com/api/test", nil)
+	err := p.setServiceNowAuthentication(req)
+
+	username, password, ok := req.BasicAuth()
+	s.NoError(err, "No error expected")
+	s.True(ok, "Basic authentication expected")
+	s.Equal("testUser", username, "Username should be used")
+	s.Equal("testPassword", password, "Password should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSetServiceNowAuthenticationOAuth() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	req, _ := http.NewRequest("GET", oauthServer.server.URL+"/api/test", nil)
+	err := p.setServiceNowAuthentication(req)
+
+	s.NoError(err, "No error expected")
+	s.Equal("Bearer token-1", req.Header.Get("Authorization"), "Bearer token expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestInvalidateOAuthToken() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, _ = p.getOAuthToken(context.Background())
+	p.invalidateOAuthToken()
+	token, _ := p.getOAuthToken(context.Background())
+
+	s.Equal("token-2", token, "New token expected after invalidation")
+	s.Equal(2, len(oauthServer.tokenRequests), "Two token requests expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestPluginHelperMethods(t *testing.T) {
+	suite.Run(t, new(PluginHelperMethodsTestSuite))
+}
+
+func simulateHttpRequestToServiceNow(t *testing.T, responseMap map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := ""
+
+		for uri := range responseMap {
+			if uri == r.URL.RequestURI() {
+				response = responseMap[uri]
+				break
+			}
+		}
+		if response == "" {
+			fmt.Printf("No response found for %s, error in testset?\n", r.URL.RequestURI())
+		}
+		if r.Header.Get("Accept") != "application/json" {
+			t.Errorf("Expected Accept: application/json header, got: %s", r.Header.Get("Accept"))
+		}
+		usedUsername, usedPassword, ok := r.BasicAuth()
+		if ok {
+			assert.Equal(t, "testUser", usedUsername, "Username that is used should match username that is requested")
+			assert.Equal(t, "testPassword", usedPassword, "Password that is used should match username that is requested")
+		}
+
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(response))
+	}))
+	return server
+}
+
+func simulateSimpleHttpRequestWithStatusCodeRedirect(response string) (*httptest.Server, *httptest.Server) {
+
+	var secondServer = httptest.NewServer(http.HandlerFunc(func(w2 http.ResponseWriter, r2 *http.Request) {
+		w2.WriteHeader(http.StatusOK)
+		_, _ = w2.Write([]byte(response))
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w1 http.ResponseWriter, r1 *http.Request) {
+		http.Redirect(w1, r1, secondServer.URL, http.StatusFound)
+	}))
+	return server, secondServer
+}
+
+func (s *ServiceNowTestSuite) TestCheckAPIResultNormalResponse() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var resp = http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+	}
+	var body = `{"result":[]}`
+
+	result, err := p.checkAPIResult(&resp, []byte(body))
+
+	s.Equal(body, string(result), "Body should not be changed")
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCheckAPIResultForbidden() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "ServiceNow API changed"
+
+	var resp = http.Response{
+		Status:     "403 Forbidden",
+		StatusCode: 403,
+	}
+	var body = `{"result":[]}`
+
+	_, err := p.checkAPIResult(&resp, []byte(body))
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCheckAPIResultBadGateway() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "ServiceNow API server is down"
+
+	var resp = http.Response{
+		Status:     "502 Bad Gateway",
+		StatusCode: 502,
+	}
+	var body = `{"result":[]}`
+
+	_, err := p.checkAPIResult(&resp, []byte(body))
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCheckAPIResultBadGatewayWith200() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "ServiceNow API server is down"
+
+	var resp = http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+	}
+	responseText := "<html><body>Server down!</body></html>"
+
+	_, err := p.checkAPIResult(&resp, []byte(responseText))
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCheckAPIResultTooManyRequests() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	expectedErrorText := "ServiceNow API rate limit exceeded"
+
+	var resp = http.Response{
+		Status:     "429 Too Many Requests",
+		StatusCode: 429,
+	}
+	var body = `{"error":{"message":"Too many requests"}}`
+
+	_, err := p.checkAPIResult(&resp, []byte(body))
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestIsRetryableServiceNowError() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	statusCodes := map[int]bool{
+		200: false,
+		400: false,
+		401: false,
+		404: false,
+		429: true,
+		500: false,
+		502: true,
+		503: true,
+		504: true,
+	}
+	for statusCode, expectedRetryable := range statusCodes {
+		resp := http.Response{StatusCode: statusCode}
+		s.Equal(expectedRetryable, p.isRetryableServiceNowError("GET", &resp, nil), fmt.Sprintf("Retryable for status code %d", statusCode))
+	}
+
+	connectionReset := fmt.Errorf("Error in client.Do: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})
+	connectionRefused := fmt.Errorf("Error in client.Do: %w", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+	s.True(p.isRetryableServiceNowError("GET", nil, connectionReset), "Connection reset should be retried")
+	s.True(p.isRetryableServiceNowError("GET", nil, connectionRefused), "Refused connection should be retried")
+	s.True(p.isRetryableServiceNowError("GET", nil, fmt.Errorf("Error in client.Do: %w", io.EOF)), "Closed connection should be retried")
+	s.False(p.isRetryableServiceNowError("GET", nil, errors.New("Error in client.Do: dial tcp: lookup servicenow: no such host")), "Unknown host should not be retried")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestIsRetryableServiceNowErrorNotIdempotent() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	statusCodes := map[int]bool{
+		200: false,
+		429: true,
+		500: false,
+		502: false,
+		503: false,
+		504: false,
+	}
+	for _, method := range []string{"POST", "PATCH"} {
+		for statusCode, expectedRetryable := range statusCodes {
+			resp := http.Response{StatusCode: statusCode}
+			s.Equal(expectedRetryable, p.isRetryableServiceNowError(method, &resp, nil), fmt.Sprintf("Retryable for %s with status code %d", method, statusCode))
+		}
+
+		connectionReset := fmt.Errorf("Error in client.Do: %w", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET})
+		connectionRefused := fmt.Errorf("Error in client.Do: %w", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})
+		s.False(p.isRetryableServiceNowError(method, nil, connectionReset), fmt.Sprintf("%s after a connection reset should not be retried", method))
+		s.False(p.isRetryableServiceNowError(method, nil, fmt.Errorf("Error in client.Do: %w", io.EOF)), fmt.Sprintf("%s after a closed connection should not be retried", method))
+		s.True(p.isRetryableServiceNowError(method, nil, connectionRefused), fmt.Sprintf("%s that was not sent should be retried", method))
+	}
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRetryDelayRetryAfterSeconds() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	resp := http.Response{StatusCode: 429, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "7")
+
+	s.Equal(7*time.Second, p.getRetryDelay(&resp, 1), "Retry-After in seconds should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRetryDelayRetryAfterDate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	resp := http.Response{StatusCode: 503, Header: http.Header{}}
+	resp.Header.Set("Retry-After", time.Now().Add(30*time.Second).UTC().Format(http.TimeFormat))
+
+	delay := p.getRetryDelay(&resp, 1)
+
+	s.True(delay > 28*time.Second && delay <= 30*time.Second, fmt.Sprintf("Retry-After as date should be used, delay is %s", delay))
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRetryDelayRateLimitReset() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	resp := http.Response{StatusCode: 429, Header: http.Header{}}
+	resp.Header.Set("X-RateLimit-Remaining", "0")
+	resp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(20*time.Second).Unix(), 10))
+
+	delay := p.getRetryDelay(&resp, 1)
+
+	s.True(delay > 18*time.Second && delay <= 20*time.Second, fmt.Sprintf("X-RateLimit-Reset should be used, delay is %s", delay))
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRetryDelayBackoff() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{BaseDelay: time.Second, MaxDelay: 5 * time.Second})
+
+	resp := http.Response{StatusCode: 503, Header: http.Header{}}
+	expectedMaxDelays := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, expectedMaxDelay := range expectedMaxDelays {
+		attempt := i + 1
+		delay := p.getRetryDelay(&resp, attempt)
+		s.True(delay >= expectedMaxDelay/2 && delay <= expectedMaxDelay, fmt.Sprintf("Delay for attempt %d should be between %s and %s, is %s", attempt, expectedMaxDelay/2, expectedMaxDelay, delay))
+	}
+
+	s.LessOrEqual(p.getRetryDelay(nil, 100), 5*time.Second, "Delay should never exceed the maximum delay")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestDoServiceNowRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		requestBody, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.Header.Get("Accept"), username, password, requestBody)
+	}))
+	defer server.Close()
+
+	resp, body, err := p.doServiceNowRequest(context.Background(), "PATCH", server.URL+"/api/test", "{}")
+
+	s.Equal(nil, err, "No error expected")
+	s.Equal(200, resp.StatusCode, "Status code should be returned")
+	s.Equal("PATCH application/json testUser testPassword {}", string(body), "Request should contain method, headers, credentials and data")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestDoServiceNowRequestDeadlineExceeded() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-1*time.Second))
+	defer cancel()
+
+	_, _, err := p.doServiceNowRequest(ctx, "GET", server.URL+"/api/test", "")
+
+	s.True(errors.Is(err, context.DeadlineExceeded), "Request after the deadline should fail")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestDoServiceNowRequestUnauthorizedOAuth() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	oauthServer := testSimulateOAuthServer(t, p, AuthMethodOAuthClientCredentials, 1800)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, _ = p.getOAuthToken(context.Background())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	resp, _, err := p.doServiceNowRequest(context.Background(), "GET", server.URL+"/api/test", "")
+
+	s.Equal(nil, err, "No error expected")
+	s.Equal(401, resp.StatusCode, "Status code should be returned")
+	s.Nil(p.getServiceNowClient().token, "Token should be forgotten after 401")
+	s.Equal(1, len(oauthServer.tokenRequests), "One token request expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func testSimulateServiceNowWithStatusCodes(t *testing.T, statusCodes []int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		statusCode := statusCodes[min(call, len(statusCodes))-1]
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statusCode)
+		_, _ = fmt.Fprintf(w, `{"result":"call %d"}`, call)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPIRetryAfterRateLimit() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	server, calls := testSimulateServiceNowWithStatusCodes(t, []int{429, 200}, http.Header{"Retry-After": []string{"0"}})
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", "GET /api/test failed: ServiceNow API rate limit exceeded, retry 1 of 2 in 0s")
+
+	body, err := p.callServiceNowAPI(context.Background(), "GET", "/api/test", "")
+
+	s.NoError(err, "No error expected after retry")
+	s.Equal(`{"result":"call 2"}`, string(body), "Body of the second call expected")
+	s.Equal(int32(2), calls.Load(), "Two calls expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPINoRetryOnPermanentError() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	server, calls := testSimulateServiceNowWithStatusCodes(t, []int{404}, http.Header{})
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, err := p.callServiceNowAPI(context.Background(), "GET", "/api/test", "")
+
+	s.EqualError(err, "ServiceNow API changed", "Error text should be correct")
+	s.Equal(int32(1), calls.Load(), "Permanent errors should not be retried")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPIMaxAttempts() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	server, calls := testSimulateServiceNowWithStatusCodes(t, []int{503}, http.Header{})
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", mock.Anything)
+
+	_, err := p.callServiceNowAPI(context.Background(), "GET", "/api/test", "")
+
+	s.EqualError(err, "ServiceNow API server is down", "Error text should be correct")
+	s.Equal(int32(3), calls.Load(), "Three attempts expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPINoRetryOfPostAfterGatewayTimeout() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	server, calls := testSimulateServiceNowWithStatusCodes(t, []int{504, 201}, http.Header{})
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, err := p.callServiceNowAPI(context.Background(), "POST", "/api/test", "{}")
+
+	s.Error(err, "The gateway timeout should be returned")
+	s.Equal(int32(1), calls.Load(), "A POST that may have been handled should not be sent again")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPIDeadline() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	server, calls := testSimulateServiceNowWithStatusCodes(t, []int{429}, http.Header{"Retry-After": []string{"10"}})
+	config.ServiceNowUrl = server.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	expectedErrorText := "ServiceNow API rate limit exceeded (no retry: retry in 10s would exceed the deadline)"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.callServiceNowAPI(ctx, "GET", "/api/test", "")
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.Equal(int32(1), calls.Load(), "No retry after the deadline expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCallServiceNowAPIConnectionReset() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	testUseServiceNowClient(t, p, ServiceNowClientSettings{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"result":[]}`)
+	}))
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", mock.Anything)
+
+	body, err := p.callServiceNowAPI(context.Background(), "GET", "/api/test", "")
+
+	s.NoError(err, "No error expected after retry")
+	s.Equal(`{"result":[]}`, string(body), "Body of the second call expected")
+	s.Equal(int32(2), calls.Load(), "Two calls expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestgetFromServiceNowAPINormalResponse() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	responseText := "{\"results\":[]}"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	requestURI := "/api/test"
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+
+	result, err := p.getFromServiceNowAPI(context.Background(), requestURI)
+	s.Equal(responseText, string(result), "Correct result from API")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestgetFromServiceNowAPINormalResponseWithRedirect() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	responseText := "{\"results\":[]}"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	requestURI := "/api/test"
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+
+	server, secondServer := simulateSimpleHttpRequestWithStatusCodeRedirect(responseText)
+	defer server.Close()
+	defer secondServer.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+
+	// Redirect is done by http, not by the plugin program. We will therefore just get the apiCall for the primary address,
+	// not for the redirect server.
+	//
+	// It is very important that redirects works.
+
+	result, err := p.getFromServiceNowAPI(context.Background(), requestURI)
+	s.Equal(responseText, string(result), "Correct result from API")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetFromServiceNowAPIErrorInApiCall() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	responseText := "{\"results\":[]}"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	ciName := "app-demoapp"
+
+	requestURI := getTestCIRequestURI(ciName)
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	// requestURI is changed to something incorrect (contains config.ServiceNowUrl which it shouldn't)
+
+	requestURI = fmt.Sprintf("%s%s", config.ServiceNowUrl, requestURI)
+
+	// Expected apiCall contains the config.ServiceNowUrl twice
+	apiCall := fmt.Sprintf("%s%s", config.ServiceNowUrl, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Error", mock.Anything)
+
+	_, err := p.getFromServiceNowAPI(context.Background(), requestURI)
+	if !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("%s should contain text no such host", err)
+	}
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetFromServiceNowAPITimeout() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowClient, _ = p.newServiceNowClient(ServiceNowClientSettings{ConnectTimeout: time.Second, Timeout: 100 * time.Millisecond})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	_, err := p.getFromServiceNowAPI(context.Background(), "/api/test")
+
+	s.ErrorContains(err, "Client.Timeout exceeded", "A hanging ServiceNow should result in a timeout")
+	loggerObj.AssertExpectations(t)
+}
+
+// PostNote is a very simple method, so re-use the test for PatchServiceNowAPINormalRequest for both methods
+
+func testPatchServiceNowAPINormalRequest(s *ServiceNowTestSuite, requestURI string, data string, responseText string) {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", config.ServiceNowUrl, requestURI)
+	loggerObj.On("Debug", "apiCall: "+apiCall)
+	loggerObj.On("Debug", "Data: "+data)
+	loggerObj.On("Debug", responseText)
+
+	result, err := p.patchServiceNowAPI(context.Background(), requestURI, data)
+	s.Equal(responseText, string(result), "Correct result from API")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestPatchServiceNowAPINormalRequest() {
+	requestURI := "/api/test/1"
+	data := `{"test": 1, "result": "success"}`
+	responseText := `{"test": 1, "testText": "More results than the data that is sent", "result": "success"}`
+
+	testPatchServiceNowAPINormalRequest(s, requestURI, data, responseText)
+}
+
+func (s *ServiceNowTestSuite) TestPatchServiceNowAPIErrorInApiCall() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUrl = "https://example.com"
+	// Incorrect requestURI containing the config.ServiceNowUrl
+	incorrectRequestURI := fmt.Sprintf("%s/api/test/1", config.ServiceNowUrl)
+	data := `{"test": 1, "result": "success"}`
+
+	// No need to set up simulation server, as this will never be reached
+
+	apiCall := fmt.Sprintf("%s%s", config.ServiceNowUrl, incorrectRequestURI)
+	loggerObj.On("Debug", "apiCall: "+apiCall)
+	loggerObj.On("Debug", "Data: "+data)
+	loggerObj.On("Error", mock.Anything)
+
+	_, err := p.patchServiceNowAPI(context.Background(), incorrectRequestURI, data)
+	if !strings.Contains(err.Error(), "no such host") {
+		t.Errorf("%s should contain text no such host", err)
+	}
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestPostServiceNowAPINormalRequest() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	requestURI := "/api/now/table/incident?sysparm_fields=number,sys_id"
+	data := `{"short_description":"test"}`
+	responseText := `{"result":{"number":"INC0010010","sys_id":"b1"}}`
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", "apiCall: "+server.URL+requestURI)
+	loggerObj.On("Debug", "Data: "+data)
+	loggerObj.On("Debug", responseText)
+
+	result, err := p.postServiceNowAPI(context.Background(), requestURI, data)
+	s.Equal(responseText, string(result), "Correct result from API")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestServiceNowMethods(t *testing.T) {
+	suite.Run(t, new(ServiceNowTestSuite))
+}
+
+func (s *ServiceNowTestSuite) TestDetermineCIQueryFieldName() {
+	p, _ := testGetPlugin()
+	testNewConfig(p)
+
+	s.Equal("name", p.determineCIQueryField("app-demoapp"), "A name should be searched by name")
+}
+
+func (s *ServiceNowTestSuite) TestDetermineCIQueryFieldSysId() {
+	p, _ := testGetPlugin()
+	testNewConfig(p)
+
+	s.Equal("sys_id", p.determineCIQueryField("1c741bd70b2322007518478d83673af3"), "A sys_id should be searched by sys_id")
+	s.Equal("name", p.determineCIQueryField("1C741BD70B2322007518478D83673AF3"), "A sys_id has lower case characters only")
+}
+
+func (s *ServiceNowTestSuite) TestDetermineCIQueryFieldCorrelationId() {
+	p, _ := testGetPlugin()
+	config := testNewConfig(p)
+	config.CICorrelationIdPattern = "^ext-[0-9]+$"
+
+	s.Equal("correlation_id", p.determineCIQueryField("ext-12345"), "A correlation id should be searched by correlation_id")
+	s.Equal("name", p.determineCIQueryField("app-demoapp"), "Other values should be searched by name")
+}
+
+func (s *ServiceNowTestSuite) TestDetermineCIQueryFieldCorrelationIdWithoutPattern() {
+	p, _ := testGetPlugin()
+	testNewConfig(p)
+
+	s.Equal("name", p.determineCIQueryField("ext-12345"), "Without a pattern, correlation ids are not used")
+}
+
+func (s *ServiceNowTestSuite) TestParseCINamesCommaSeparated() {
+	p, _ := testGetPlugin()
+
+	ciNames, err := p.parseCINames(" app-frontend, app-backend,,app-frontend ")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-frontend", "app-backend"}, ciNames, "Empty and double names should be removed")
+}
+
+func (s *ServiceNowTestSuite) TestParseCINamesJSONList() {
+	p, _ := testGetPlugin()
+
+	ciNames, err := p.parseCINames(`["app-frontend", "app-backend"]`)
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-frontend", "app-backend"}, ciNames, "Names in the list should be returned")
+}
+
+func (s *ServiceNowTestSuite) TestParseCINamesEmpty() {
+	p, _ := testGetPlugin()
+
+	ciNames, err := p.parseCINames(`""`)
+
+	s.NoError(err, "No error expected")
+	s.Empty(ciNames, "No names expected")
+}
+
+func (s *ServiceNowTestSuite) TestParseCINamesIncorrectJSON() {
+	p, _ := testGetPlugin()
+
+	_, err := p.parseCINames(`["app-frontend", `)
+
+	s.Error(err, "Error expected for an incorrect JSON list")
+}
+
+func (s *ServiceNowTestSuite) TestReadCINamesFromMetadata() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	labels := map[string]string{
+		"ci-name":          "app-frontend",
+		"ci-name.database": "db-demoapp",
+		"ci-name.backend":  "app-backend",
+		"ci-names":         "not-a-ci",
+	}
+	annotations := map[string]string{"ci-name": `["app-frontend", "app-shared"]`}
+
+	ciNames, err := p.readCINamesFromMetadata("application demoapp", labels, annotations)
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-frontend", "app-shared", "app-backend", "db-demoapp"}, ciNames, "Annotation, label and labels with prefix should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestReadCINamesFromMetadataIncorrectList() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	expectedErrorText := `Incorrect list of CIs ["app-frontend" in application demoapp: unexpected end of JSON input`
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.readCINamesFromMetadata("application demoapp", nil, map[string]string{"ci-name": `["app-frontend"`})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrCINotFound, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetUnstructuredAppProject(namespace string, name string, labels map[string]string) *unstructured.Unstructured {
+	appProject := &unstructured.Unstructured{}
+	appProject.SetAPIVersion(argocd.GroupVersion.String())
+	appProject.SetKind("AppProject")
+	appProject.SetNamespace(namespace)
+	appProject.SetName(name)
+	appProject.SetLabels(labels)
+
+	return appProject
+}
+
+func (s *ServiceNowTestSuite) TestReadCINamesFromAppProject() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAppProject("argocd", "team-a", map[string]string{"ci-name": "app-team-a"}))
+
+	ciNames, err := p.readCINamesFromAppProject("team-a")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-team-a"}, ciNames, "CI of the project should be returned")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestReadCINamesFromAppProjectNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+	k8sdynamicclient = testGetDynamicClient()
+
+	loggerObj.On("Debug", "AppProject team-a not found in namespace argocd")
+
+	ciNames, err := p.readCINamesFromAppProject("team-a")
+
+	s.NoError(err, "A missing project is not an error")
+	s.Empty(ciNames, "No CIs expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCINamesFilled() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	var app = new(argocd.Application)
+	var m = make(map[string]string)
+
+	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
+	loggerObj.On("Debug", "ciLabel ci-name found: app-demoapp")
+
+	config.CILabel = "ci-name"
+	m[config.CILabel] = "app-demoapp"
+	app.Labels = m
+
+	ciNames, err := p.getCINames(app)
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-demoapp"}, ciNames, "Label found, correct content")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCINamesEmpty() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	var app = new(argocd.Application)
+	var m map[string]string
+
+	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
+
+	app.Name = "demoapp"
+	app.Labels = m
+	config.CILabel = "ci-name"
+	_, err := p.getCINames(app)
+
+	s.EqualError(err, "No CI name found: expected label or annotation with name ci-name in application demoapp", "Error text should be correct")
+	s.ErrorIs(err, ErrCINotFound, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCINamesFromAppProject() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	testNewConfig(p)
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAppProject("argocd", "team-a", map[string]string{"ci-name": "app-team-a"}))
+
+	var app = new(argocd.Application)
+	app.Name = "demoapp"
+	app.Spec.Project = "team-a"
+
+	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
+	loggerObj.On("Debug", "ciLabel ci-name found: app-team-a")
+
+	ciNames, err := p.getCINames(app)
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"app-team-a"}, ciNames, "CI of the project should be used when the application has no CI")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCINamesNotInAppProject() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	testNewConfig(p)
+	k8sdynamicclient = testGetDynamicClient(testGetUnstructuredAppProject("argocd", "team-a", nil))
+
+	var app = new(argocd.Application)
+	app.Name = "demoapp"
+	app.Spec.Project = "team-a"
+
+	loggerObj.On("Debug", "Search for ci-name in the CMDB...")
+
+	_, err := p.getCINames(app)
+
+	s.EqualError(err, "No CI name found: expected label or annotation with name ci-name in application demoapp or in project team-a", "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareGetCI(t *testing.T, p *ServiceNowPlugin, ciName string, responseText string) (*httptest.Server, string) {
+	config := testNewConfig(p)
+	requestURI := getTestCIRequestURI(ciName)
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	return server, apiCall
+}
+
+func (s *CITestSuite) TestGetCIOneCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ciName := "app-demoapp"
+	responseText := fmt.Sprintf(`{"result":[{"install_status":"1", "name":"%s", "sys_id": "5"}]}`, ciName)
+	server, apiCall := testPrepareGetCI(t, p, ciName, responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Debug", "InstallStatus: 1, OperationalStatus: , Class: , CI name: app-demoapp, SysId: 5")
+
+	cmdb, err := p.getCI(context.Background(), ciName)
+
+	s.Equal("1", cmdb.InstallStatus.Value, "InstallStatus should be 1")
+	s.Equal(ciName, cmdb.Name.Value, "Name should be "+ciName)
+	s.Equal("5", cmdb.SysId.Value, "SysId should be 5")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCIWithDisplayValues() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ciName := "app-demoapp"
+	responseText := `{"result":[{"install_status":{"display_value":"Installed","value":"1"}, "operational_status":{"display_value":"Operational","value":"1"}, "sys_class_name":{"display_value":"Application","value":"cmdb_ci_appl"}, "name":{"display_value":"app-demoapp","value":"app-demoapp"}, "sys_id":{"display_value":"5","value":"5"}}]}`
+	server, _ := testPrepareGetCI(t, p, ciName, responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	cmdb, err := p.getCI(context.Background(), ciName)
+
+	s.NoError(err, "No errors expected")
+	s.Equal(ServiceNowValue{Value: "1", DisplayValue: "Installed"}, cmdb.InstallStatus, "Install status should be read")
+	s.Equal(ServiceNowValue{Value: "1", DisplayValue: "Operational"}, cmdb.OperationalStatus, "Operational status should be read")
+	s.Equal("cmdb_ci_appl", cmdb.ClassName.Value, "Class should be read")
+	s.Equal("5", cmdb.SysId.Value, "SysId should be read")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCIMultiWordName() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ciName := "R&D Portal"
+	responseText := `{"result":[{"install_status":"1", "name":"R&D Portal", "sys_id": "5"}]}`
+	server, apiCall := testPrepareGetCI(t, p, ciName, responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	cmdb, err := p.getCI(context.Background(), ciName)
+
+	s.NoError(err, "No errors expected")
+	s.Equal(ciName, cmdb.Name.Value, "CI with spaces and & in the name should be found")
+	s.Contains(apiCall, "?name=R%26D+Portal&sysparm_fields=", "CI name should be escaped in the query")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCITwoCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ciName := "app-demoapp"
+
+	responseText := `{"result":[{"install_status":"1", "sys_class_name":"cmdb_ci_appl", "name":"app-demoapp", "sys_id": "1"},
+	                            {"install_status":"6", "sys_class_name":"cmdb_ci_service", "name":"app-demoapp", "sys_id": "2"}]}`
+	server, apiCall := testPrepareGetCI(t, p, ciName, responseText)
+	defer server.Close()
+
+	expectedErrorText := "More than one CI with name app-demoapp found in cmdb_ci: app-demoapp (class cmdb_ci_appl, sys_id 1), app-demoapp (class cmdb_ci_service, sys_id 2). Use the sys_id of the CI in label ci-name of the application"
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	cmdb, err := p.getCI(context.Background(), ciName)
+
+	s.Nil(cmdb, "No CI should be returned")
+	s.EqualError(err, expectedErrorText, "Expected error text is correct")
+	s.ErrorIs(err, ErrAmbiguousCI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCIBySysIdInClass() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.CIClass = "cmdb_ci_appl"
+
+	sysId := "1c741bd70b2322007518478d83673af3"
+	requestURI := getTestCIRequestURIWithField("cmdb_ci_appl", "sys_id", sysId)
+	responseText := fmt.Sprintf(`{"result":[{"install_status":"1", "sys_class_name":"cmdb_ci_appl", "name":"app-demoapp", "sys_id": "%s"}]}`, sysId)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	cmdb, err := p.getCI(context.Background(), sysId)
+
+	s.NoError(err, "No errors expected")
+	s.Equal("app-demoapp", cmdb.Name.Value, "Name should be read")
+	s.Equal(sysId, cmdb.SysId.Value, "SysId should be read")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCIByCorrelationIdNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.CICorrelationIdPattern = "^ext-[0-9]+$"
+
+	requestURI := getTestCIRequestURIWithField("cmdb_ci", "correlation_id", "ext-12345")
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = `{"result":[]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := "No CI with correlation_id ext-12345 found in cmdb_ci"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getCI(context.Background(), "ext-12345")
+
+	s.EqualError(err, expectedErrorText, "Expected error text is correct")
+	s.ErrorIs(err, ErrCINotFound, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CITestSuite) TestGetCINoCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	responseText := "{\"result\":[]}"
+	expectedErrorText := "No CI with name app-demoapp found in cmdb_ci"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	ciName := "app-demoapp"
+
+	requestURI := getTestCIRequestURI(ciName)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+
+	config.ServiceNowUrl = server.URL
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getCI(context.Background(), ciName)
+
+	s.EqualError(err, expectedErrorText, "Expected error text is correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCIServerDown() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	expectedErrorText := "ServiceNow API server is down"
+	responseText := "<html><body>Server down!</body></html>"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	ciName := "app-demoapp"
+
+	requestURI := getTestCIRequestURI(ciName)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	_, err := p.getCI(context.Background(), "app-demoapp")
+
+	s.EqualError(err, expectedErrorText, "Correct error")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetCINoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
+	responseText := "<Result/>"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	ciName := "app-demoapp"
+
+	requestURI := getTestCIRequestURI(ciName)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getCI(context.Background(), ciName)
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRelatedCIsWithoutDepth() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Debug", "Related CIs of 5: 5")
+
+	ciSysIds, err := p.getRelatedCIs(context.Background(), "5")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"5"}, ciSysIds, "Only the CI itself expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func getTestRelatedCIsRequestURI(p *ServiceNowPlugin, query string) string {
+	return "/api/now/table/cmdb_rel_ci?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=parent&sysparm_exclude_reference_link=true"
+}
+
+func (s *ServiceNowTestSuite) TestGetRelatedCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIRelationDepth = 3
+	config.CIRelationTypes = []string{"Depends on::Used by", "Runs on::Runs"}
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN5^type.nameINDepends on::Used by,Runs on::Runs")] = `{"result":[{"parent":"7"},{"parent":"8"}]}`
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN7,8^type.nameINDepends on::Used by,Runs on::Runs")] = `{"result":[{"parent":"9"},{"parent":"5"},{"parent":"9"}]}`
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN9^type.nameINDepends on::Used by,Runs on::Runs")] = `{"result":[]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciSysIds, err := p.getRelatedCIs(context.Background(), "5")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"5", "7", "8", "9"}, ciSysIds, "CI and its parents expected, every CI once")
+	loggerObj.AssertCalled(t, "Debug", "Related CIs of 5: 5, 7, 8, 9")
+}
+
+func (s *ServiceNowTestSuite) TestGetRelatedCIsMaximumDepth() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIRelationDepth = 1
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN5")] = `{"result":[{"parent":"7"}]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciSysIds, err := p.getRelatedCIs(context.Background(), "5")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"5", "7"}, ciSysIds, "Parents of parents should not be searched")
+}
+
+func (s *ServiceNowTestSuite) TestGetRelatedCIsNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIRelationDepth = 1
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN5")] = "<Result/>"
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getRelatedCIs(context.Background(), "5")
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedChangeNumberAnnotation() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Annotations = map[string]string{"change-number": "Deploy hotfix for chg0030002"}
+
+	loggerObj.On("Debug", "Change number chg0030002 requested in access request test-ar")
+
+	changeNumber, err := p.getRequestedChangeNumber(&ar)
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG0030002", changeNumber, "Change number should be taken from the text in the annotation")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedChangeNumberLabel() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Labels = map[string]string{"change-number": "CHG0030003"}
+
+	loggerObj.On("Debug", "Change number CHG0030003 requested in access request test-ar")
+
+	changeNumber, err := p.getRequestedChangeNumber(&ar)
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG0030003", changeNumber, "Change number should be taken from the label")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedChangeNumberNotGiven() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+
+	changeNumber, err := p.getRequestedChangeNumber(&ar)
+
+	s.NoError(err, "No error expected")
+	s.Equal("", changeNumber, "No change number expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedChangeNumberIncorrect() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Annotations = map[string]string{"change-number": "the big release"}
+
+	expectedErrorText := "No change number found in change-number (the big release) of access request test-ar, use f.e. CHG0030002"
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.getRequestedChangeNumber(&ar)
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareServiceNowUser(t *testing.T, p *ServiceNowPlugin, query string, responseText string) (*Config, *httptest.Server) {
+	config := testNewConfig(p)
+	config.RequesterCheck = true
+
+	requestURI := "/api/now/table/sys_user?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=sys_id&sysparm_limit=2"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return config, server
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedIncidentNumber() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Annotations = map[string]string{"incident-number": "Website down, see inc0010001"}
+
+	loggerObj.On("Debug", "Incident number inc0010001 requested in access request test-ar")
+
+	incidentNumber, err := p.getRequestedIncidentNumber(&ar)
+
+	s.NoError(err, "No error expected")
+	s.Equal("INC0010001", incidentNumber, "Incident number should be taken from the text in the annotation")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedIncidentNumberNotGiven() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Annotations = map[string]string{"change-number": "CHG0030002"}
+
+	incidentNumber, err := p.getRequestedIncidentNumber(&ar)
+
+	s.NoError(err, "No error expected")
+	s.Equal("", incidentNumber, "No incident number expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetRequestedIncidentNumberIncorrect() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Labels = map[string]string{"incident-number": "outage"}
+
+	expectedErrorText := "No incident number found in incident-number (outage) of access request test-ar, use f.e. INC0010001"
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.getRequestedIncidentNumber(&ar)
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidIncident, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetJustification() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+	ar.Annotations = map[string]string{"justification": "  Database is down, see alert 1234 \n"}
+
+	justification := p.getJustification(&ar)
+
+	s.Equal("Database is down, see alert 1234", justification, "Justification should be taken from the annotation")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetJustificationFromLabel() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.JustificationKey = "reason"
+
+	ar, _ := getTestARApp()
+	ar.Labels = map[string]string{"reason": "outage"}
+
+	justification := p.getJustification(&ar)
+
+	s.Equal("outage", justification, "Justification should be taken from the label with the configured key")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetJustificationNotGiven() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	ar, _ := getTestARApp()
+
+	justification := p.getJustification(&ar)
+
+	s.Equal("", justification, "No justification expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysId() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareServiceNowUser(t, p, "user_name=jdoe^active=true", `{"result":[{"sys_id":"u1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	sysId, err := p.getServiceNowUserSysId(context.Background(), "jdoe")
+
+	s.NoError(err, "No error expected")
+	s.Equal("u1", sysId, "Sys_id of the user expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysIdMapped() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config, server := testPrepareServiceNowUser(t, p, "user_name=jdoe^active=true", `{"result":[{"sys_id":"u1"}]}`)
+	defer server.Close()
+	config.RequesterMapping = map[string]string{"jane.doe@example.com": "jdoe"}
+
+	loggerObj.On("Debug", mock.Anything)
+
+	sysId, err := p.getServiceNowUserSysId(context.Background(), "jane.doe@example.com")
+
+	s.NoError(err, "No error expected")
+	s.Equal("u1", sysId, "Sys_id of the mapped user expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysIdEmail() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config, server := testPrepareServiceNowUser(t, p, "email=jane.doe%40example.com^active=true", `{"result":[{"sys_id":"u1"}]}`)
+	defer server.Close()
+	config.RequesterUserField = "email"
+
+	loggerObj.On("Debug", mock.Anything)
+
+	sysId, err := p.getServiceNowUserSysId(context.Background(), "jane.doe@example.com")
+
+	s.NoError(err, "No error expected")
+	s.Equal("u1", sysId, "Sys_id of the user with this email address expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysIdQueryOperator() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config, server := testPrepareServiceNowUser(t, p, "user_name=jdoe%5E%5EORuser_name%3Dadmin^active=true", `{"result":[]}`)
+	defer server.Close()
+	config.RequesterMapping = map[string]string{"jane.doe@example.com": "jdoe^ORuser_name=admin"}
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No active ServiceNow user found with user_name jdoe^ORuser_name=admin for requester jane.doe@example.com")
+
+	sysId, err := p.getServiceNowUserSysId(context.Background(), "jane.doe@example.com")
+
+	s.ErrorIs(err, ErrRequesterNotAssigned, "A ^ in the username should not add a condition to the query")
+	s.Equal("", sysId, "No sys_id expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysIdNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareServiceNowUser(t, p, "user_name=jdoe^active=true", `{"result":[]}`)
+	defer server.Close()
+
+	expectedErrorText := "No active ServiceNow user found with user_name jdoe for requester jdoe"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.getServiceNowUserSysId(context.Background(), "jdoe")
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetServiceNowUserSysIdMoreThanOne() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareServiceNowUser(t, p, "user_name=jdoe^active=true", `{"result":[{"sys_id":"u1"},{"sys_id":"u2"}]}`)
+	defer server.Close()
+
+	expectedErrorText := "More than one active ServiceNow user found with user_name jdoe for requester jdoe"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.getServiceNowUserSysId(context.Background(), "jdoe")
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestCIMethods(t *testing.T) {
+	suite.Run(t, new(CITestSuite))
+}
+
+func getHttpDateTime(t time.Time) string {
+	return fmt.Sprintf("%04d%%2d%02d%%2d%02d", t.Year(), t.Month(), t.Day())
+}
+
+func getExpectedRequestURI(cmdb_ci string, startDate time.Time, endDate time.Time, sysparmOffset int) string {
+	requestURIStart := "/api/now/table/change_request?sysparm_query=cmdb_ci%3d" + cmdb_ci + "%5estate%3d%2d1%5ephase%3drequested%5eapproval%3dapproved%5eactive%3dtrue"
+
+	startDateHttpString := getHttpDateTime(startDate)
+	endDateHttpString := getHttpDateTime(endDate)
+	firstTimeString := "00%3a00%3a00"
+	lastTimeString := "23%3a59%3a59"
+	requestURIStartDatePart := "GOTOstart_date%3e" + startDateHttpString + "%20" + firstTimeString
+	requestURIEndDatePart := "GOTOend_date%3c" + endDateHttpString + "%20" + lastTimeString
+
+	sysparmOffsetString := fmt.Sprintf("%d", sysparmOffset)
+	requestURIEnd := "&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=5&sysparm_offset=" + sysparmOffsetString
+
+	return requestURIStart + "%5e" + requestURIStartDatePart + "%5e" + requestURIEndDatePart + requestURIEnd
+}
+
+func (s *ChangeTestSuite) TestEncodeServiceNowQuery() {
+	p, _ := testGetPlugin()
+
+	encodedQuery := p.encodeServiceNowQuery("state=-1^start_date>2025-05-20 00:00:00")
+
+	s.Equal("state%3d%2d1%5estart_date%3e2025%2d05%2d20%2000%3a00%3a00", encodedQuery, "Query should be encoded for the URL")
+}
+
+func (s *ChangeTestSuite) TestGetChangeEligibilityQuery() {
+	p, _ := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeEligibility = ChangeEligibility{
+		Default: "state=-1^approval=approved",
+		Types:   map[string]string{"emergency": "state=-2"},
+	}
+
+	s.Equal("state=-2", p.getChangeEligibilityQuery("emergency"), "Conditions of the change type expected")
+	s.Equal("state=-1^approval=approved", p.getChangeEligibilityQuery("normal"), "Default conditions expected for other change types")
+}
+
+func (s *ChangeTestSuite) TestGetChangeEligibilityQueryWithoutConfiguration() {
+	p, _ := testGetPlugin()
+	testNewConfig(p)
+
+	s.Equal(DefaultChangeEligibilityQuery, p.getChangeEligibilityQuery("normal"), "Built in default conditions expected")
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow0Days() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	cmdbCi := "id1"
+	sysparmOffset := 0
+
+	config.TimeWindowChangesDays = 0
+	startDate := time.Now() // first time of today
+	endDate := time.Now()   // last time of today
+	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+
+	requestURI := p.getChangeRequestURI([]string{cmdbCi}, sysparmOffset)
+
+	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow1Days() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	cmdbCi := "id2"
+	sysparmOffset := 0
+
+	config.TimeWindowChangesDays = 1
+	startDate := time.Now().Add(-1 * 24 * time.Hour) // first time of yesterday
+	endDate := time.Now().Add(1 * 24 * time.Hour)    // last time of tomorrow
+	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+
+	requestURI := p.getChangeRequestURI([]string{cmdbCi}, sysparmOffset)
+
+	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindow7Days() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	cmdbCi := "id3"
+	sysparmOffset := 0
+
+	config.TimeWindowChangesDays = 7
+	startDate := time.Now().Add(-7 * 24 * time.Hour) // first time of last week
+	endDate := time.Now().Add(7 * 24 * time.Hour)    // last time of next week
+	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+
+	requestURI := p.getChangeRequestURI([]string{cmdbCi}, sysparmOffset)
+
+	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIDateWindowDifferentSysparmOffset() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	cmdbCi := "cioffset"
+	sysparmOffset := 5
+
+	config.TimeWindowChangesDays = 7
+	startDate := time.Now().Add(-7 * 24 * time.Hour) // first time of last week
+	endDate := time.Now().Add(7 * 24 * time.Hour)    // last time of next week
+	expectedRequestURI := getExpectedRequestURI(cmdbCi, startDate, endDate, sysparmOffset)
+
+	requestURI := p.getChangeRequestURI([]string{cmdbCi}, sysparmOffset)
+
+	s.Equal(expectedRequestURI, requestURI, "RequestURI should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIWithChangeTypes() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.TimeWindowChangesDays = 0
+	config.ChangeEligibility = ChangeEligibility{
+		Default: "state=-1",
+		Types:   map[string]string{"standard": "state=-1^risk!=1", "emergency": "state=-2"},
+	}
+
+	today := fmt.Sprintf("%04d-%02d-%02d", time.Now().Year(), time.Now().Month(), time.Now().Day())
+	window := fmt.Sprintf("^GOTOstart_date>%s 00:00:00^GOTOend_date<%s 23:59:59", today, today)
+	expectedQuery := "cmdb_ci=id1^type=emergency^state=-2" + window +
+		"^NQcmdb_ci=id1^type=standard^state=-1^risk!=1" + window +
+		"^NQcmdb_ci=id1^typeNOT INemergency,standard^state=-1" + window
+	expectedRequestURI := "/api/now/table/change_request?sysparm_query=" + p.encodeServiceNowQuery(expectedQuery) +
+		"&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=5&sysparm_offset=0"
+
+	requestURI := p.getChangeRequestURI([]string{"id1"}, 0)
+
+	s.Equal(expectedRequestURI, requestURI, "Every change type should have its own part of the query")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIRelatedCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.TimeWindowChangesDays = 0
+
+	today := fmt.Sprintf("%04d-%02d-%02d", time.Now().Year(), time.Now().Month(), time.Now().Day())
+	window := fmt.Sprintf("^GOTOstart_date>%s 00:00:00^GOTOend_date<%s 23:59:59", today, today)
+	expectedQuery := "cmdb_ciIN5,7^" + DefaultChangeEligibilityQuery + window
+	expectedRequestURI := "/api/now/table/change_request?sysparm_query=" + p.encodeServiceNowQuery(expectedQuery) +
+		"&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=5&sysparm_offset=0"
+
+	requestURI := p.getChangeRequestURI([]string{"5", "7"}, 0)
+
+	s.Equal(expectedRequestURI, requestURI, "Changes of all related CIs should be searched")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeRequestURIAffectedCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.TimeWindowChangesDays = 0
+	config.ChangeAffectedCIs = true
+
+	today := fmt.Sprintf("%04d-%02d-%02d", time.Now().Year(), time.Now().Month(), time.Now().Day())
+	window := fmt.Sprintf("^GOTOstart_date>%s 00:00:00^GOTOend_date<%s 23:59:59", today, today)
+	expectedQuery := "cmdb_ci=5^" + DefaultChangeEligibilityQuery + window +
+		"^NQRLQUERYtask_ci.task,>=1^ci_itemIN5^ENDRLQUERY^" + DefaultChangeEligibilityQuery + window
+	expectedRequestURI := "/api/now/table/change_request?sysparm_query=" + p.encodeServiceNowQuery(expectedQuery) +
+		"&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=5&sysparm_offset=0"
+
+	requestURI := p.getChangeRequestURI([]string{"5"}, 0)
+
+	s.Equal(expectedRequestURI, requestURI, "Changes with the CI as affected CI should be searched as well")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesOneChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	cmdbCi := "1chg"
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "1"}]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", config.ServiceNowUrl, requestURI)
+	loggerObj.On("Debug", "apiCall: "+apiCall)
+	loggerObj.On("Debug", responseText)
+
+	changes, number, err := p.getChanges(context.Background(), []string{cmdbCi}, sysparmOffset)
+
+	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
+	s.Equal(1, number, "Number should be incremented by the number of changes that are received")
+	s.NoError(err, "No errors expected")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesTwoChanges() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	cmdbCi := "chg2"
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "2"},
+                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00", "sys_id": "22"}]}`
+
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+	defer server.Close()
+
+	apiCall := fmt.Sprintf("%s%s", config.ServiceNowUrl, requestURI)
+	loggerObj.On("Debug", "apiCall: "+apiCall)
+	loggerObj.On("Debug", responseText)
+
+	changes, newSysparmOffset, err := p.getChanges(context.Background(), []string{cmdbCi}, sysparmOffset)
+
+	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
+	s.Equal(2, newSysparmOffset, "SysparmOffset should be incremented by the number of changes that are received")
+	s.Equal("2", changes[0].SysId, "SysId should be incremented by the number of changes that are received")
+	s.Equal("CHG300031", changes[1].Number, "Change number should be the same as in the API result")
+	s.Equal("22", changes[1].SysId, "SysId should be the same as in the API result")
+	s.NoError(err, "No errors expected")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesExactAPIWindowSize() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	cmdbCi := "chg5"
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "1"},
+                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00", "sys_id": "2"},
+                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00", "sys_id": "3"},
+                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00", "sys_id": "4"},
+                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00", "sys_id": "5"}]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changes, newSysparmOffet, err := p.getChanges(context.Background(), []string{cmdbCi}, sysparmOffset)
+
+	s.Equal("CHG300030", changes[0].Number, "Change number should be the same as in the API result")
+	s.Equal(5, newSysparmOffet, "New sysparmOffset should be incremented by the number of changes that are received")
+	s.Equal("CHG300031", changes[1].Number, "Change number should be the same as in the API result")
+	s.Equal("CHG300032", changes[2].Number, "Change number should be the same as in the API result")
+	s.Equal("CHG300033", changes[3].Number, "Change number should be the same as in the API result")
+	s.Equal("CHG300034", changes[4].Number, "Change number should be the same as in the API result")
+	s.NoError(err, "No errors expected")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesNoChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	cmdbCi := "ci1"
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := "{\"result\":[]}"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Info", "No changes found")
+
+	changes, newPointer, err := p.getChanges(context.Background(), []string{cmdbCi}, 0)
+
+	s.Equal(0, len(changes), "No changes should be found")
+	s.Equal(0, newPointer, "New value for offset should be 0")
+	s.EqualError(err, "No changes found", "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	responseText := "!"
+	expectedErrorText := "Error in json.Unmarshal: invalid character '!' looking for beginning of value (!)"
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	cmdbCi := "ci5"
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, _, err := p.getChanges(context.Background(), []string{cmdbCi}, 0)
+
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangesAPIServerDown() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	sysparmOffset := 0
+	cmdbCi := "ci6"
+	responseText := "<html><body>Server down!</body></html>"
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+
+	apiCall := fmt.Sprintf("%s%s", server.URL, requestURI)
+	expectedErrorText := "ServiceNow API server is down"
+
+	loggerObj.On("Debug", fmt.Sprintf("apiCall: %s", apiCall))
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	_, _, err := p.getChanges(context.Background(), []string{cmdbCi}, sysparmOffset)
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func getTestChangeByNumberRequestURI(changeNumber string) string {
+	return fmt.Sprintf("/api/now/table/change_request?number=%s&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,cmdb_ci,state,approval,risk,assigned_to,assignment_group&sysparm_exclude_reference_link=true", changeNumber)
+}
+
+func (s *ChangeTestSuite) TestGetChangeByNumberFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	changeNumber := "CHG300030"
+	requestURI := getTestChangeByNumberRequestURI(changeNumber)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id": "1"}]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", "apiCall: "+config.ServiceNowUrl+requestURI)
+	loggerObj.On("Debug", responseText)
+
+	change, err := p.getChangeByNumber(context.Background(), changeNumber)
+
+	s.Equal("CHG300030", change.Number, "Change number should be the same as in the API result")
+	s.Equal("1", change.SysId, "SysId should be the same as in the API result")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeByNumberNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	changeNumber := "CHG300039"
+	requestURI := getTestChangeByNumberRequestURI(changeNumber)
+	responseText := `{"result":[]}`
+	expectedErrorText := "No change with number CHG300039 found"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", "apiCall: "+config.ServiceNowUrl+requestURI)
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getChangeByNumber(context.Background(), changeNumber)
+
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeByNumberNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	changeNumber := "CHG300030"
+	requestURI := getTestChangeByNumberRequestURI(changeNumber)
+	responseText := "!"
+	expectedErrorText := "Error in json.Unmarshal: invalid character '!' looking for beginning of value (!)"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", "apiCall: "+config.ServiceNowUrl+requestURI)
+	loggerObj.On("Debug", responseText)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getChangeByNumber(context.Background(), changeNumber)
+
+	s.EqualError(err, expectedErrorText, "Correct error text")
+	loggerObj.AssertExpectations(t)
+}
+
+func getTestChangeTaskRequestURI(query string) string {
+	query = strings.ReplaceAll(query, "-", "%2d")
+	query = strings.ReplaceAll(query, "=", "%3d")
+	query = strings.ReplaceAll(query, "^", "%5e")
+
+	return "/api/now/table/change_task?sysparm_query=" + query +
+		"&sysparm_fields=number,short_description,planned_start_date,planned_end_date,sys_id,assigned_to,assignment_group," +
+		"change_request,change_request.number,change_request.type,change_request.risk,change_request.state,change_request.approval" +
+		"&sysparm_exclude_reference_link=true&sysparm_limit=5&sysparm_offset=0"
+}
+
+func (s *ChangeTestSuite) TestGetChangeTaskRequestURI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	requestURI := p.getChangeTaskRequestURI([]string{"5"}, "", 0)
+
+	s.Equal(getTestChangeTaskRequestURI("cmdb_ci=5^active=true"), requestURI, "Open change tasks of the CI should be requested")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeTaskRequestURIWithChangeNumber() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	requestURI := p.getChangeTaskRequestURI([]string{"5", "50"}, "CHG300030", 0)
+
+	s.Equal(getTestChangeTaskRequestURI("cmdb_ciIN5,50^active=true^change_request.number=CHG300030"), requestURI, "Only the change tasks of the requested change should be requested")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeTasks() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeTaskRequestURI("cmdb_ci=5^active=true")] = `{"result":[{"number":"CTASK0010001", "change_request":"1", "change_request.number":"CHG300030"}]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changeTasks, number, err := p.getChangeTasks(context.Background(), []string{"5"}, "", 0)
+
+	s.NoError(err, "No error expected")
+	s.Equal("CTASK0010001", changeTasks[0].Number, "Change task number should be the same as in the API result")
+	s.Equal("1", changeTasks[0].ChangeRequest.Value, "Sys_id of the change should be the same as in the API result")
+	s.Equal("CHG300030", changeTasks[0].ChangeNumber, "Change number should be the same as in the API result")
+	s.Equal(1, number, "Number should be incremented by the number of change tasks that are received")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestGetChangeTasksNoChangeTask() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeTaskRequestURI("cmdb_ci=5^active=true^change_request.number=CHG300030")] = `{"result":[]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No open change tasks of change CHG300030 found")
+
+	changeTasks, _, err := p.getChangeTasks(context.Background(), []string{"5"}, "CHG300030", 0)
+
+	s.Empty(changeTasks, "No change tasks expected")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func getTestEligibilityRequestURI(sysId string, eligibilityQuery string) string {
+	query := fmt.Sprintf("sys_id%%3d%s%%5e%s", sysId, eligibilityQuery)
+	query = strings.ReplaceAll(query, "-", "%2d")
+	query = strings.ReplaceAll(query, "=", "%3d")
+	query = strings.ReplaceAll(query, "^", "%5e")
+
+	return "/api/now/table/change_request?sysparm_query=" + query + "&sysparm_fields=sys_id"
+}
+
+func (s *ChangeTestSuite) TestCheckEligibility() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestEligibilityRequestURI("1", DefaultChangeEligibilityQuery)] = `{"result":[{"sys_id":"1"}]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	err := p.checkEligibility(context.Background(), change)
+
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestCheckEligibilityConditionsNotMet() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeEligibility = ChangeEligibility{
+		Default: DefaultChangeEligibilityQuery,
+		Types:   map[string]string{"emergency": "state=-2^approval=approved"},
+	}
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestEligibilityRequestURI("1", "state=-2^approval=approved")] = `{"result":[]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := "Change CHG300030 (type: emergency, state: -1, approval: requested) doesn't meet the conditions to be implemented: state=-2^approval=approved"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	change.Type = "emergency"
+	change.Approval = "requested"
+	err := p.checkEligibility(context.Background(), change)
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestParseChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var change_servicenow = ChangeServiceNow{
+		Type:             "1",
+		Number:           "CHG12345",
+		EndDate:          "2025-05-16 23:59:59",
+		ShortDescription: "Test",
+		StartDate:        "2025-05-16 08:00:00",
+		SysId:            "sys_id",
+	}
+
+	debugText := fmt.Sprintf("Change: Type: %s, Number: %s, Short description: %s, Start Date: %s, End Date: %s, SysId: %s",
+		change_servicenow.Type,
+		change_servicenow.Number,
+		change_servicenow.ShortDescription,
+		change_servicenow.StartDate,
+		change_servicenow.EndDate,
+		change_servicenow.SysId)
+	loggerObj.On("Debug", debugText)
+
+	chg, err := p.parseChange(change_servicenow)
+
+	s.Equal(change_servicenow.Type, chg.Type, "Change type should be the same")
+	s.Equal(change_servicenow.Number, chg.Number, "Change number should be the same")
+	s.Equal(time.Date(2025, 05, 16, 23, 59, 59, 0, time.UTC), chg.EndDate, "Change end date should be the same")
+	s.Equal(change_servicenow.ShortDescription, chg.ShortDescription, "Change short description should be the same")
+	s.Equal(time.Date(2025, 05, 16, 8, 0, 0, 0, time.UTC), chg.StartDate, "Change start date should be the same")
+	s.Equal(change_servicenow.SysId, chg.SysId, "Change sys_id should be the same")
+	s.Equal(TableChangeRequest, chg.Table, "Table should be change_request")
+	s.NoError(err, "No errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ChangeTestSuite) TestParseChangeTask() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	changeTaskServiceNow := ChangeTaskServiceNow{
+		Number:           "CTASK0010001",
+		ShortDescription: "deploy",
+		StartDate:        "2025-05-16 08:00:00",
+		EndDate:          "2025-05-16 10:00:00",
+		SysId:            "t1",
+		AssignedTo:       ServiceNowValue{Value: "u1"},
+		ChangeRequest:    ServiceNowValue{Value: "1"},
+		ChangeNumber:     "CHG300030",
+		ChangeType:       "normal",
+		ChangeRisk:       "4",
+	}
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changeTask, err := p.parseChangeTask(changeTaskServiceNow)
+
+	s.NoError(err, "No errors expected")
+	s.Equal("CTASK0010001", changeTask.Number, "Number should be the number of the change task")
+	s.Equal("normal", changeTask.Type, "Type should be the type of the change")
+	s.Equal("4", changeTask.Risk, "Risk should be the risk of the change")
+	s.Equal(time.Date(2025, 05, 16, 8, 0, 0, 0, time.UTC), changeTask.StartDate, "Start date should be the planned start date")
+	s.Equal(time.Date(2025, 05, 16, 10, 0, 0, 0, time.UTC), changeTask.EndDate, "End date should be the planned end date")
+	s.Equal("u1", changeTask.AssignedTo, "Assigned to should be the assignee of the change task")
+	s.Equal(TableChangeTask, changeTask.Table, "Table should be change_task")
+	s.Equal("CHG300030", changeTask.ParentNumber, "Parent number should be the number of the change")
+	s.Equal("1", changeTask.ParentSysId, "Parent sys_id should be the sys_id of the change")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestChangeMethods(t *testing.T) {
+	suite.Run(t, new(ChangeTestSuite))
+}
+
+func (s *CITestSuite) TestGetCIStatusPolicy() {
+	p, _ := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIValidity = CIValidity{
+		Default: CIStatusPolicy{InstallStatus: []string{"1"}},
+		Classes: map[string]CIStatusPolicy{"cmdb_ci_service": {InstallStatus: []string{"1", "3"}, OperationalStatus: []string{"1"}}},
+	}
+
+	s.Equal(CIStatusPolicy{InstallStatus: []string{"1", "3"}, OperationalStatus: []string{"1"}}, p.getCIStatusPolicy("cmdb_ci_service"), "Statuses of the class expected")
+	s.Equal(CIStatusPolicy{InstallStatus: []string{"1"}}, p.getCIStatusPolicy("cmdb_ci_appl"), "Default statuses expected for other classes")
+}
+
+func (s *CITestSuite) TestGetCIStatusPolicyWithoutConfiguration() {
+	p, _ := testGetPlugin()
+	testNewConfig(p)
+
+	s.Equal(CIStatusPolicy{InstallStatus: []string{"1", "3", "4", "5"}}, p.getCIStatusPolicy("cmdb_ci_appl"), "Built in default statuses expected")
+}
+
+func (s *CITestSuite) TestFormatServiceNowValue() {
+	p, _ := testGetPlugin()
+
+	s.Equal("In Stock (6)", p.formatServiceNowValue(ServiceNowValue{Value: "6", DisplayValue: "In Stock"}), "Display value and value expected")
+	s.Equal("6", p.formatServiceNowValue(ServiceNowValue{Value: "6", DisplayValue: "6"}), "Value expected once")
+	s.Equal("6", p.formatServiceNowValue(ServiceNowValue{Value: "6"}), "Value expected without display value")
+}
+
+func testAllowedCIStatus(s *CheckCITestSuite, status string) {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var ci = CmdbServiceNow{
+		InstallStatus: ServiceNowValue{Value: status},
+		Name:          ServiceNowValue{Value: "whatever"},
+	}
+
+	err := p.checkCI(ci)
+
+	s.NoError(err, "Installed state should be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func testNotAllowedCIStatus(s *CheckCITestSuite, status string) {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	var ci = CmdbServiceNow{
+		InstallStatus: ServiceNowValue{Value: status},
+		Name:          ServiceNowValue{Value: "whatever"},
+	}
+
+	err := p.checkCI(ci)
+	expectedCheckString := fmt.Sprintf("Invalid install status %s for CI whatever", status)
+	s.EqualError(err, expectedCheckString, "Other states should not be accepted")
+	s.ErrorIs(err, ErrCIInvalidStatus, "Error should be of the correct kind")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckCITestSuite) TestCheckCICorrectState() {
+	const installed = "1"
+	const inMaintenance = "3"
+	const pendingInstall = "4"
+	const pendingRepair = "5"
+
+	validStates := []string{installed, inMaintenance, pendingInstall, pendingRepair}
+	for _, state := range validStates {
+		testAllowedCIStatus(s, state)
+	}
+}
+
+func (s *CheckCITestSuite) TestCheckCIInvalidState() {
+	invalidStates := []string{"0", "2", "6"}
+	for _, state := range invalidStates {
+		testNotAllowedCIStatus(s, state)
+	}
+}
+
+func (s *CheckCITestSuite) TestCheckCIRetired() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIValidity = CIValidity{Default: CIStatusPolicy{InstallStatus: []string{"1", "7"}}}
+
+	var ci = CmdbServiceNow{
+		InstallStatus:     ServiceNowValue{Value: "1", DisplayValue: "Installed"},
+		OperationalStatus: ServiceNowValue{Value: "6", DisplayValue: "Retired"},
+		ClassName:         ServiceNowValue{Value: "cmdb_ci_appl", DisplayValue: "Application"},
+		Name:              ServiceNowValue{Value: "app-demoapp"},
+	}
+
+	err := p.checkCI(ci)
+
+	s.EqualError(err, "CI app-demoapp (class cmdb_ci_appl) is retired (install status Installed (1), operational status Retired (6))", "Retired CIs should not be accepted")
+	s.ErrorIs(err, ErrCIInvalidStatus, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckCITestSuite) TestCheckCIInvalidOperationalStatus() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.CIValidity = CIValidity{
+		Default: CIStatusPolicy{InstallStatus: []string{"1"}},
+		Classes: map[string]CIStatusPolicy{"cmdb_ci_service": {InstallStatus: []string{"1"}, OperationalStatus: []string{"1"}}},
+	}
+
+	var ci = CmdbServiceNow{
+		InstallStatus:     ServiceNowValue{Value: "1", DisplayValue: "Installed"},
+		OperationalStatus: ServiceNowValue{Value: "2", DisplayValue: "Non-Operational"},
+		ClassName:         ServiceNowValue{Value: "cmdb_ci_service", DisplayValue: "Business Service"},
+		Name:              ServiceNowValue{Value: "app-demoapp"},
+	}
+
+	err := p.checkCI(ci)
+
+	s.EqualError(err, "Invalid operational status Non-Operational (2) for CI app-demoapp (class cmdb_ci_service)", "Operational status of the class should be checked")
+	s.ErrorIs(err, ErrCIInvalidStatus, "Error should be of the correct kind")
+
+	ci.ClassName = ServiceNowValue{Value: "cmdb_ci_appl"}
+	s.NoError(p.checkCI(ci), "Every operational status is valid for other classes")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckCITestSuite) TestCheckCIInvalidInstallStatusLabel() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	var ci = CmdbServiceNow{
+		InstallStatus: ServiceNowValue{Value: "6", DisplayValue: "In Stock"},
+		Name:          ServiceNowValue{Value: "app-demoapp"},
+	}
+
+	err := p.checkCI(ci)
+
+	s.EqualError(err, "Invalid install status In Stock (6) for CI app-demoapp", "The label of the status should be shown")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestCheckCI(t *testing.T) {
+	suite.Run(t, new(CheckCITestSuite))
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeCorrectTime() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	currentTime := time.Now()
+	startDate := currentTime.Add(-5 * time.Minute)
+	endDate := currentTime.Add(time.Hour * 2).Add(time.Microsecond * 50)
+
+	var change = Change{
+		Type:             "1",
+		Number:           "CHG12345",
+		EndDate:          endDate,
+		ShortDescription: "Test",
+		StartDate:        startDate,
+	}
+
+	remainingTime, err := p.checkChange(change, ChangeFilter{})
+
+	expectedRemainingTime := time.Duration(time.Hour * 2).Truncate(time.Second)
+
+	s.NoError(err, "Change that is started between start date and end date should be accepted")
+	s.Equal(expectedRemainingTime, remainingTime.Truncate(time.Second), "Remaining time should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func testChangeTimeIncorrect(s *CheckChangeTestSuite, currentTime time.Time, startDate time.Time, endDate time.Time, situation string) {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+
+	var change = Change{
+		Type:             "1",
+		Number:           "CHG12345",
+		EndDate:          endDate,
+		ShortDescription: "Test",
+		StartDate:        startDate,
+		SysId:            "1",
+	}
+
+	expectedErrorText := fmt.Sprintf("Change %s (%s) is not in the valid time range. start date: %s and end date: %s (current date: %s)",
+		change.Number,
+		change.ShortDescription,
+		p.getLocalTime(change.StartDate),
+		p.getLocalTime(change.EndDate),
+		p.getLocalTime(currentTime))
+	loggerObj.On("Debug", expectedErrorText)
+
+	_, err := p.checkChange(change, ChangeFilter{})
+
+	assert.EqualError(t, err, expectedErrorText, "Change that is started "+situation+" should not be accepted")
+	assert.ErrorIs(t, err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeTooEarly() {
+	currentTime := time.Now()
+	startDate := currentTime.Add(time.Hour)
+	endDate := currentTime.Add(time.Hour * 2)
+
+	testChangeTimeIncorrect(s, currentTime, startDate, endDate, "too early")
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeTooLate() {
+	currentTime := time.Now()
+	startDate := currentTime.Add(-2 * time.Hour)
+	endDate := currentTime.Add(-1 * time.Hour)
+
+	testChangeTimeIncorrect(s, currentTime, startDate, endDate, "too late")
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeWithinGracePeriodBeforeStart() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	currentTime := time.Now()
+	change := Change{Number: "CHG12345", StartDate: currentTime.Add(10 * time.Minute), EndDate: currentTime.Add(1 * time.Hour)}
+
+	remainingTime, err := p.checkChange(change, ChangeFilter{GraceBeforeStart: 15 * time.Minute, GraceAfterEnd: 10 * time.Minute})
+
+	s.NoError(err, "Change that starts within the grace period should be accepted")
+	s.Equal(70*time.Minute, remainingTime.Round(time.Minute), "Remaining time should include the grace period after the end")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeWithinGracePeriodAfterEnd() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	currentTime := time.Now()
+	change := Change{Number: "CHG12345", StartDate: currentTime.Add(-2 * time.Hour), EndDate: currentTime.Add(-5 * time.Minute)}
+
+	remainingTime, err := p.checkChange(change, ChangeFilter{GraceAfterEnd: 10 * time.Minute})
+
+	s.NoError(err, "Change that ended within the grace period should be accepted")
+	s.Equal(5*time.Minute, remainingTime.Round(time.Minute), "Remaining time should be the rest of the grace period")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckChangeOutsideGracePeriod() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	currentTime := time.Now()
+	change := Change{Number: "CHG12345", ShortDescription: "Test", StartDate: currentTime.Add(20 * time.Minute), EndDate: currentTime.Add(1 * time.Hour)}
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, err := p.checkChange(change, ChangeFilter{GraceBeforeStart: 15 * time.Minute})
+
+	s.ErrorContains(err, "Change CHG12345 (Test) is not in the valid time range", "Change that starts after the grace period should not be accepted")
+	s.ErrorContains(err, "with a grace period of 15m0s before the start", "Error should mention the grace period")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetRequestedChange() ChangeServiceNow {
+	return ChangeServiceNow{
+		Number:   "CHG300030",
+		CmdbCi:   "5",
+		State:    "-1",
+		Approval: "approved",
+	}
+}
+
+func testPrepareAffectedCIs(t *testing.T, p *ServiceNowPlugin, query string, responseText string) *httptest.Server {
+	config := testNewConfig(p)
+	config.ChangeAffectedCIs = true
+
+	requestURI := "/api/now/table/task_ci?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=ci_item&sysparm_exclude_reference_link=true&sysparm_limit=1"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func (s *CheckChangeTestSuite) TestCheckAffectedCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareAffectedCIs(t, p, "task=1^ci_itemIN6,7", `{"result":[{"ci_item":"7"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	affected, err := p.checkAffectedCIs(context.Background(), change, []string{"6", "7"})
+
+	s.NoError(err, "No error expected")
+	s.True(affected, "CI should be an affected CI of the change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckAffectedCIsNotAffected() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareAffectedCIs(t, p, "task=1^ci_itemIN6", `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	affected, err := p.checkAffectedCIs(context.Background(), change, []string{"6"})
+
+	s.NoError(err, "No error expected")
+	s.False(affected, "CI should not be an affected CI of the change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckAffectedCIsNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareAffectedCIs(t, p, "task=1^ci_itemIN6", "<Result/>")
+	defer server.Close()
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	_, err := p.checkAffectedCIs(context.Background(), change, []string{"6"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareGroupMember(t *testing.T, p *ServiceNowPlugin, query string, responseText string) *httptest.Server {
+	config := testNewConfig(p)
+	config.RequesterCheck = true
+
+	requestURI := "/api/now/table/sys_user_grmember?sysparm_query=" + p.encodeServiceNowQuery(query) + "&sysparm_fields=sys_id&sysparm_limit=1"
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func testGetAssignedChange() Change {
+	return Change{Number: "CHG300030", SysId: "1", AssignedTo: "u1", AssignmentGroup: "g1"}
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterWithoutCheck() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkRequester(context.Background(), "", testGetAssignedChange())
+
+	s.NoError(err, "Every change should be accepted when the requester is not checked")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterAssignedTo() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkRequester(context.Background(), "u1", testGetAssignedChange())
+
+	s.NoError(err, "The assignee of the change should be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterGroupMember() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareGroupMember(t, p, "user=u2^group=g1", `{"result":[{"sys_id":"m1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	err := p.checkRequester(context.Background(), "u2", testGetAssignedChange())
+
+	s.NoError(err, "A member of the assignment group should be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterNotAssigned() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareGroupMember(t, p, "user=u2^group=g1", `{"result":[]}`)
+	defer server.Close()
+
+	expectedErrorText := "Change CHG300030 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkRequester(context.Background(), "u2", testGetAssignedChange())
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterWithoutAssignmentGroup() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	expectedErrorText := "Change CHG300030 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Info", expectedErrorText)
+
+	change := testGetAssignedChange()
+	change.AssignmentGroup = ""
+	err := p.checkRequester(context.Background(), "u2", change)
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequesterNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareGroupMember(t, p, "user=u2^group=g1", "<Result/>")
+	defer server.Close()
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	err := p.checkRequester(context.Background(), "u2", testGetAssignedChange())
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetRolePolicy() *RolePolicy {
+	return &RolePolicy{ChangeTypes: []string{"normal", "emergency"}, MaxRisk: "moderate"}
+}
+
+func (s *CheckChangeTestSuite) TestCheckRolePolicyWithoutPolicy() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkRolePolicy("admin", nil, Change{Number: "CHG300030", Type: "standard", Risk: "1"})
+
+	s.NoError(err, "Every change should be accepted without a policy")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRolePolicyAllowed() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkRolePolicy("admin", testGetRolePolicy(), Change{Number: "CHG300030", Type: "normal", Risk: "3"})
+
+	s.NoError(err, "A normal change with moderate risk should be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRolePolicyTypeAndRiskNotAllowed() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	expectedErrorText := "Change CHG300030 cannot be used for role admin: type standard is not one of normal, emergency and risk 2 is higher than moderate"
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkRolePolicy("admin", testGetRolePolicy(), Change{Number: "CHG300030", Type: "standard", Risk: "2"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrChangeNotAllowed, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRolePolicyWithoutRisk() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	expectedErrorText := "Change CHG300030 cannot be used for role admin: risk  is higher than moderate"
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkRolePolicy("admin", testGetRolePolicy(), Change{Number: "CHG300030", Type: "normal"})
+
+	s.EqualError(err, expectedErrorText, "A change without a risk should not be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareExclusionGroupMember(t *testing.T, p *ServiceNowPlugin, userResponseText string, memberResponseText string) *httptest.Server {
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap["/api/now/table/sys_user?sysparm_query="+p.encodeServiceNowQuery("user_name=jdoe^active=true")+"&sysparm_fields=sys_id&sysparm_limit=2"] = userResponseText
+	responseMap["/api/now/table/sys_user_grmember?sysparm_query="+p.encodeServiceNowQuery("user=u2^group.nameINMajor Incident Managers,DBA")+"&sysparm_fields=sys_id&sysparm_limit=1"] = memberResponseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func testGetExclusionPolicy() ExclusionPolicy {
+	return ExclusionPolicy{Users: []string{"jane.doe@example.com"}, Groups: []string{"Major Incident Managers", "DBA"}}
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyWithoutAllowList() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkExclusionPolicy(context.Background(), "jdoe", "incidentmanagers", ExclusionPolicy{MaxDurationMinutes: 60})
+
+	s.NoError(err, "Every requester should be allowed without users and groups")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyUser() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	err := p.checkExclusionPolicy(context.Background(), "jane.doe@example.com", "incidentmanagers", testGetExclusionPolicy())
+
+	s.NoError(err, "A user in the policy should be allowed without a call to ServiceNow")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyGroupMember() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[{"sys_id":"u2"}]}`, `{"result":[{"sys_id":"m1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	err := p.checkExclusionPolicy(context.Background(), "jdoe", "incidentmanagers", testGetExclusionPolicy())
+
+	s.NoError(err, "A member of one of the groups should be allowed")
+	loggerObj.AssertCalled(t, "Debug", "Requester jdoe is a member of one of the groups of exclusion role incidentmanagers")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyNotAllowed() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[{"sys_id":"u2"}]}`, `{"result":[]}`)
+	defer server.Close()
+
+	expectedErrorText := "Requester jdoe is not allowed to use exclusion role incidentmanagers"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkExclusionPolicy(context.Background(), "jdoe", "incidentmanagers", testGetExclusionPolicy())
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrExclusionNotAllowed, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyUnknownUser() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[]}`, "")
+	defer server.Close()
+
+	expectedErrorText := "Requester jdoe is not allowed to use exclusion role incidentmanagers"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No active ServiceNow user found with user_name jdoe for requester jdoe")
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkExclusionPolicy(context.Background(), "jdoe", "incidentmanagers", testGetExclusionPolicy())
+
+	s.EqualError(err, expectedErrorText, "A requester that is not a ServiceNow user is not a member of a group")
+	s.ErrorIs(err, ErrExclusionNotAllowed, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckExclusionPolicyServiceNowError() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[{"sys_id":"u2"}]}`, "invalid")
+	defer server.Close()
+
+	unmarshalErrorText := "Error in json.Unmarshal: invalid character 'i' looking for beginning of value (invalid)"
+	expectedErrorText := "Requester jdoe is not allowed to use exclusion role incidentmanagers (the groups of the role cannot be checked in ServiceNow)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", unmarshalErrorText)
+	loggerObj.On("Warn", "Groups of exclusion role incidentmanagers cannot be checked, only the users of the role are allowed: "+unmarshalErrorText)
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkExclusionPolicy(context.Background(), "jdoe", "incidentmanagers", testGetExclusionPolicy())
+
+	s.EqualError(err, expectedErrorText, "Only the users should be allowed when the groups cannot be checked")
+	s.ErrorIs(err, ErrExclusionNotAllowed, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestIsExclusionGroupMember() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[{"sys_id":"u2"}]}`, `{"result":[{"sys_id":"m1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	member, err := p.isExclusionGroupMember(context.Background(), "jdoe", testGetExclusionPolicy().Groups)
+
+	s.NoError(err, "No error expected")
+	s.True(member, "Requester should be a member of one of the groups")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestIsExclusionGroupMemberUnknownUser() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[]}`, "")
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No active ServiceNow user found with user_name jdoe for requester jdoe")
+
+	member, err := p.isExclusionGroupMember(context.Background(), "jdoe", testGetExclusionPolicy().Groups)
+
+	s.NoError(err, "A requester that is not a ServiceNow user is not an error")
+	s.False(member, "A requester that is not a ServiceNow user is not a member of a group")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestIsExclusionGroupMemberInvalidResponse() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareExclusionGroupMember(t, p, `{"result":[{"sys_id":"u2"}]}`, "invalid")
+	defer server.Close()
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character 'i' looking for beginning of value (invalid)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	member, err := p.isExclusionGroupMember(context.Background(), "jdoe", testGetExclusionPolicy().Groups)
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	s.False(member, "Membership is unknown when ServiceNow cannot be checked")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestFilterChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	change := testGetAssignedChange()
+	change.Type = "normal"
+	change.Risk = "4"
+	err := p.filterChange(context.Background(), ChangeFilter{RequesterSysId: "u1", Role: "admin", RolePolicy: testGetRolePolicy()}, change)
+
+	s.NoError(err, "Change should pass the filter")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestFilterChangeRolePolicyFirst() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	// The role policy is checked before the requester, so ServiceNow is not asked for the group members
+	loggerObj.On("Info", "Change CHG300030 cannot be used for role admin: type standard is not one of normal, emergency")
+
+	change := testGetAssignedChange()
+	change.Type = "standard"
+	change.Risk = "4"
+	err := p.filterChange(context.Background(), ChangeFilter{RequesterSysId: "u2", Role: "admin", RolePolicy: testGetRolePolicy()}, change)
+
+	s.ErrorIs(err, ErrChangeNotAllowed, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	err := p.checkRequestedChange(context.Background(), testGetRequestedChange(), "app-demoapp", []string{"5"})
+
+	s.NoError(err, "No error expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChangeOtherCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	expectedErrorText := "Change CHG300030 is not linked to CI app-demoapp"
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkRequestedChange(context.Background(), testGetRequestedChange(), "app-demoapp", []string{"6"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrChangeNotLinked, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChangeAffectedCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareAffectedCIs(t, p, "task=1^ci_itemIN6", `{"result":[{"ci_item":"6"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	err := p.checkRequestedChange(context.Background(), change, "app-demoapp", []string{"6"})
+
+	s.NoError(err, "A change with the CI as affected CI should be accepted")
+	loggerObj.AssertCalled(t, "Debug", "CI app-demoapp is an affected CI of change CHG300030")
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChangeNotAffected() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareAffectedCIs(t, p, "task=1^ci_itemIN6", `{"result":[]}`)
+	defer server.Close()
+
+	expectedErrorText := "Change CHG300030 is not linked to CI app-demoapp"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	change := testGetRequestedChange()
+	change.SysId = "1"
+	err := p.checkRequestedChange(context.Background(), change, "app-demoapp", []string{"6"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrChangeNotLinked, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChangeParentCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	err := p.checkRequestedChange(context.Background(), testGetRequestedChange(), "app-demoapp", []string{"6", "5"})
+
+	s.NoError(err, "A change of a parent should be accepted")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *CheckChangeTestSuite) TestCheckRequestedChangeNotLinkedToParents() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	expectedErrorText := "Change CHG300030 is not linked to CI app-demoapp or to one of its parents in the CMDB"
+	loggerObj.On("Info", expectedErrorText)
+
+	err := p.checkRequestedChange(context.Background(), testGetRequestedChange(), "app-demoapp", []string{"6", "7"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func TestCheckChange(t *testing.T) {
+	suite.Run(t, new(CheckChangeTestSuite))
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIWithValidCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	loggerObj.On("Debug", mock.Anything)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	ciName := "app-demoapp"
+
+	requestURI := getTestCIRequestURI(ciName)
+	responseText := fmt.Sprintf(`{"result":[{"install_status":"1", "name":"%s", "sys_id": "1"}]}`, ciName)
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	CI, err := p.processCI(context.Background(), ciName)
+
+	s.NoError(err, "No error expected")
+	s.Equal("1", CI.SysId.Value, "sys_id should be 1")
+	// Don't assert logging, is done in other tests
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIWithoutValidCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	ciName := "app-demoapp"
+	requestURI := getTestCIRequestURI(ciName)
+	responseText := `{"result":[]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := fmt.Sprintf("No CI with name %s found in cmdb_ci", ciName)
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	CI, err := p.processCI(context.Background(), ciName)
+
+	s.EqualError(err, expectedErrorText, "Error should be correct")
+	s.ErrorIs(err, ErrCINotFound, "Error should be of the correct kind")
+	s.Nil(CI, "No CI should be returned")
+	// Don't assert logging, is done in other tests
+}
+
+func getTestCIRequestURI(ciName string) string {
+	return getTestCIRequestURIWithField("cmdb_ci", "name", ciName)
+}
+
+func getTestCIRequestURIWithField(ciClass string, queryField string, value string) string {
+	requestURI := fmt.Sprintf(`/api/now/table/%s?%s=%s&sysparm_fields=install_status,operational_status,sys_class_name,name,sys_id&sysparm_display_value=all`, ciClass, queryField, url.QueryEscape(value))
+	return requestURI
+}
+
+func getTestChangeRequestURI(cmdbCi string, sysparmOffset int) string {
+
+	// I know, next part is awful.
+	//
+	// Reason: search for start_date > 2025-05-20 00:00:00 and end_date < 2025-05-22 23:59:59 is not possible without sysparm_query,
+	// and to make it possible you need to use %20 for space, %5e for ^, etc.
+	//
+	// When we can search for number=CHG0030002 we don't need the time window anymore and then this part will be better
+	// readable.
+	//
+	// Sorry for now!
+
+	startDate := time.Now().Add(-1 * time.Hour * 24 * time.Duration(7))
+	startYear := startDate.Year()
+	startMonth := startDate.Month()
+	startDay := startDate.Day()
+
+	endDate := time.Now().Add(+1 * time.Hour * 24 * time.Duration(7))
+	endYear := endDate.Year()
+	endMonth := endDate.Month()
+	endDay := endDate.Day()
+
+	requestURIBegin := "/api/now/table/change_request?sysparm_query=cmdb_ci%3d" + cmdbCi + "%5estate%3d%2d1%5ephase%3drequested%5eapproval%3dapproved%5eactive%3dtrue%5eGOTOstart_date%3e"
+	startDateURI := fmt.Sprintf("%04d%%2d%02d%%2d%02d", startYear, startMonth, startDay)
+	endDateURI := fmt.Sprintf("%04d%%2d%02d%%2d%02d", endYear, endMonth, endDay)
+	requestURIEndDate := "%2000%3a00%3a00%5eGOTOend_date%3c"
+	requestURIRest := "%2023%3a59%3a59&sysparm_fields=type,number,short_description,start_date,end_date,sys_id,risk,assigned_to,assignment_group&sysparm_limit=5&sysparm_offset="
+
+	sysparmOffsetString := fmt.Sprintf("%d", sysparmOffset)
+	requestURI := requestURIBegin + startDateURI + requestURIEndDate + endDateURI + requestURIRest + sysparmOffsetString
+
+	return requestURI
+}
+
+func testGetValidChanges() []Change {
+	currentTime := time.Now()
+
+	return []Change{
+		{Number: "CHG300030", StartDate: currentTime.Add(-1 * time.Hour), EndDate: currentTime.Add(1 * time.Hour)},
+		{Number: "CHG300031", StartDate: currentTime.Add(-2 * time.Hour), EndDate: currentTime.Add(3 * time.Hour)},
+		{Number: "CHG300032", StartDate: currentTime.Add(-3 * time.Hour), EndDate: currentTime.Add(2 * time.Hour)},
+	}
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeLatestEnd() {
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Debug", "Change CHG300031 selected (latest-end) from valid changes CHG300030, CHG300031, CHG300032")
+
+	change, err := p.selectChange("app-demoapp", testGetValidChanges())
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300031", change.Number, "Change with the latest end date expected")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeEarliestStart() {
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeSelectionPolicy = ChangeSelectionEarliestStart
+
+	loggerObj.On("Debug", "Change CHG300032 selected (earliest-start) from valid changes CHG300030, CHG300031, CHG300032")
+
+	change, err := p.selectChange("app-demoapp", testGetValidChanges())
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300032", change.Number, "Change with the earliest start date expected")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeDenyWhenAmbiguous() {
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeSelectionPolicy = ChangeSelectionDenyWhenAmbiguous
+
+	expectedErrorText := "More than one valid change found for CI app-demoapp: CHG300030, CHG300031, CHG300032. Add the change number to the access request in annotation or label change-number"
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.selectChange("app-demoapp", testGetValidChanges())
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrAmbiguousChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeDenyWhenAmbiguousOneChange() {
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeSelectionPolicy = ChangeSelectionDenyWhenAmbiguous
+
+	change, err := p.selectChange("app-demoapp", testGetValidChanges()[:1])
+
+	s.NoError(err, "One valid change is not ambiguous")
+	s.Equal("CHG300030", change.Number, "The only valid change expected")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeExplicit() {
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ChangeSelectionPolicy = ChangeSelectionExplicit
+
+	expectedErrorText := "A change number is required, add it to the access request in annotation or label change-number. Valid changes for CI app-demoapp: CHG300030"
+	loggerObj.On("Info", expectedErrorText)
+
+	_, err := p.selectChange("app-demoapp", testGetValidChanges()[:1])
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrChangeNumberRequired, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectChangeNoValidChange() {
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	_, err := p.selectChange("app-demoapp", []Change{})
+
+	s.EqualError(err, "No valid change found", "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(s.T())
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	config.Timezone = "UTC"
+
+	currentTime := time.Now()
+	startDate := currentTime.Add(-5 * time.Minute)
+	endDate := currentTime.Add(time.Hour * 2)
+
+	cmdbCi := "a7b5e1"
+	ciName := "app-demoapp"
+	sysparmOffset := 0
+
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"%s", "end_date":"%s", "sys_id": "1"}]}`,
+		testConvertTimeToString(startDate),
+		testConvertTimeToString(endDate))
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changeRemainingTime, validChange, err := p.processChanges(context.Background(), ciName, []string{cmdbCi}, ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	if changeRemainingTime.Minutes() < 40 {
+		s.Fail("changeRemainingTime is too small, less than 40 minutes")
+	}
+
+	s.Equal("CHG300030", validChange.Number, "Numbers must be equal")
+	s.Equal("test", validChange.ShortDescription, "Short descriptions must be equal")
+	// Don't assert logging, is done in other tests
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithTwoValidChanges() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	currentTime := time.Now()
+	cmdbCi := "a7b5e1"
+
+	requestURI := getTestChangeRequestURI(cmdbCi, 0)
+	responseText := fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"short", "start_date":"%s", "end_date":"%s", "sys_id": "1"},
+                                {"type":"1", "number":"CHG300031", "short_description":"long", "start_date":"%s", "end_date":"%s", "sys_id": "2"}]}`,
+		testConvertTimeToString(currentTime.Add(-5*time.Minute)),
+		testConvertTimeToString(currentTime.Add(1*time.Hour)),
+		testConvertTimeToString(currentTime.Add(-5*time.Minute)),
+		testConvertTimeToString(currentTime.Add(3*time.Hour)))
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changeRemainingTime, validChange, err := p.processChanges(context.Background(), "app-demoapp", []string{cmdbCi}, ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300031", validChange.Number, "The change that ends last should be selected, not the first change")
+	if changeRemainingTime.Minutes() < 170 {
+		s.Fail("changeRemainingTime should be the remaining time of the selected change")
+	}
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithoutChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	sysparmOffset := 0
+	ciName := "app-demoapp1"
+	cmdbCi := "a7b5e2"
+
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedInfoString := "No changes found"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedInfoString)
+
+	_, _, err := p.processChanges(context.Background(), ciName, []string{cmdbCi}, ChangeFilter{})
+
+	s.EqualError(err, expectedInfoString, "Error should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+
+	// Don't assert logging, is done in other tests
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesWithOneInvalidChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.Timezone = "UTC"
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+
+	sysparmOffset := 0
+	ciName := "app-demoapp1"
+	cmdbCi := "a7b5e2"
+
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00", "sys_id": "abc123def567"}]}`
+	var responseMap = make(map[string]string)
+	responseMap[requestURI] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedInfoString := "No valid change found"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedInfoString)
+
+	_, _, err := p.processChanges(context.Background(), ciName, []string{cmdbCi}, ChangeFilter{})
+
+	s.EqualError(err, expectedInfoString, "Error should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+
+	// Don't assert logging, is done in other tests
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesTwoAPIWindowsWithValidChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	config.Timezone = "UTC"
+
+	currentTime := time.Now()
+	startDate := currentTime.Add(-5 * time.Minute)
+	endDate := currentTime.Add(time.Hour * 2)
+
+	ciName := "app-demoapp2"
+	cmdbCi := "ci1"
+
+	var responseMap = make(map[string]string)
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00","sys_id": "abc123def561"},
+                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00","sys_id": "abc123def562"},
+                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00","sys_id": "abc123def563"},
+                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00","sys_id": "abc123def564"},
+                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00","sys_id": "abc123def565"}]}`
+	responseMap[requestURI] = responseText
+
+	sysparmOffset = 5
+	requestURI = getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300040", "short_description":"test6", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00","sys_id": "abc123def570"},
+                                {"type":"1", "number":"CHG300041", "short_description":"test7", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00","sys_id": "abc123def571"},
+                                {"type":"1", "number":"CHG300042", "short_description":"test8", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00","sys_id": "abc123def572"},
+                                {"type":"1", "number":"CHG300043", "short_description":"test9", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00","sys_id": "abc123def573"},
+                                {"type":"1", "number":"CHG300044", "short_description":"test10", "start_date":"%s", "end_date":"%s","sys_id": "abc123def574"}]}`,
+		testConvertTimeToString(startDate),
+		testConvertTimeToString(endDate))
+	responseMap[requestURI] = responseText
+
+	sysparmOffset = 10
+	requestURI = getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseMap[requestURI] = `{"result":[]}`
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No changes found")
+
+	changeRemainingTime, validChange, err := p.processChanges(context.Background(), ciName, []string{cmdbCi}, ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	if changeRemainingTime.Minutes() < 40 {
+		s.Fail("changeRemainingTime is too small, less than 40 minutes")
+	}
+
+	s.Equal("CHG300044", validChange.Number, "Numbers must be correct")
+	s.Equal("test10", validChange.ShortDescription, "Short descriptions must be correct")
+	s.Equal("abc123def574", validChange.SysId, "sys_id must be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesTwoAPIWindowsErrorInSecondBatch() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	config.ServiceNowUsername = "testUser"
+	config.ServiceNowPassword = "testPassword"
+	config.Timezone = "UTC"
+
+	ciName := "app-demoapp3"
+	cmdbCi := "id2"
+
+	var responseMap = make(map[string]string)
+
+	sysparmOffset := 0
+	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00"},
+                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00"},
+                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00"},
+                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00"},
+                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00"}]}`
+	responseMap[requestURI] = responseText
+
+	sysparmOffset = 5
+	requestURI = getTestChangeRequestURI(cmdbCi, sysparmOffset)
+	responseText = `{"result":[]}`
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedInfoString := "No changes found"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedInfoString)
+
+	changeRemainingTime, _, err := p.processChanges(context.Background(), ciName, []string{cmdbCi}, ChangeFilter{})
+
+	s.EqualError(err, expectedInfoString, "Error should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	s.Equal(changeRemainingTime.Minutes(), 0.0, "changeRemainingTime is incorrect, different from 0")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesAssignedToRequester() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.RequesterCheck = true
+
+	startDate := time.Now().Add(-5 * time.Minute)
+	endDate := time.Now().Add(time.Hour * 2)
+	cmdbCi := "a7b5e1"
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeRequestURI(cmdbCi, 0)] = fmt.Sprintf(`{"result":[
+		{"type":"1", "number":"CHG300030", "short_description":"other team", "start_date":"%s", "end_date":"%s", "sys_id":"1", "assigned_to":{"link":"https://example.com/api/now/table/sys_user/u2","value":"u2"}},
+		{"type":"1", "number":"CHG300031", "short_description":"my change", "start_date":"%s", "end_date":"%s", "sys_id":"2", "assigned_to":{"link":"https://example.com/api/now/table/sys_user/u1","value":"u1"}}]}`,
+		testConvertTimeToString(startDate), testConvertTimeToString(endDate.Add(time.Hour)),
+		testConvertTimeToString(startDate), testConvertTimeToString(endDate))
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Change CHG300030 is not assigned to the requester or to one of the groups of the requester")
+
+	_, validChange, err := p.processChanges(context.Background(), "app-demoapp", []string{cmdbCi}, ChangeFilter{RequesterSysId: "u1"})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300031", validChange.Number, "Only the change of the requester should be selected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesNotAssignedToRequester() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.RequesterCheck = true
+
+	startDate := time.Now().Add(-5 * time.Minute)
+	endDate := time.Now().Add(time.Hour * 2)
+	cmdbCi := "a7b5e1"
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeRequestURI(cmdbCi, 0)] = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"other team", "start_date":"%s", "end_date":"%s", "sys_id":"1", "assigned_to":"u2"}]}`,
+		testConvertTimeToString(startDate), testConvertTimeToString(endDate))
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := "Change CHG300030 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	_, validChange, err := p.processChanges(context.Background(), "app-demoapp", []string{cmdbCi}, ChangeFilter{RequesterSysId: "u1"})
+
+	s.EqualError(err, expectedErrorText, "The requester should be the reason of the denial")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	s.Nil(validChange, "No change expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangesNotAllowedForRole() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+
+	startDate := time.Now().Add(-5 * time.Minute)
+	endDate := time.Now().Add(time.Hour * 2)
+	cmdbCi := "a7b5e1"
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeRequestURI(cmdbCi, 0)] = fmt.Sprintf(`{"result":[
+		{"type":"normal", "number":"CHG300030", "short_description":"high risk", "start_date":"%s", "end_date":"%s", "sys_id":"1", "risk":"2"},
+		{"type":"normal", "number":"CHG300031", "short_description":"low risk", "start_date":"%s", "end_date":"%s", "sys_id":"2", "risk":"4"}]}`,
+		testConvertTimeToString(startDate), testConvertTimeToString(endDate.Add(time.Hour)),
+		testConvertTimeToString(startDate), testConvertTimeToString(endDate))
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Change CHG300030 cannot be used for role admin: risk 2 is higher than moderate")
+
+	_, validChange, err := p.processChanges(context.Background(), "app-demoapp", []string{cmdbCi}, ChangeFilter{Role: "admin", RolePolicy: testGetRolePolicy()})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300031", validChange.Number, "Only the change with an allowed risk should be selected")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareRequestedChange(t *testing.T, p *ServiceNowPlugin, changeNumber string, responseText string) *httptest.Server {
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeByNumberRequestURI(changeNumber)] = responseText
+	responseMap[getTestEligibilityRequestURI("1", DefaultChangeEligibilityQuery)] = `{"result":[{"sys_id":"1"}]}`
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessRequestedChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	// A long change that starts and ends outside the time window of the search
+	startDate := time.Now().Add(-30 * 24 * time.Hour)
+	endDate := time.Now().Add(30 * 24 * time.Hour)
+	responseText := fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"long change", "start_date":"%s", "end_date":"%s", "sys_id":"1", "cmdb_ci":"5", "state":"-1", "approval":"approved"}]}`,
+		testConvertTimeToString(startDate),
+		testConvertTimeToString(endDate))
+	server := testPrepareRequestedChange(t, p, "CHG300030", responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	changeRemainingTime, validChange, err := p.processRequestedChange(context.Background(), "CHG300030", "app-demoapp", []string{"5"}, ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300030", validChange.Number, "Requested change expected")
+	if changeRemainingTime.Hours() < 29*24 {
+		s.Fail("changeRemainingTime is too small, less than 29 days")
+	}
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessRequestedChangeOtherCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id":"1", "cmdb_ci":"6", "state":"-1", "approval":"approved"}]}`
+	server := testPrepareRequestedChange(t, p, "CHG300030", responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "Change CHG300030 is not linked to CI app-demoapp")
+
+	changeRemainingTime, validChange, err := p.processRequestedChange(context.Background(), "CHG300030", "app-demoapp", []string{"5"}, ChangeFilter{})
+
+	s.ErrorIs(err, ErrChangeNotLinked, "Error should be of the correct kind")
+	s.Nil(validChange, "No change expected")
+	s.Equal(0.0, changeRemainingTime.Minutes(), "No remaining time expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessRequestedChangeNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	server := testPrepareRequestedChange(t, p, "CHG300039", `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", "No change with number CHG300039 found")
+
+	_, _, err := p.processRequestedChange(context.Background(), "CHG300039", "app-demoapp", []string{"5"}, ChangeFilter{})
+
+	s.EqualError(err, "No change with number CHG300039 found", "Error text should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessRequestedChangeNotAssignedToRequester() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	startDate := time.Now().Add(-5 * time.Minute)
+	endDate := time.Now().Add(2 * time.Hour)
+	responseText := fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"%s", "end_date":"%s", "sys_id":"1", "cmdb_ci":"5", "state":"-1", "approval":"approved", "assigned_to":"u2"}]}`,
+		testConvertTimeToString(startDate),
+		testConvertTimeToString(endDate))
+	server := testPrepareRequestedChange(t, p, "CHG300030", responseText)
+	defer server.Close()
+
+	expectedErrorText := "Change CHG300030 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	_, validChange, err := p.processRequestedChange(context.Background(), "CHG300030", "app-demoapp", []string{"5"}, ChangeFilter{RequesterSysId: "u1"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	s.Nil(validChange, "No change expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessRequestedChangeTooLate() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00", "sys_id":"1", "cmdb_ci":"5", "state":"-1", "approval":"approved"}]}`
+	server := testPrepareRequestedChange(t, p, "CHG300030", responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	_, _, err := p.processRequestedChange(context.Background(), "CHG300030", "app-demoapp", []string{"5"}, ChangeFilter{})
+
+	s.ErrorContains(err, "Change CHG300030 (test) is not in the valid time range", "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func testGetChangeTask() Change {
+	return Change{
+		Type:             "normal",
+		Number:           "CTASK0010001",
+		ShortDescription: "deploy",
+		SysId:            "t1",
+		Table:            TableChangeTask,
+		ParentNumber:     "CHG300030",
+		ParentSysId:      "1",
+	}
+}
+
+func testPrepareChangeTasks(t *testing.T, p *ServiceNowPlugin, query string, responseText string) *httptest.Server {
+	config := testNewConfig(p)
+	config.ChangeTasks = true
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestChangeTaskRequestURI(query)] = responseText
+	responseMap[getTestEligibilityRequestURI("1", DefaultChangeEligibilityQuery)] = `{"result":[{"sys_id":"1"}]}`
+	responseMap[getTestEligibilityRequestURI("2", DefaultChangeEligibilityQuery)] = `{"result":[]}`
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func testGetChangeTaskResponse(number string, changeSysId string, assignedTo string, startDate time.Time, endDate time.Time) string {
+	return fmt.Sprintf(`{"number":"%s", "short_description":"deploy", "planned_start_date":"%s", "planned_end_date":"%s", "sys_id":"t%s", "assigned_to":"%s", "change_request":"%s", "change_request.number":"CHG30003%s", "change_request.type":"normal"}`,
+		number,
+		testConvertTimeToString(startDate),
+		testConvertTimeToString(endDate),
+		number,
+		assignedTo,
+		changeSysId,
+		changeSysId)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangeTasks() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	currentTime := time.Now()
+	responseText := fmt.Sprintf(`{"result":[%s, %s, %s]}`,
+		testGetChangeTaskResponse("CTASK0010001", "1", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(1*time.Hour)),
+		testGetChangeTaskResponse("CTASK0010002", "1", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(2*time.Hour)),
+		testGetChangeTaskResponse("CTASK0010003", "1", "u1", currentTime.Add(1*time.Hour), currentTime.Add(3*time.Hour)))
+	server := testPrepareChangeTasks(t, p, "cmdb_ci=5^active=true", responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	remainingTime, validChangeTask, err := p.processChangeTasks(context.Background(), "app-demoapp", []string{"5"}, "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CTASK0010002", validChangeTask.Number, "The change task that ends last should be selected, a change task that didn't start yet is skipped")
+	s.Equal("CHG300031", validChangeTask.ParentNumber, "The change of the change task should be known")
+	if remainingTime.Minutes() < 119 {
+		s.Fail("remainingTime should be the remaining time of the change task")
+	}
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangeTasksChangeNotEligible() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	currentTime := time.Now()
+	responseText := fmt.Sprintf(`{"result":[%s]}`,
+		testGetChangeTaskResponse("CTASK0010001", "2", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(1*time.Hour)))
+	server := testPrepareChangeTasks(t, p, "cmdb_ci=5^active=true", responseText)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	_, validChangeTask, err := p.processChangeTasks(context.Background(), "app-demoapp", []string{"5"}, "", ChangeFilter{})
+
+	s.ErrorIs(err, ErrNoValidChange, "A change task of a change that can't be implemented should not be used")
+	s.Nil(validChangeTask, "No change task expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangeTasksNotAssignedToRequester() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	currentTime := time.Now()
+	responseText := fmt.Sprintf(`{"result":[%s]}`,
+		testGetChangeTaskResponse("CTASK0010001", "1", "u2", currentTime.Add(-5*time.Minute), currentTime.Add(1*time.Hour)))
+	server := testPrepareChangeTasks(t, p, "cmdb_ci=5^active=true", responseText)
+	defer server.Close()
+
+	expectedErrorText := "Change CTASK0010001 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	_, validChangeTask, err := p.processChangeTasks(context.Background(), "app-demoapp", []string{"5"}, "", ChangeFilter{RequesterSysId: "u1"})
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	s.Nil(validChangeTask, "No change task expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessChangeTasksRequestedChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	currentTime := time.Now()
+	responseText := fmt.Sprintf(`{"result":[%s, %s]}`,
+		testGetChangeTaskResponse("CTASK0010001", "1", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(2*time.Hour)),
+		testGetChangeTaskResponse("CTASK0010002", "1", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(1*time.Hour)))
+	server := testPrepareChangeTasks(t, p, "cmdb_ci=5^active=true^change_request.number=CHG300031", responseText)
+	defer server.Close()
+
+	// The change number is in the access request, the plugin doesn't have to ask for it
+	p.getConfig().ChangeSelectionPolicy = ChangeSelectionExplicit
+	loggerObj.On("Debug", mock.Anything)
+
+	_, validChangeTask, err := p.processChangeTasks(context.Background(), "app-demoapp", []string{"5"}, "CHG300031", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CTASK0010001", validChangeTask.Number, "The change task of the requested change that ends last should be selected")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareTwoCIs(t *testing.T, p *ServiceNowPlugin, secondInstallStatus string, secondChangeNumber string) *httptest.Server {
+	config := testNewConfig(p)
+
+	currentTime := time.Now()
+	startDate := testConvertTimeToString(currentTime.Add(-5 * time.Minute))
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestCIRequestURI("app-demoapp")] = `{"result":[{"install_status":"1", "name":"app-demoapp", "sys_id": "5"}]}`
+	responseMap[getTestCIRequestURI("app-second")] = fmt.Sprintf(`{"result":[{"install_status":"%s", "name":"app-second", "sys_id": "6"}]}`, secondInstallStatus)
+	responseMap[getTestChangeRequestURI("5", 0)] = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"first change", "start_date":"%s", "end_date":"%s", "sys_id":"1"}]}`,
+		startDate, testConvertTimeToString(currentTime.Add(2*time.Hour)))
+	if secondChangeNumber != "" {
+		responseMap[getTestChangeRequestURI("6", 0)] = fmt.Sprintf(`{"result":[{"type":"1", "number":"%s", "short_description":"second change", "start_date":"%s", "end_date":"%s", "sys_id":"2"}]}`,
+			secondChangeNumber, startDate, testConvertTimeToString(currentTime.Add(1*time.Hour)))
+	} else {
+		responseMap[getTestChangeRequestURI("6", 0)] = `{"result":[]}`
+	}
+	responseMap["/api/now/table/change_request/1"] = `{"whatever":"true"}`
+	responseMap["/api/now/table/change_request/2"] = `{"whatever":"true"}`
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, correctCMDBInstallStatus, "CHG300031")
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciChange, err := p.processCIChange(context.Background(), "app-demoapp", "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("app-demoapp", ciChange.CIName, "CI name should be correct")
+	s.Equal("5", ciChange.CISysId, "CI sys_id should be correct")
+	s.Equal("CHG300030", ciChange.Change.Number, "Change should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIChangeParentCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	config := testNewConfig(p)
+	config.CIRelationDepth = 1
+
+	currentTime := time.Now()
+	var responseMap = make(map[string]string)
+	responseMap[getTestCIRequestURI("app-demoapp")] = `{"result":[{"install_status":"1", "name":"app-demoapp", "sys_id": "5"}]}`
+	responseMap[getTestRelatedCIsRequestURI(p, "childIN5")] = `{"result":[{"parent":"9"}]}`
+	responseMap[p.getChangeRequestURI([]string{"5", "9"}, 0)] = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300039", "short_description":"service change", "start_date":"%s", "end_date":"%s", "sys_id":"3"}]}`,
+		testConvertTimeToString(currentTime.Add(-5*time.Minute)), testConvertTimeToString(currentTime.Add(time.Hour)))
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciChange, err := p.processCIChange(context.Background(), "app-demoapp", "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("5", ciChange.CISysId, "The CI of the application should be returned")
+	s.Equal("CHG300039", ciChange.Change.Number, "The change of the parent should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareCIWithChangeTasks(t *testing.T, p *ServiceNowPlugin, changeTasksResponse string) *httptest.Server {
+	config := testNewConfig(p)
+	config.ChangeTasks = true
+
+	currentTime := time.Now()
+	var responseMap = make(map[string]string)
+	responseMap[getTestCIRequestURI("app-demoapp")] = `{"result":[{"install_status":"1", "name":"app-demoapp", "sys_id": "5"}]}`
+	responseMap[getTestChangeTaskRequestURI("cmdb_ci=5^active=true")] = changeTasksResponse
+	responseMap[getTestEligibilityRequestURI("1", DefaultChangeEligibilityQuery)] = `{"result":[{"sys_id":"1"}]}`
+	responseMap[p.getChangeRequestURI([]string{"5"}, 0)] = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300039", "short_description":"change without tasks", "start_date":"%s", "end_date":"%s", "sys_id":"3"}]}`,
+		testConvertTimeToString(currentTime.Add(-5*time.Minute)), testConvertTimeToString(currentTime.Add(time.Hour)))
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIChangeWithChangeTask() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	currentTime := time.Now()
+	changeTasksResponse := fmt.Sprintf(`{"result":[%s]}`,
+		testGetChangeTaskResponse("CTASK0010001", "1", "u1", currentTime.Add(-5*time.Minute), currentTime.Add(1*time.Hour)))
+	server := testPrepareCIWithChangeTasks(t, p, changeTasksResponse)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciChange, err := p.processCIChange(context.Background(), "app-demoapp", "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CTASK0010001", ciChange.Change.Number, "The open change task should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIChangeWithoutChangeTask() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareCIWithChangeTasks(t, p, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No open change tasks found")
+
+	ciChange, err := p.processCIChange(context.Background(), "app-demoapp", "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Equal("CHG300039", ciChange.Change.Number, "Without an open change task, the change of the CI should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestProcessCIChangeInvalidCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, "6", "CHG300031")
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	ciChange, err := p.processCIChange(context.Background(), "app-second", "", ChangeFilter{})
+
+	s.ErrorIs(err, ErrCIInvalidStatus, "Error should be of the correct kind")
+	s.Nil(ciChange, "No change expected")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestFindValidCIChangesEvery() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, correctCMDBInstallStatus, "CHG300031")
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	validCIChanges, err := p.findValidCIChanges(context.Background(), []string{"app-demoapp", "app-second"}, "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Len(validCIChanges, 2, "Every CI should have a change")
+	s.Equal("CHG300031", validCIChanges[1].Change.Number, "Change of the second CI should be correct")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestFindValidCIChangesEveryWithoutChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, correctCMDBInstallStatus, "")
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	validCIChanges, err := p.findValidCIChanges(context.Background(), []string{"app-demoapp", "app-second"}, "", ChangeFilter{})
+
+	s.EqualError(err, "No changes found", "Error of the CI without change expected")
+	s.ErrorIs(err, ErrNoValidChange, "Error should be of the correct kind")
+	s.Nil(validCIChanges, "No changes expected when one CI has no change")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestFindValidCIChangesAny() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, "6", "CHG300031")
+	defer server.Close()
+	p.getConfig().CIPolicy = CIPolicyAny
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No valid change for CI app-second: Invalid install status 6 for CI app-second")
+
+	validCIChanges, err := p.findValidCIChanges(context.Background(), []string{"app-second", "app-demoapp"}, "", ChangeFilter{})
+
+	s.NoError(err, "No error expected")
+	s.Len(validCIChanges, 1, "The first CI with a valid change is enough")
+	s.Equal("CHG300030", validCIChanges[0].Change.Number, "Change of the valid CI should be used")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestFindValidCIChangesAnyWithoutChanges() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	server := testPrepareTwoCIs(t, p, "6", "CHG300031")
+	defer server.Close()
+	p.getConfig().CIPolicy = CIPolicyAny
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	_, err := p.findValidCIChanges(context.Background(), []string{"app-second", "app-unknown"}, "", ChangeFilter{})
+
+	s.ErrorIs(err, ErrCIInvalidStatus, "Error of the first CI expected")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error of the second CI expected")
+}
+
+func (s *PluginHelperMethodsTestSuite) TestSelectCIChange() {
+	p, _ := testGetPlugin()
+
+	currentTime := time.Now()
+	first := Change{Number: "CHG300030", SysId: "1", EndDate: currentTime.Add(2 * time.Hour)}
+	second := Change{Number: "CHG300031", SysId: "2", EndDate: currentTime.Add(1 * time.Hour)}
+	validCIChanges := []CIChange{
+		{CIName: "app-demoapp", CISysId: "5", Change: &first},
+		{CIName: "app-second", CISysId: "6", Change: &second},
+		{CIName: "app-third", CISysId: "7", Change: &first},
+	}
+
+	selected, otherChanges := p.selectCIChange(validCIChanges)
+
+	s.Equal("app-second", selected.CIName, "The change that ends first should be selected")
+	s.Equal([]Change{first}, otherChanges, "Other changes should only be returned once")
+}
+
+const testBlackoutSpansRequestURI = "/api/now/table/cmn_schedule_span?sysparm_query=schedule.type%3dblackout" +
+	"&sysparm_fields=name,schedule,schedule.name,start_date_time,end_date_time,repeat_type,repeat_count,repeat_until,days_of_week&sysparm_exclude_reference_link=true"
+
+func testGetScheduleTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405")
+}
+
+// The nightly window started a week ago and repeats every day, so an occurrence is active now. The weekly
+// window of s4 ended in 2024.
+func testGetBlackoutSpans() string {
+	currentTime := time.Now()
+	return fmt.Sprintf(`{"result":[
+		{"name":"year end", "schedule":"s1", "schedule.name":"Year end freeze", "start_date_time":"%s", "end_date_time":"%s", "repeat_type":""},
+		{"name":"last year", "schedule":"s2", "schedule.name":"Old freeze", "start_date_time":"20240101T000000", "end_date_time":"20240102T000000", "repeat_type":""},
+		{"name":"nightly", "schedule":"s3", "schedule.name":"Nightly freeze", "start_date_time":"%s", "end_date_time":"%s", "repeat_type":"daily"},
+		{"name":"weekend", "schedule":"s4", "schedule.name":"Old weekend freeze", "start_date_time":"20240106T000000", "end_date_time":"20240108T000000", "repeat_type":"weekly", "repeat_until":"2024-12-31"}]}`,
+		testGetScheduleTime(currentTime.Add(-time.Hour)),
+		testGetScheduleTime(currentTime.Add(24*time.Hour)),
+		testGetScheduleTime(currentTime.Add(-7*24*time.Hour-time.Hour)),
+		testGetScheduleTime(currentTime.Add(-7*24*time.Hour+time.Hour)))
+}
+
+// The repeating window of s3 applies to changes of CI 9
+func testPrepareBlackouts(t *testing.T, p *ServiceNowPlugin, conditionsResponse string, conditionCheckResponse string) *httptest.Server {
+	config := testNewConfig(p)
+	config.BlackoutCheck = true
+
+	var responseMap = make(map[string]string)
+	responseMap[testBlackoutSpansRequestURI] = testGetBlackoutSpans()
+	responseMap["/api/now/table/cmn_schedule_condition?schedule=s1&sysparm_fields=condition"] = conditionsResponse
+	responseMap["/api/now/table/change_request?sysparm_query="+p.encodeServiceNowQuery("sys_id=1^cmdb_ci=5")+"&sysparm_fields=sys_id"] = conditionCheckResponse
+	responseMap["/api/now/table/cmn_schedule_condition?schedule=s3&sysparm_fields=condition"] = `{"result":[{"condition":"cmdb_ci=9"}]}`
+	responseMap["/api/now/table/change_request?sysparm_query="+p.encodeServiceNowQuery("sys_id=1^cmdb_ci=9")+"&sysparm_fields=sys_id"] = `{"result":[]}`
+	responseMap["/api/now/table/change_request?sysparm_query="+p.encodeServiceNowQuery("sys_id=2^cmdb_ci=5")+"&sysparm_fields=sys_id"] = `{"result":[]}`
+	responseMap["/api/now/table/change_request?sysparm_query="+p.encodeServiceNowQuery("sys_id=2^cmdb_ci=9")+"&sysparm_fields=sys_id"] = `{"result":[{"sys_id":"2"}]}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func testGetWeekendSpan() *ScheduleSpanServiceNow {
+	return &ScheduleSpanServiceNow{Name: "weekend", ScheduleName: "Weekend freeze", StartDateTime: "20240106T000000", EndDateTime: "20240108T000000", RepeatType: "weekly"}
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRepeatsOnDay() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	firstDay := time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)
+	saturday := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	wednesday := time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC)
+
+	weekly := testGetWeekendSpan()
+	s.True(p.repeatsOnDay(weekly, saturday, firstDay, 1), "Without days of the week, the window repeats on the day of the first occurrence")
+	s.False(p.repeatsOnDay(weekly, sunday, firstDay, 1), "Without days of the week, the window only repeats on the day of the first occurrence")
+	weekly.DaysOfWeek = "67"
+	s.True(p.repeatsOnDay(weekly, sunday, firstDay, 1), "The window repeats on the days of the week")
+	s.False(p.repeatsOnDay(weekly, wednesday, firstDay, 1), "The window doesn't repeat on other days of the week")
+	s.False(p.repeatsOnDay(weekly, saturday, firstDay, 2), "A window that repeats every other week doesn't repeat 145 weeks after the first occurrence")
+	s.True(p.repeatsOnDay(weekly, saturday.AddDate(0, 0, 7), firstDay, 2), "A window that repeats every other week repeats 146 weeks after the first occurrence")
+
+	s.True(p.repeatsOnDay(&ScheduleSpanServiceNow{RepeatType: "weekends"}, sunday, firstDay, 1), "Weekends include Sunday")
+	s.False(p.repeatsOnDay(&ScheduleSpanServiceNow{RepeatType: "weekdays"}, sunday, firstDay, 1), "Weekdays don't include Sunday")
+	s.True(p.repeatsOnDay(&ScheduleSpanServiceNow{RepeatType: "weekdays"}, wednesday, firstDay, 1), "Weekdays include Wednesday")
+	s.True(p.repeatsOnDay(&ScheduleSpanServiceNow{RepeatType: "daily"}, wednesday, firstDay, 1), "A daily window repeats every day")
+	s.False(p.repeatsOnDay(&ScheduleSpanServiceNow{RepeatType: "daily"}, firstDay.AddDate(0, 0, 3), firstDay, 2), "A window that repeats every 2 days doesn't repeat after 3 days")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRepeatingWindowEnd() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	span := testGetWeekendSpan()
+	startDate, _ := p.convertScheduleTime(span.StartDateTime)
+	endDate, _ := p.convertScheduleTime(span.EndDateTime)
+
+	windowEnd, active, err := p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	s.NoError(err, "No error expected")
+	s.True(active, "The weekend window of this week should be active on Sunday")
+	s.Equal(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), windowEnd.UTC(), "The window of this week ends on Monday")
+
+	_, active, err = p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC))
+
+	s.NoError(err, "No error expected")
+	s.False(active, "The weekend window should not be active on Wednesday")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRepeatingWindowEndRepeatUntil() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	span := testGetWeekendSpan()
+	span.RepeatUntil = "2025-12-31"
+	startDate, _ := p.convertScheduleTime(span.StartDateTime)
+	endDate, _ := p.convertScheduleTime(span.EndDateTime)
+
+	_, active, err := p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+	s.NoError(err, "No error expected")
+	s.False(active, "A window that stopped repeating should not be active")
+
+	_, active, err = p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2025, 12, 28, 12, 0, 0, 0, time.UTC))
+	s.NoError(err, "No error expected")
+	s.True(active, "The window should be active before repeat_until")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRepeatingWindowEndUnsupportedRepeatType() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	span := testGetWeekendSpan()
+	span.RepeatType = "yearly"
+	startDate, _ := p.convertScheduleTime(span.StartDateTime)
+	endDate, _ := p.convertScheduleTime(span.EndDateTime)
+
+	loggerObj.On("Warn", "Blackout window weekend of Weekend freeze repeats (yearly), this repeat type is not supported: the window is not checked")
+
+	_, active, err := p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2027, 1, 6, 12, 0, 0, 0, time.UTC))
+
+	s.NoError(err, "No error expected")
+	s.False(active, "A window that cannot be checked should not deny access")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetRepeatingWindowEndIncorrectRepeatUntil() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	span := testGetWeekendSpan()
+	span.RepeatUntil = "end of year"
+	startDate, _ := p.convertScheduleTime(span.StartDateTime)
+	endDate, _ := p.convertScheduleTime(span.EndDateTime)
+
+	loggerObj.On("Error", mock.Anything)
+
+	_, active, err := p.getRepeatingWindowEnd(span, startDate, endDate, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	s.False(active, "No active window expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetActiveBlackouts() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	blackouts, err := p.getActiveBlackouts(context.Background())
+
+	s.NoError(err, "No error expected")
+	s.Len(blackouts, 2, "The window of the current moment and the occurrence of the repeating window are active")
+	s.Equal("Year end freeze", blackouts[0].ScheduleName, "Name of the schedule expected")
+	s.Equal("s1", blackouts[0].Schedule, "Sys_id of the schedule expected")
+	s.Equal("Nightly freeze", blackouts[1].ScheduleName, "Occurrence of the repeating window should be active")
+	s.WithinDuration(time.Now().Add(time.Hour), blackouts[1].EndDate, 2*time.Second, "End of the current occurrence expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetActiveBlackoutsNoJSON() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+
+	var responseMap = make(map[string]string)
+	responseMap[testBlackoutSpansRequestURI] = "<Result/>"
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	expectedErrorText := "Error in json.Unmarshal: invalid character '<' looking for beginning of value (<Result/>)"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	_, err := p.getActiveBlackouts(context.Background())
+
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGetScheduleConditions() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[{"condition":"cmdb_ci=5"},{"condition":""}]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	conditions, err := p.getScheduleConditions(context.Background(), "s1")
+
+	s.NoError(err, "No error expected")
+	s.Equal([]string{"cmdb_ci=5"}, conditions, "Empty conditions should be skipped")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutCondition() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[]}`, `{"result":[{"sys_id":"1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	applies, err := p.checkBlackoutCondition(context.Background(), "cmdb_ci=5", Change{Number: "CHG300030", SysId: "1"})
+
+	s.NoError(err, "No error expected")
+	s.True(applies, "The change meets the condition of the blackout schedule")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutConditionNotMet() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	applies, err := p.checkBlackoutCondition(context.Background(), "cmdb_ci=5", Change{Number: "CHG300030", SysId: "1"})
+
+	s.NoError(err, "No error expected")
+	s.False(applies, "The change doesn't meet the condition of the blackout schedule")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutsWithoutConditions() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	err := p.checkBlackouts(context.Background(), []Change{{Number: "CHG300030", SysId: "1"}})
+
+	s.ErrorContains(err, "Change freeze Year end freeze (year end) is active until ", "A blackout without conditions applies to every change")
+	s.ErrorContains(err, ", no access is granted during a change freeze", "Error text should be correct")
+	s.ErrorIs(err, ErrBlackout, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutsConditionMet() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[{"condition":"cmdb_ci=5"}]}`, `{"result":[{"sys_id":"1"}]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	err := p.checkBlackouts(context.Background(), []Change{{Number: "CHG300030", SysId: "1"}})
+
+	s.ErrorIs(err, ErrBlackout, "The change meets the condition of the active blackout")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutsConditionNotMet() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[{"condition":"cmdb_ci=5"}]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	err := p.checkBlackouts(context.Background(), []Change{{Number: "CHG300030", SysId: "1"}})
+
+	s.NoError(err, "The active blackout doesn't apply to the change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCheckBlackoutsRepeatingWindow() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareBlackouts(t, p, `{"result":[{"condition":"cmdb_ci=5"}]}`, `{"result":[]}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	err := p.checkBlackouts(context.Background(), []Change{{Number: "CHG300031", SysId: "2"}})
+
+	s.ErrorContains(err, "Change freeze Nightly freeze (nightly) is active until ", "An active occurrence of a repeating window that applies to the change should deny access")
+	s.ErrorIs(err, ErrBlackout, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func getTestARApp() (api.AccessRequest, argocd.Application) {
+	var ar api.AccessRequest
+	var requestedRole api.TargetRole
+	var app argocd.Application
+
+	requestedRole.TemplateRef.Name = "administrator"
+
+	ar.Name = "test-ar"
+	ar.Namespace = "argocd"
+	ar.UID = "ar-uid-1"
+	ar.Spec.Subject.Username = "Test User"
+	ar.Spec.Role = requestedRole
+	ar.Spec.Application.Namespace = "argocd"
+	ar.Spec.Application.Name = "demoapp"
+	ar.Spec.Duration.Duration = 4 * time.Hour
+
+	app.Name = "demoapp"
+
+	var m = make(map[string]string)
+	m["ci-name"] = "app-demoapp"
+	app.Labels = m
+
+	return ar, app
+}
+
+func getTestIncidentRequestURI(query string) string {
+	query = strings.ReplaceAll(query, "=", "%3d")
+	query = strings.ReplaceAll(query, "^", "%5e")
+
+	return "/api/now/table/incident?sysparm_query=" + query +
+		"&sysparm_fields=number,short_description,priority,sys_id,assigned_to,assignment_group&sysparm_exclude_reference_link=true&sysparm_limit=1"
+}
+
+func testPrepareIncidents(t *testing.T, p *ServiceNowPlugin) *httptest.Server {
+	config := testNewConfig(p)
+	config.IncidentAccess = true
+
+	var responseMap = make(map[string]string)
+	responseMap[getTestCIRequestURI("app-demoapp")] = `{"result":[{"install_status":"1", "name":"app-demoapp", "sys_id":"5"}]}`
+	responseMap[getTestCIRequestURI("app-second")] = `{"result":[{"install_status":"1", "name":"app-second", "sys_id":"6"}]}`
+	responseMap[getTestIncidentRequestURI("cmdb_ciIN5^active=true^priorityIN1,2^ORDERBYpriority")] = `{"result":[]}`
+	responseMap[getTestIncidentRequestURI("cmdb_ciIN6^active=true^priorityIN1,2^ORDERBYpriority")] = `{"result":[{"number":"INC0010002", "short_description":"website down", "priority":"1", "sys_id":"i2", "assigned_to":"u2"}]}`
+	responseMap[getTestIncidentRequestURI("cmdb_ciIN5^active=true^priorityIN1,2^number=INC0010001^ORDERBYpriority")] = `{"result":[{"number":"INC0010001", "short_description":"slow", "priority":"2", "sys_id":"i1", "assigned_to":"u1"}]}`
+	responseMap[getTestIncidentRequestURI("cmdb_ciIN5^active=true^priorityIN1,2^number=INC0010003^ORDERBYpriority")] = `{"result":[]}`
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return server
+}
+
+func (s *ServiceNowTestSuite) TestCheckIncidentRolePolicy() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	s.NoError(p.checkIncidentRolePolicy("admin", nil), "Without a policy, an incident can give access")
+	s.NoError(p.checkIncidentRolePolicy("admin", &RolePolicy{GraceAfterEndMinutes: new(int)}), "A policy without change types and maximum risk allows incidents")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestCheckIncidentRolePolicyChangeTypes() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+
+	expectedErrorText := "Role admin only gets access with a change that meets the role policy, an incident doesn't give access to this role"
+	loggerObj.On("Info", expectedErrorText).Twice()
+
+	err := p.checkIncidentRolePolicy("admin", &RolePolicy{ChangeTypes: []string{"standard"}})
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrChangeNotAllowed, "Error should be of the correct kind")
+
+	err = p.checkIncidentRolePolicy("admin", &RolePolicy{MaxRisk: "low"})
+	s.ErrorIs(err, ErrChangeNotAllowed, "A role with a maximum risk should not get access with an incident")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetIncidentRequested() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	incident, err := p.getIncident(context.Background(), "app-demoapp", []string{"5"}, "INC0010001")
+
+	s.NoError(err, "No error expected")
+	s.Equal("INC0010001", incident.Number, "The requested incident should be found")
+	s.Equal("i1", incident.SysId, "Sys_id of the incident should be the same as in the API result")
+	s.Equal("u1", incident.AssignedTo, "Assignee of the incident should be the same as in the API result")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetIncidentRequestedLowPriority() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	expectedErrorText := "Incident INC0010003 is not active, doesn't have priority 1 or 2 or is not linked to CI app-demoapp"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	incident, err := p.getIncident(context.Background(), "app-demoapp", []string{"5"}, "INC0010003")
+
+	s.Nil(incident, "An incident without one of the INCIDENT_PRIORITIES should not be used")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidIncident, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestGetIncidentNoMajorIncident() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	expectedErrorText := "No active incident with priority 1 or 2 found for CI app-demoapp"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	incident, err := p.getIncident(context.Background(), "app-demoapp", []string{"5"}, "")
+
+	s.Nil(incident, "No incident expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrNoValidIncident, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestFindIncident() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No active incident with priority 1 or 2 found for CI app-demoapp")
+
+	ciIncident, err := p.findIncident(context.Background(), []string{"app-demoapp", "app-second"}, "", ChangeFilter{})
+
+	s.NoError(err, "An incident of one of the CIs should be enough")
+	s.Equal("INC0010002", ciIncident.Incident.Number, "Incident of the second CI expected")
+	s.Equal("6", ciIncident.CISysId, "Sys_id of the CI of the incident expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestFindIncidentNotFound() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", "No active incident with priority 1 or 2 found for CI app-demoapp")
+
+	ciIncident, err := p.findIncident(context.Background(), []string{"app-demoapp"}, "", ChangeFilter{})
+
+	s.Nil(ciIncident, "No incident expected")
+	s.ErrorIs(err, ErrNoValidIncident, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestFindIncidentRequesterAssigned() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	ciIncident, err := p.findIncident(context.Background(), []string{"app-demoapp"}, "INC0010001", ChangeFilter{RequesterSysId: "u1"})
+
+	s.NoError(err, "An incident that is assigned to the requester should give access")
+	s.Equal("INC0010001", ciIncident.Incident.Number, "Requested incident expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestFindIncidentRequesterNotAssigned() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	server := testPrepareIncidents(t, p)
+	defer server.Close()
+
+	expectedErrorText := "Incident INC0010002 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", expectedErrorText)
+
+	ciIncident, err := p.findIncident(context.Background(), []string{"app-second"}, "", ChangeFilter{RequesterSysId: "u1"})
+
+	s.Nil(ciIncident, "No incident expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrRequesterNotAssigned, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestFindIncidentRolePolicy() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testNewConfig(p)
+
+	loggerObj.On("Info", mock.Anything)
+
+	ciIncident, err := p.findIncident(context.Background(), []string{"app-demoapp"}, "", ChangeFilter{Role: "admin", RolePolicy: &RolePolicy{ChangeTypes: []string{"standard"}}})
+
+	s.Nil(ciIncident, "No incident expected")
+	s.ErrorIs(err, ErrChangeNotAllowed, "The role policy should be checked before incidents are searched")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *ServiceNowTestSuite) TestPostNote() {
+	requestURI := "/api/now/table/change_request/CHG0030002"
+	noteText := `{"work_notes": "This is the text of the note"}`
+	responseText := `{"number": "CHG00300002", "other_fields": "whatever"}`
+
+	testPatchServiceNowAPINormalRequest(s, requestURI, noteText, responseText)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGrantIncidentAccess() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	config := testNewConfig(p)
+	config.IncidentAccessMinutes = 60
+
+	k8sclientset = testclient.NewClientset()
+	var responseMap = make(map[string]string)
+	responseMap["/api/now/table/incident/i2"] = `{"whatever":"true"}`
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	defer server.Close()
+	config.ServiceNowUrl = server.URL
+
+	ar, _ := getTestARApp()
+	ciIncident := CIIncident{CIName: "app-demoapp", CISysId: "5", Incident: &IncidentServiceNow{Number: "INC0010002", ShortDescription: "website down", Priority: "1", SysId: "i2"}}
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", mock.Anything)
+
+	response, err := p.grantIncidentAccess(context.Background(), &ar, ciIncident)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "Granted access: incident __INC0010002__ (website down), until __", "Message should contain the incident")
+	s.Equal(60*time.Minute, ar.Spec.Duration.Duration, "Duration should be the duration of incident access")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("INC0010002", grantRecord.ChangeNumber, "Grant record should contain the incident number")
+	s.Equal(TableIncident, grantRecord.ChangeTable, "Grant record should contain the incident table")
+	s.True(grantRecord.ExpireByPlugin, "Incident access ends before the access request, the plugin should expire the access request")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/incident/i2")
+	loggerObj.AssertExpectations(t)
+}
+
+func testPrepareExclusionRecord(t *testing.T, p *ServiceNowPlugin, responseText string) (*Config, *httptest.Server) {
+	config := testNewConfig(p)
+
+	k8sclientset = testclient.NewClientset()
+	var responseMap = make(map[string]string)
+	responseMap["/api/now/table/incident?sysparm_fields=number,sys_id"] = responseText
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	config.ServiceNowUrl = server.URL
+
+	return config, server
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateExclusionRecord() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareExclusionRecord(t, p, `{"result":{"number":"INC0010010","sys_id":"b1"}}`)
+	defer server.Close()
+
+	realEndDate := time.Date(2025, 5, 20, 12, 0, 0, 0, time.UTC)
+	expectedData := `{"description":"ServiceNow plugin granted access to Test User, for exclusion role incidentmanagers and application demoapp, until 2025-05-20 12:00:00 (1h0m0s), without a change. Justification: database \"orders\" is down","short_description":"Exclusion role incidentmanagers used by Test User for application demoapp"}`
+
+	loggerObj.On("Debug", mock.Anything)
+
+	record, err := p.createExclusionRecord(context.Background(), "Test User", "incidentmanagers", "demoapp", `database "orders" is down`, time.Hour, realEndDate)
+
+	s.NoError(err, "No error expected")
+	s.Equal(ExclusionRecordServiceNow{Number: "INC0010010", SysId: "b1"}, *record, "The created record should be returned")
+	loggerObj.AssertCalled(t, "Debug", "Data: "+expectedData)
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateExclusionRecordWithoutNumber() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareExclusionRecord(t, p, `{"result":{"sys_id":"b1"}}`)
+	defer server.Close()
+
+	loggerObj.On("Debug", mock.Anything)
+
+	record, err := p.createExclusionRecord(context.Background(), "Test User", "incidentmanagers", "demoapp", "", time.Hour, time.Now().Add(time.Hour))
+
+	s.NoError(err, "No error expected")
+	s.Equal("b1", record.Number, "The sys_id should be used for a table without numbers")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestCreateExclusionRecordNotCreated() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	_, server := testPrepareExclusionRecord(t, p, `{"error":{"message":"Operation Failed"}}`)
+	defer server.Close()
+
+	expectedErrorText := `No record created in table incident ({"error":{"message":"Operation Failed"}})`
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", expectedErrorText)
+
+	record, err := p.createExclusionRecord(context.Background(), "Test User", "incidentmanagers", "demoapp", "", time.Hour, time.Now().Add(time.Hour))
+
+	s.Nil(record, "No record expected")
+	s.EqualError(err, expectedErrorText, "Error text should be correct")
+	s.ErrorIs(err, ErrServiceNowAPI, "Error should be of the correct kind")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGrantExclusionAccessMaxDuration() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config, server := testPrepareExclusionRecord(t, p, `{"result":{"number":"INC0010010","sys_id":"b1"}}`)
+	defer server.Close()
+	config.ExclusionPolicies = map[string]ExclusionPolicy{"incidentmanagers": {MaxDurationMinutes: 60}}
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	ar.Annotations = map[string]string{"justification": "database is down"}
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", mock.Anything)
+
+	response, err := p.grantExclusionAccess(context.Background(), &ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	s.Equal(60*time.Minute, ar.Spec.Duration.Duration, "Duration should be the maximum duration of the exclusion role")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("INC0010010", grantRecord.ChangeNumber, "Grant record should contain the record in ServiceNow")
+	s.True(grantRecord.ExpireByPlugin, "Access ends before the access request, the plugin should expire the access request")
+	loggerObj.AssertCalled(t, "Warn", mock.MatchedBy(func(text string) bool {
+		return strings.Contains(text, "justification: database is down")
+	}))
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGrantExclusionAccessGrantRecordNotStored() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config, server := testPrepareExclusionRecord(t, p, `{"result":{"number":"INC0010010","sys_id":"b1"}}`)
+	defer server.Close()
+	config.ExclusionPolicies = map[string]ExclusionPolicy{"incidentmanagers": {MaxDurationMinutes: 60}}
+
+	ar, app := getTestARApp()
+	ar.UID = ""
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
+
+	response, err := p.grantExclusionAccess(context.Background(), &ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Without a grant record the access would not end after the maximum duration")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertNotCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/incident?sysparm_fields=number,sys_id")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestGrantExclusionAccessServiceNowUnavailable() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	config := testNewConfig(p)
+	config.ServiceNowUrl = "http://localhost:1"
+	k8sclientset = testclient.NewClientset()
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Warn", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	response, err := p.grantExclusionAccess(context.Background(), &ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Exclusion roles should also work when ServiceNow is not available")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "not registered in ServiceNow", "Message should show that the record is missing")
+	s.Equal(4*time.Hour, ar.Spec.Duration.Duration, "Duration should not change without a maximum duration")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("", grantRecord.ChangeSysId, "Grant record should not contain a record")
+	loggerObj.AssertCalled(t, "Error", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Use of exclusion role incidentmanagers by Test User is not registered in ServiceNow: ")
+	}))
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRunValidateConfig() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	loggerObj.On("Debug", mock.Anything)
+
+	var out bytes.Buffer
+	exitCode := p.runValidateConfig(&out)
+
+	s.Equal(0, exitCode, "Exit code 0 expected for a valid configuration")
+	s.Equal("The configuration is valid: ServiceNow https://example.com, authentication method basic, time zone UTC, revoke mode scheduler\n", out.String(), "Summary of the configuration expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PluginHelperMethodsTestSuite) TestRunValidateConfigWithErrors() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	testPrepareConfigEnvironment("argocd-ephemeral-access")
+	_ = os.Setenv("TIMEZONE", "Mars/Olympus_Mons")
+	_ = os.Setenv("REVOKE_MODE", "manual")
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	var out bytes.Buffer
+	exitCode := p.runValidateConfig(&out)
+
+	s.Equal(1, exitCode, "Exit code 1 expected for an incorrect configuration")
+	s.Equal("The configuration is not valid:\n"+
+		"- Unknown time zone Mars/Olympus_Mons (environment variable TIMEZONE), use f.e. UTC or Europe/Amsterdam\n"+
+		"- Unknown revoke mode manual (environment variable REVOKE_MODE), use scheduler or cronjob\n", out.String(), "All errors expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestInit() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	result := p.Init()
+
+	s.Equal(nil, result, "Init correctly executed")
+	s.Equal(server.URL, p.getConfig().ServiceNowUrl, "Configuration should be loaded in Init")
+	s.Equal([]string{"incidentmanagers"}, p.getConfig().ExclusionRoles, "Exclusion roles should be loaded in Init")
+	loggerObj.AssertCalled(t, "Debug", "This is a call to the Init method")
+}
+
+func (s *PublicMethodsTestSuite) TestInitWithoutSecret() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
+	unittest = true
+	k8sclientset = testclient.NewClientset()
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Error", mock.Anything)
+
+	result := p.Init()
+
+	s.ErrorIs(result, ErrConfig, "Init should fail when the configuration is not valid")
+	s.Equal(Config{}, *p.getConfig(), "No configuration expected")
+	loggerObj.AssertCalled(t, "Error", "Configuration is not valid, the plugin is not started")
+}
+
+func configureTestEnvWithTestData(t *testing.T, loggerObj *MockedLogger, installStatus string, addChange bool) *httptest.Server {
+	_ = os.Setenv("TIMEZONE", "UTC")
+	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
+
+	secretName := "servicenow-secret"
+	namespace := "argocd-ephemeral-access"
+	genericUsername := "testUser"
+	genericPassword := "testPassword"
+	unittest = true // don't initialize k8sconfig/k8sclientset
+
+	k8sclientset = testclient.NewClientset()
+	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
+	setSecret(namespace, secretName, genericUsername, genericPassword)
+
+	currentTime := time.Now()
+	startDate := currentTime.Add(-5 * time.Minute)
+	endDate := currentTime.Add(2 * time.Hour)
+	startDateString := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", startDate.Year(), startDate.Month(), startDate.Day(), startDate.Hour(), startDate.Minute(), startDate.Second())
+	endDateString := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", endDate.Year(), endDate.Month(), endDate.Day(), endDate.Hour(), endDate.Minute(), endDate.Second())
+
+	loggerObj.On("Debug", mock.Anything)
+	loggerObj.On("Info", mock.Anything)
+
+	var responseMap = make(map[string]string)
+
+	requestURI := getTestCIRequestURI("app-demoapp")
+	responseText := fmt.Sprintf(`{"result": [{"install_status": "%s", "name": "app-demoapp", "sys_id": "5"}]}`, installStatus)
+	responseMap[requestURI] = responseText
+
+	sysparmOffset := 0
+	requestURI = getTestChangeRequestURI("5", sysparmOffset)
+	if addChange {
+		responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"valid change", "start_date":"%s", "end_date":"%s", "sys_id":"1", "assigned_to":{"link":"https://example.com/api/now/table/sys_user/u1","value":"u1"}}]}`, startDateString, endDateString)
+	} else {
+		responseText = `{"result": []}`
+	}
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/change_request/1" // for post, but whatever. We don't do anything with the response...
+	responseText = `{"whatever":"true"}`
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestChangeByNumberRequestURI("CHG300030")
+	responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"valid change", "start_date":"%s", "end_date":"%s", "sys_id":"1", "cmdb_ci":"5", "state":"-1", "approval":"approved"}]}`, startDateString, endDateString)
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestEligibilityRequestURI("1", DefaultChangeEligibilityQuery)
+	responseText = `{"result":[{"sys_id":"1"}]}`
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestChangeByNumberRequestURI("CHG300040")
+	responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300040", "short_description":"change of other CI", "start_date":"%s", "end_date":"%s", "sys_id":"2", "cmdb_ci":"6", "state":"-1", "approval":"approved"}]}`, startDateString, endDateString)
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestChangeTaskRequestURI("cmdb_ci=5^active=true")
+	responseText = fmt.Sprintf(`{"result":[{"number":"CTASK0010001", "short_description":"deploy", "planned_start_date":"%s", "planned_end_date":"%s", "sys_id":"t1", "change_request":"1", "change_request.number":"CHG300030", "change_request.type":"1"}]}`, startDateString, endDateString)
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/change_task/t1"
+	responseText = `{"whatever":"true"}`
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestIncidentRequestURI("cmdb_ciIN5^active=true^priorityIN1,2^ORDERBYpriority")
+	responseText = `{"result":[{"number":"INC0010002", "short_description":"website down", "priority":"1", "sys_id":"i2"}]}`
+	responseMap[requestURI] = responseText
+
+	requestURI = getTestIncidentRequestURI("cmdb_ciIN5^active=true^priorityIN1,2^number=INC0010009^ORDERBYpriority")
+	responseText = `{"result":[]}`
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/incident/i2"
+	responseText = `{"whatever":"true"}`
 	responseMap[requestURI] = responseText
 
-	sysparmOffset = 5
-	requestURI = getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300040", "short_description":"test6", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00","sys_id": "abc123def570"},
-                                {"type":"1", "number":"CHG300041", "short_description":"test7", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00","sys_id": "abc123def571"},
-                                {"type":"1", "number":"CHG300042", "short_description":"test8", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00","sys_id": "abc123def572"},
-                                {"type":"1", "number":"CHG300043", "short_description":"test9", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00","sys_id": "abc123def573"},
-                                {"type":"1", "number":"CHG300044", "short_description":"test10", "start_date":"%s", "end_date":"%s","sys_id": "abc123def574"}]}`,
-		testConvertTimeToString(startDate),
-		testConvertTimeToString(endDate))
-	responseMap[requestURI] = responseText
+	requestURI = "/api/now/table/incident?sysparm_fields=number,sys_id"
+	responseText = `{"result":{"number":"INC0010010","sys_id":"b1"}}`
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/incident/b1"
+	responseText = `{"whatever":"true"}`
+	responseMap[requestURI] = responseText
+
+	requestURI = testBlackoutSpansRequestURI
+	responseText = testGetBlackoutSpans()
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/cmn_schedule_condition?schedule=s1&sysparm_fields=condition"
+	responseText = `{"result":[]}`
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/sys_user?sysparm_query=user_name%3dTest+User%5eactive%3dtrue&sysparm_fields=sys_id&sysparm_limit=2"
+	responseText = `{"result":[{"sys_id":"u1"}]}`
+	responseMap[requestURI] = responseText
+
+	requestURI = "/api/now/table/sys_user?sysparm_query=user_name%3dOther+User%5eactive%3dtrue&sysparm_fields=sys_id&sysparm_limit=2"
+	responseText = `{"result":[{"sys_id":"u2"}]}`
+	responseMap[requestURI] = responseText
+
+	server := simulateHttpRequestToServiceNow(t, responseMap)
+	_ = os.Setenv("SERVICENOW_URL", server.URL)
+
+	return server
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccess() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	loggerObj.On("Info", "Call to GrantAccess: username: Test User, role: administrator, application: [argocd]demoapp, duration: 4h0m0s")
+
+	ar, app := getTestARApp()
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	if !strings.Contains(response.Message, "Granted access") {
+		t.Errorf("%s should contain text Granted access", response.Message)
+	}
+	if !strings.Contains(response.Message, "change") {
+		t.Errorf("%s should contain text change", response.Message)
+	}
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("CHG300030", grantRecord.ChangeNumber, "Grant record should contain the change number")
+	s.Equal("1", grantRecord.ChangeSysId, "Grant record should contain the change sys_id")
+	s.Equal("5", grantRecord.CISysId, "Grant record should contain the CI sys_id")
+	s.False(grantRecord.ExclusionRole, "Grant record should not be marked as exclusion role")
+	s.True(grantRecord.ExpireByPlugin, "Change ends before the access request, the plugin should expire the access request")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessTwoCIs() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	testServer := testPrepareTwoCIs(t, p, correctCMDBInstallStatus, "CHG300031")
+	defer testServer.Close()
+	_ = os.Setenv("SERVICENOW_URL", testServer.URL)
+	_ = p.reloadConfig()
+
+	ar, app := getTestARApp()
+	app.Annotations = map[string]string{"ci-name": "app-demoapp,app-second"}
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "Granted access: change __CHG300031__", "The change that ends first should be used")
+	s.Contains(response.Message, "changes of other CIs: __CHG300030__", "The other change should be shown")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("CHG300031", grantRecord.ChangeNumber, "Grant record should contain the change that ends first")
+	s.Equal("6", grantRecord.CISysId, "Grant record should contain the CI of this change")
+	s.Equal([]string{"CHG300030"}, grantRecord.OtherChangeNumbers, "Grant record should contain the other change")
+	s.Equal([]string{"1"}, grantRecord.OtherChangeSysIds, "Grant record should contain the sys_id of the other change")
+	s.Equal([]string{TableChangeRequest}, grantRecord.OtherChangeTables, "Grant record should contain the table of the other change")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+testServer.URL+"/api/now/table/change_request/1")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+testServer.URL+"/api/now/table/change_request/2")
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRevokeModeCronJob() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	_ = os.Setenv("REVOKE_MODE", "cronjob")
+
+	ar, app := getTestARApp()
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+
+	_, err = k8sclientset.BatchV1().CronJobs("argocd").Get(context.TODO(), "stop-test-ar", metav1.GetOptions{})
+	s.Equal(nil, err, "CronJob should be created")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.False(grantRecord.ExpireByPlugin, "The CronJob expires the access request, not the expiry scheduler")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessGrantRecordNotStored() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+	ar.UID = ""
+	loggerObj.On("Error", "Access request test-ar has no UID, grant record is not stored")
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "The change ends before the access request, without a grant record the access would not end in time")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertNotCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/change_request/1")
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessExclusionRole() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	loggerObj.On("Warn", mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	if !strings.Contains(response.Message, "Granted access") {
+		t.Errorf("%s should contain text Granted access", response.Message)
+	}
+	if !strings.Contains(response.Message, "exclusion role") {
+		t.Errorf("%s should contain text exclusion role", response.Message)
+	}
+	s.Contains(response.Message, "registered in ServiceNow as __INC0010010__", "Message should contain the record in ServiceNow")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.True(grantRecord.ExclusionRole, "Grant record should be marked as exclusion role")
+	s.Equal("INC0010010", grantRecord.ChangeNumber, "Grant record should contain the record in ServiceNow")
+	s.Equal("b1", grantRecord.ChangeSysId, "Grant record should contain the sys_id of the record in ServiceNow")
+	s.Equal(TableIncident, grantRecord.ChangeTable, "Grant record should contain the table of the record in ServiceNow")
+	loggerObj.AssertExpectations(t)
+}
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
+func (s *PublicMethodsTestSuite) TestGrantAccessExclusionRoleNotAllowed() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "exclusion-policies", "incidentmanagers:\n  users: [jane.doe@example.com]")
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied")
+	s.Equal(nil, err, "Error should be nil")
+	s.Equal("Requester Test User is not allowed to use exclusion role incidentmanagers", response.Message, "Message should explain why access is denied")
+	loggerObj.AssertNotCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/incident?sysparm_fields=number,sys_id")
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessExclusionRoleWithoutJustification() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "exclusion-policies", "incidentmanagers:\n  justificationRequired: true")
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied")
+	s.Equal(nil, err, "Error should be nil")
+	s.Equal("A justification is required for exclusion role incidentmanagers, add it to the access request as annotation justification", response.Message, "Message should explain how to add a justification")
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessNoCIName() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	errorText := "No CI name found: expected label or annotation with name ci-name in application demoapp"
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (ci-not-found): "+errorText)
+
+	ar, app := getTestARApp()
+	var m = make(map[string]string)
+	m["ci-name"] = "\"\""
+	app.Labels = m
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(errorText, response.Message, "Response message should be correct")
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(nil, err, "Error should be nil")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessNoServiceNowURL() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	_ = os.Setenv("SERVICENOW_URL", "")
+
+	expectedErrorText := "No Service Now URL given (environment variable SERVICENOW_URL is empty)"
+	expectedMessage := "Access cannot be checked: the ServiceNow plugin is not configured correctly, please contact your Argo CD administrator"
+	loggerObj.On("Error", expectedErrorText)
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (config): "+expectedErrorText)
+
+	ar, app := getTestARApp()
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(expectedMessage, response.Message, "Configuration errors should not be shown to the requester")
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(nil, err, "Error should be nil")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessIncorrectCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar, app := getTestARApp()
+	invalidInstallStatus := "-1"
+
+	server := configureTestEnvWithTestData(t, loggerObj, invalidInstallStatus, addChange)
+	defer server.Close()
+
+	errorText := fmt.Sprintf("Invalid install status %s for CI app-demoapp", invalidInstallStatus)
+
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (ci-invalid-status): "+errorText)
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(errorText, response.Message, "Response message should be correct")
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(nil, err, "Error should be nil")
+
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessNoChange() {
+	t := s.T()
+
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	ar, app := getTestARApp()
+
+	dontAddChange := !addChange
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, dontAddChange)
+	defer server.Close()
+
+	loggerObj.On("Error", mock.Anything)
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (no-valid-change): No changes found")
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal("No changes found", response.Message, "Response message should be correct")
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(nil, err, "Error should be nil")
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRequestedChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	// The time window has no changes, so access can only be granted via the requested change
+	dontAddChange := !addChange
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, dontAddChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+	ar.Annotations = map[string]string{"change-number": "CHG300030"}
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("CHG300030", grantRecord.ChangeNumber, "Grant record should contain the requested change number")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRequestedChangeOtherCI() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+	ar.Annotations = map[string]string{"change-number": "CHG300040"}
+
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (change-not-linked): Change CHG300040 is not linked to CI app-demoapp")
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied")
+	s.Equal("Change CHG300040 is not linked to CI app-demoapp", response.Message, "Response message should be correct")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRequesterCheck() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("REQUESTER_CHECK", "true")
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted, the change is assigned to the requester")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRequesterCheckNotAssigned() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("REQUESTER_CHECK", "true")
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+	ar.Spec.Subject.Username = "Other User"
+
+	expectedMessage := "Change CHG300030 is not assigned to the requester or to one of the groups of the requester"
+	loggerObj.On("Warn", "Access denied for Other User, role administrator (requester-not-assigned): "+expectedMessage)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied")
+	s.Equal(expectedMessage, response.Message, "Response message should be correct")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessRoleWithoutChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "role-policies", "readonly-plus:\n  noChange: true")
+
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "readonly-plus"
+	app.Labels = nil
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted, without a CI and a change")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "role readonly-plus doesn't need a change", "Message should explain why no change is used")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.False(grantRecord.ExclusionRole, "Grant record should not be marked as exclusion role")
+	s.Equal("", grantRecord.ChangeNumber, "Grant record should not contain a change")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessChangeNotAllowedForRole() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "role-policies", "administrator:\n  changeTypes: [normal, emergency]")
+
+	ar, app := getTestARApp()
+
+	expectedMessage := "Change CHG300030 cannot be used for role administrator: type 1 is not one of normal, emergency"
+	loggerObj.On("Warn", "Access denied for Test User, role administrator (change-not-allowed): "+expectedMessage)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied")
+	s.Equal(expectedMessage, response.Message, "Response message should be correct")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessBlackout() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("BLACKOUT_CHECK", "true")
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
+	ar, app := getTestARApp()
+
+	loggerObj.On("Warn", mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Status should be denied during a change freeze")
+	s.Contains(response.Message, "Change freeze Year end freeze (year end) is active until ", "Response message should contain the freeze")
+	s.Equal(nil, err, "Error should be nil")
+
+	_, err = p.loadGrantRecord(&ar)
+	s.Error(err, "No grant record expected")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestGrantAccessGracePeriod() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("GRACE_AFTER_END_MINUTES", "30")
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
-	serviceNowUrl = server.URL
 
-	loggerObj.On("Debug", mock.Anything)
+	ar, app := getTestARApp()
 
-	errorString, changeRemainingTime, validChange := p.processChanges(ciName, cmdbCi)
+	response, err := p.GrantAccess(&ar, &app)
 
-	s.Equal("", errorString, "Errorstring should be empty")
-	if changeRemainingTime.Minutes() < 40 {
-		s.Fail("changeRemainingTime is too small, less than 40 minutes")
-	}
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "with a grace period of 30m0s after the end", "Message should contain the grace period")
+	s.Equal(150*time.Minute, ar.Spec.Duration.Duration.Round(time.Minute), "Duration should include the grace period after the end of the change")
 
-	s.Equal("CHG300044", validChange.Number, "Numbers must be correct")
-	s.Equal("test10", validChange.ShortDescription, "Short descriptions must be correct")
-	s.Equal("abc123def574", validChange.SysId, "sys_id must be correct")
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal(150*time.Minute, time.Until(grantRecord.EndTime).Round(time.Minute), "End time should include the grace period after the end of the change")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PluginHelperMethodsTestSuite) TestProcessChangesTwoAPIWindowsErrorInSecondBatch() {
+func (s *PublicMethodsTestSuite) TestGrantAccessGracePeriodOfRole() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	_ = os.Setenv("GRACE_AFTER_END_MINUTES", "30")
 
-	serviceNowUsername = "testUser"
-	serviceNowPassword = "testPassword"
-	timezone = "UTC"
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "role-policies", "administrator:\n  graceAfterEndMinutes: 0")
 
-	ciName := "app-demoapp3"
-	cmdbCi := "id2"
+	ar, app := getTestARApp()
 
-	var responseMap = make(map[string]string)
+	response, err := p.GrantAccess(&ar, &app)
 
-	sysparmOffset := 0
-	requestURI := getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText := `{"result":[{"type":"1", "number":"CHG300030", "short_description":"test", "start_date":"2025-05-15 17:00:00", "end_date":"2025-05-15 17:45:00"},
-                                {"type":"1", "number":"CHG300031", "short_description":"test2", "start_date":"2025-05-15 18:00:00", "end_date":"2025-05-15 18:45:00"},
-                                {"type":"1", "number":"CHG300032", "short_description":"test3", "start_date":"2025-05-15 19:00:00", "end_date":"2025-05-15 19:45:00"},
-                                {"type":"1", "number":"CHG300033", "short_description":"test4", "start_date":"2025-05-15 20:00:00", "end_date":"2025-05-15 20:45:00"},
-                                {"type":"1", "number":"CHG300034", "short_description":"test5", "start_date":"2025-05-15 21:00:00", "end_date":"2025-05-15 21:45:00"}]}`
-	responseMap[requestURI] = responseText
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	s.Equal(nil, err, "Error should be nil")
+	s.NotContains(response.Message, "grace period", "The role has no grace period")
+	s.Equal(120*time.Minute, ar.Spec.Duration.Duration.Round(time.Minute), "The grace period of the role should replace the global grace period")
+	loggerObj.AssertExpectations(t)
+}
 
-	sysparmOffset = 5
-	requestURI = getTestChangeRequestURI(cmdbCi, sysparmOffset)
-	responseText = `{"result":[]}`
-	responseMap[requestURI] = responseText
+func (s *PublicMethodsTestSuite) TestGrantAccessIncident() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("INCIDENT_ACCESS", "true")
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	serviceNowUrl = server.URL
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, !addChange)
 	defer server.Close()
-	serviceNowUrl = server.URL
 
-	expectedInfoString := "No changes found"
+	ar, app := getTestARApp()
 
-	loggerObj.On("Debug", mock.Anything)
-	loggerObj.On("Info", expectedInfoString)
+	loggerObj.On("Warn", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Granted access for Test User: incident INC0010002 (website down), priority 1, role administrator")
+	}))
 
-	errorString, changeRemainingTime, _ := p.processChanges(ciName, cmdbCi)
+	response, err := p.GrantAccess(&ar, &app)
 
-	s.Equal(expectedInfoString, errorString, "Errorstring should be correct")
-	s.Equal(changeRemainingTime.Minutes(), 0.0, "changeRemainingTime is incorrect, different from 0")
+	s.Equal(plugin.GrantStatusGranted, response.Status, "Without a change, the major incident of the CI should give access")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "Granted access: incident __INC0010002__", "Message should contain the incident")
 
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("INC0010002", grantRecord.ChangeNumber, "Grant record should contain the incident number")
+	s.Equal(TableIncident, grantRecord.ChangeTable, "Grant record should contain the incident table")
 	loggerObj.AssertExpectations(t)
 }
 
-func getTestARApp() (api.AccessRequest, argocd.Application) {
-	var ar api.AccessRequest
-	var requestedRole api.TargetRole
-	var app argocd.Application
-
-	requestedRole.TemplateRef.Name = "administrator"
-
-	ar.Spec.Subject.Username = "Test User"
-	ar.Spec.Role = requestedRole
-	ar.Spec.Application.Namespace = "argocd"
-	ar.Spec.Application.Name = "demoapp"
-	ar.Spec.Duration.Duration = 4 * time.Hour
+func (s *PublicMethodsTestSuite) TestGrantAccessIncidentNotUsedWithoutOption() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	app.Name = "demoapp"
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, !addChange)
+	defer server.Close()
 
-	var m = make(map[string]string)
-	m["ci-name"] = "app-demoapp"
-	app.Labels = m
+	ar, app := getTestARApp()
 
-	return ar, app
-}
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
 
-func (s *ServiceNowTestSuite) TestPostNote() {
-	serviceNowUrl = "https://servicenow.com"
-	requestURI := "/api/now/table/change_request/CHG0030002"
-	noteText := `{"work_notes": "This is the text of the note"}`
-	responseText := `{"number": "CHG00300002", "other_fields": "whatever"}`
+	response, err := p.GrantAccess(&ar, &app)
 
-	testPatchServiceNowAPINormalRequest(s, requestURI, noteText, responseText)
+	s.Equal(plugin.GrantStatusDenied, response.Status, "Incidents should not give access by default")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestInit() {
+func (s *PublicMethodsTestSuite) TestGrantAccessRequestedIncidentNotLinked() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	_ = os.Setenv("INCIDENT_ACCESS", "true")
 
-	loggerObj.On("Debug", "This is a call to the Init method")
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
 
-	result := p.Init()
+	ar, app := getTestARApp()
+	ar.Annotations = map[string]string{"incident-number": "INC0010009"}
 
-	s.Equal(nil, result, "Init correctly executed")
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
+
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "A requested incident that is not linked to the CI should not give access")
+	s.Equal("Incident INC0010009 is not active, doesn't have priority 1 or 2 or is not linked to CI app-demoapp", response.Message, "Message should contain the reason")
+	s.Equal(nil, err, "Error should be nil")
 	loggerObj.AssertExpectations(t)
 }
 
-func configureTestEnvWithTestData(t *testing.T, loggerObj *MockedLogger, installStatus string, addChange bool) *httptest.Server {
-	_ = os.Setenv("TIMEZONE", "UTC")
-	_ = os.Setenv("SERVICENOW_URL", "https://example.com")
+func (s *PublicMethodsTestSuite) TestGrantAccessIncidentRolePolicy() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("INCIDENT_ACCESS", "true")
 
-	secretName := "servicenow-secret"
-	namespace := "argocd-ephemeral-access"
-	genericUsername := "serviceNowUsername"
-	genericPassword := "serviceNowPassword"
-	unittest = true // don't initialize k8sconfig/k8sclientset
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	addToConfigMap("argocd-ephemeral-access", ExclusionsConfigMapName, "role-policies", "administrator:\n  changeTypes: [standard]")
 
-	k8sclientset = testclient.NewClientset()
-	setConfigMap(namespace, ExclusionsConfigMapName, "exclusion-roles", "incidentmanagers")
-	setSecret(namespace, secretName, genericUsername, genericPassword)
+	ar, app := getTestARApp()
+	ar.Annotations = map[string]string{"incident-number": "INC0010002"}
 
-	currentTime := time.Now()
-	startDate := currentTime.Add(-5 * time.Minute)
-	endDate := currentTime.Add(2 * time.Hour)
-	startDateString := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", startDate.Year(), startDate.Month(), startDate.Day(), startDate.Hour(), startDate.Minute(), startDate.Second())
-	endDateString := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", endDate.Year(), endDate.Month(), endDate.Day(), endDate.Hour(), endDate.Minute(), endDate.Second())
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
 
-	loggerObj.On("Debug", mock.Anything)
-	loggerObj.On("Info", mock.Anything)
+	response, err := p.GrantAccess(&ar, &app)
 
-	var responseMap = make(map[string]string)
+	s.Equal(plugin.GrantStatusDenied, response.Status, "An incident should not give access to a role that needs a certain change")
+	s.Equal("Role administrator only gets access with a change that meets the role policy, an incident doesn't give access to this role", response.Message, "Message should contain the reason")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
+}
 
-	requestURI := getTestCIRequestURI("app-demoapp")
-	responseText := fmt.Sprintf(`{"result": [{"install_status": "%s", "name": "app-demoapp", "sys_id": "5"}]}`, installStatus)
-	responseMap[requestURI] = responseText
+func (s *PublicMethodsTestSuite) TestGrantAccessIncidentRequesterCheck() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+	_ = os.Setenv("INCIDENT_ACCESS", "true")
+	_ = os.Setenv("REQUESTER_CHECK", "true")
 
-	sysparmOffset := 0
-	requestURI = getTestChangeRequestURI("5", sysparmOffset)
-	if addChange {
-		responseText = fmt.Sprintf(`{"result":[{"type":"1", "number":"CHG300030", "short_description":"valid change", "start_date":"%s", "end_date":"%s", "sys_id":"1"}]}`, startDateString, endDateString)
-	} else {
-		responseText = `{"result": []}`
-	}
-	responseMap[requestURI] = responseText
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, !addChange)
+	defer server.Close()
 
-	requestURI = "/api/now/table/change_request/1" // for post, but whatever. We don't do anything with the response...
-	responseText = `{"whatever":"true"}`
-	responseMap[requestURI] = responseText
+	ar, app := getTestARApp()
 
-	server := simulateHttpRequestToServiceNow(t, responseMap)
-	_ = os.Setenv("SERVICENOW_URL", server.URL)
+	loggerObj.On("Warn", mock.Anything, mock.Anything, mock.Anything)
 
-	return server
+	response, err := p.GrantAccess(&ar, &app)
+
+	s.Equal(plugin.GrantStatusDenied, response.Status, "An incident that is not assigned to the requester should not give access")
+	s.Contains(response.Message, "Incident INC0010002 is not assigned to the requester or to one of the groups of the requester", "Message should contain the reason")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccess() {
+func (s *PublicMethodsTestSuite) TestGrantAccessChangeTask() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
+	_ = os.Setenv("CHANGE_TASKS", "true")
 
 	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
-	loggerObj.On("Info", "Call to GrantAccess: username: Test User, role: administrator, application: [argocd]demoapp, duration: 4h0m0s")
 
 	ar, app := getTestARApp()
 
@@ -2229,18 +9621,22 @@ func (s *PublicMethodsTestSuite) TestGrantAccess() {
 
 	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
 	s.Equal(nil, err, "Error should be nil")
-	if !strings.Contains(response.Message, "Granted access") {
-		t.Errorf("%s should contain text Granted access", response.Message)
-	}
-	if !strings.Contains(response.Message, "change") {
-		t.Errorf("%s should contain text change", response.Message)
-	}
+	s.Contains(response.Message, "Granted access: change task __CTASK0010001__ (deploy) of change __CHG300030__", "Message should contain the change task and its change")
+
+	grantRecord, _ := p.loadGrantRecord(&ar)
+	s.Equal("CTASK0010001", grantRecord.ChangeNumber, "Grant record should contain the change task number")
+	s.Equal("t1", grantRecord.ChangeSysId, "Grant record should contain the change task sys_id")
+	s.Equal(TableChangeTask, grantRecord.ChangeTable, "Grant record should contain the table of the change task")
+
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/change_task/t1")
+	loggerObj.AssertCalled(t, "Debug", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Data: ") && strings.Contains(text, ", change CHG300030")
+	}))
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccessExclusionRole() {
+func (s *PublicMethodsTestSuite) TestRevokeAccess() {
 	t := s.T()
-
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
@@ -2248,23 +9644,24 @@ func (s *PublicMethodsTestSuite) TestGrantAccessExclusionRole() {
 	defer server.Close()
 
 	ar, app := getTestARApp()
-	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
-	loggerObj.On("Warn", mock.Anything)
+	ar.Name = "test-ar"
+	ar.UpdateStatusHistory(api.GrantedStatus, "Granted access: change __CHG300030__ (valid change), until __2025-05-20 23:59:59 (1h0m0s)__")
 
-	response, err := p.GrantAccess(&ar, &app)
+	cronjobs := k8sclientset.BatchV1().CronJobs(ar.Spec.Application.Namespace)
+	_, _ = cronjobs.Create(context.TODO(), &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "stop-test-ar"}}, metav1.CreateOptions{})
 
-	s.Equal(plugin.GrantStatusGranted, response.Status, "Status should be granted")
+	response, err := p.RevokeAccess(&ar, &app)
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
 	s.Equal(nil, err, "Error should be nil")
-	if !strings.Contains(response.Message, "Granted access") {
-		t.Errorf("%s should contain text Granted access", response.Message)
-	}
-	if !strings.Contains(response.Message, "exclusion role") {
-		t.Errorf("%s should contain text exclusion role", response.Message)
-	}
+	s.Contains(response.Message, "Revoked access: change __CHG300030__", "Message should contain the change number")
+
+	_, err = cronjobs.Get(context.TODO(), "stop-test-ar", metav1.GetOptions{})
+	s.True(k8serrors.IsNotFound(err), "CronJob should be deleted")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccessNoCIName() {
+func (s *PublicMethodsTestSuite) TestRevokeAccessWithGrantRecord() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
@@ -2272,101 +9669,146 @@ func (s *PublicMethodsTestSuite) TestGrantAccessNoCIName() {
 	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
 
-	errorText := "No CI name found: expected label with name ci-name in application demoapp"
-	loggerObj.On("Error", errorText)
-
 	ar, app := getTestARApp()
-	var m = make(map[string]string)
-	m["ci-name"] = "\"\""
-	app.Labels = m
+	p.storeGrantRecord(&ar, testGetGrantRecord())
 
-	response, err := p.GrantAccess(&ar, &app)
+	response, err := p.RevokeAccess(&ar, &app)
 
-	s.Equal(errorText, response.Message, "Response message should be correct")
-	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
 	s.Equal(nil, err, "Error should be nil")
-
+	s.Contains(response.Message, "Revoked access: change __CHG300030__", "Change number should be taken from the grant record")
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccessNoServiceNowURL() {
+func (s *PublicMethodsTestSuite) TestRevokeAccessWithOtherChanges() {
 	t := s.T()
-
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
 	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
-	_ = os.Setenv("SERVICENOW_URL", "")
-
-	expectedErrorText := "No Service Now URL given (environment variable SERVICENOW_URL is empty)"
-	loggerObj.On("Error", expectedErrorText)
 
 	ar, app := getTestARApp()
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CHG300031"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{TableChangeRequest}
+	p.storeGrantRecord(&ar, grantRecord)
 
-	response, err := p.GrantAccess(&ar, &app)
+	response, err := p.RevokeAccess(&ar, &app)
 
-	s.Equal(expectedErrorText, response.Message, "Response message should be correct")
-	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
 	s.Equal(nil, err, "Error should be nil")
-
-	loggerObj.AssertExpectations(t)
+	loggerObj.AssertCalled(t, "Info", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Revoked access for Test User: change CHG300031")
+	}))
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccessIncorrectCI() {
+func (s *PublicMethodsTestSuite) TestRevokeAccessWithOtherChangeTask() {
 	t := s.T()
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
 	ar, app := getTestARApp()
-	invalidInstallStatus := "-1"
+	grantRecord := testGetGrantRecord()
+	grantRecord.OtherChangeNumbers = []string{"CTASK0010001"}
+	grantRecord.OtherChangeSysIds = []string{"2"}
+	grantRecord.OtherChangeTables = []string{TableChangeTask}
+	p.storeGrantRecord(&ar, grantRecord)
 
-	server := configureTestEnvWithTestData(t, loggerObj, invalidInstallStatus, addChange)
+	response, err := p.RevokeAccess(&ar, &app)
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
+	s.Equal(nil, err, "Error should be nil")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+p.getConfig().ServiceNowUrl+"/api/now/table/change_task/2")
+	loggerObj.AssertCalled(t, "Info", mock.MatchedBy(func(text string) bool {
+		return strings.HasPrefix(text, "Revoked access for Test User: change task CTASK0010001")
+	}))
+}
+
+func (s *PublicMethodsTestSuite) TestRevokeAccessExclusionRole() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
 
-	errorText := fmt.Sprintf("Invalid install status (%s) for CI app-demoapp", invalidInstallStatus)
+	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	ar.UpdateStatusHistory(api.GrantedStatus, "Granted access: incidentmanagers is an exclusion role, until __2025-05-20 23:59:59 (1h0m0s)__")
 
-	loggerObj.On("Error", "Access Denied for Test User : "+errorText)
-	response, err := p.GrantAccess(&ar, &app)
+	response, err := p.RevokeAccess(&ar, &app)
 
-	s.Equal(errorText, response.Message, "Response message should be correct")
-	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
+	s.Equal("Revoked access", response.Message, "No change to mention in the message")
 	s.Equal(nil, err, "Error should be nil")
-
 	loggerObj.AssertExpectations(t)
 }
 
-func (s *PublicMethodsTestSuite) TestGrantAccessNoChange() {
+func (s *PublicMethodsTestSuite) TestRevokeAccessExclusionRoleWithRecord() {
 	t := s.T()
-
 	p, loggerObj := testGetPlugin()
 	testResetEnvVar()
 
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+
 	ar, app := getTestARApp()
+	ar.Spec.Role.TemplateRef.Name = "incidentmanagers"
+	p.storeGrantRecord(&ar, GrantRecord{AccessRequestName: "test-ar", Requester: "Test User", Role: "incidentmanagers", ChangeNumber: "INC0010010", ChangeSysId: "b1", ChangeTable: TableIncident, EndTime: time.Now().Add(time.Hour), ExclusionRole: true})
 
-	dontAddChange := !addChange
-	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, dontAddChange)
+	response, err := p.RevokeAccess(&ar, &app)
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Status should be revoked")
+	s.Equal(nil, err, "Error should be nil")
+	s.Contains(response.Message, "Revoked access: incident __INC0010010__", "Record should be taken from the grant record")
+	loggerObj.AssertCalled(t, "Debug", "apiCall: "+server.URL+"/api/now/table/incident/b1")
+	loggerObj.AssertExpectations(t)
+}
+
+func (s *PublicMethodsTestSuite) TestRevokeAccessUnknownChange() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
+
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
 	defer server.Close()
 
+	ar, app := getTestARApp()
+	ar.UpdateStatusHistory(api.GrantedStatus, "Granted access: change __CHG999999__ (unknown change), until __2025-05-20 23:59:59 (1h0m0s)__")
+
 	loggerObj.On("Error", mock.Anything)
-	loggerObj.On("Warn", "Access Denied for Test User, role administrator: No changes found")
-	response, err := p.GrantAccess(&ar, &app)
+	loggerObj.On("Warn", mock.Anything)
 
-	s.Equal("No changes found", response.Message, "Response message should be correct")
-	s.Equal(plugin.GrantStatusDenied, response.Status, "Response status should be correct")
+	response, err := p.RevokeAccess(&ar, &app)
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Access is revoked by the extension, even when ServiceNow is not updated")
+	s.Contains(response.Message, "change __CHG999999__ is not updated", "Message should mention the change that is not updated")
 	s.Equal(nil, err, "Error should be nil")
 }
 
-func (s *PublicMethodsTestSuite) TestRevokeAccess() {
-	p, _ := testGetPlugin()
+func (s *PublicMethodsTestSuite) TestRevokeAccessNoServiceNowURL() {
+	t := s.T()
+	p, loggerObj := testGetPlugin()
+	testResetEnvVar()
 
-	var ar api.AccessRequest
-	var app argocd.Application
+	server := configureTestEnvWithTestData(t, loggerObj, correctCMDBInstallStatus, addChange)
+	defer server.Close()
+	_ = os.Setenv("SERVICENOW_URL", "")
+
+	expectedErrorText := "No Service Now URL given (environment variable SERVICENOW_URL is empty)"
+	loggerObj.On("Error", expectedErrorText)
 
-	var expectedResponse *plugin.RevokeResponse = nil
+	ar, app := getTestARApp()
 
 	response, err := p.RevokeAccess(&ar, &app)
-	s.Equal(expectedResponse, response, "Revoke Access is not used, expect nil")
+
+	s.Equal(plugin.RevokeStatusRevoked, response.Status, "Access is revoked by the extension, even when ServiceNow is not updated")
+	s.Equal("Revoked access, ServiceNow is not updated: "+expectedErrorText, response.Message, "Response message should be correct")
 	s.Equal(nil, err, "Error should be nil")
 }
 